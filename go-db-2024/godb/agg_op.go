@@ -2,6 +2,7 @@ package godb
 
 import (
 	"fmt"
+	"slices"
 )
 
 var DEBUGAGGOP = false
@@ -23,8 +24,30 @@ type Aggregator struct {
 	newAggState []AggState
 
 	child Operator // the child operator for the inputs to aggregate
+
+	// Used to spill the tuples of groups that don't fit in memory to
+	// temporary files; if nil, all groups are kept in memory
+	bufPool   *BufferPool
+	maxGroups int // the maximum number of groups kept in memory at once
+
+	// The probability that each input tuple was sampled, if they differ (see
+	// [SampleInfo.inclusionProbabilities]); set when iterating
+	probs func(*Tuple) (float64, error)
 }
 
+// The maximum number of groups a grouped aggregation planned by the parser
+// keeps in memory before it starts spilling tuples to disk.
+var AggMemoryBudget = 100000
+
+// Number of partitions the tuples of the groups that don't fit in memory are
+// split into when an aggregation spills.
+var AggSpillPartitions = 16
+
+// Maximum number of times a spilled partition is re-partitioned before its
+// groups are all aggregated in memory anyway, even if there are more than
+// maxGroups of them.
+const maxAggSpillDepth = 3
+
 type AggType int
 
 const (
@@ -36,19 +59,30 @@ const DefaultGroup int = 0 // for handling the case of no group-by
 
 // Construct an aggregator with a group-by.
 func NewGroupedAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator) *Aggregator {
-	return &Aggregator{groupByFields, emptyAggState, child}
+	return &Aggregator{groupByFields, emptyAggState, child, nil, 0, nil}
+}
+
+// Construct an aggregator with a group-by that keeps at most maxGroups groups
+// in memory. Once that many groups exist, tuples belonging to any other group
+// are hash partitioned into temporary heap files (read back through bp), and
+// each partition is aggregated after the in memory groups have been output.
+func NewSpillingGroupedAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator, bp *BufferPool, maxGroups int) (*Aggregator, error) {
+	if maxGroups <= 0 {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("aggregator needs room for at least one group, got %v", maxGroups)}
+	}
+	return &Aggregator{groupByFields, emptyAggState, child, bp, maxGroups, nil}, nil
 }
 
 // Construct an aggregator with no group-by.
 func NewAggregator(emptyAggState []AggState, child Operator) *Aggregator {
-	return &Aggregator{nil, emptyAggState, child}
+	return &Aggregator{nil, emptyAggState, child, nil, 0, nil}
 }
 
-func (a *Aggregator) Statistics() map[string]map[string]float64 {
+func (a *Aggregator) SampleInfo() *SampleInfo {
 	if len(a.groupByFields) == 0 {
-		return a.child.Statistics()
+		return a.child.SampleInfo()
 	}
-	return make(map[string]map[string]float64)
+	return nil
 }
 
 // Return a TupleDescriptor for this aggregation.
@@ -97,73 +131,191 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 	if childIter == nil {
 		return nil, GoDBError{MalformedDataError, "child iter unexpectedly nil"}
 	}
+	a.probs = a.child.SampleInfo().inclusionProbabilities(a.child.Descriptor())
 
-	// the map that stores the aggregation state of each group
-	aggState := make(map[any]*[]AggState)
-	if a.groupByFields == nil {
-		var newAggState []AggState
-		for _, as := range a.newAggState {
-			copy := as.Copy()
-			if copy == nil {
-				return nil, GoDBError{MalformedDataError, "aggState Copy unexpectedly returned nil"}
-			}
-			newAggState = append(newAggState, copy)
-		}
-
-		aggState[DefaultGroup] = &newAggState
+	if a.groupByFields != nil {
+		return a.groupedIterator(childIter, tid), nil
 	}
 
-	// the list of group key tuples
-	var groupByList []*Tuple
-	// the iterator for iterating thru the finalized aggregation results for each group
-	var finalizedIter func() (*Tuple, error)
+	// the aggregation state of the single group
+	var aggState []AggState
+	for _, as := range a.newAggState {
+		copy := as.Copy()
+		if copy == nil {
+			return nil, GoDBError{MalformedDataError, "aggState Copy unexpectedly returned nil"}
+		}
+		aggState = append(aggState, copy)
+	}
 
+	done := false
 	return func() (*Tuple, error) {
+		if done {
+			return nil, nil
+		}
 		// iterates thru all child tuples
 		for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
 			if err != nil {
 				return nil, err
 			}
-			if t == nil {
-				return nil, nil
+			for i := 0; i < len(a.newAggState); i++ {
+				if err := a.addTuple(aggState[i], t); err != nil {
+					return nil, err
+				}
 			}
+		}
 
-			if a.groupByFields == nil { // adds tuple to the aggregation in the case of no group-by
-				for i := 0; i < len(a.newAggState); i++ {
-					(*aggState[DefaultGroup])[i].AddTuple(t)
+		var tup *Tuple
+		for i := 0; i < len(a.newAggState); i++ {
+			newTup := aggState[i].Finalize(a.child.SampleInfo())
+			tup = joinTuples(tup, newTup)
+		}
+		done = true
+		return tup, nil
+	}, nil
+}
+
+// A partition of the input of a grouped aggregation that was spilled to disk,
+// and the level of partitioning it was produced at.
+type aggPartition struct {
+	file  *tempHeapFile
+	level int
+}
+
+// Return an iterator over the groups of the tuples from childIter. The groups
+// that fit in memory are output first, followed by the groups of each
+// partition spilled to disk, one partition at a time.
+func (a *Aggregator) groupedIterator(childIter func() (*Tuple, error), tid TransactionID) func() (*Tuple, error) {
+	var pending []aggPartition
+	started := false
+	// the iterator for iterating thru the finalized aggregation results for
+	// the groups of the current partition
+	var finalizedIter func() (*Tuple, error)
+
+	return func() (*Tuple, error) {
+		for {
+			if finalizedIter != nil {
+				t, err := finalizedIter()
+				if err != nil || t != nil {
+					return t, err
+				}
+				finalizedIter = nil
+			}
+
+			// aggregate the next partition (the whole input, to start with)
+			iter, level := childIter, 0
+			var current *tempHeapFile
+			if started {
+				if len(pending) == 0 {
+					return nil, nil
 				}
-			} else { // adds tuple to the aggregation with grouping
-				keygenTup, err := extractGroupByKeyTuple(a, t)
+				current, level = pending[0].file, pending[0].level+1
+				pending = pending[1:]
+				var err error
+				iter, err = current.Iterator(tid)
 				if err != nil {
+					current.close()
+					a.closePartitions(pending)
 					return nil, err
 				}
+				iter = a.unspillIterator(iter)
+			}
+			started = true
 
-				key := keygenTup.tupleKey()
-				if aggState[key] == nil {
-					asNew := make([]AggState, len(a.newAggState))
-					aggState[key] = &asNew
-					groupByList = append(groupByList, keygenTup)
+			groupByList, aggState, parts, err := a.aggregateGroups(iter, level)
+			if current != nil {
+				current.close()
+			}
+			if err != nil {
+				a.closePartitions(pending)
+				return nil, err
+			}
+			for _, part := range parts {
+				if part != nil {
+					pending = append(pending, aggPartition{part, level})
 				}
-
-				addTupleToGrpAggState(a, t, aggState[key])
 			}
+			DebugAggOp("aggregated %d groups in memory at level %d, %d partitions left", len(groupByList), level, len(pending))
+			finalizedIter = getFinalizedTuplesIterator(a, groupByList, aggState)
 		}
+	}
+}
+
+func (a *Aggregator) closePartitions(parts []aggPartition) {
+	for _, part := range parts {
+		part.file.close()
+	}
+}
 
-		if finalizedIter == nil { // builds the iterator for iterating thru the finalized aggregation results for each group
-			if a.groupByFields == nil {
-				var tup *Tuple
-				for i := 0; i < len(a.newAggState); i++ {
-					newTup := (*aggState[DefaultGroup])[i].Finalize(a.child.Statistics())
-					tup = joinTuples(tup, newTup)
+// Add the tuples from iter to their groups. If the aggregator can spill, once
+// it has maxGroups groups the tuples of any new group are hash partitioned
+// into temporary files instead, which are returned (some entries may be nil).
+func (a *Aggregator) aggregateGroups(iter func() (*Tuple, error), level int) ([]*Tuple, map[any]*[]AggState, []*tempHeapFile, error) {
+	// the map that stores the aggregation state of each group
+	aggState := make(map[any]*[]AggState)
+	// the list of group key tuples
+	var groupByList []*Tuple
+	var parts []*tempHeapFile
+	canSpill := a.bufPool != nil && level < maxAggSpillDepth
+
+	for {
+		t, err := iter()
+		if err != nil {
+			closeTempFiles(parts)
+			return nil, nil, nil, err
+		}
+		if t == nil {
+			break
+		}
+		keygenTup, err := extractGroupByKeyTuple(a, t)
+		if err != nil {
+			closeTempFiles(parts)
+			return nil, nil, nil, err
+		}
+
+		key := keygenTup.tupleKey()
+		if aggState[key] == nil {
+			if canSpill && len(groupByList) >= a.maxGroups {
+				if parts == nil {
+					parts = make([]*tempHeapFile, AggSpillPartitions)
+				}
+				p := hashPartition(key.(string), level, len(parts))
+				if parts[p] == nil {
+					parts[p], err = newTempHeapFile(a.spillDesc(), a.bufPool)
 				}
-				finalizedIter = func() (*Tuple, error) { return nil, nil }
-				return tup, nil
-			} else {
-				finalizedIter = getFinalizedTuplesIterator(a, groupByList, aggState)
+				var spilled *Tuple
+				if err == nil {
+					spilled, err = a.spillTuple(t)
+				}
+				if err == nil {
+					err = parts[p].append(spilled)
+				}
+				if err != nil {
+					closeTempFiles(parts)
+					return nil, nil, nil, err
+				}
+				continue
 			}
+			asNew := make([]AggState, len(a.newAggState))
+			aggState[key] = &asNew
+			groupByList = append(groupByList, keygenTup)
 		}
-		return finalizedIter()
-	}, nil
+
+		if err := addTupleToGrpAggState(a, t, aggState[key]); err != nil {
+			closeTempFiles(parts)
+			return nil, nil, nil, err
+		}
+	}
+
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		if err := part.finish(); err != nil {
+			closeTempFiles(parts)
+			return nil, nil, nil, err
+		}
+	}
+	return groupByList, aggState, parts, nil
 }
 
 // Given a tuple t from a child iterator, return a tuple that identifies t's
@@ -200,7 +352,7 @@ func extractGroupByKeyTuple(a *Aggregator, t *Tuple) (*Tuple, error) {
 // (i.e., because this is the first invocation of this method, create a new
 // aggState using [aggState.Copy] on appropriate element of the a.newAggState
 // field and add the new aggState to grpAggState.
-func addTupleToGrpAggState(a *Aggregator, t *Tuple, grpAggState *[]AggState) {
+func addTupleToGrpAggState(a *Aggregator, t *Tuple, grpAggState *[]AggState) error {
 	// TODO: some code goes here
 	for i, aggState := range *grpAggState {
 		if aggState == nil {
@@ -208,7 +360,69 @@ func addTupleToGrpAggState(a *Aggregator, t *Tuple, grpAggState *[]AggState) {
 			(*grpAggState)[i] = aggState
 		}
 
-		aggState.AddTuple(t)
+		if err := a.addTuple(aggState, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add t to state, with its probability of having been sampled if the input's
+// tuples were sampled with different probabilities.
+func (a *Aggregator) addTuple(state AggState, t *Tuple) error {
+	if a.probs == nil {
+		state.AddTuple(t)
+		return nil
+	}
+	p, err := a.probs(t)
+	if err != nil {
+		return err
+	}
+	addSampledTuple(state, t, p)
+	return nil
+}
+
+// Return the descriptor of the tuples the aggregator spills to temporary
+// files: the child's, followed by the probability that each tuple was sampled
+// if the probabilities differ, since spilled tuples lose the record ids that
+// may carry it (see [weightedRID]).
+func (a *Aggregator) spillDesc() *TupleDesc {
+	desc := a.child.Descriptor()
+	if a.probs == nil {
+		return desc
+	}
+	desc = desc.copy()
+	desc.Fields = append(desc.Fields, FieldType{Fname: InclusionProbabilityField, Ftype: FloatType})
+	return desc
+}
+
+// Return the tuple to spill for t (see [Aggregator.spillDesc]).
+func (a *Aggregator) spillTuple(t *Tuple) (*Tuple, error) {
+	if a.probs == nil {
+		return t, nil
+	}
+	p, err := a.probs(t)
+	if err != nil {
+		return nil, err
+	}
+	return &Tuple{t.Desc, append(slices.Clone(t.Fields), FloatField{p}), nil}, nil
+}
+
+// Return an iterator over the tuples of a spilled partition read by iter, with
+// their probabilities of having been sampled moved back into their record ids.
+func (a *Aggregator) unspillIterator(iter func() (*Tuple, error)) func() (*Tuple, error) {
+	if a.probs == nil {
+		return iter
+	}
+	desc := a.child.Descriptor()
+	return func() (*Tuple, error) {
+		t, err := iter()
+		if t == nil || err != nil {
+			return t, err
+		}
+		hidden := len(t.Fields) - 1
+		p := t.Fields[hidden].(FloatField).Value
+		return &Tuple{*desc, t.Fields[:hidden:hidden], weightedRID{t.Rid, p}}, nil
 	}
 }
 
@@ -235,7 +449,7 @@ func getFinalizedTuplesIterator(a *Aggregator, groupByList []*Tuple, aggState ma
 			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Should have aggState list for tuple %v", *tup)}
 		}
 		for _, aggState := range *aggStateList {
-			aggTup := aggState.Finalize(a.child.Statistics())
+			aggTup := aggState.Finalize(a.child.SampleInfo())
 			tup = joinTuples(tup, aggTup)
 		}
 		i++
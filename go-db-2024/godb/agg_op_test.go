@@ -373,3 +373,131 @@ func TestAggRepeatedIteration(t *testing.T) {
 		t.Errorf("count changed on repeated iteration")
 	}
 }
+
+// Drain a count(*), sum(age) group by age aggregation and check each group,
+// returning the number of groups.
+func checkAgeGroups(t *testing.T, iter func() (*Tuple, error), groupSize int64) int {
+	seen := make(map[int64]bool)
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		age := tup.Fields[0].(IntField).Value
+		if seen[age] {
+			t.Fatalf("group %d returned twice", age)
+		}
+		seen[age] = true
+		if cnt := tup.Fields[1].(IntField).Value; cnt != groupSize {
+			t.Errorf("group %d has count %d, expected %d", age, cnt, groupSize)
+		}
+		if sum := tup.Fields[2].(IntField).Value; sum != groupSize*age {
+			t.Errorf("group %d has sum %d, expected %d", age, sum, groupSize*age)
+		}
+	}
+	return len(seen)
+}
+
+func makeAgeAggStates(t *testing.T, age Expr) []AggState {
+	cnt := CountAggState{}
+	sum := SumAggState{}
+	if err := cnt.Init("count", age); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := sum.Init("sum", age); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return []AggState{&cnt, &sum}
+}
+
+func TestAggGbySpill(t *testing.T) {
+	hf, _, bp, tid := makeJoinTestFiles(t,
+		3000, func(i int) int64 { return int64((i * 7919) % 500) },
+		0, func(i int) int64 { return 0 })
+
+	age := FieldExpr{hf.Descriptor().Fields[1]}
+	// few enough groups in memory that partitions have to be split again
+	for _, maxGroups := range []int{1000, 100, 20} {
+		agg, err := NewSpillingGroupedAggregator(makeAgeAggStates(t, &age), []Expr{&age}, hf, bp, maxGroups)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, err := agg.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if groups := checkAgeGroups(t, iter, 6); groups != 500 {
+			t.Errorf("expected 500 groups with %d groups in memory, got %d", maxGroups, groups)
+		}
+		checkNoSpillPages(t, bp)
+	}
+}
+
+func TestSortAggregator(t *testing.T) {
+	hf, _, _, tid := makeJoinTestFiles(t,
+		300, func(i int) int64 { return int64((i * 7919) % 50) },
+		0, func(i int) int64 { return 0 })
+
+	age := FieldExpr{hf.Descriptor().Fields[1]}
+	sorted, err := NewOrderBy([]Expr{&age}, hf, []bool{false})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	agg, err := NewSortAggregator(makeAgeAggStates(t, &age), []Expr{&age}, sorted)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if groups := checkAgeGroups(t, iter, 6); groups != 50 {
+		t.Errorf("expected 50 groups, got %d", groups)
+	}
+
+	if !isGroupedOn(sorted, []Expr{&age}) || isGroupedOn(hf, []Expr{&age}) {
+		t.Errorf("isGroupedOn should only accept the sorted input")
+	}
+	if _, err := NewSortAggregator(makeAgeAggStates(t, &age), nil, sorted); err == nil {
+		t.Errorf("expected error for sort-based aggregation without a group by")
+	}
+}
+
+func TestParseAggSpill(t *testing.T) {
+	defer func(budget int) { AggMemoryBudget = budget }(AggMemoryBudget)
+	AggMemoryBudget = 2
+
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	sql := "select t.age, count(*) from t group by t.age"
+	_, _, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	tid := BeginTransactionForTest(t, bp)
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	groups, total := 0, int64(0)
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		groups++
+		total += tup.Fields[1].(IntField).Value
+	}
+	bp.CommitTransaction(tid)
+	if groups != 10 || total != 12 {
+		t.Errorf("expected 10 groups covering 12 tuples, got %d groups covering %d", groups, total)
+	}
+}
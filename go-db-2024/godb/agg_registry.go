@@ -0,0 +1,153 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Aggregate functions are looked up by name in a table of factories that make
+// empty aggregation states, which queries then Init with the expression they
+// aggregate. Besides the built in aggregates, the table holds the aggregates
+// registered with [RegisterAggregate].
+//
+// Aggregation states may implement a few optional interfaces:
+//
+//   - [AggParameters], to take constant arguments after the aggregated
+//     expression, as in PERCENTILE_CONT(x, 0.9).
+//   - [ErrorBounder], to report a confidence interval around a result
+//     estimated from a sample.
+//   - [SampleEstimator], to estimate the result over the whole table, and the
+//     variance of the estimate, from a sample. Queries over a sample use the
+//     estimate instead of the result of Finalize, and its variance gives the
+//     confidence interval, so the aggregate takes part in HAVING clauses over
+//     confidence intervals (see [HavingConfidence]).
+
+var aggregates = map[string]func() AggState{
+	"count":           func() AggState { return &CountAggState{} },
+	"sum":             func() AggState { return &SumAggState{} },
+	"avg":             func() AggState { return &AvgAggState{} },
+	"max":             func() AggState { return &MaxAggState{} },
+	"min":             func() AggState { return &MinAggState{} },
+	"variance":        func() AggState { return &VarianceAggState{} },
+	"var_samp":        func() AggState { return &VarianceAggState{} },
+	"var_pop":         func() AggState { return &VarianceAggState{population: true} },
+	"stddev":          func() AggState { return &VarianceAggState{stddev: true} },
+	"stddev_samp":     func() AggState { return &VarianceAggState{stddev: true} },
+	"stddev_pop":      func() AggState { return &VarianceAggState{stddev: true, population: true} },
+	"percentile_cont": func() AggState { return &PercentileContAggState{name: "PERCENTILE_CONT"} },
+
+	// in the sketch of quantile_sketch.go
+	"approx_percentile": func() AggState { return &ApproxPercentileAggState{name: "APPROX_PERCENTILE"} },
+	"percentile":        func() AggState { return &ApproxPercentileAggState{name: "PERCENTILE"} },
+	"median":            func() AggState { return &ApproxPercentileAggState{name: "MEDIAN", fraction: 0.5, hasParam: true} },
+
+	// COUNT(DISTINCT x), in distinct_aggs.go
+	"count_distinct":        func() AggState { return &CountDistinctAggState{} },
+	"approx_count_distinct": func() AggState { return &ApproxCountDistinctAggState{} },
+}
+
+// Register an aggregate function that queries can call by name. factory
+// makes an empty aggregation state, which is then set up with Init (and
+// SetParams, for [AggParameters]), copied for each group, and finalized.
+//
+// The aggregate table isn't locked, so aggregates should be registered before
+// any queries run (e.g., in an init function).
+func RegisterAggregate(name string, factory func() AggState) error {
+	name = strings.ToLower(name)
+	if _, exists := aggregates[name]; exists {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("aggregate %s is already registered", name)}
+	}
+	_, isFunc := funcs[name]
+	_, isOverloaded := overloadedFuncs[name]
+	if isFunc || isOverloaded || specialForms[name] != nil {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("can't register aggregate %s, which is a scalar function", name)}
+	}
+	if factory() == nil {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("the factory of aggregate %s made a nil state", name)}
+	}
+	aggregates[name] = factory
+	return nil
+}
+
+// Implemented by aggregation states that take constant arguments after the
+// expression they aggregate.
+type AggParameters interface {
+	// Sets the values of the constant arguments; called before Init.
+	SetParams(params []DBValue) error
+}
+
+// Pass the constant arguments params of the aggregate name to state.
+func setAggParams(name string, state AggState, params []Expr) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if e, ok := state.(*estimatingAggState); ok {
+		state = e.AggState
+	}
+	withParams, ok := state.(AggParameters)
+	if !ok {
+		return GoDBError{ParseError, fmt.Sprintf("aggregate %s takes one argument", name)}
+	}
+	vals := make([]DBValue, len(params))
+	for i, p := range params {
+		c, ok := p.(*ConstExpr)
+		if !ok {
+			return GoDBError{ParseError, fmt.Sprintf("argument %d of aggregate %s must be a constant", i+2, name)}
+		}
+		vals[i] = c.val
+	}
+	return withParams.SetParams(vals)
+}
+
+// Implemented by aggregation states that can estimate their result over a
+// whole table from a sample of it.
+type SampleEstimator interface {
+	// Returns the estimate of the result over the table that the input is a
+	// sample of (see [SampleInfo]), of the type of the field of
+	// GetTupleDesc(), and the variance of the estimate.
+	EstimateFromSample(info *SampleInfo) (DBValue, float64)
+}
+
+// Wraps an aggregation state that implements [SampleEstimator], so that its
+// estimate is the result for samples, and its variance gives the state's
+// [ErrorBounder] confidence interval.
+type estimatingAggState struct {
+	AggState
+}
+
+func (a *estimatingAggState) Copy() AggState {
+	return &estimatingAggState{a.AggState.Copy()}
+}
+
+func (a *estimatingAggState) AddSampledTuple(t *Tuple, p float64) {
+	addSampledTuple(a.AggState, t, p)
+}
+
+func (a *estimatingAggState) Merge(other AggState) error {
+	if o, ok := other.(*estimatingAggState); ok {
+		other = o.AggState
+	}
+	return a.AggState.Merge(other)
+}
+
+func (a *estimatingAggState) Finalize(info *SampleInfo) *Tuple {
+	if !info.IsSample() {
+		return a.AggState.Finalize(info)
+	}
+	v, _ := a.AggState.(SampleEstimator).EstimateFromSample(info)
+	return &Tuple{*a.GetTupleDesc(), []DBValue{v}, nil}
+}
+
+// The confidence interval of the estimate, or, if the input isn't a sample, of
+// the result of the aggregation state, if it has one.
+func (a *estimatingAggState) ErrorBound(info *SampleInfo) float64 {
+	if !info.IsSample() {
+		if b, ok := a.AggState.(ErrorBounder); ok {
+			return b.ErrorBound(info)
+		}
+		return 0
+	}
+	_, variance := a.AggState.(SampleEstimator).EstimateFromSample(info)
+	return ConfidenceZ * math.Sqrt(math.Max(0, variance))
+}
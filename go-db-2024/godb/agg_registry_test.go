@@ -0,0 +1,190 @@
+package godb
+
+import (
+	"math"
+	"testing"
+)
+
+// An aggregate that computes the range of its input (its max minus its min).
+type rangeAggState struct {
+	alias    string
+	expr     Expr
+	lo, hi   int64
+	nonEmpty bool
+}
+
+func (a *rangeAggState) Copy() AggState {
+	c := *a
+	return &c
+}
+
+func (a *rangeAggState) Init(alias string, expr Expr) error {
+	a.alias, a.expr, a.nonEmpty = alias, expr, false
+	return nil
+}
+
+func (a *rangeAggState) add(v int64) {
+	if !a.nonEmpty || v < a.lo {
+		a.lo = v
+	}
+	if !a.nonEmpty || v > a.hi {
+		a.hi = v
+	}
+	a.nonEmpty = true
+}
+
+func (a *rangeAggState) AddTuple(t *Tuple) {
+	if v, err := a.expr.EvalExpr(t); err == nil {
+		if i, ok := v.(IntField); ok {
+			a.add(i.Value)
+		}
+	}
+}
+
+func (a *rangeAggState) Merge(other AggState) error {
+	o, ok := other.(*rangeAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	if o.nonEmpty {
+		a.add(o.lo)
+		a.add(o.hi)
+	}
+	return nil
+}
+
+func (a *rangeAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func (a *rangeAggState) Finalize(info *SampleInfo) *Tuple {
+	return &Tuple{*a.GetTupleDesc(), []DBValue{IntField{a.hi - a.lo}}, nil}
+}
+
+func TestRegisterAggregate(t *testing.T) {
+	name := "test_range"
+	defer delete(aggregates, name)
+	if err := RegisterAggregate("TEST_RANGE", func() AggState { return &rangeAggState{} }); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, bad := range []string{name, "sum", "abs", "coalesce"} {
+		if err := RegisterAggregate(bad, func() AggState { return &rangeAggState{} }); err == nil {
+			t.Errorf("expected error registering aggregate %s", bad)
+		}
+	}
+
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	ranges := make(map[string]DBValue)
+	for _, tup := range runHavingQuery(t, bp, c, "select name, test_range(age) from t group by name having test_range(age) > 10") {
+		ranges[tup.Fields[0].(StringField).Value] = tup.Fields[1]
+	}
+	if len(ranges) != 2 || ranges["sam"] != (IntField{74}) || ranges["riza"] != (IntField{21}) {
+		t.Errorf("unexpected results of registered aggregate %v", ranges)
+	}
+	if _, _, _, err := Parse(c, "select test_range(age, 2) from t"); err == nil {
+		t.Errorf("expected error passing a parameter to an aggregate without parameters")
+	}
+}
+
+func TestAggStateMerge(t *testing.T) {
+	td := &TupleDesc{[]FieldType{{"x", "", IntType}}}
+	var expr Expr = &FieldExpr{td.Fields[0]}
+	values := []int64{3, 9, 1, 12, 7, 7, 40, 2}
+
+	for name := range aggregates {
+		whole, _ := newAggState(name)
+		parts := []AggState{}
+		if err := setAggParams(name, whole, []Expr{&ConstExpr{FloatField{0.3}, FloatType}}); err != nil && name == "percentile_cont" {
+			t.Fatalf(err.Error())
+		}
+		if err := whole.Init(name, expr); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		for i := 0; i < 3; i++ {
+			parts = append(parts, whole.Copy())
+		}
+		for i, v := range values {
+			tup := &Tuple{*td, []DBValue{IntField{v}}, nil}
+			whole.AddTuple(tup)
+			parts[i%3].AddTuple(tup)
+		}
+		for _, p := range parts[1:] {
+			if err := parts[0].Merge(p); err != nil {
+				t.Fatalf("%s: %s", name, err.Error())
+			}
+		}
+		want := whole.Finalize(nil).Fields[0]
+		got := parts[0].Finalize(nil).Fields[0]
+		wf, isFloat := want.(FloatField)
+		if isFloat && math.Abs(wf.Value-got.(FloatField).Value) > 1e-9 || !isFloat && got != want {
+			t.Errorf("%s: expected merged result %v, got %v", name, want, got)
+		}
+	}
+
+	a, _ := newAggState("sum")
+	if err := a.Merge(&CountAggState{}); err == nil {
+		t.Errorf("expected error merging states of different aggregates")
+	}
+}
+
+func TestStatAggregates(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	sql := "select stddev(age), variance(age), var_pop(age), percentile_cont(age, 0.5), percentile_cont(age, 1) from t"
+
+	var ages []float64
+	for _, tup := range runHavingQuery(t, bp, c, "select age from t") {
+		if v, ok := numericValue(tup.Fields[0]); ok {
+			ages = append(ages, v)
+		}
+	}
+	n := float64(len(ages))
+	mean, m2 := 0.0, 0.0
+	for _, x := range ages {
+		mean += x / n
+	}
+	for _, x := range ages {
+		m2 += (x - mean) * (x - mean)
+	}
+
+	tups := runHavingQuery(t, bp, c, sql)
+	if len(tups) != 1 {
+		t.Fatalf("expected one row, got %v", tups)
+	}
+	want := []float64{math.Sqrt(m2 / (n - 1)), m2 / (n - 1), m2 / n, (40 + 43) / 2.0, 99}
+	for i, w := range want {
+		if got := tups[0].Fields[i].(FloatField).Value; math.Abs(got-w) > 1e-9 {
+			t.Errorf("column %d: expected %v, got %v", i, w, got)
+		}
+	}
+
+	// over a sample, the population variance is scaled from the sample
+	// variance, and the estimates have confidence intervals
+	hf, _ := c.GetTable("t")
+	hf.(*HeapFile).sampleInfo.SampleSize = 12
+	hf.(*HeapFile).sampleInfo.PopulationSize = 120
+	tups = runHavingQuery(t, bp, c, sql)
+	if got, w := tups[0].Fields[2].(FloatField).Value, m2/(n-1)*119/120; math.Abs(got-w) > 1e-9 {
+		t.Errorf("expected estimated population variance %v, got %v", w, got)
+	}
+	state, _ := newAggState("variance")
+	if _, ok := state.(ErrorBounder); !ok {
+		t.Errorf("expected VARIANCE to have confidence intervals")
+	}
+
+	for _, bad := range []string{
+		"select percentile_cont(age) from t",
+		"select percentile_cont(age, 2) from t",
+		"select percentile_cont(age, age) from t",
+		"select stddev(name) from t",
+	} {
+		if _, _, _, err := Parse(c, bad); err == nil {
+			t.Errorf("expected error parsing %s", bad)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package godb
 
 import (
 	"fmt"
+	"math"
 )
 
 var DEBUGAGGSTATE = false
@@ -26,13 +27,39 @@ type AggState interface {
 	// Adds an tuple to the aggregation state.
 	AddTuple(*Tuple)
 
-	// Returns the final result of the aggregation as a tuple.
-	Finalize(map[string]map[string]float64) *Tuple
+	// Adds the tuples that other, a state of the same aggregate initialized
+	// the same way, has aggregated to the aggregation state, e.g. to combine
+	// the aggregates of parts of the input computed separately.
+	Merge(other AggState) error
+
+	// Returns the final result of the aggregation as a tuple, scaled up to
+	// the whole table if the input is a sample (see [SampleInfo]).
+	Finalize(*SampleInfo) *Tuple
 
 	// Gets the tuple description of the tuple that Finalize() returns.
 	GetTupleDesc() *TupleDesc
 }
 
+// Make an empty aggregation state for the aggregate function name (see
+// [RegisterAggregate]).
+func newAggState(name string) (AggState, error) {
+	factory, ok := aggregates[name]
+	if !ok {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("unknown aggregate function %s", name)}
+	}
+	state := factory()
+	if _, ok := state.(SampleEstimator); ok {
+		return &estimatingAggState{state}, nil
+	}
+	return state, nil
+}
+
+// Return the error for merging other into the aggregation state a, which
+// aren't states of the same aggregate.
+func mergeMismatch(a AggState, other AggState) error {
+	return GoDBError{TypeMismatchError, fmt.Sprintf("can't merge aggregation state %T into %T", other, a)}
+}
+
 // Implements the aggregation state for COUNT
 // We are supplying the implementation of CountAggState as an example. You need to
 // implement the rest of the aggregation states.
@@ -40,39 +67,74 @@ type CountAggState struct {
 	alias string
 	expr  Expr
 	count int
+	ht    htEstimate // for samples with unequal probabilities
 }
 
 func (a *CountAggState) Copy() AggState {
-	return &CountAggState{a.alias, a.expr, a.count}
+	return &CountAggState{a.alias, a.expr, a.count, a.ht}
 }
 
 func (a *CountAggState) Init(alias string, expr Expr) error {
 	a.count = 0
+	a.ht = htEstimate{}
 	a.expr = expr
 	a.alias = alias
 	return nil
 }
 
+// COUNT(expr) counts the tuples whose expr isn't NULL; COUNT(*) is planned
+// with a constant expr (see [countStarExpr]), so it counts every tuple.
+func (a *CountAggState) counts(t *Tuple) bool {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+	}
+	return !isNull(v)
+}
+
 func (a *CountAggState) AddTuple(t *Tuple) {
-	a.count++
+	if a.counts(t) {
+		a.count++
+	}
+}
+
+func (a *CountAggState) AddSampledTuple(t *Tuple, p float64) {
+	if a.counts(t) {
+		a.count++
+		a.ht.add(1, p)
+	}
+}
+
+func (a *CountAggState) Merge(other AggState) error {
+	o, ok := other.(*CountAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.count += o.count
+	a.ht.merge(o.ht)
+	return nil
 }
 
-func (a *CountAggState) Finalize(stats map[string]map[string]float64) *Tuple {
+func (a *CountAggState) Finalize(info *SampleInfo) *Tuple {
 	td := a.GetTupleDesc()
 	f := IntField{int64(a.count)}
-	if stats != nil {
-		estimatedLines := stats[ESTIMATEDLINES][MEAN]
-		linesRead := stats[N][MEAN]
-		if linesRead != 0 {
-			// // fmt.Printf("Using stats! %v %v %v %v %v\n", f.Value, stats[ESTIMATEDLINES], stats[N], stats[COMPLETE], stats[COMPLETE][MEAN] != 1)
-			f.Value = int64(float64(f.Value) * estimatedLines / linesRead)
-		}
+	if a.ht.weighted {
+		f.Value = int64(math.Round(a.ht.total))
+	} else if scale, ok := info.ScaleFactor(); ok {
+		f.Value = int64(float64(f.Value) * scale)
 	}
 	fs := []DBValue{f}
 	t := Tuple{*td, fs, nil}
 	return &t
 }
 
+func (a *CountAggState) ErrorBound(info *SampleInfo) float64 {
+	if a.ht.weighted {
+		return a.ht.totalBound()
+	}
+	return totalErrorBound(float64(a.count), float64(a.count), info)
+}
+
 func (a *CountAggState) GetTupleDesc() *TupleDesc {
 	ft := FieldType{a.alias, "", IntType}
 	fts := []FieldType{ft}
@@ -83,16 +145,18 @@ func (a *CountAggState) GetTupleDesc() *TupleDesc {
 
 // Implements the aggregation state for SUM
 type SumAggState struct {
-	alias    string
-	expr     Expr
-	sumInt   int64
-	sumFloat float64
-	sumStr   string
+	alias      string
+	expr       Expr
+	sumInt     int64
+	sumFloat   float64
+	sumStr     string
+	sumSquares float64    // for estimating the error of a scaled up sum
+	ht         htEstimate // for samples with unequal probabilities
 }
 
 func (a *SumAggState) Copy() AggState {
 	// TODO: some code goes here
-	return &SumAggState{a.alias, a.expr, a.sumInt, a.sumFloat, a.sumStr}
+	return &SumAggState{a.alias, a.expr, a.sumInt, a.sumFloat, a.sumStr, a.sumSquares, a.ht}
 }
 
 func (a *SumAggState) Init(alias string, expr Expr) error {
@@ -100,11 +164,22 @@ func (a *SumAggState) Init(alias string, expr Expr) error {
 	a.sumInt = 0
 	a.sumFloat = 0
 	a.sumStr = ""
+	a.sumSquares = 0
+	a.ht = htEstimate{}
 	a.expr = expr
 	a.alias = alias
 	return nil
 }
 
+func (a *SumAggState) AddSampledTuple(t *Tuple, p float64) {
+	a.AddTuple(t)
+	if v, err := a.expr.EvalExpr(t); err == nil {
+		if y, ok := numericValue(v); ok {
+			a.ht.add(y, p)
+		}
+	}
+}
+
 func (a *SumAggState) AddTuple(t *Tuple) {
 	// TODO: some code goes here
 	dbValue, err := a.expr.EvalExpr(t)
@@ -115,51 +190,50 @@ func (a *SumAggState) AddTuple(t *Tuple) {
 	switch dbType := dbValue.(type) {
 	case IntField:
 		a.sumInt += dbType.Value
+		a.sumSquares += float64(dbType.Value) * float64(dbType.Value)
 	case FloatField:
 		a.sumFloat += dbType.Value
+		a.sumSquares += dbType.Value * dbType.Value
 	case StringField:
 		a.sumStr += dbType.Value
 	}
 }
 
+func (a *SumAggState) Merge(other AggState) error {
+	o, ok := other.(*SumAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.sumInt += o.sumInt
+	a.sumFloat += o.sumFloat
+	a.sumStr += o.sumStr
+	a.sumSquares += o.sumSquares
+	a.ht.merge(o.ht)
+	return nil
+}
+
 func (a *SumAggState) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	return &TupleDesc{[]FieldType{{a.alias, "", a.expr.GetExprType().Ftype}}}
 }
 
-func (a *SumAggState) Finalize(stats map[string]map[string]float64) *Tuple {
+func (a *SumAggState) Finalize(info *SampleInfo) *Tuple {
 	// TODO: some code goes here
 	var f DBValue
 	switch a.expr.GetExprType().Ftype {
 	case IntType:
 		f = IntField{a.sumInt}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				estimatedLines := stats[ESTIMATEDLINES][MEAN]
-				linesRead := stats[N][MEAN]
-				if linesRead != 0 {
-					// fmt.Printf("Using stats! %v %v %v\n", a.sumInt, stats[ESTIMATEDLINES], stats[N])
-
-					f = IntField{int64(float64(a.sumInt) * estimatedLines / linesRead)}
-				}
-			}
+		if a.ht.weighted {
+			f = IntField{int64(math.Round(a.ht.total))}
+		} else if scale, ok := a.scale(info); ok {
+			f = IntField{int64(float64(a.sumInt) * scale)}
 		}
 	case FloatType:
 		f = FloatField{a.sumFloat}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				estimatedLines := stats[ESTIMATEDLINES][MEAN]
-				linesRead := stats[N][MEAN]
-				if linesRead != 0 {
-					// fmt.Printf("Using stats! %v %v %v\n", a.sumFloat, stats[ESTIMATEDLINES], stats[N])
-
-					f = FloatField{a.sumFloat * estimatedLines / linesRead}
-				}
-			}
+		if a.ht.weighted {
+			f = FloatField{a.ht.total}
+		} else if scale, ok := a.scale(info); ok {
+			f = FloatField{a.sumFloat * scale}
 		}
 	case StringType:
 		f = StringField{a.sumStr}
@@ -167,21 +241,41 @@ func (a *SumAggState) Finalize(stats map[string]map[string]float64) *Tuple {
 	return &Tuple{*a.GetTupleDesc(), []DBValue{f}, nil}
 }
 
+// Sums are only scaled up if the summed field has statistics.
+func (a *SumAggState) scale(info *SampleInfo) (float64, bool) {
+	if info.Column(a.expr.GetExprType().Fname) == nil {
+		return 1, false
+	}
+	return info.ScaleFactor()
+}
+
+func (a *SumAggState) ErrorBound(info *SampleInfo) float64 {
+	if a.ht.weighted {
+		return a.ht.totalBound()
+	}
+	if _, ok := a.scale(info); !ok || a.expr.GetExprType().Ftype == StringType {
+		return 0
+	}
+	return totalErrorBound(float64(a.sumInt)+a.sumFloat, a.sumSquares, info)
+}
+
 // Implements the aggregation state for AVG
 // Note that we always AddTuple() at least once before Finalize()
 // so no worries for divide-by-zero
 type AvgAggState struct {
 	// TODO: some code goes here
-	alias    string
-	expr     Expr
-	sum      int64
-	sumFloat float64
-	count    int
+	alias      string
+	expr       Expr
+	sum        int64
+	sumFloat   float64
+	count      int
+	sumSquares float64    // for estimating the error of an average of a sample
+	ht         htEstimate // for samples with unequal probabilities
 }
 
 func (a *AvgAggState) Copy() AggState {
 	// TODO: some code goes here
-	return &AvgAggState{a.alias, a.expr, a.sum, a.sumFloat, a.count}
+	return &AvgAggState{a.alias, a.expr, a.sum, a.sumFloat, a.count, a.sumSquares, a.ht}
 }
 
 func (a *AvgAggState) Init(alias string, expr Expr) error {
@@ -192,6 +286,8 @@ func (a *AvgAggState) Init(alias string, expr Expr) error {
 	a.sumFloat = 0
 	a.sum = 0
 	a.count = 0
+	a.sumSquares = 0
+	a.ht = htEstimate{}
 	a.expr = expr
 	a.alias = alias
 	return nil
@@ -199,35 +295,91 @@ func (a *AvgAggState) Init(alias string, expr Expr) error {
 
 func (a *AvgAggState) AddTuple(t *Tuple) {
 	// TODO: some code goes here
-	a.count++
 	dbValue, err := a.expr.EvalExpr(t)
 	if err != nil {
 		DebugAggState("Got err: %v", err)
 	}
+	// NULLs don't count towards the average
+	if isNull(dbValue) {
+		return
+	}
+	a.count++
 
 	switch dbType := dbValue.(type) {
 	case IntField:
 		a.sum += dbType.Value
+		a.sumSquares += float64(dbType.Value) * float64(dbType.Value)
 	case FloatField:
 		a.sumFloat += dbType.Value
+		a.sumSquares += dbType.Value * dbType.Value
 	case StringField:
 		DebugAggState("Shouldn't be average a string value!")
 	}
 }
 
+// Over a sample with unequal probabilities, the average is estimated as the
+// estimate of the total over the estimate of the number of values.
+func (a *AvgAggState) AddSampledTuple(t *Tuple, p float64) {
+	a.AddTuple(t)
+	if v, err := a.expr.EvalExpr(t); err == nil {
+		if y, ok := numericValue(v); ok {
+			a.ht.add(y, p)
+		}
+	}
+}
+
+func (a *AvgAggState) Merge(other AggState) error {
+	o, ok := other.(*AvgAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.sum += o.sum
+	a.sumFloat += o.sumFloat
+	a.count += o.count
+	a.sumSquares += o.sumSquares
+	a.ht.merge(o.ht)
+	return nil
+}
+
+// The average of a sample estimates the average over the table, with a
+// standard error of the sample standard deviation over the square root of the
+// number of values averaged.
+func (a *AvgAggState) ErrorBound(info *SampleInfo) float64 {
+	if a.ht.weighted {
+		return a.ht.meanBound()
+	}
+	if !info.IsSample() || a.count < 2 {
+		return 0
+	}
+	count := float64(a.count)
+	sum := float64(a.sum) + a.sumFloat
+	variance := math.Max(0, (a.sumSquares-sum*sum/count)/(count-1))
+	return ConfidenceZ * math.Sqrt(variance/count*finitePopulationCorrection(info.SampleSize, info.PopulationSize))
+}
+
 func (a *AvgAggState) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	return &TupleDesc{[]FieldType{{a.alias, "", a.expr.GetExprType().Ftype}}}
 }
 
-func (a *AvgAggState) Finalize(stats map[string]map[string]float64) *Tuple {
+func (a *AvgAggState) Finalize(info *SampleInfo) *Tuple {
 	// TODO: some code goes here
 	var f DBValue
+	if a.count == 0 {
+		// every value was NULL
+		return &Tuple{*a.GetTupleDesc(), []DBValue{NullField{}}, nil}
+	}
 	switch a.expr.GetExprType().Ftype {
 	case IntType:
 		f = IntField{a.sum / int64(a.count)}
+		if a.ht.weighted {
+			f = IntField{int64(a.ht.total / a.ht.count)}
+		}
 	case FloatType:
 		f = FloatField{a.sumFloat / float64(a.count)}
+		if a.ht.weighted {
+			f = FloatField{a.ht.total / a.ht.count}
+		}
 	}
 	return &Tuple{*a.GetTupleDesc(), []DBValue{f}, nil}
 }
@@ -293,50 +445,47 @@ func (a *MaxAggState) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MaxAggState) Merge(other AggState) error {
+	o, ok := other.(*MaxAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	if !o.addedValue {
+		return nil
+	}
+	if !a.addedValue {
+		*a = *o
+		return nil
+	}
+	a.maxInt = max(a.maxInt, o.maxInt)
+	a.maxFloat = max(a.maxFloat, o.maxFloat)
+	a.maxStr = max(a.maxStr, o.maxStr)
+	return nil
+}
+
 func (a *MaxAggState) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	return &TupleDesc{[]FieldType{{a.alias, "", a.expr.GetExprType().Ftype}}}
 }
 
-func (a *MaxAggState) Finalize(stats map[string]map[string]float64) *Tuple {
+func (a *MaxAggState) Finalize(info *SampleInfo) *Tuple {
 	// TODO: some code goes here
 	var f DBValue
+	if !a.addedValue {
+		// every value was NULL
+		return &Tuple{*a.GetTupleDesc(), []DBValue{NullField{}}, nil}
+	}
+	_, estMax, estimated := estimatedRange(info, a.expr)
 	switch a.expr.GetExprType().Ftype {
 	case IntType:
 		f = IntField{a.maxInt}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				if fieldStats[STDDEV] == -1 {
-					// fmt.Printf("Using stats! %v %v\n", stats[SUMSQUARESDIFF], stats[N])
-
-					// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-					fieldStats[STDDEV] = fieldStats[SUMSQUARESDIFF] / stats[N][MEAN]
-				}
-				estMax := int64(fieldStats[MEAN] + 3*fieldStats[STDDEV])
-				if estMax > a.maxInt {
-					f = IntField{estMax}
-				}
-			}
+		if estimated && int64(estMax) > a.maxInt {
+			f = IntField{int64(estMax)}
 		}
 	case FloatType:
 		f = FloatField{a.maxFloat}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				if fieldStats[STDDEV] == -1 {
-					// fmt.Printf("Using stats! %v %v\n", stats[SUMSQUARESDIFF], stats[N])
-
-					// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-					fieldStats[STDDEV] = fieldStats[SUMSQUARESDIFF] / stats[N][MEAN]
-				}
-				estMax := fieldStats[MEAN] + 3*fieldStats[STDDEV]
-				if estMax > a.maxFloat {
-					f = FloatField{estMax}
-				}
-			}
+		if estimated && estMax > a.maxFloat {
+			f = FloatField{estMax}
 		}
 	case StringType:
 		f = StringField{a.maxStr}
@@ -344,6 +493,23 @@ func (a *MaxAggState) Finalize(stats map[string]map[string]float64) *Tuple {
 	return &Tuple{*a.GetTupleDesc(), []DBValue{f}, nil}
 }
 
+// Estimate the smallest and largest values of the column expr reads as three
+// standard deviations either side of its mean, if it has statistics, but
+// within the range of the column if the statistics are over the whole table.
+// Tables with an outlier index have all of their extreme values loaded, so
+// need no estimate.
+func estimatedRange(info *SampleInfo, expr Expr) (float64, float64, bool) {
+	col := info.Column(expr.GetExprType().Fname)
+	if col == nil || info.Outliers != nil {
+		return 0, 0, false
+	}
+	lo, hi := col.Mean-3*col.StdDev, col.Mean+3*col.StdDev
+	if info.Complete && col.Count > 0 {
+		lo, hi = math.Max(lo, col.Min), math.Min(hi, col.Max)
+	}
+	return lo, hi, true
+}
+
 // Implements the aggregation state for MIN
 // Note that we always AddTuple() at least once before Finalize()
 // so no worries for NaN min
@@ -405,50 +571,47 @@ func (a *MinAggState) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MinAggState) Merge(other AggState) error {
+	o, ok := other.(*MinAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	if !o.addedValue {
+		return nil
+	}
+	if !a.addedValue {
+		*a = *o
+		return nil
+	}
+	a.minInt = min(a.minInt, o.minInt)
+	a.minFloat = min(a.minFloat, o.minFloat)
+	a.minStr = min(a.minStr, o.minStr)
+	return nil
+}
+
 func (a *MinAggState) GetTupleDesc() *TupleDesc {
 	// TODO: some code goes here
 	return &TupleDesc{[]FieldType{{a.alias, "", a.expr.GetExprType().Ftype}}}
 }
 
-func (a *MinAggState) Finalize(stats map[string]map[string]float64) *Tuple {
+func (a *MinAggState) Finalize(info *SampleInfo) *Tuple {
 	// TODO: some code goes here
 	var f DBValue
+	if !a.addedValue {
+		// every value was NULL
+		return &Tuple{*a.GetTupleDesc(), []DBValue{NullField{}}, nil}
+	}
+	estMin, _, estimated := estimatedRange(info, a.expr)
 	switch a.expr.GetExprType().Ftype {
 	case IntType:
 		f = IntField{a.minInt}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				if fieldStats[STDDEV] == -1 {
-					// fmt.Printf("Using stats! %v %v\n", stats[SUMSQUARESDIFF], stats[N])
-
-					// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-					fieldStats[STDDEV] = fieldStats[SUMSQUARESDIFF] / stats[N][MEAN]
-				}
-				estMin := int64(fieldStats[MEAN] - 3*fieldStats[STDDEV])
-				if estMin < a.minInt {
-					f = IntField{estMin}
-				}
-			}
+		if estimated && int64(estMin) < a.minInt {
+			f = IntField{int64(estMin)}
 		}
 	case FloatType:
 		f = FloatField{a.minFloat}
-		if stats != nil {
-			fieldName := a.expr.GetExprType().Fname
-			fieldStats := stats[fieldName]
-			if fieldStats != nil {
-				if fieldStats[STDDEV] == -1 {
-					// fmt.Printf("Using stats! %v %v\n", stats[SUMSQUARESDIFF], stats[N])
-
-					// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-					fieldStats[STDDEV] = fieldStats[SUMSQUARESDIFF] / stats[N][MEAN]
-				}
-				estMin := fieldStats[MEAN] - 3*fieldStats[STDDEV]
-				if estMin > a.minFloat {
-					f = FloatField{estMin}
-				}
-			}
+		if estimated && estMin < a.minFloat {
+			f = FloatField{estMin}
 		}
 	case StringType:
 		f = StringField{a.minStr}
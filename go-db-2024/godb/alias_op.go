@@ -0,0 +1,39 @@
+package godb
+
+// A derived table: the output of a subquery of the FROM clause, with its
+// fields qualified by the subquery's alias, so that queries can tell apart
+// the same fields of different subqueries (e.g., when joining a common table
+// expression with itself).
+type TableAliasOp struct {
+	child Operator
+	alias string
+	desc  *TupleDesc
+}
+
+func NewTableAliasOp(alias string, child Operator) *TableAliasOp {
+	desc := child.Descriptor().copy()
+	desc.setTableAlias(alias)
+	return &TableAliasOp{child, alias, desc}
+}
+
+func (a *TableAliasOp) Descriptor() *TupleDesc {
+	return a.desc
+}
+
+func (a *TableAliasOp) SampleInfo() *SampleInfo {
+	return a.child.SampleInfo()
+}
+
+func (a *TableAliasOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := a.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		t, err := childIter()
+		if err != nil || t == nil {
+			return nil, err
+		}
+		return &Tuple{*a.desc, t.Fields, t.Rid}, nil
+	}, nil
+}
@@ -341,3 +341,53 @@ func (bp *BufferPool) AddPage(page Page, file DBFile, pageNo int, tid Transactio
 
 	return page, bp.checkRep()
 }
+
+// Write the dirty cached pages of file to disk, leaving the pages of other
+// files alone (compare [BufferPool.FlushAllPages]).
+func (bp *BufferPool) flushFilePages(file *HeapFile) error {
+	for cacheItem := bp.cacheHead; cacheItem != nil; cacheItem = cacheItem.previousItem {
+		page, ok := cacheItem.page.(*heapPage)
+		if !ok || page.File != file || !page.isDirty() {
+			continue
+		}
+		if err := file.flushPage(page); err != nil {
+			return err
+		}
+		page.setDirty(0, false)
+	}
+	return nil
+}
+
+// Drop every cached page belonging to file from the buffer pool without
+// flushing them. Used when a file is being deleted (e.g. temporary files that
+// operators spill to), so its pages should neither be written back nor take
+// up space in the cache.
+func (bp *BufferPool) discardFilePages(file *HeapFile) {
+	bp.discardPagesFrom(file, 0)
+}
+
+// Drop the cached pages of file numbered firstPage or more from the buffer
+// pool without flushing them. Used when the end of a file is cut off (see
+// [HeapFile.Vacuum]).
+func (bp *BufferPool) discardPagesFrom(file *HeapFile, firstPage int) {
+	cacheItem := bp.cacheHead
+	for cacheItem != nil {
+		prev := cacheItem.previousItem
+		if page, ok := cacheItem.page.(*heapPage); ok && page.File == file && page.PageNo >= firstPage {
+			delete(bp.fileMap, cacheItem.pageKey)
+			if cacheItem.nextItem != nil {
+				cacheItem.nextItem.previousItem = cacheItem.previousItem
+			} else {
+				bp.cacheHead = cacheItem.previousItem
+			}
+			if cacheItem.previousItem != nil {
+				cacheItem.previousItem.nextItem = cacheItem.nextItem
+			} else {
+				bp.cacheTail = cacheItem.nextItem
+			}
+			bp.numPages--
+		}
+		cacheItem = prev
+	}
+	DebugBufferPool("discarded pages of %v, %v pages left in cache", file.fileName, bp.numPages)
+}
@@ -74,6 +74,9 @@ func ImportCatalogFromCSVs(
 		if err != nil {
 			return err
 		}
+		if err := hf.Truncate(); err != nil {
+			return err
+		}
 		f, err := os.Open(fileName)
 		if err != nil {
 			return err
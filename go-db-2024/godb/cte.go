@@ -0,0 +1,226 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// The SQL parser doesn't know about WITH clauses, so they are split off of
+// the front of a query before it is parsed. The common table expressions they
+// define are then inlined as derived tables wherever the query (or a later
+// common table expression) reads them, so a common table expression that is
+// read twice is also computed twice. Recursive common table expressions
+// aren't supported.
+
+// A common table expression of a WITH clause.
+type commonTableExpr struct {
+	name    string
+	columns []string // renames the columns of its query, if set
+	query   string
+}
+
+// Split the WITH clause off of the front of query, returning the rest of the
+// query and the common table expressions the clause defines, in order.
+func splitWith(query string) (string, []*commonTableExpr, error) {
+	sc := &withScanner{query, 0}
+	if !sc.keyword("with") {
+		return query, nil, nil
+	}
+	if sc.keyword("recursive") {
+		return "", nil, GoDBError{ParseError, "recursive common table expressions are not supported"}
+	}
+	var ctes []*commonTableExpr
+	for {
+		name := sc.identifier()
+		if name == "" {
+			return "", nil, GoDBError{ParseError, fmt.Sprintf("expected the name of a common table expression at '%s'", sc.rest())}
+		}
+		for _, cte := range ctes {
+			if cte.name == name {
+				return "", nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s is defined twice", name)}
+			}
+		}
+		cte := &commonTableExpr{name: name}
+		if cols, ok := sc.parens(); ok {
+			for _, col := range strings.Split(cols, ",") {
+				cte.columns = append(cte.columns, strings.Trim(strings.ToLower(strings.TrimSpace(col)), "`"))
+			}
+		}
+		if !sc.keyword("as") {
+			return "", nil, GoDBError{ParseError, fmt.Sprintf("expected AS after common table expression %s", name)}
+		}
+		query, ok := sc.parens()
+		if !ok {
+			return "", nil, GoDBError{ParseError, fmt.Sprintf("expected the parenthesized query of common table expression %s", name)}
+		}
+		cte.query = query
+		ctes = append(ctes, cte)
+		if !sc.punct(',') {
+			return sc.rest(), ctes, nil
+		}
+	}
+}
+
+// Parse the query of the common table expression, inlining the common table
+// expressions in earlier that it reads.
+func (cte *commonTableExpr) parse(earlier []*commonTableExpr) (sqlparser.SelectStatement, error) {
+	stmt, err := sqlparser.Parse(cte.query)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(sqlparser.SelectStatement)
+	if !ok {
+		return nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s is not a query", cte.name)}
+	}
+	if err := inlineCTEs(sel, earlier); err != nil {
+		return nil, err
+	}
+	if len(cte.columns) > 0 {
+		// the output is named by the first SELECT of a set operation
+		first := leftmostSelect(sel)
+		if len(first.SelectExprs) != len(cte.columns) {
+			return nil, GoDBError{ParseError, fmt.Sprintf("common table expression %s has %d column names but %d columns", cte.name, len(cte.columns), len(first.SelectExprs))}
+		}
+		for i, expr := range first.SelectExprs {
+			aliased, ok := expr.(*sqlparser.AliasedExpr)
+			if !ok {
+				return nil, GoDBError{ParseError, fmt.Sprintf("can't rename %s of common table expression %s", sqlparser.String(expr), cte.name)}
+			}
+			aliased.As = sqlparser.NewColIdent(cte.columns[i])
+		}
+	}
+	return sel, nil
+}
+
+// Replace the reads of the common table expressions ctes in node with their
+// queries.
+func inlineCTEs(node sqlparser.SQLNode, ctes []*commonTableExpr) error {
+	if len(ctes) == 0 {
+		return nil
+	}
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		tableEx, ok := node.(*sqlparser.AliasedTableExpr)
+		if !ok {
+			return true, nil
+		}
+		table, ok := tableEx.Expr.(sqlparser.TableName)
+		if !ok || !table.Qualifier.IsEmpty() {
+			return true, nil
+		}
+		for i, cte := range ctes {
+			if cte.name != strings.ToLower(table.Name.String()) {
+				continue
+			}
+			// each read gets its own copy of the query
+			sel, err := cte.parse(ctes[:i])
+			if err != nil {
+				return false, err
+			}
+			tableEx.Expr = &sqlparser.Subquery{Select: sel}
+			if tableEx.As.IsEmpty() {
+				tableEx.As = table.Name
+			}
+			return false, nil
+		}
+		return true, nil
+	}, node)
+}
+
+// Scans the WITH clause at the start of a query.
+type withScanner struct {
+	query string
+	pos   int
+}
+
+func (sc *withScanner) skipSpace() {
+	for sc.pos < len(sc.query) && unicode.IsSpace(rune(sc.query[sc.pos])) {
+		sc.pos++
+	}
+}
+
+func (sc *withScanner) rest() string {
+	return sc.query[sc.pos:]
+}
+
+// Consume the keyword kw, if it's next.
+func (sc *withScanner) keyword(kw string) bool {
+	sc.skipSpace()
+	end := sc.pos + len(kw)
+	if end > len(sc.query) || !strings.EqualFold(sc.query[sc.pos:end], kw) {
+		return false
+	}
+	if end < len(sc.query) && isIdentChar(sc.query[end]) {
+		return false
+	}
+	sc.pos = end
+	return true
+}
+
+// Consume the character ch, if it's next.
+func (sc *withScanner) punct(ch byte) bool {
+	sc.skipSpace()
+	if sc.pos < len(sc.query) && sc.query[sc.pos] == ch {
+		sc.pos++
+		return true
+	}
+	return false
+}
+
+// Consume an identifier, returning it in lower case, or "" if there isn't one.
+func (sc *withScanner) identifier() string {
+	sc.skipSpace()
+	if sc.pos < len(sc.query) && sc.query[sc.pos] == '`' {
+		end := strings.IndexByte(sc.query[sc.pos+1:], '`')
+		if end < 0 {
+			return ""
+		}
+		name := sc.query[sc.pos+1 : sc.pos+1+end]
+		sc.pos += end + 2
+		return strings.ToLower(name)
+	}
+	start := sc.pos
+	for sc.pos < len(sc.query) && isIdentChar(sc.query[sc.pos]) {
+		sc.pos++
+	}
+	return strings.ToLower(sc.query[start:sc.pos])
+}
+
+// Consume a parenthesized string, returning what's inside of the parentheses.
+// Parentheses inside of quotes don't count.
+func (sc *withScanner) parens() (string, bool) {
+	if !sc.punct('(') {
+		return "", false
+	}
+	start := sc.pos
+	depth := 1
+	var quote byte
+	for ; sc.pos < len(sc.query); sc.pos++ {
+		ch := sc.query[sc.pos]
+		switch {
+		case quote != 0 && ch == '\\':
+			sc.pos++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				sc.pos++
+				return sc.query[start : sc.pos-1], true
+			}
+		}
+	}
+	return "", false
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
@@ -0,0 +1,71 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestSplitWith(t *testing.T) {
+	query, ctes, err := splitWith("WITH x AS (select ')' from t), `Y` (a, b) as (select name, age from x) select * from y")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if query != "select * from y" {
+		t.Errorf("unexpected query %q", query)
+	}
+	if len(ctes) != 2 || ctes[0].name != "x" || ctes[0].query != "select ')' from t" {
+		t.Fatalf("unexpected common table expressions %v", ctes)
+	}
+	if ctes[1].name != "y" || len(ctes[1].columns) != 2 || ctes[1].columns[1] != "b" {
+		t.Errorf("unexpected common table expression %v", ctes[1])
+	}
+
+	// queries without WITH are left alone
+	if query, ctes, _ := splitWith("select * from without"); query != "select * from without" || ctes != nil {
+		t.Errorf("unexpected split %q, %v", query, ctes)
+	}
+
+	for _, bad := range []string{
+		"with recursive x as (select 1) select * from x",
+		"with x as (select 1), x as (select 2) select * from x",
+		"with x (select 1) select * from x",
+		"with x as (select 1 select * from x",
+	} {
+		if _, _, err := splitWith(bad); err == nil {
+			t.Errorf("expected error splitting %q", bad)
+		}
+	}
+}
+
+func TestParseCTEs(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql  string
+		rows int
+	}{
+		{"with old as (select name, age from t where age > 40) select name from old where age < 60", 3},
+		{"with a as (select name from t where age > 40), b (n) as (select name from a where name like 's%') select n from b", 2},
+		// each read of a is planned separately
+		{"with a as (select name, age from t) select a1.name from a a1, a a2 where a1.name = a2.name and a1.age < a2.age", 2},
+		{"with names as (select name from t intersect select name from t2 where age > 90) select * from names", 2},
+		{"with young as (select name from t2 where age < 30) select name from t where name in (select name from young)", 5},
+	}
+	for _, q := range queries {
+		if tups := runHavingQuery(t, bp, c, q.sql); len(tups) != q.rows {
+			t.Errorf("q=%s: expected %d rows, got %d", q.sql, q.rows, len(tups))
+		}
+	}
+
+	tups := runHavingQuery(t, bp, c, "with b (n) as (select name from t) select * from b")
+	if len(tups) != 12 || tups[0].Desc.Fields[0].Fname != "n" {
+		t.Errorf("expected 12 tuples with a renamed column n, got %v", tups)
+	}
+
+	// common table expressions can only read earlier ones
+	if _, _, _, err := Parse(c, "with a as (select name from b), b as (select name from t) select * from a"); err == nil {
+		t.Errorf("expected error reading a later common table expression")
+	}
+}
@@ -24,8 +24,8 @@ func NewDeleteOp(deleteFile DBFile, child Operator) *DeleteOp {
 	return &DeleteOp{deleteFile, child}
 }
 
-func (dop *DeleteOp) Statistics() map[string]map[string]float64 {
-	return dop.child.Statistics()
+func (dop *DeleteOp) SampleInfo() *SampleInfo {
+	return dop.child.SampleInfo()
 }
 
 // The delete TupleDesc is a one column descriptor with an integer field named
@@ -0,0 +1,321 @@
+package godb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"math"
+	"math/bits"
+)
+
+// Aggregates that count distinct values, registered in agg_registry.go.
+//
+// Scaling up the number of distinct values in a sample like a count would be
+// badly biased (values that appear many times in the table are in the sample
+// whatever its size), so over a sample these aggregates estimate the number of
+// distinct values in the table from how many values were seen once and twice,
+// with the estimator of Chao and Lin for sampling without replacement (see
+// [freqProfile.estimate]).
+
+// The number of distinct values seen in a sample, and of them, the number seen
+// once and twice, out of n values.
+type freqProfile struct {
+	d, f1, f2, n float64
+}
+
+// Make the frequency profile of values seen the given numbers of times.
+func profileOf[K comparable](counts map[K]int) freqProfile {
+	var p freqProfile
+	for _, c := range counts {
+		p.d++
+		p.n += float64(c)
+		switch c {
+		case 1:
+			p.f1++
+		case 2:
+			p.f2++
+		}
+	}
+	return p
+}
+
+// Estimate the number of distinct values in the table that the profiled values
+// are a sample of, and the variance of the estimate. The number of values
+// missing from the sample is estimated with the bias corrected Chao1 estimator
+// adjusted for sampling a fraction q of the table without replacement,
+//
+//	f0 = f1 (f1-1) / (2 (n/(n-1)) (f2+1) + f1 q/(1-q))
+//
+// (A. Chao and C. Lin, "Nonparametric lower bounds for species richness and
+// shared species richness under sampling without replacement", Biometrics
+// 2012), and its variance by the delta method, treating the frequencies as
+// multinomial counts over the estimated distinct values, as Chao does.
+func (p freqProfile) estimate(info *SampleInfo) (float64, float64) {
+	q := info.InclusionProbability()
+	if q >= 1 || p.f1 == 0 {
+		return p.d, 0
+	}
+	a := 1.0
+	if p.n > 1 {
+		a = p.n / (p.n - 1)
+	}
+	b := q / (1 - q)
+	num := p.f1 * (p.f1 - 1)
+	den := 2*a*(p.f2+1) + b*p.f1
+	f0 := num / den
+	// no more distinct values than tuples in the table
+	est := math.Min(p.d+f0, math.Max(p.d, p.n/q))
+
+	df1 := ((2*p.f1-1)*den - num*b) / (den * den)
+	df2 := -num * 2 * a / (den * den)
+	variance := df1*df1*p.f1*(1-p.f1/est) + df2*df2*p.f2*(1-p.f2/est) - 2*df1*df2*p.f1*p.f2/est
+	return est, math.Max(0, variance)
+}
+
+// Implements the aggregation state for COUNT(DISTINCT x), which keeps the
+// number of times each value was seen in memory. NULLs are ignored.
+type CountDistinctAggState struct {
+	alias  string
+	expr   Expr
+	counts map[DBValue]int
+}
+
+func (a *CountDistinctAggState) Copy() AggState {
+	return &CountDistinctAggState{a.alias, a.expr, maps.Clone(a.counts)}
+}
+
+func (a *CountDistinctAggState) Init(alias string, expr Expr) error {
+	a.alias, a.expr, a.counts = alias, expr, make(map[DBValue]int)
+	return nil
+}
+
+func (a *CountDistinctAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+		return
+	}
+	if !isNull(v) {
+		a.counts[v]++
+	}
+}
+
+func (a *CountDistinctAggState) Merge(other AggState) error {
+	o, ok := other.(*CountDistinctAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	for v, c := range o.counts {
+		a.counts[v] += c
+	}
+	return nil
+}
+
+func (a *CountDistinctAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func (a *CountDistinctAggState) Finalize(info *SampleInfo) *Tuple {
+	return &Tuple{*a.GetTupleDesc(), []DBValue{IntField{int64(len(a.counts))}}, nil}
+}
+
+func (a *CountDistinctAggState) EstimateFromSample(info *SampleInfo) (DBValue, float64) {
+	est, variance := profileOf(a.counts).estimate(info)
+	return IntField{int64(math.Round(est))}, variance
+}
+
+// The number of bits of a hash that pick a register of a HyperLogLog sketch.
+const hllPrecision = 12
+
+// The number of distinct values an APPROX_COUNT_DISTINCT state keeps counts of.
+const distinctSampleSize = 1024
+
+// Implements the aggregation state for APPROX_COUNT_DISTINCT(x), which counts
+// the distinct values in a fixed amount of memory with a HyperLogLog sketch
+// (see https://en.wikipedia.org/wiki/HyperLogLog), to within about
+// 1.04/sqrt(2^hllPrecision), i.e. 1.6%. NULLs are ignored.
+//
+// The state also counts how many times it saw each of a sample of the
+// distinct values, those whose hashes end in level zero bits, increasing the
+// level as needed to keep at most distinctSampleSize of them (as in Gibbons'
+// distinct sampling). Until the level first increases, these are all of the
+// values, and the count is exact. Over a sample of a table, the fractions of
+// the sampled values that were seen once and twice estimate the frequency
+// profile of all the values, from which the number of distinct values in the
+// table is estimated as for COUNT(DISTINCT x).
+type ApproxCountDistinctAggState struct {
+	alias     string
+	expr      Expr
+	registers []uint8
+	level     int
+	sample    map[uint64]int // the number of times each sampled value was seen, by hash
+	n         float64        // the number of values seen
+}
+
+func (a *ApproxCountDistinctAggState) Copy() AggState {
+	c := *a
+	c.registers = append([]uint8(nil), a.registers...)
+	c.sample = maps.Clone(a.sample)
+	return &c
+}
+
+func (a *ApproxCountDistinctAggState) Init(alias string, expr Expr) error {
+	*a = ApproxCountDistinctAggState{
+		alias:     alias,
+		expr:      expr,
+		registers: make([]uint8, 1<<hllPrecision),
+		sample:    make(map[uint64]int),
+	}
+	return nil
+}
+
+// Hash a (non-NULL) value for the sketch.
+func hashDistinctValue(v DBValue) uint64 {
+	h := fnv.New64a()
+	var buf [9]byte
+	switch v := v.(type) {
+	case IntField:
+		buf[0] = 'i'
+		binary.LittleEndian.PutUint64(buf[1:], uint64(v.Value))
+		h.Write(buf[:])
+	case FloatField:
+		buf[0] = 'f'
+		binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(v.Value))
+		h.Write(buf[:])
+	case StringField:
+		h.Write([]byte{'s'})
+		h.Write([]byte(v.Value))
+	}
+	// mix the bits (the finalizer of splitmix64), since the sketch uses both
+	// the high and the low bits of the hash
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Whether the value with hash h is in the sample of distinct values at level.
+func inDistinctSample(h uint64, level int) bool {
+	return bits.TrailingZeros64(h) >= level
+}
+
+// Raise the level of the sample of distinct values until it is small enough.
+func (a *ApproxCountDistinctAggState) shrinkSample() {
+	for len(a.sample) > distinctSampleSize {
+		a.level++
+		for h := range a.sample {
+			if !inDistinctSample(h, a.level) {
+				delete(a.sample, h)
+			}
+		}
+	}
+}
+
+func (a *ApproxCountDistinctAggState) add(h uint64, count int) {
+	reg := h >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(h<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	a.registers[reg] = max(a.registers[reg], rank)
+	if inDistinctSample(h, a.level) {
+		a.sample[h] += count
+	}
+}
+
+func (a *ApproxCountDistinctAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+		return
+	}
+	if isNull(v) {
+		return
+	}
+	a.n++
+	a.add(hashDistinctValue(v), 1)
+	a.shrinkSample()
+}
+
+func (a *ApproxCountDistinctAggState) Merge(other AggState) error {
+	o, ok := other.(*ApproxCountDistinctAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.level = max(a.level, o.level)
+	for h := range a.sample {
+		if !inDistinctSample(h, a.level) {
+			delete(a.sample, h)
+		}
+	}
+	for h, c := range o.sample {
+		if inDistinctSample(h, a.level) {
+			a.sample[h] += c
+		}
+	}
+	for i, r := range o.registers {
+		a.registers[i] = max(a.registers[i], r)
+	}
+	a.n += o.n
+	a.shrinkSample()
+	return nil
+}
+
+// Return the estimate of the number of distinct values of the HyperLogLog
+// sketch, with linear counting for small numbers.
+func (a *ApproxCountDistinctAggState) sketchEstimate() float64 {
+	m := float64(len(a.registers))
+	sum, zeros := 0.0, 0.0
+	for _, r := range a.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/zeros)
+	}
+	return est
+}
+
+// Return the number of distinct values seen, which is exact until the level
+// of the sample of distinct values first increases.
+func (a *ApproxCountDistinctAggState) distinct() float64 {
+	if a.level == 0 {
+		return float64(len(a.sample))
+	}
+	return a.sketchEstimate()
+}
+
+// The standard error of the number of distinct values seen.
+func (a *ApproxCountDistinctAggState) stdErr() float64 {
+	if a.level == 0 {
+		return 0
+	}
+	return 1.04 / math.Sqrt(float64(len(a.registers))) * a.sketchEstimate()
+}
+
+func (a *ApproxCountDistinctAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", IntType}}}
+}
+
+func (a *ApproxCountDistinctAggState) Finalize(info *SampleInfo) *Tuple {
+	return &Tuple{*a.GetTupleDesc(), []DBValue{IntField{int64(math.Round(a.distinct()))}}, nil}
+}
+
+// The confidence interval of the sketch's count, when the input isn't a
+// sample (see [estimatingAggState.ErrorBound]).
+func (a *ApproxCountDistinctAggState) ErrorBound(info *SampleInfo) float64 {
+	return ConfidenceZ * a.stdErr()
+}
+
+func (a *ApproxCountDistinctAggState) EstimateFromSample(info *SampleInfo) (DBValue, float64) {
+	p := profileOf(a.sample)
+	if a.level > 0 && p.d > 0 {
+		// scale the profile of the sampled distinct values up to all of them
+		scale := a.distinct() / p.d
+		p.d, p.f1, p.f2 = p.d*scale, p.f1*scale, p.f2*scale
+	}
+	p.n = a.n
+	est, variance := p.estimate(info)
+	stdErr := a.stdErr() * est / math.Max(1, a.distinct())
+	return IntField{int64(math.Round(est))}, variance + stdErr*stdErr
+}
@@ -0,0 +1,93 @@
+package godb
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestParseCountDistinct(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	tups := runHavingQuery(t, bp, c, "select count(distinct name), approx_count_distinct(name), count(name) from t")
+	if len(tups) != 1 || tups[0].Fields[0] != (IntField{10}) || tups[0].Fields[1] != (IntField{10}) || tups[0].Fields[2] != (IntField{12}) {
+		t.Errorf("unexpected distinct counts %v", tups)
+	}
+	// sam and riza have two different ages
+	tups = runHavingQuery(t, bp, c, "select name from t group by name having count(distinct age) > 1")
+	if len(tups) != 2 {
+		t.Errorf("expected 2 names with different ages, got %v", tups)
+	}
+
+	for _, sql := range []string{
+		"select sum(distinct age) from t",
+		"select count(distinct *) from t",
+		"select count(distinct age) over () from t",
+	} {
+		if _, _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+func TestApproxCountDistinct(t *testing.T) {
+	td := &TupleDesc{[]FieldType{{"x", "", IntType}}}
+	var expr Expr = &FieldExpr{td.Fields[0]}
+	whole := &ApproxCountDistinctAggState{}
+	whole.Init("d", expr)
+	halves := []AggState{whole.Copy(), whole.Copy()}
+	distinct := 50000
+	for i := 0; i < 2*distinct; i++ {
+		tup := &Tuple{*td, []DBValue{IntField{int64(i % distinct)}}, nil}
+		whole.AddTuple(tup)
+		halves[i%2].AddTuple(tup)
+	}
+	got := float64(whole.Finalize(nil).Fields[0].(IntField).Value)
+	if math.Abs(got-float64(distinct)) > 0.05*float64(distinct) {
+		t.Errorf("expected about %d distinct values, got %v", distinct, got)
+	}
+	if len(whole.sample) > distinctSampleSize {
+		t.Errorf("expected at most %d sampled distinct values, got %d", distinctSampleSize, len(whole.sample))
+	}
+	if bound := whole.ErrorBound(nil); bound <= 0 || bound > 0.1*float64(distinct) {
+		t.Errorf("unexpected error bound %v", bound)
+	}
+	if err := halves[0].Merge(halves[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if merged := halves[0].Finalize(nil).Fields[0]; merged != whole.Finalize(nil).Fields[0] {
+		t.Errorf("expected merged sketch to count %v, got %v", whole.Finalize(nil).Fields[0], merged)
+	}
+}
+
+func TestDistinctFromSample(t *testing.T) {
+	// a table of 100000 tuples with 10000 values, each 10 times, of which a
+	// tenth is sampled
+	const population, distinct = 100000, 10000
+	td := &TupleDesc{[]FieldType{{"x", "", IntType}}}
+	var expr Expr = &FieldExpr{td.Fields[0]}
+	for _, name := range []string{"count_distinct", "approx_count_distinct"} {
+		state, _ := newAggState(name)
+		state.Init(name, expr)
+		for _, i := range rand.New(rand.NewSource(1)).Perm(population)[:population/10] {
+			state.AddTuple(&Tuple{*td, []DBValue{IntField{int64(i % distinct)}}, nil})
+		}
+
+		// about 65% of the values are in the sample
+		seen := state.Finalize(nil).Fields[0].(IntField).Value
+		if seen > 7000 || seen < 6000 {
+			t.Errorf("%s: expected about 6500 values in the sample, got %d", name, seen)
+		}
+		info := &SampleInfo{PopulationSize: population, SampleSize: population / 10}
+		est := state.Finalize(info).Fields[0].(IntField).Value
+		if math.Abs(float64(est-distinct)) > 0.1*distinct {
+			t.Errorf("%s: expected an estimate of about %d values, got %d", name, distinct, est)
+		}
+		bound := state.(ErrorBounder).ErrorBound(info)
+		if bound <= 0 || bound > 0.2*distinct {
+			t.Errorf("%s: unexpected error bound %v", name, bound)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -67,6 +69,16 @@ type FuncExpr struct {
 }
 
 func (f *FuncExpr) GetExprType() FieldType {
+	ft := FieldType{f.op, "", IntType}
+	for _, fe := range f.args {
+		fieldExpr, ok := (*fe).(*FieldExpr)
+		if ok {
+			ft = fieldExpr.GetExprType()
+		}
+	}
+	if fType, ok := f.resolve(); ok {
+		return FieldType{ft.Fname, ft.TableQualifier, fType.outType}
+	}
 	fType, exists := funcs[f.op]
 	//todo return err
 	if !exists {
@@ -76,12 +88,7 @@ func (f *FuncExpr) GetExprType() FieldType {
 		}
 	}
 	outType := fType.outType
-	ft := FieldType{f.op, "", IntType}
 	for _, fe := range f.args {
-		fieldExpr, ok := (*fe).(*FieldExpr)
-		if ok {
-			ft = fieldExpr.GetExprType()
-		}
 		if (*fe).GetExprType().Ftype == FloatType {
 			outType = FloatType
 		}
@@ -89,6 +96,35 @@ func (f *FuncExpr) GetExprType() FieldType {
 	return FieldType{ft.Fname, ft.TableQualifier, outType}
 }
 
+// Return the first overload of the function whose argument types match the
+// types of its arguments. Arguments of unknown type (NULLs) match any type.
+func (f *FuncExpr) resolve() (FuncType, bool) {
+	candidates, exists := overloadedFuncs[f.op]
+	if !exists {
+		fType, exists := funcs[f.op]
+		if !exists {
+			return FuncType{}, false
+		}
+		candidates = []FuncType{fType}
+	}
+	for _, fType := range candidates {
+		if len(fType.argTypes) != len(f.args) {
+			continue
+		}
+		match := true
+		for i, argType := range fType.argTypes {
+			if t := (*f.args[i]).GetExprType().Ftype; t != argType && t != UnknownType {
+				match = false
+				break
+			}
+		}
+		if match {
+			return fType, true
+		}
+	}
+	return FuncType{}, false
+}
+
 type FuncType struct {
 	argTypes []DBType
 	outType  DBType
@@ -103,6 +139,17 @@ var overloadedFuncs = map[string][]FuncType{
 	"sq":   {{[]DBType{FloatType}, FloatType, sqFuncFloat}, {[]DBType{IntType}, IntType, sqFuncInt}},
 	"nmin": {{[]DBType{FloatType, FloatType}, FloatType, minFuncFloats}, {[]DBType{IntType, IntType}, IntType, minFuncInts}, {[]DBType{FloatType, IntType}, FloatType, minFuncFloats}, {[]DBType{IntType, FloatType}, FloatType, minFuncFloats}},
 	"nmax": {{[]DBType{FloatType, FloatType}, FloatType, maxFuncFloats}, {[]DBType{IntType, IntType}, IntType, maxFuncInts}, {[]DBType{FloatType, IntType}, FloatType, maxFuncFloats}, {[]DBType{IntType, FloatType}, FloatType, maxFuncFloats}},
+
+	// math and date functions, in scalar_funcs.go
+	"abs":      {{[]DBType{FloatType}, FloatType, absFuncFloat}, {[]DBType{IntType}, IntType, absFuncInt}},
+	"round":    {{[]DBType{FloatType}, FloatType, roundFuncFloat}, {[]DBType{IntType}, IntType, roundFuncInt}, {[]DBType{FloatType, IntType}, FloatType, roundFuncFloat}, {[]DBType{IntType, IntType}, IntType, roundFuncInt}},
+	"floor":    {{[]DBType{FloatType}, FloatType, floorFuncFloat}, {[]DBType{IntType}, IntType, identityFunc}},
+	"ceil":     {{[]DBType{FloatType}, FloatType, ceilFuncFloat}, {[]DBType{IntType}, IntType, identityFunc}},
+	"ceiling":  {{[]DBType{FloatType}, FloatType, ceilFuncFloat}, {[]DBType{IntType}, IntType, identityFunc}},
+	"extract":  {{[]DBType{StringType, StringType}, IntType, extractFunc}, {[]DBType{StringType, IntType}, IntType, extractFunc}},
+	"date_add": {{[]DBType{StringType, IntType, StringType}, StringType, dateAddFunc}, {[]DBType{IntType, IntType, StringType}, IntType, dateAddFunc}},
+	"date_sub": {{[]DBType{StringType, IntType, StringType}, StringType, dateSubFunc}, {[]DBType{IntType, IntType, StringType}, IntType, dateSubFunc}},
+	"datediff": {{[]DBType{StringType, StringType}, IntType, dateDiffFunc}, {[]DBType{IntType, IntType}, IntType, dateDiffFunc}},
 }
 
 var funcs = map[string]FuncType{
@@ -123,7 +170,47 @@ var funcs = map[string]FuncType{
 	"imin":                  {[]DBType{IntType, IntType}, IntType, minFuncInts},
 	"imax":                  {[]DBType{IntType, IntType}, IntType, maxFuncInts},
 	"fmin":                  {[]DBType{FloatType, FloatType}, FloatType, minFuncFloats},
-	"fmax":                  {[]DBType{FloatType, FloatType}, FloatType, minFuncFloats},
+	"fmax":                  {[]DBType{FloatType, FloatType}, FloatType, maxFuncFloats},
+	"lower":                 {[]DBType{StringType}, StringType, lowerFunc},
+	"upper":                 {[]DBType{StringType}, StringType, upperFunc},
+	"length":                {[]DBType{StringType}, IntType, lengthFunc},
+	"concat":                {[]DBType{StringType, StringType}, StringType, concatFunc},
+	"trim":                  {[]DBType{StringType}, StringType, trimFunc},
+	"ltrim":                 {[]DBType{StringType}, StringType, ltrimFunc},
+	"rtrim":                 {[]DBType{StringType}, StringType, rtrimFunc},
+}
+
+// Register a scalar function that queries can call by name, or another
+// overload of one: a call runs the first overload whose argument types match
+// the types of its arguments. f gets the values of the arguments as int64s,
+// float64s and strings, as given by argTypes, and must return a value of
+// outType, or nil for NULL. If any argument is NULL, f isn't called and the
+// call is NULL.
+//
+// The function tables aren't locked, so functions should be registered
+// before any queries run (e.g., in an init function).
+func RegisterFunction(name string, argTypes []DBType, outType DBType, f func(args []any) any) error {
+	name = strings.ToLower(name)
+	if isAgg(name) || specialForms[name] != nil {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("can't register function %s, which is built into the parser", name)}
+	}
+	for _, t := range append(slices.Clone(argTypes), outType) {
+		if t != IntType && t != FloatType && t != StringType {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("function %s can't take or return values of type %v", name, t)}
+		}
+	}
+	overloads := overloadedFuncs[name]
+	if fType, exists := funcs[name]; exists {
+		overloads = append(overloads, fType)
+	}
+	for _, fType := range overloads {
+		if slices.Equal(fType.argTypes, argTypes) {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("function %s%v is already registered", name, argTypes)}
+		}
+	}
+	overloadedFuncs[name] = append(overloads, FuncType{slices.Clone(argTypes), outType, f})
+	delete(funcs, name)
+	return nil
 }
 
 func ListOfFunctions() string {
@@ -157,8 +244,20 @@ func ListOfFunctions() string {
 	for name, f := range funcs {
 		processFunc(name, f)
 	}
+	// the special forms of scalar_exprs.go
+	fList += "\tCASE [x] WHEN cond THEN val ... [ELSE val] END\n\tCAST(x AS type)\n\tCOALESCE(x, ...)\n\tEXTRACT(unit FROM date)\n\tdate + INTERVAL n unit, date - INTERVAL n unit\n"
 	return fList
 }
+
+// Return an argument of a function that takes floats, which may be an
+// integer for the overloads that mix integers and floats.
+func floatArg(arg any) float64 {
+	if i, ok := arg.(int64); ok {
+		return float64(i)
+	}
+	return arg.(float64)
+}
+
 func minFuncInts(args []any) any {
 	first := args[0].(int64)
 	second := args[1].(int64)
@@ -169,8 +268,8 @@ func minFuncInts(args []any) any {
 }
 
 func minFuncFloats(args []any) any {
-	first := args[0].(float64)
-	second := args[1].(float64)
+	first := floatArg(args[0])
+	second := floatArg(args[1])
 	if first < second {
 		return first
 	}
@@ -187,8 +286,8 @@ func maxFuncInts(args []any) any {
 }
 
 func maxFuncFloats(args []any) any {
-	first := args[0].(float64)
-	second := args[1].(float64)
+	first := floatArg(args[0])
+	second := floatArg(args[1])
 	if first >= second {
 		return first
 	}
@@ -242,7 +341,7 @@ func divFuncInts(args []any) any {
 }
 
 func divFuncFloats(args []any) any {
-	return args[0].(float64) / args[1].(float64)
+	return floatArg(args[0]) / floatArg(args[1])
 }
 
 func timesFuncInts(args []any) any {
@@ -250,7 +349,7 @@ func timesFuncInts(args []any) any {
 }
 
 func timesFuncFloats(args []any) any {
-	return args[0].(float64) * args[1].(float64)
+	return floatArg(args[0]) * floatArg(args[1])
 }
 
 func minusFuncInts(args []any) any {
@@ -274,7 +373,7 @@ func addFuncInts(args []any) any {
 }
 
 func addFuncFloats(args []any) any {
-	return args[0].(float64) + args[1].(float64)
+	return floatArg(args[0]) + floatArg(args[1])
 }
 
 func sqFuncInt(args []any) any {
@@ -310,7 +409,7 @@ func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
 		argvals := make([]any, len(fType.argTypes))
 		for i, argType := range fType.argTypes {
 			arg := *f.args[i]
-			if arg.GetExprType().Ftype != argType {
+			if t := arg.GetExprType().Ftype; t != argType && t != UnknownType {
 				typeName := "string"
 				switch argType {
 				case IntType:
@@ -324,16 +423,23 @@ func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
 			if err != nil {
 				return nil, err
 			}
-			switch argType {
-			case IntType:
-				argvals[i] = val.(IntField).Value
-			case FloatType:
-				argvals[i] = val.(FloatField).Value
-			case StringType:
-				argvals[i] = val.(StringField).Value
+			// functions of NULL are NULL
+			if isNull(val) {
+				return NullField{}, nil
+			}
+			switch v := val.(type) {
+			case IntField:
+				argvals[i] = v.Value
+			case FloatField:
+				argvals[i] = v.Value
+			case StringField:
+				argvals[i] = v.Value
 			}
 		}
 		result := fType.f(argvals)
+		if result == nil {
+			return NullField{}, nil
+		}
 		switch fType.outType {
 		case IntType:
 			return IntField{result.(int64)}, nil
@@ -7,6 +7,10 @@ type Filter struct {
 	left  Expr
 	right Expr
 	child Operator
+
+	// the predicate tuples must satisfy; for filters made by NewFilter, the
+	// comparison of left and right
+	pred Expr
 }
 
 var DEBUGFILTER = false
@@ -18,13 +22,30 @@ func DebugFilter(format string, a ...any) (int, error) {
 	return 0, nil
 }
 
-// Construct a filter operator on ints.
+// Construct a filter operator on ints. The patterns of pattern matching
+// operators (LIKE, etc) are compiled here, once.
 func NewFilter(constExpr Expr, op BoolOp, field Expr, child Operator) (*Filter, error) {
-	return &Filter{op, field, constExpr, child}, nil
+	pred, err := newComparison(field, op, constExpr)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{op, field, constExpr, child, pred}, nil
+}
+
+// Construct a filter that passes the tuples for which an arbitrary predicate
+// (see [CompareExpr], [AndExpr], [OrExpr], etc) is true.
+func NewPredicateFilter(pred Expr, child Operator) (*Filter, error) {
+	if pred == nil {
+		return nil, GoDBError{IllegalOperationError, "filter needs a predicate"}
+	}
+	return &Filter{child: child, pred: pred}, nil
 }
 
-func (f *Filter) Statistics() map[string]map[string]float64 {
-	return make(map[string]map[string]float64)
+// The tuples that pass a filter are a sample of the tuples of the table that
+// pass it, drawn with the same inclusion probability as the input, so the
+// sampling metadata is passed through unchanged.
+func (f *Filter) SampleInfo() *SampleInfo {
+	return f.child.SampleInfo()
 }
 
 // Return a TupleDescriptor for this filter op.
@@ -65,21 +86,15 @@ func (f *Filter) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 				return nil, nil
 			}
 
-			// evaluate left and right sides
-			v1, err := f.left.EvalExpr(tup)
-			if err != nil {
-				DebugFilter("Got err getting tuple: %v", err)
-				return nil, err
-			}
-
-			v2, err := f.right.EvalExpr(tup)
+			// evaluate the predicate
+			passes, err := evalPredicate(f.pred, tup)
 			if err != nil {
 				DebugFilter("Got err getting tuple: %v", err)
 				return nil, err
 			}
 
 			// return if passes filtering
-			if v1.EvalPred(v2, f.op) {
+			if passes {
 				// fmt.Printf("%v passes filtering \n", tup)
 				return tup, nil
 			}
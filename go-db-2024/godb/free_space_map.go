@@ -0,0 +1,234 @@
+package godb
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The free space map of a heap file records how many free slots each of its
+// pages has, so that a heap file that is reopened knows which pages inserts
+// can reuse. It is stored in a file next to the heap file's backing file (see
+// [freeSpaceMapFileName]): a header with the magic bytes "GFSM", the version
+// of the format, the number of pages recorded and the highest LSN of the
+// pages written (see [heapPage.LSN]), then the number of free slots of each
+// page, all as 32 bit integers in LittleEndian order like the headers of heap
+// pages. A page that is recorded with -1 free slots, or isn't recorded at
+// all, may have free slots. Maps of version 1, which didn't record the LSN,
+// are rewritten in the current format when they are opened.
+//
+// The number of pages of a heap file is that of its backing file, and the
+// map is updated whenever a page is written to it, so it never claims that a
+// page on disk has less room than it does.
+
+const freeSpaceMapMagic = "GFSM"
+
+// The version of the format of free space maps written by this version of
+// GoDB.
+const freeSpaceMapVersion = 2
+
+const freeSpaceMapHeaderSize = 16
+
+// The size of the header of free space maps of version 1.
+const freeSpaceMapHeaderSizeV1 = 12
+
+// The name of the file that stores the free space map of the heap file backed
+// by fileName.
+func freeSpaceMapFileName(fileName string) string {
+	return strings.TrimSuffix(fileName, ".dat") + ".fsm"
+}
+
+// Read the free slots of each page recorded in a free space map file, or nil
+// if the file is empty, the highest LSN it records, and its version.
+func readFreeSpaceMap(file *os.File) ([]int32, uint32, int32, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, 0, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(data) == 0 {
+		return nil, 0, freeSpaceMapVersion, nil
+	}
+	if len(data) < freeSpaceMapHeaderSizeV1 || string(data[:4]) != freeSpaceMapMagic {
+		return nil, 0, 0, GoDBError{MalformedDataError, fmt.Sprintf("%s is not a free space map", file.Name())}
+	}
+	var header struct{ Version, NumPages int32 }
+	buf := bytes.NewBuffer(data[4:])
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
+		return nil, 0, 0, err
+	}
+	var lastLSN uint32
+	switch {
+	case header.Version == 1:
+	case header.Version == freeSpaceMapVersion && len(data) >= freeSpaceMapHeaderSize:
+		if err := binary.Read(buf, binary.LittleEndian, &lastLSN); err != nil {
+			return nil, 0, 0, err
+		}
+	default:
+		return nil, 0, 0, GoDBError{MalformedDataError, fmt.Sprintf("free space map %s has unsupported version %d", file.Name(), header.Version)}
+	}
+	// (the pages of a map that was cut off while it was written aren't
+	// recorded)
+	numPages := min(int(header.NumPages), buf.Len()/4)
+	free := make([]int32, numPages)
+	if err := binary.Read(buf, binary.LittleEndian, free); err != nil {
+		return nil, 0, 0, err
+	}
+	return free, lastLSN, header.Version, nil
+}
+
+// Open the free space map of the heap file, creating it if it doesn't exist,
+// and set the number of pages of the heap file and the pages with free slots.
+func (f *HeapFile) openFreeSpaceMap() error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	numPages := int(info.Size() / int64(PageSize))
+	file, err := os.OpenFile(freeSpaceMapFileName(f.fileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	free, lastLSN, version, err := readFreeSpaceMap(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.fsmFile = file
+	f.numPages = numPages
+	f.lastLSN = lastLSN
+	for pageNo := 0; pageNo < numPages; pageNo++ {
+		if pageNo >= len(free) || free[pageNo] != 0 {
+			f.pagesWithFreeSlots.add(pageNo)
+		}
+	}
+	if version != freeSpaceMapVersion {
+		// move the pages after the larger header
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, free)
+		if _, err := file.WriteAt(b.Bytes(), int64(freeSpaceMapHeaderSize)); err != nil {
+			return err
+		}
+	}
+	// pages the map records that were never written to the backing file
+	// don't exist
+	return f.truncateFreeSpaceMap(min(len(free), numPages))
+}
+
+// Cut the free space map of the heap file down to the first numPages pages.
+func (f *HeapFile) truncateFreeSpaceMap(numPages int) error {
+	if err := f.fsmFile.Truncate(int64(freeSpaceMapHeaderSize + 4*numPages)); err != nil {
+		return err
+	}
+	f.fsmPages = numPages
+	return f.writeFreeSpaceMapHeader()
+}
+
+func (f *HeapFile) writeFreeSpaceMapHeader() error {
+	var b bytes.Buffer
+	b.WriteString(freeSpaceMapMagic)
+	binary.Write(&b, binary.LittleEndian, []int32{freeSpaceMapVersion, int32(f.fsmPages)})
+	binary.Write(&b, binary.LittleEndian, f.lastLSN)
+	_, err := f.fsmFile.WriteAt(b.Bytes(), 0)
+	return err
+}
+
+// Record the number of free slots of a page that was written to the backing
+// file, and its LSN. Pages between the last page recorded and this one may
+// have free slots.
+func (f *HeapFile) updateFreeSpaceMap(pageNo int, free int) error {
+	if f.fsmFile == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	for p := f.fsmPages; p < pageNo; p++ {
+		binary.Write(&b, binary.LittleEndian, int32(-1))
+	}
+	binary.Write(&b, binary.LittleEndian, int32(free))
+	start := min(f.fsmPages, pageNo)
+	if _, err := f.fsmFile.WriteAt(b.Bytes(), int64(freeSpaceMapHeaderSize+4*start)); err != nil {
+		return err
+	}
+	f.fsmPages = max(f.fsmPages, pageNo+1)
+	return f.writeFreeSpaceMapHeader()
+}
+
+// The pages of a heap file that may have free slots, as a min heap of page
+// numbers, so that inserts find the lowest numbered one in O(1) and fill the
+// start of the heap file first. The zero value is an empty set.
+type freePageSet struct {
+	pages []int
+	pos   map[int]int // the position of each page in pages
+}
+
+func (s *freePageSet) Len() int           { return len(s.pages) }
+func (s *freePageSet) Less(i, j int) bool { return s.pages[i] < s.pages[j] }
+func (s *freePageSet) Swap(i, j int) {
+	s.pages[i], s.pages[j] = s.pages[j], s.pages[i]
+	s.pos[s.pages[i]], s.pos[s.pages[j]] = i, j
+}
+func (s *freePageSet) Push(x any) {
+	s.pos[x.(int)] = len(s.pages)
+	s.pages = append(s.pages, x.(int))
+}
+func (s *freePageSet) Pop() any {
+	pageNo := s.pages[len(s.pages)-1]
+	s.pages = s.pages[:len(s.pages)-1]
+	delete(s.pos, pageNo)
+	return pageNo
+}
+
+func (s *freePageSet) add(pageNo int) {
+	if s.pos == nil {
+		s.pos = make(map[int]int)
+	}
+	if _, ok := s.pos[pageNo]; !ok {
+		heap.Push(s, pageNo)
+	}
+}
+
+func (s *freePageSet) remove(pageNo int) {
+	if i, ok := s.pos[pageNo]; ok {
+		heap.Remove(s, i)
+	}
+}
+
+func (s *freePageSet) has(pageNo int) bool {
+	_, ok := s.pos[pageNo]
+	return ok
+}
+
+// Return the lowest numbered page in the set, if any.
+func (s *freePageSet) first() (int, bool) {
+	if len(s.pages) == 0 {
+		return 0, false
+	}
+	return s.pages[0], true
+}
+
+// Forget every free page of the heap file, once all of its pages are gone.
+func (f *HeapFile) clearFreeSpaceMap() error {
+	f.pagesWithFreeSlots = freePageSet{}
+	if f.fsmFile == nil {
+		return nil
+	}
+	return f.truncateFreeSpaceMap(0)
+}
+
+// Stop keeping a free space map for the heap file, deleting its file.
+// Temporary heap files don't outlive the operators that write them, so they
+// don't need one.
+func (f *HeapFile) dropFreeSpaceMap() error {
+	if f.fsmFile == nil {
+		return nil
+	}
+	f.fsmFile.Close()
+	f.fsmFile = nil
+	return os.Remove(freeSpaceMapFileName(f.fileName))
+}
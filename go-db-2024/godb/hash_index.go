@@ -0,0 +1,125 @@
+package godb
+
+import "fmt"
+
+// An in memory hash index over the tuples of a heap file, keyed on one of its
+// columns. Wander joins (see [WanderJoin]) use them to find the tuples that
+// join with a tuple. A heap file builds an index on a column the first time
+// it is asked for one (see [HeapFile.hashIndex]), keeps the
+// [MaxHashIndexes] it used most recently, and drops them all when tuples are
+// inserted or deleted.
+//
+// The index only holds the record ids of the tuples, which are read from the
+// buffer pool when they are looked up (see [HeapFile.tupleAt]).
+type hashIndex struct {
+	column string
+	file   *HeapFile
+	rids   []recordID       // the record id of every tuple of the heap file
+	keys   map[string][]int // the positions in rids of the tuples with each key
+	field  int              // the position of the indexed column
+}
+
+// The number of hash indexes a heap file keeps.
+var MaxHashIndexes = 4
+
+// Encode a value of an indexed column as a key of a [hashIndex]. Ints are
+// keyed as floats, so that they are found by the equal values of float
+// columns. The bool is false if the value is NULL, which matches nothing.
+func hashIndexKey(v DBValue) (string, bool) {
+	key, null, err := hashJoinKey([]DBValue{v}, []bool{true})
+	return key, err == nil && !null
+}
+
+// Return the positions of the indexed tuples whose column equals v.
+func (idx *hashIndex) lookup(v DBValue) []int {
+	key, ok := hashIndexKey(v)
+	if !ok {
+		return nil
+	}
+	return idx.keys[key]
+}
+
+// Return the number of indexed tuples.
+func (idx *hashIndex) size() int {
+	return len(idx.rids)
+}
+
+// Return the indexed tuple at position i, or nil if it was deleted since the
+// index was built.
+func (idx *hashIndex) tuple(i int, tid TransactionID) (*Tuple, error) {
+	return idx.file.tupleAt(idx.rids[i], tid)
+}
+
+// Return the hash index of the heap file on the named column, building it
+// from the tuples of the heap file if there isn't one yet.
+func (f *HeapFile) hashIndex(column string, tid TransactionID) (*hashIndex, error) {
+	for i, idx := range f.indexes {
+		if idx.column == column {
+			// move it to the end, which is kept the longest
+			f.indexes = append(append(f.indexes[:i:i], f.indexes[i+1:]...), idx)
+			return idx, nil
+		}
+	}
+	field, err := findFieldInTd(FieldType{Fname: column, Ftype: UnknownType}, f.desc)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := f.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	idx := &hashIndex{column: column, file: f, keys: make(map[string][]int), field: field}
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		if key, ok := hashIndexKey(t.Fields[field]); ok {
+			idx.keys[key] = append(idx.keys[key], len(idx.rids))
+		}
+		idx.rids = append(idx.rids, t.Rid)
+	}
+	if len(f.indexes) >= MaxHashIndexes {
+		f.indexes = f.indexes[len(f.indexes)-MaxHashIndexes+1:]
+	}
+	f.indexes = append(f.indexes, idx)
+	return idx, nil
+}
+
+// Return the tuple of the heap file with the record id rid, as its iterator
+// returns it, or nil if there is no longer a tuple with that record id.
+func (f *HeapFile) tupleAt(rid recordID, tid TransactionID) (*Tuple, error) {
+	switch r := rid.(type) {
+	case outlierRID:
+		if f.outliers == nil {
+			return nil, nil
+		}
+		t, err := f.outliers.tupleAt(r.rid, tid)
+		if t == nil || err != nil {
+			return nil, err
+		}
+		return &Tuple{*f.desc, t.Fields, outlierRID{t.Rid}}, nil
+	case weightedRID:
+		return f.tupleAt(r.rid, tid)
+	case *recordIDImpl:
+		if r.pageNo >= f.NumPages() {
+			return nil, nil
+		}
+		page, err := f.bufPool.GetPage(f, r.pageNo, tid, ReadPerm)
+		if err != nil {
+			return nil, err
+		}
+		hp, ok := page.(*heapPage)
+		if !ok {
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", page)}
+		}
+		if r.slotNo >= len(hp.Tuples) || hp.Tuples[r.slotNo] == nil {
+			return nil, nil
+		}
+		return f.fromStoredTuple(hp.Tuples[r.slotNo]), nil
+	}
+	return nil, GoDBError{TypeMismatchError, fmt.Sprintf("unexpected record id %v", rid)}
+}
@@ -0,0 +1,479 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Number of partitions each side of a grace hash join is split into when the
+// build side doesn't fit in memory.
+var GraceJoinPartitions = 16
+
+// Maximum number of times a partition is re-partitioned before we give up and
+// build it in memory anyway (happens when a single key is heavily skewed).
+const maxGraceJoinDepth = 3
+
+// A GraceHashJoin is an equality join that builds a hash table over its left
+// input and probes it with its right input. If the left input has more than
+// maxBufferSize tuples, both inputs are hash partitioned into temporary heap
+// files and each pair of partitions is joined separately, recursively
+// partitioning again if a partition still doesn't fit.
+//
+// The join may be on several key columns, may have additional (non equality)
+// conditions that matching tuples must satisfy, and may be any [JoinType].
+type GraceHashJoin struct {
+	leftFields, rightFields []Expr
+
+	left, right *Operator
+
+	joinType JoinType
+
+	// conditions checked on each pair of tuples with equal keys
+	residual []Expr
+
+	bufPool *BufferPool
+
+	// The maximum number of left tuples kept in the in memory hash table
+	maxBufferSize int
+}
+
+// A pair of matching left and right partitions waiting to be joined.
+type graceJoinTask struct {
+	left, right *tempHeapFile
+	level       int
+}
+
+// A tuple in the hash table, and whether it found a match while probing.
+type hashJoinEntry struct {
+	tuple   *Tuple
+	matched bool
+}
+
+// Constructor for an inner grace hash join on a single pair of expressions.
+// The BufferPool is used to read back any partitions spilled to disk.
+//
+// Returns an error if the join expressions have incompatible types.
+func NewGraceHashJoin(left Operator, leftField Expr, right Operator, rightField Expr, bp *BufferPool, maxBufferSize int) (*GraceHashJoin, error) {
+	return NewHashJoin(left, []Expr{leftField}, right, []Expr{rightField}, InnerJoin, nil, bp, maxBufferSize)
+}
+
+// Constructor for a grace hash join of any type. Tuples join when each of
+// leftFields is equal to the corresponding entry in rightFields, and all of
+// the residual conditions hold.
+//
+// Returns an error if there are no keys, or if any pair of keys has
+// incompatible types.
+func NewHashJoin(left Operator, leftFields []Expr, right Operator, rightFields []Expr, joinType JoinType, residual []Expr, bp *BufferPool, maxBufferSize int) (*GraceHashJoin, error) {
+	if len(leftFields) == 0 || len(leftFields) != len(rightFields) {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("hash join needs matching join keys, got %v and %v", len(leftFields), len(rightFields))}
+	}
+	for i := range leftFields {
+		if !joinTypesCompatible(leftFields[i].GetExprType().Ftype, rightFields[i].GetExprType().Ftype) {
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("cannot join %v with %v", leftFields[i].GetExprType(), rightFields[i].GetExprType())}
+		}
+	}
+	if maxBufferSize <= 0 {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("hash join needs a positive buffer size, got %v", maxBufferSize)}
+	}
+	return &GraceHashJoin{leftFields, rightFields, &left, &right, joinType, residual, bp, maxBufferSize}, nil
+}
+
+func (hj *GraceHashJoin) Descriptor() *TupleDesc {
+	return joinDescriptor((*hj.left).Descriptor(), (*hj.right).Descriptor(), hj.joinType)
+}
+
+func (hj *GraceHashJoin) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// Ints and floats can be joined with each other, strings only with strings.
+func joinTypesCompatible(left, right DBType) bool {
+	if left == StringType || right == StringType {
+		return left == right
+	}
+	return true
+}
+
+// Encode the values of a tuple's join keys into a string that can be used as
+// a map key. Ints are encoded as floats for the keys where asFloat is set, so
+// that 1 and 1.0 hash together. The bool is true if any key is NULL, in which
+// case the tuple can't match anything.
+func hashJoinKey(vals []DBValue, asFloat []bool) (string, bool, error) {
+	var buf []byte
+	var num [8]byte
+	for i, v := range vals {
+		switch val := v.(type) {
+		case IntField:
+			if asFloat[i] {
+				buf = append(buf, 'f')
+				binary.LittleEndian.PutUint64(num[:], math.Float64bits(float64(val.Value)))
+			} else {
+				buf = append(buf, 'i')
+				binary.LittleEndian.PutUint64(num[:], uint64(val.Value))
+			}
+			buf = append(buf, num[:]...)
+		case FloatField:
+			f := val.Value
+			if f == 0 {
+				f = 0 // don't distinguish -0 from 0
+			}
+			buf = append(buf, 'f')
+			binary.LittleEndian.PutUint64(num[:], math.Float64bits(f))
+			buf = append(buf, num[:]...)
+		case StringField:
+			buf = append(buf, 's')
+			binary.LittleEndian.PutUint32(num[:4], uint32(len(val.Value)))
+			buf = append(buf, num[:4]...)
+			buf = append(buf, val.Value...)
+		case NullField:
+			return "", true, nil
+		default:
+			return "", false, GoDBError{TypeMismatchError, fmt.Sprintf("can't hash join on value %v", v)}
+		}
+	}
+	return string(buf), false, nil
+}
+
+// For each key, whether ints have to be compared as floats.
+func (hj *GraceHashJoin) keysAsFloat() []bool {
+	asFloat := make([]bool, len(hj.leftFields))
+	for i := range hj.leftFields {
+		asFloat[i] = hj.leftFields[i].GetExprType().Ftype == FloatType || hj.rightFields[i].GetExprType().Ftype == FloatType
+	}
+	return asFloat
+}
+
+// Evaluate the join keys of t.
+func evalJoinKey(t *Tuple, fields []Expr, asFloat []bool) (string, bool, error) {
+	vals := make([]DBValue, len(fields))
+	for i, field := range fields {
+		v, err := field.EvalExpr(t)
+		if err != nil {
+			return "", false, err
+		}
+		vals[i] = v
+	}
+	return hashJoinKey(vals, asFloat)
+}
+
+// Partition the tuples returned by iter into numPartitions temporary files.
+// Any tuples in buffered are written first. Tuples with NULL keys can't match
+// anything, but still go to partition 0 so outer joins can output them.
+func (hj *GraceHashJoin) partition(buffered []*Tuple, iter func() (*Tuple, error), fields []Expr, desc *TupleDesc, level int) ([]*tempHeapFile, error) {
+	parts := make([]*tempHeapFile, GraceJoinPartitions)
+	for i := range parts {
+		part, err := newTempHeapFile(desc, hj.bufPool)
+		if err != nil {
+			closeTempFiles(parts)
+			return nil, err
+		}
+		parts[i] = part
+	}
+
+	asFloat := hj.keysAsFloat()
+	add := func(t *Tuple) error {
+		key, null, err := evalJoinKey(t, fields, asFloat)
+		if err != nil {
+			return err
+		}
+		if null {
+			return parts[0].append(t)
+		}
+		return parts[hashPartition(key, level, len(parts))].append(t)
+	}
+
+	for _, t := range buffered {
+		if err := add(t); err != nil {
+			closeTempFiles(parts)
+			return nil, err
+		}
+	}
+	for iter != nil {
+		t, err := iter()
+		if err != nil {
+			closeTempFiles(parts)
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		if err := add(t); err != nil {
+			closeTempFiles(parts)
+			return nil, err
+		}
+	}
+
+	for _, part := range parts {
+		if err := part.finish(); err != nil {
+			closeTempFiles(parts)
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func closeTempFiles(files []*tempHeapFile) {
+	for _, f := range files {
+		if f != nil {
+			f.close()
+		}
+	}
+}
+
+// Read up to limit tuples from iter. The returned bool is true if iter was
+// exhausted.
+func bufferTuples(iter func() (*Tuple, error), limit int) ([]*Tuple, bool, error) {
+	var tuples []*Tuple
+	for len(tuples) < limit {
+		t, err := iter()
+		if err != nil {
+			return nil, false, err
+		}
+		if t == nil {
+			return tuples, true, nil
+		}
+		tuples = append(tuples, t)
+	}
+	return tuples, false, nil
+}
+
+// Join operator implementation. Tuples are returned grouped by partition, so
+// the output order is not the order of either input. Unmatched left tuples of
+// outer and anti joins (and the matches of semi joins) are returned after the
+// partition they belong to has been probed.
+func (hj *GraceHashJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	asFloat := hj.keysAsFloat()
+	leftDesc := (*hj.left).Descriptor()
+	rightDesc := (*hj.right).Descriptor()
+
+	leftIter, err := (*hj.left).Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*hashJoinEntry
+	var table map[string][]*hashJoinEntry
+	var probeIter func() (*Tuple, error)
+	var tasks []graceJoinTask
+	var curTask *graceJoinTask
+
+	// output tuples that haven't been returned yet
+	var pending []*Tuple
+
+	buildTable := func(tuples []*Tuple) error {
+		entries = make([]*hashJoinEntry, len(tuples))
+		table = make(map[string][]*hashJoinEntry)
+		for i, t := range tuples {
+			entries[i] = &hashJoinEntry{t, false}
+			key, null, err := evalJoinKey(t, hj.leftFields, asFloat)
+			if err != nil {
+				return err
+			}
+			if !null {
+				table[key] = append(table[key], entries[i])
+			}
+		}
+		return nil
+	}
+
+	probe := func(t *Tuple) error {
+		key, null, err := evalJoinKey(t, hj.rightFields, asFloat)
+		if err != nil {
+			return err
+		}
+		matched := false
+		if !null {
+			for _, entry := range table[key] {
+				joined := joinTuples(entry.tuple, t)
+				ok, err := evalJoinConditions(hj.residual, joined)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if err := checkSingleMatch(hj.joinType, entry.matched); err != nil {
+					return err
+				}
+				matched = true
+				entry.matched = true
+				if !hj.joinType.leftOnly() {
+					pending = append(pending, joined)
+				}
+			}
+		}
+		if !matched && hj.joinType.keepsUnmatchedRight() {
+			pending = append(pending, joinTuples(nullTuple(leftDesc), t))
+		}
+		return nil
+	}
+
+	// after probing, output the build side tuples that semi, anti and left
+	// outer joins return
+	finishTable := func() {
+		for _, entry := range entries {
+			switch {
+			case hj.joinType == SemiJoin && entry.matched:
+				pending = append(pending, entry.tuple)
+			case hj.joinType == AntiJoin && !entry.matched:
+				pending = append(pending, entry.tuple)
+			case hj.joinType.keepsUnmatchedLeft() && !hj.joinType.leftOnly() && !entry.matched:
+				pending = append(pending, joinTuples(entry.tuple, nullTuple(rightDesc)))
+			}
+		}
+		entries = nil
+		table = nil
+	}
+
+	// queue up the pairs of partitions that can produce results
+	addTasks := func(leftParts, rightParts []*tempHeapFile, level int) {
+		for i := range leftParts {
+			leftEmpty := leftParts[i].NumTuples() == 0
+			rightEmpty := rightParts[i].NumTuples() == 0
+			if (leftEmpty && rightEmpty) ||
+				(leftEmpty && !hj.joinType.keepsUnmatchedRight()) ||
+				(rightEmpty && !hj.joinType.keepsUnmatchedLeft()) {
+				leftParts[i].close()
+				rightParts[i].close()
+				continue
+			}
+			tasks = append(tasks, graceJoinTask{leftParts[i], rightParts[i], level})
+		}
+	}
+
+	closeTasks := func() {
+		if curTask != nil {
+			curTask.left.close()
+			curTask.right.close()
+			curTask = nil
+		}
+		for _, task := range tasks {
+			task.left.close()
+			task.right.close()
+		}
+		tasks = nil
+	}
+
+	// set up the next partition pair for probing, re-partitioning it first if
+	// its left side is still too big
+	startTask := func() error {
+		task := tasks[0]
+		tasks = tasks[1:]
+		curTask = &task
+
+		leftPartIter, err := task.left.Iterator(tid)
+		if err != nil {
+			return err
+		}
+		if task.left.NumTuples() > hj.maxBufferSize && task.level < maxGraceJoinDepth {
+			DebugJoin("grace join re-partitioning partition with %v tuples at level %v", task.left.NumTuples(), task.level+1)
+			leftParts, err := hj.partition(nil, leftPartIter, hj.leftFields, task.left.desc, task.level+1)
+			if err != nil {
+				return err
+			}
+			rightPartIter, err := task.right.Iterator(tid)
+			if err != nil {
+				closeTempFiles(leftParts)
+				return err
+			}
+			rightParts, err := hj.partition(nil, rightPartIter, hj.rightFields, task.right.desc, task.level+1)
+			if err != nil {
+				closeTempFiles(leftParts)
+				return err
+			}
+			task.left.close()
+			task.right.close()
+			curTask = nil
+			addTasks(leftParts, rightParts, task.level+1)
+			return nil
+		}
+
+		if task.left.NumTuples() > hj.maxBufferSize {
+			DebugJoin("grace join partition with %v tuples still too big after %v levels, building in memory", task.left.NumTuples(), task.level)
+		}
+		tuples, _, err := bufferTuples(leftPartIter, task.left.NumTuples())
+		if err != nil {
+			return err
+		}
+		if err := buildTable(tuples); err != nil {
+			return err
+		}
+		probeIter, err = task.right.Iterator(tid)
+		return err
+	}
+
+	// build phase: if all of the left input fits in memory, this is a plain
+	// in memory hash join. Otherwise partition both inputs.
+	buffered, exhausted, err := bufferTuples(leftIter, hj.maxBufferSize+1)
+	if err != nil {
+		return nil, err
+	}
+	if exhausted {
+		if err := buildTable(buffered); err != nil {
+			return nil, err
+		}
+		probeIter, err = (*hj.right).Iterator(tid)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		DebugJoin("grace join spilling, left input has more than %v tuples", hj.maxBufferSize)
+		leftParts, err := hj.partition(buffered, leftIter, hj.leftFields, leftDesc, 0)
+		if err != nil {
+			return nil, err
+		}
+		rightIter, err := (*hj.right).Iterator(tid)
+		if err != nil {
+			closeTempFiles(leftParts)
+			return nil, err
+		}
+		rightParts, err := hj.partition(nil, rightIter, hj.rightFields, rightDesc, 0)
+		if err != nil {
+			closeTempFiles(leftParts)
+			return nil, err
+		}
+		addTasks(leftParts, rightParts, 0)
+	}
+
+	return func() (*Tuple, error) {
+		for {
+			if len(pending) > 0 {
+				t := pending[0]
+				pending = pending[1:]
+				return t, nil
+			}
+
+			if probeIter == nil {
+				if curTask != nil {
+					curTask.left.close()
+					curTask.right.close()
+					curTask = nil
+				}
+				if len(tasks) == 0 {
+					return nil, nil
+				}
+				if err := startTask(); err != nil {
+					closeTasks()
+					return nil, err
+				}
+				continue
+			}
+
+			t, err := probeIter()
+			if err != nil {
+				closeTasks()
+				return nil, err
+			}
+			if t == nil {
+				probeIter = nil
+				finishTable()
+				continue
+			}
+			if err := probe(t); err != nil {
+				closeTasks()
+				return nil, err
+			}
+		}
+	}, nil
+}
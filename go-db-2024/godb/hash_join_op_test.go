@@ -0,0 +1,262 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const GraceJoinFile1 string = "gracejoin1.dat"
+const GraceJoinFile2 string = "gracejoin2.dat"
+
+// Make two heap files of (name, age) tuples, filling in age with leftKey(i) and
+// rightKey(i) respectively. The fields of the files are qualified with "l"
+// and "r".
+func makeJoinTestFiles(t *testing.T, nLeft int, leftKey func(int) int64, nRight int, rightKey func(int) int64) (*HeapFile, *HeapFile, *BufferPool, TransactionID) {
+	baseTd, _, _ := makeTupleTestVars()
+	td1 := *baseTd.copy()
+	td1.setTableAlias("l")
+	td2 := *baseTd.copy()
+	td2.setTableAlias("r")
+	bp, err := NewBufferPool(500)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	os.Remove(GraceJoinFile1)
+	os.Remove(GraceJoinFile2)
+	hf1, err := NewHeapFile(GraceJoinFile1, &td1, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf2, err := NewHeapFile(GraceJoinFile2, &td2, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for i := 0; i < nLeft; i++ {
+		tup := Tuple{td1, []DBValue{StringField{"left"}, IntField{leftKey(i)}}, nil}
+		insertTupleForTest(t, hf1, &tup, tid)
+	}
+	for i := 0; i < nRight; i++ {
+		tup := Tuple{td2, []DBValue{StringField{"right"}, IntField{rightKey(i)}}, nil}
+		insertTupleForTest(t, hf2, &tup, tid)
+	}
+	bp.FlushAllPages()
+	return hf1, hf2, bp, tid
+}
+
+// Drain iter, checking that every result joins equal ages, and return the
+// number of results.
+func countJoinResults(t *testing.T, iter func() (*Tuple, error)) int {
+	cnt := 0
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		if len(tup.Fields) != 4 {
+			t.Fatalf("expected joined tuple with 4 fields, got %v", tup)
+		}
+		if !tup.Fields[1].EvalPred(tup.Fields[3], OpEq) {
+			t.Fatalf("join returned non matching tuple %v", tup)
+		}
+		cnt++
+	}
+	return cnt
+}
+
+// Check that no pages of temporary files are left in the buffer pool.
+func checkNoSpillPages(t *testing.T, bp *BufferPool) {
+	for key := range bp.fileMap {
+		hh, ok := key.(heapHash)
+		if ok && strings.Contains(hh.FileName, "godb-spill-") {
+			t.Fatalf("buffer pool still holds page %v of a temporary file", hh)
+		}
+	}
+}
+
+func TestGraceHashJoinInMemory(t *testing.T) {
+	hf1, hf2, _, tid := makeJoinTestFiles(t,
+		300, func(i int) int64 { return int64(i % 100) },
+		100, func(i int) int64 { return int64(i) })
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewGraceHashJoin(hf1, &field, hf2, &field, hf1.bufPool, 1000)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cnt := countJoinResults(t, iter); cnt != 300 {
+		t.Errorf("unexpected number of join results (%d, expected 300)", cnt)
+	}
+}
+
+func TestGraceHashJoinSpill(t *testing.T) {
+	hf1, hf2, bp, tid := makeJoinTestFiles(t,
+		2000, func(i int) int64 { return int64(i % 500) },
+		600, func(i int) int64 { return int64(i) })
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewGraceHashJoin(hf1, &field, hf2, &field, bp, 100)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cnt := countJoinResults(t, iter); cnt != 2000 {
+		t.Errorf("unexpected number of join results (%d, expected 2000)", cnt)
+	}
+	checkNoSpillPages(t, bp)
+}
+
+func TestGraceHashJoinSkew(t *testing.T) {
+	// every left tuple has the same key, so re-partitioning can't help
+	hf1, hf2, bp, tid := makeJoinTestFiles(t,
+		300, func(i int) int64 { return 7 },
+		5, func(i int) int64 { return int64(i + 5) })
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewGraceHashJoin(hf1, &field, hf2, &field, bp, 50)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cnt := countJoinResults(t, iter); cnt != 300 {
+		t.Errorf("unexpected number of join results (%d, expected 300)", cnt)
+	}
+	checkNoSpillPages(t, bp)
+}
+
+func TestGraceHashJoinTypeMismatch(t *testing.T) {
+	td, _, _, hf, bp, _ := makeTestVars(t)
+	nameField := FieldExpr{td.Fields[0]}
+	ageField := FieldExpr{td.Fields[1]}
+	_, err := NewGraceHashJoin(hf, &nameField, hf, &ageField, bp, 100)
+	if err == nil {
+		t.Errorf("expected error joining a string with an int")
+	}
+}
+
+// Drain iter, checking that every result has nFields fields, and return the
+// number of results and how many of them contain a NULL.
+func countJoinTypeResults(t *testing.T, iter func() (*Tuple, error), nFields int) (int, int) {
+	cnt, nulls := 0, 0
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		if len(tup.Fields) != nFields {
+			t.Fatalf("expected tuple with %d fields, got %v", nFields, tup)
+		}
+		for _, f := range tup.Fields {
+			if isNull(f) {
+				nulls++
+				break
+			}
+		}
+		cnt++
+	}
+	return cnt, nulls
+}
+
+func TestGraceHashJoinTypes(t *testing.T) {
+	hf1, hf2, bp, tid := makeJoinTestFiles(t,
+		300, func(i int) int64 { return int64(i % 100) },
+		100, func(i int) int64 { return int64(2 * i) })
+
+	leftField := FieldExpr{hf1.Descriptor().Fields[1]}
+	rightField := FieldExpr{hf2.Descriptor().Fields[1]}
+	tests := []struct {
+		joinType    JoinType
+		rows, nulls int
+	}{
+		{InnerJoin, 150, 0},
+		{LeftOuterJoin, 300, 150},
+		{RightOuterJoin, 200, 50},
+		{FullOuterJoin, 350, 200},
+		{SemiJoin, 150, 0},
+		{AntiJoin, 150, 0},
+	}
+	// once with everything in memory, and once spilling partitions to disk
+	for _, maxBufferSize := range []int{1000, 20} {
+		for _, test := range tests {
+			join, err := NewHashJoin(hf1, []Expr{&leftField}, hf2, []Expr{&rightField}, test.joinType, nil, bp, maxBufferSize)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			iter, err := join.Iterator(tid)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			nFields := 4
+			if test.joinType.leftOnly() {
+				nFields = 2
+			}
+			rows, nulls := countJoinTypeResults(t, iter, nFields)
+			if rows != test.rows || nulls != test.nulls {
+				t.Errorf("%v join with buffer %d: expected %d results with %d NULLs, got %d with %d", test.joinType, maxBufferSize, test.rows, test.nulls, rows, nulls)
+			}
+			checkNoSpillPages(t, bp)
+		}
+	}
+}
+
+func TestGraceHashJoinMultiKeyResidual(t *testing.T) {
+	hf1, hf2, bp, tid := makeJoinTestFiles(t,
+		300, func(i int) int64 { return int64(i % 100) },
+		100, func(i int) int64 { return int64(2 * i) })
+
+	leftName := FieldExpr{hf1.Descriptor().Fields[0]}
+	leftAge := FieldExpr{hf1.Descriptor().Fields[1]}
+	rightAge := FieldExpr{hf2.Descriptor().Fields[1]}
+	var l, r Expr = &leftAge, &rightAge
+	leftSum := FuncExpr{"+", []*Expr{&l, &l}}
+	rightSum := FuncExpr{"+", []*Expr{&r, &r}}
+
+	// joining on age and age + age is the same as joining on age
+	join, err := NewHashJoin(hf1, []Expr{&leftAge, &leftSum}, hf2, []Expr{&rightAge, &rightSum}, InnerJoin, nil, bp, 20)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cnt := countJoinResults(t, iter); cnt != 150 {
+		t.Errorf("unexpected number of join results (%d, expected 150)", cnt)
+	}
+
+	residual := []Expr{&CompareExpr{&leftAge, OpLt, &ConstExpr{IntField{50}, IntType}}, &CompareExpr{&leftName, OpEq, &ConstExpr{StringField{"left"}, StringType}}}
+	for _, maxBufferSize := range []int{1000, 20} {
+		join, err = NewHashJoin(hf1, []Expr{&leftAge}, hf2, []Expr{&rightAge}, LeftOuterJoin, residual, bp, maxBufferSize)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, err = join.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows, nulls := countJoinTypeResults(t, iter, 4)
+		if rows != 300 || nulls != 225 {
+			t.Errorf("expected 300 results with 225 NULLs, got %d with %d", rows, nulls)
+		}
+	}
+	checkNoSpillPages(t, bp)
+}
@@ -0,0 +1,229 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HAVING clauses are applied by a [Filter] on the output of the aggregation,
+// before the select list is projected, so they may refer to the group by
+// fields, to the aliases of aggregates in the select list, and to aggregates
+// that aren't in the select list at all (which are computed but not output).
+//
+// When the input is a sample, the aggregates are only estimates, and a group
+// may pass the HAVING clause even though its true value doesn't, or vice
+// versa. [HavingConfidence] controls how such groups are treated: by default
+// the estimates are compared as if they were exact, but comparisons between
+// an aggregate and another value can instead be made over the aggregate's
+// confidence interval (see [ErrorBounder]). Such a comparison is true if it
+// holds everywhere in the interval, false if it holds nowhere, and unknown if
+// the interval crosses the threshold, and follows three valued logic from
+// there.
+
+type HavingMode int
+
+const (
+	// compare the estimates of aggregates as if they were exact
+	HavingEstimate HavingMode = iota
+	// only pass groups that satisfy the HAVING clause over the whole
+	// confidence interval of their aggregates
+	HavingCertain HavingMode = iota
+	// also pass groups that satisfy the HAVING clause somewhere in the
+	// confidence interval, adding a column (named [HavingConfidentField])
+	// that is 1 for groups that satisfy it everywhere and 0 for the others
+	HavingPossible HavingMode = iota
+)
+
+var havingModeNames = map[HavingMode]string{
+	HavingEstimate: "estimate",
+	HavingCertain:  "certain",
+	HavingPossible: "possible",
+}
+
+func (m HavingMode) String() string {
+	return havingModeNames[m]
+}
+
+// Parse the name of a HAVING mode, as printed by [HavingMode.String].
+func ParseHavingMode(name string) (HavingMode, error) {
+	for mode, modeName := range havingModeNames {
+		if modeName == strings.ToLower(name) {
+			return mode, nil
+		}
+	}
+	return HavingEstimate, GoDBError{ParseError, fmt.Sprintf("unknown HAVING mode %s", name)}
+}
+
+// How HAVING clauses treat aggregates estimated from a sample.
+var HavingConfidence = HavingEstimate
+
+// The name of the column added to the results of queries with a HAVING clause
+// in [HavingPossible] mode.
+const HavingConfidentField = "having_confident"
+
+// An aggregation state that computes the error bound of another aggregation
+// state (see [ErrorBounder]) rather than its result.
+type ErrorBoundAggState struct {
+	alias string
+	state AggState
+}
+
+// Return a state computing the error bound of state, or nil if state doesn't
+// have error bounds. alias is the name of the bound's field.
+func NewErrorBoundAggState(alias string, state AggState) *ErrorBoundAggState {
+	if _, ok := state.(ErrorBounder); !ok {
+		return nil
+	}
+	return &ErrorBoundAggState{alias, state.Copy()}
+}
+
+func (a *ErrorBoundAggState) Init(alias string, expr Expr) error {
+	a.alias = alias
+	return a.state.Init(a.state.GetTupleDesc().Fields[0].Fname, expr)
+}
+
+func (a *ErrorBoundAggState) Copy() AggState {
+	return &ErrorBoundAggState{a.alias, a.state.Copy()}
+}
+
+func (a *ErrorBoundAggState) AddTuple(t *Tuple) {
+	a.state.AddTuple(t)
+}
+
+func (a *ErrorBoundAggState) AddSampledTuple(t *Tuple, p float64) {
+	addSampledTuple(a.state, t, p)
+}
+
+func (a *ErrorBoundAggState) Merge(other AggState) error {
+	o, ok := other.(*ErrorBoundAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	return a.state.Merge(o.state)
+}
+
+func (a *ErrorBoundAggState) Finalize(info *SampleInfo) *Tuple {
+	bound := a.state.(ErrorBounder).ErrorBound(info)
+	return &Tuple{*a.GetTupleDesc(), []DBValue{FloatField{bound}}, nil}
+}
+
+func (a *ErrorBoundAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", FloatType}}}
+}
+
+// A comparison between an estimate, known to lie within bound of its true
+// value, and another value. It is true if the comparison holds for every
+// value in the confidence interval, false if it holds for none of them, and
+// unknown otherwise.
+type IntervalCompareExpr struct {
+	estimate, bound Expr
+	op              BoolOp
+	other           Expr
+	// whether the estimate is the right hand side of the comparison
+	flipped bool
+}
+
+func (e *IntervalCompareExpr) GetExprType() FieldType {
+	return predExprType("interval compare")
+}
+
+func (e *IntervalCompareExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	vals := make([]DBValue, 3)
+	for i, expr := range []Expr{e.estimate, e.bound, e.other} {
+		v, err := expr.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(v) {
+			return NullField{}, nil
+		}
+		vals[i] = v
+	}
+	estimate, ok1 := numericValue(vals[0])
+	bound, ok2 := numericValue(vals[1])
+	if !ok1 || !ok2 {
+		return predValue(e.compare(vals[0], vals[2], e.op)), nil
+	}
+	low, high := FloatField{estimate - bound}, FloatField{estimate + bound}
+
+	switch e.op {
+	case OpEq, OpNeq:
+		// equal everywhere only if the interval is the single value, and
+		// nowhere if the value is outside of the interval
+		everywhere := bound == 0 && e.compare(low, vals[2], OpEq)
+		nowhere := e.compare(low, vals[2], OpGt) || e.compare(high, vals[2], OpLt)
+		if !everywhere && !nowhere {
+			return NullField{}, nil
+		}
+		return predValue(everywhere == (e.op == OpEq)), nil
+	default:
+		// the other comparisons hold everywhere if they hold at both ends
+		atLow, atHigh := e.compare(low, vals[2], e.op), e.compare(high, vals[2], e.op)
+		if atLow != atHigh {
+			return NullField{}, nil
+		}
+		return predValue(atLow), nil
+	}
+}
+
+// Compare a value of the estimate's interval with other, on the same sides as
+// the original comparison.
+func (e *IntervalCompareExpr) compare(v DBValue, other DBValue, op BoolOp) bool {
+	if e.flipped {
+		return other.EvalPred(v, op)
+	}
+	return v.EvalPred(other, op)
+}
+
+func numericValue(v DBValue) (float64, bool) {
+	switch v := v.(type) {
+	case IntField:
+		return float64(v.Value), true
+	case FloatField:
+		return v.Value, true
+	}
+	return 0, false
+}
+
+// Replace the comparisons in pred between an aggregate that has an error
+// bound and another value with comparisons over the aggregate's confidence
+// interval. bounds maps the fields of aggregates to the fields of their error
+// bounds.
+func intervalPredicate(pred Expr, bounds map[FieldType]FieldType) Expr {
+	switch ex := pred.(type) {
+	case *CompareExpr:
+		if bound, ok := boundOf(ex.left, bounds); ok {
+			return &IntervalCompareExpr{ex.left, bound, ex.op, ex.right, false}
+		}
+		if bound, ok := boundOf(ex.right, bounds); ok {
+			return &IntervalCompareExpr{ex.right, bound, ex.op, ex.left, true}
+		}
+	case *AndExpr:
+		exprs := make([]Expr, len(ex.exprs))
+		for i, sub := range ex.exprs {
+			exprs[i] = intervalPredicate(sub, bounds)
+		}
+		return &AndExpr{exprs}
+	case *OrExpr:
+		exprs := make([]Expr, len(ex.exprs))
+		for i, sub := range ex.exprs {
+			exprs[i] = intervalPredicate(sub, bounds)
+		}
+		return &OrExpr{exprs}
+	case *NotExpr:
+		return &NotExpr{intervalPredicate(ex.expr, bounds)}
+	}
+	return pred
+}
+
+func boundOf(e Expr, bounds map[FieldType]FieldType) (Expr, bool) {
+	field, ok := e.(*FieldExpr)
+	if !ok {
+		return nil, false
+	}
+	bound, ok := bounds[field.selectField]
+	if !ok {
+		return nil, false
+	}
+	return &FieldExpr{bound}, true
+}
@@ -0,0 +1,113 @@
+package godb
+
+import (
+	"testing"
+)
+
+// Run sql against c, returning the result tuples.
+func runHavingQuery(t *testing.T, bp *BufferPool, c *Catalog, sql string) []*Tuple {
+	tid := BeginTransactionForTest(t, bp)
+	defer bp.CommitTransaction(tid)
+	_, _, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var tups []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			return tups
+		}
+		tups = append(tups, tup)
+	}
+}
+
+func TestParseHaving(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql    string
+		rows   int
+		fields int
+	}{
+		{"select name, sum(age) from t group by name having sum(age) > 60", 3, 2},
+		// aggregates that are only in the HAVING clause aren't output
+		{"select name from t group by name having count(*) > 1", 2, 1},
+		{"select name, count(*) c from t group by name having c > 1 and min(age) < 25", 1, 2},
+		{"select name, sum(age) s from t group by name having s >= 45 or name = 'ang'", 7, 2},
+		{"select sum(age) from t having sum(age) > 500", 1, 1},
+		{"select sum(age) from t having sum(age) > 1000", 0, 1},
+	}
+	for _, q := range queries {
+		tups := runHavingQuery(t, bp, c, q.sql)
+		if len(tups) != q.rows {
+			t.Errorf("q=%s: expected %d rows, got %d", q.sql, q.rows, len(tups))
+		}
+		for _, tup := range tups {
+			if len(tup.Fields) != q.fields {
+				t.Errorf("q=%s: expected %d fields, got %v", q.sql, q.fields, tup)
+			}
+		}
+	}
+}
+
+func TestHavingConfidence(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	// pretend the 12 tuples of t are a sample of 120, so each group's count
+	// is scaled up by 10 and is uncertain
+	hf, _ := c.GetTable("t")
+	hf.(*HeapFile).sampleInfo.SampleSize = 12
+	hf.(*HeapFile).sampleInfo.PopulationSize = 120
+
+	defer func(mode HavingMode) { HavingConfidence = mode }(HavingConfidence)
+	sql := "select name, count(*) from t group by name having count(*) > 15 or name = 'bo'"
+
+	// sam and riza appear twice, so their estimated counts of 20 pass
+	HavingConfidence = HavingEstimate
+	if tups := runHavingQuery(t, bp, c, sql); len(tups) != 3 {
+		t.Errorf("expected 3 groups comparing estimates, got %d", len(tups))
+	}
+
+	// but the confidence intervals of all of the counts include 15
+	HavingConfidence = HavingCertain
+	tups := runHavingQuery(t, bp, c, sql)
+	if len(tups) != 1 || tups[0].Fields[0].(StringField).Value != "bo" {
+		t.Errorf("expected only bo to certainly pass, got %v", tups)
+	}
+
+	HavingConfidence = HavingPossible
+	tups = runHavingQuery(t, bp, c, sql)
+	if len(tups) != 10 {
+		t.Errorf("expected all 10 groups to possibly pass, got %d", len(tups))
+	}
+	for _, tup := range tups {
+		// the estimated counts are output with their error bounds
+		if len(tup.Fields) != 4 || tup.Desc.Fields[3].Fname != HavingConfidentField {
+			t.Fatalf("expected a %s column, got %v", HavingConfidentField, tup.Desc)
+		}
+		if bound, ok := tup.Fields[2].(FloatField); !ok || bound.Value <= 0 {
+			t.Errorf("expected a positive error bound of the count, got %v", tup.Fields[2])
+		}
+		confident := tup.Fields[3].(IntField).Value == 1
+		if bo := tup.Fields[0].(StringField).Value == "bo"; confident != bo {
+			t.Errorf("unexpected confidence %v for group %v", confident, tup.Fields[0])
+		}
+	}
+
+	if _, err := ParseHavingMode("sometimes"); err == nil {
+		t.Errorf("expected error parsing an unknown HAVING mode")
+	}
+}
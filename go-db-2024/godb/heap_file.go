@@ -3,30 +3,18 @@ package godb
 import (
 	"bufio"
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 var DEBUGHEAPFILE = false
 
-var MEAN = "mean"
-var STDDEV = "standardDeviation"
-
-// from https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-var SUMSQUARESDIFF = "SumSquaresDiff"
-var N = "n"
-var OFFSET = "offset"
-var ESTIMATEDLINES = "estimatedLines"
-
-// sentinel value to tell when the entire .tbl file has been loaded
-var COMPLETE = "complete"
-
 func DebugHeapFile(format string, a ...any) (int, error) {
 	if DEBUGHEAPFILE || GLOBALDEBUG {
 		return fmt.Println(fmt.Sprintf(format, a...))
@@ -54,12 +42,18 @@ type HeapFile struct {
 	tupleSize          int
 	numPages           int
 	file               *os.File
-	pagesWithFreeSpace map[int]bool
+	pagesWithFreeSlots freePageSet // the pages that may have free slots
 	numInserted        int
 	offSetsLoaded      map[int64]bool
-	statNames          []string
-	statistics         map[string]map[string]float64
+	sampleInfo         *SampleInfo
+	contiguousOffset   int64 // where LoadSomeFromCSVContiguous left off
 	freezeStats        bool
+	outliers           *HeapFile    // the outlier table, if any (see [OutlierIndex])
+	storedDesc         *TupleDesc   // desc plus the hidden column of a measure-biased sample (see [MeasureBias]), or nil
+	indexes            []*hashIndex // hash indexes, least recently used first, dropped when the heap file changes
+	fsmFile            *os.File     // the free space map (see [freeSpaceMapFileName]), or nil
+	fsmPages           int          // the number of pages the free space map records
+	lastLSN            uint32       // the highest LSN of the pages read or written
 }
 
 func (f *HeapFile) writeToStatsFile() error {
@@ -69,22 +63,17 @@ func (f *HeapFile) writeToStatsFile() error {
 	}
 	// overwrite entire file to replace stats
 	f.statsFile.Seek(0, io.SeekStart)
-	statsFileContent := fmt.Sprintf("FieldName,%v,%v,%v,%v\n", MEAN, STDDEV, SUMSQUARESDIFF, N)
-	for field, stats := range f.statistics {
-		statsFileContent += fmt.Sprintf("%s,%.2f,%.2f,%.2f,%.2f\n",
-			field, stats[MEAN], stats[STDDEV], stats[SUMSQUARESDIFF], stats[N])
-	}
-	_, err := f.statsFile.WriteString(statsFileContent)
-	// fmt.Printf("Wrote here %v %v\n", f.statsFile, len(f.statistics))
+	err := f.statsFile.Truncate(0)
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeSampleInfo(f.statsFile, f.sampleInfo, f.contiguousOffset)
 }
 
 // Create a HeapFile.
 // Parameters
-// - fromFile: backing file for the HeapFile.  May be empty or a previously created heap file.
+// - fromFile: backing file for the HeapFile.  May be empty or a previously created heap file,
+// whose pages are kept, and reused by inserts as its free space map allows (see [freeSpaceMapFileName]).
 // - td: the TupleDesc for the HeapFile.
 // - bp: the BufferPool that is used to store pages read from the HeapFile
 // May return an error if the file cannot be opened or created.
@@ -101,8 +90,8 @@ func NewHeapFile(fromFile string, td *TupleDesc, bp *BufferPool, extraArgs ...st
 	if len(extraArgs) > 1 {
 		statsFileName = extraArgs[1]
 	}
-	heapFile := &HeapFile{bufPool: bp, desc: td, fileName: fromFile, pagesWithFreeSpace: make(map[int]bool), metadataFileName: metadataFileName, statsFileName: statsFileName}
-	heapFile.statistics = make(map[string]map[string]float64)
+	heapFile := &HeapFile{bufPool: bp, desc: td, fileName: fromFile, metadataFileName: metadataFileName, statsFileName: statsFileName}
+	heapFile.sampleInfo = NewSampleInfo()
 
 	// fmt.Printf("backing file is %v\n", metadataFileName)
 
@@ -128,6 +117,9 @@ func NewHeapFile(fromFile string, td *TupleDesc, bp *BufferPool, extraArgs ...st
 	}
 	heapFile.file = file
 	heapFile.offSetsLoaded = make(map[int64]bool)
+	if err := heapFile.openFreeSpaceMap(); err != nil {
+		return nil, err
+	}
 
 	if metadataFileName != "" {
 		metadataFile, err := os.OpenFile(metadataFileName, os.O_RDWR|os.O_CREATE, 0644)
@@ -184,51 +176,124 @@ func NewHeapFile(fromFile string, td *TupleDesc, bp *BufferPool, extraArgs ...st
 			return nil, err
 		}
 		estimatedLinesInFile := int(fileInfo.Size()) / heapFile.tupleSize
-		estLinesStats, ok := heapFile.statistics[ESTIMATEDLINES]
-		if !ok {
-			heapFile.statistics[ESTIMATEDLINES] = make(map[string]float64)
-			estLinesStats = heapFile.statistics[ESTIMATEDLINES]
-		}
 		// fmt.Printf("Writing estimates lines as %v for %v file size is %v tuple size is %v\n", estimatedLinesInFile, statsFileName, fileInfo.Name(), heapFile.tupleSize)
-		estLinesStats[MEAN] = float64(estimatedLinesInFile)
+		if !heapFile.sampleInfo.Complete {
+			// complete statistics counted the tuples exactly
+			heapFile.sampleInfo.PopulationSize = float64(estimatedLinesInFile)
+		}
+		if heapFile.sampleInfo.Outliers != nil {
+			heapFile.outliers, err = NewHeapFile(outlierFileName(fromFile), td, bp)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if heapFile.sampleInfo.Measure != nil {
+			heapFile.setMeasureBiased()
+		}
 	}
 
 	// fmt.Printf("here stats file is %v %v\n", heapFile.statsFile, statsFileName)
 	return heapFile, nil //replace me
 }
 
-func (f *HeapFile) Statistics() map[string]map[string]float64 {
-	return f.statistics
+// Remove every tuple from the heap file, dropping its pages from the buffer
+// pool without flushing them. What was recorded about the tuples loaded goes
+// with them: the outlier table is deleted, and the sampling metadata (but the
+// size of the table) and the offsets of the loaded rows are reset.
+func (f *HeapFile) Truncate() error {
+	f.bufPool.discardFilePages(f)
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	f.numPages = 0
+	if err := f.clearFreeSpaceMap(); err != nil {
+		return err
+	}
+	f.indexes = nil
+	if f.outliers != nil {
+		if err := f.outliers.Truncate(); err != nil {
+			return err
+		}
+		if err := f.outliers.dropFreeSpaceMap(); err != nil {
+			return err
+		}
+		f.outliers.file.Close()
+		if err := os.Remove(f.outliers.fileName); err != nil {
+			return err
+		}
+		f.outliers = nil
+	}
+	if f.storedDesc != nil {
+		f.storedDesc = nil
+		f.tupleSize -= Float64Lengh
+		f.numSlots = (PageSize - HeaderSize) / f.tupleSize
+	}
+	info := NewSampleInfo()
+	info.PopulationSize = f.sampleInfo.PopulationSize
+	f.sampleInfo = info
+	f.contiguousOffset = 0
+	f.loadedEntireFile = false
+	f.offSetsLoaded = make(map[int64]bool)
+	if f.metadataFile != nil {
+		if err := f.metadataFile.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.metadataFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return f.writeToStatsFile()
+}
+
+// Return the sampling metadata of the tuples loaded into the heap file.
+func (f *HeapFile) SampleInfo() *SampleInfo {
+	return f.sampleInfo
+}
+
+// Return the outlier table of the heap file, which holds all of the outliers
+// of a table loaded in the Stat mode (see [OutlierIndex]), or nil if it has
+// none. The heap file's iterator returns the outliers after its own tuples.
+func (f *HeapFile) Outliers() *HeapFile {
+	return f.outliers
+}
+
+// The name of the backing file of the outlier table of the heap file backed
+// by fileName.
+func outlierFileName(fileName string) string {
+	return strings.TrimSuffix(fileName, ".dat") + "Outliers.dat"
 }
 
+// Store the probability that each tuple was loaded in a hidden column after
+// the columns of the heap file (see [MeasureBias]).
+func (f *HeapFile) setMeasureBiased() {
+	if f.storedDesc != nil {
+		return
+	}
+	f.storedDesc = f.desc.copy()
+	f.storedDesc.Fields = append(f.storedDesc.Fields, FieldType{Fname: InclusionProbabilityField, Ftype: FloatType})
+	f.tupleSize += Float64Lengh
+	f.numSlots = (PageSize - HeaderSize) / f.tupleSize
+}
+
+// Return the descriptor of the tuples stored in the pages of the heap file,
+// which includes any hidden columns.
+func (f *HeapFile) pageDesc() *TupleDesc {
+	if f.storedDesc != nil {
+		return f.storedDesc
+	}
+	return f.desc
+}
+
+// Read the sampling metadata of the heap file from a stats file (see
+// [writeSampleInfo] for the format).
 func (f *HeapFile) ProcessStatsFile(file *os.File) error {
-	// fmt.Printf("entering %v\n", file)
-	scanner := bufio.NewScanner(file)
-	scanner.Scan()
-	firstLine := scanner.Text()
-	statNames := strings.Split(firstLine, ",")
-	f.statNames = statNames
-	for scanner.Scan() {
-		line := scanner.Text()
-		vals := strings.Split(line, ",")
-		fieldName := vals[0]
-		for i, statVal := range vals {
-			if i == 0 {
-				continue
-			}
-			fieldStats, ok := f.statistics[fieldName]
-			if !ok {
-				f.statistics[fieldName] = make(map[string]float64)
-				fieldStats = f.statistics[fieldName]
-			}
-			floatVal, err := strconv.ParseFloat(statVal, 64)
-			if err != nil {
-				return err
-			}
-			fieldStats[statNames[i]] = floatVal
-		}
+	file.Seek(0, io.SeekStart)
+	info, offset, err := readSampleInfo(file)
+	if err != nil {
+		return err
 	}
-	// fmt.Printf("stats are now %v %v\n", f.statistics, file)
+	f.sampleInfo = info
+	f.contiguousOffset = offset
 	return nil
 }
 
@@ -316,96 +381,94 @@ func getSampledOffsets(offsets []int64, sampleRate float32) []int64 {
 	return sampledOffsets
 }
 
-// Convert a line read from a CSV file to a tuple and insert into heap file
-// If fieldStats is nil, do not select for non-outlier rows during sampling.
-// Otherwise, return error if line contains an outlier numerical field based on
-// mean, standard deviation.
-func (f *HeapFile) loadLine(line string, sep string, fieldStats map[string]map[string]float64) error {
+// Convert a line read from a CSV file to a tuple, also returning the values of
+// its numeric fields by name.
+func (f *HeapFile) parseLine(line string, sep string) (*Tuple, map[string]float64, error) {
 	fields := strings.Split(line, sep)
 	numFields := len(fields)
 
 	desc := f.Descriptor()
 	if desc == nil || desc.Fields == nil {
-		return GoDBError{MalformedDataError, "Descriptor was nil"}
+		return nil, nil, GoDBError{MalformedDataError, "Descriptor was nil"}
 	}
 	if numFields != len(desc.Fields) {
-		return GoDBError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line (%s) does not have expected number of fields (expected %d, got %d)", line, len(f.Descriptor().Fields), numFields)}
+		return nil, nil, GoDBError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line (%s) does not have expected number of fields (expected %d, got %d)", line, len(f.Descriptor().Fields), numFields)}
 	}
 
 	var newFields []DBValue
-	nStats, ok := f.statistics[N]
-	if !ok {
-		f.statistics[N] = make(map[string]float64)
-		nStats = f.statistics[N]
-	}
+	numericVals := make(map[string]float64)
 	for fno, field := range fields {
-		var floatVal float64
-		var err error
+		fieldName := desc.Fields[fno].Fname
 		switch f.Descriptor().Fields[fno].Ftype {
 		case IntType:
 			field = strings.TrimSpace(field)
-			floatVal, err = strconv.ParseFloat(field, 64)
+			floatVal, err := strconv.ParseFloat(field, 64)
 			if err != nil {
-				return GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int", field)}
+				return nil, nil, GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int", field)}
 			}
 			intValue := int(floatVal)
 			newFields = append(newFields, IntField{int64(intValue)})
-			if fieldStats != nil {
-				fieldName := desc.Fields[fno].Fname
-				stats := fieldStats[fieldName]
-				mean, ok := stats[MEAN]
-				stddev, ok2 := stats[STDDEV]
-				if ok && ok2 && (floatVal > mean+(2*stddev) || floatVal < mean-(2*stddev)) {
-					return fmt.Errorf("outlier value %v for field %v (%v, %v). not inserted into database", floatVal, fieldName, mean, stddev)
-				}
-			}
+			numericVals[fieldName] = floatVal
 		case FloatType:
 			field = strings.TrimSpace(field)
-			floatVal, err = strconv.ParseFloat(field, 64)
+			floatVal, err := strconv.ParseFloat(field, 64)
 			if err != nil {
-				return GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int", field)}
+				return nil, nil, GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int", field)}
 			}
 			floatValue := float64(floatVal)
 			newFields = append(newFields, FloatField{floatValue})
-			if fieldStats != nil {
-				fieldName := desc.Fields[fno].Fname
-				stats := fieldStats[fieldName]
-				mean, ok := stats[MEAN]
-				stddev, ok2 := stats[STDDEV]
-				if ok && ok2 && (floatVal > mean+(2*stddev) || floatVal < mean-(2*stddev)) {
-					return fmt.Errorf("outlier value %v for field %v (%v, %v). not inserted into database", floatVal, fieldName, mean, stddev)
-				}
-			}
+			numericVals[fieldName] = floatVal
 		case StringType:
 			if len(field) > StringLength {
 				field = field[0:StringLength]
 			}
 			newFields = append(newFields, StringField{field})
 		}
-		if f.statistics[COMPLETE][MEAN] != 1 {
-			n := nStats[MEAN] + 1
-			if f.Descriptor().Fields[fno].Ftype == FloatType || f.Descriptor().Fields[fno].Ftype == IntType {
-				// update our running statistics
-				// using https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-				fieldName := desc.Fields[fno].Fname
-				fieldStats, ok := f.statistics[fieldName]
-				if !ok {
-					f.statistics[fieldName] = make(map[string]float64)
-					// sentinel value to let us know if we need to compute this later on for optimized queries
-					f.statistics[fieldName][STDDEV] = -1
-					fieldStats = f.statistics[fieldName]
-				}
-				newMean := fieldStats[MEAN] + (floatVal-fieldStats[MEAN])/n
-				fieldStats[SUMSQUARESDIFF] += (floatVal - fieldStats[MEAN]) * (floatVal - newMean)
-				fieldStats[MEAN] = newMean
+	}
+	return &Tuple{*f.Descriptor(), newFields, nil}, numericVals, nil
+}
+
+// Return the name of a field of a row, given its numeric values, that has an
+// outlier value by the column statistics in stats (see [OutlierIndex]), or ""
+// if there are none.
+func outlierField(stats *SampleInfo, numericVals map[string]float64) string {
+	for fieldName, v := range numericVals {
+		if col := stats.Column(fieldName); col != nil && col.isOutlier(v, OutlierStdDevs) {
+			return fieldName
+		}
+	}
+	return ""
+}
+
+// Convert a line read from a CSV file to a tuple and insert into heap file
+// If fieldStats is nil, do not select for non-outlier rows during sampling.
+// Otherwise, return error if line contains an outlier numerical field based on
+// mean, standard deviation (the outliers are loaded into the outlier table
+// instead, see [HeapFile.StatAndLoadFromCSV]).
+func (f *HeapFile) loadLine(line string, sep string, fieldStats *SampleInfo) error {
+	newT, numericVals, err := f.parseLine(line, sep)
+	if err != nil {
+		return err
+	}
+	if fieldName := outlierField(fieldStats, numericVals); fieldName != "" {
+		col := fieldStats.Column(fieldName)
+		return fmt.Errorf("outlier value %v for field %v (%v, %v). not inserted into database", numericVals[fieldName], fieldName, col.Mean, col.StdDev)
+	}
+	if !f.sampleInfo.Complete {
+		// update our running statistics
+		for fieldName, v := range numericVals {
+			col := f.sampleInfo.Columns[fieldName]
+			if col == nil {
+				col = &ColumnStats{}
+				f.sampleInfo.Columns[fieldName] = col
 			}
+			col.add(v)
 		}
 	}
-	nStats[MEAN] += 1
+	f.sampleInfo.SampleSize++
 
-	newT := Tuple{*f.Descriptor(), newFields, nil}
 	tid := NewTID()
-	err := f.insertTuple(&newT, tid)
+	err = f.insertTuple(newT, tid)
 	if err != nil {
 		fmt.Printf("error with inserting tuple")
 		return err
@@ -420,11 +483,12 @@ func (f *HeapFile) loadLine(line string, sep string, fieldStats map[string]map[s
 // - skipLastField: if true, the final field is skipped (some TPC datasets include a trailing separator on each line)
 // - fieldStats: if nil, do not select for non-outlier rows during sampling.
 // otherwise, strictly load into the database rows with numerical fields all
-// within two standard deviations of the mean for the corresponding column.
+// within [OutlierStdDevs] standard deviations of the mean for the
+// corresponding column.
 // Returns an error if the field cannot be opened or if a line is malformed
 // We provide the implementation of this method, but it won't work until
 // [HeapFile.insertTuple] and some other utility functions are implemented
-func (f *HeapFile) LoadSomeFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, fieldStats map[string]map[string]float64) error {
+func (f *HeapFile) LoadSomeFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, fieldStats *SampleInfo) error {
 	if f.loadedEntireFile {
 		return nil
 	}
@@ -504,7 +568,8 @@ func (f *HeapFile) LoadSomeFromCSV(file *os.File, hasHeader bool, sep string, sk
 				f.offSetsLoaded[offset] = true
 				newOffsetsLoaded[offset] = true
 			}
-			f.loadLine(line, sep, nil)
+			// the outliers of a Stat load are already in the outlier table
+			f.loadLine(line, sep, fieldStats)
 			// Get the current file offset (position)
 			offset, err = file.Seek(0, io.SeekCurrent)
 			if err != nil {
@@ -562,8 +627,8 @@ func (f *HeapFile) LoadSomeFromCSVContiguous(file *os.File, hasHeader bool, sep
 	}
 	newOffsetsLoaded := make(map[int64]bool)
 	estimatedLinesInFile := int(fileInfo.Size()) / f.tupleSize
-	contiguousOffset := f.statistics[OFFSET][MEAN]
-	file.Seek(int64(contiguousOffset), io.SeekStart)
+	contiguousOffset := f.contiguousOffset
+	file.Seek(contiguousOffset, io.SeekStart)
 	// fmt.Printf("gonna start reading from %v. file size is %v tuples size is %v\n", contiguousOffset, fileInfo.Name(), f.tupleSize)
 	scanner := bufio.NewScanner(file)
 	if estimatedLinesInFile >= samplingThreshold {
@@ -597,7 +662,7 @@ func (f *HeapFile) LoadSomeFromCSVContiguous(file *os.File, hasHeader bool, sep
 			}
 		}
 
-		contiguousOffset = float64(newOffset)
+		contiguousOffset = newOffset
 		// fmt.Printf("loaded %v new lines \n", numSampledLines)
 		if numSampledLines == 0 {
 			f.loadedEntireFile = true
@@ -635,19 +700,14 @@ func (f *HeapFile) LoadSomeFromCSVContiguous(file *os.File, hasHeader bool, sep
 		}
 		// fmt.Printf("read entire file?\n")
 		f.loadedEntireFile = true
-		contiguousOffset = float64(offset)
+		contiguousOffset = offset
 	}
 	bp := f.bufPool
 	// Force dirty pages to disk. CommitTransaction may not be implemented
 	// yet if this is called in lab 1 or 2.
 	bp.FlushAllPages()
 
-	offsetStats, ok := f.statistics[OFFSET]
-	if !ok {
-		f.statistics[OFFSET] = make(map[string]float64)
-		offsetStats = f.statistics[OFFSET]
-	}
-	offsetStats[MEAN] = contiguousOffset
+	f.contiguousOffset = contiguousOffset
 	// fmt.Printf("offset is now %v\n", contiguousOffset)
 
 	newString := ""
@@ -810,163 +870,81 @@ func (f *HeapFile) LoadSomeFromCSVContiguousStratified(file *os.File, hasHeader
 	return nil
 }
 
-func computeStats(fieldValues map[string][]float64) map[string]map[string]float64 {
-	result := make(map[string]map[string]float64)
-
-	for key, values := range fieldValues {
-		numValues := float64(len(values))
-
-		// Compute the mean
-		sum := 0.0
-		for _, v := range values {
-			sum += v
+// Compute complete statistics of the numeric columns of a CSV file in a single
+// pass, with memory bounded by the number of columns rather than rows. If fn
+// isn't nil, it is also called with each row, as by [HeapFile.scanCSV].
+func (f *HeapFile) statsFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, fn func(*Tuple, map[string]float64)) (*SampleInfo, error) {
+	info := NewSampleInfo()
+	info.Complete = true
+	err := f.scanCSV(file, hasHeader, sep, skipLastField, func(t *Tuple, numericVals map[string]float64) error {
+		info.PopulationSize++
+		for fieldName, v := range numericVals {
+			col := info.Columns[fieldName]
+			if col == nil {
+				col = &ColumnStats{}
+				info.Columns[fieldName] = col
+			}
+			col.add(v)
 		}
-		mean := sum / numValues
-
-		// Compute the standard deviation
-		varianceSum := 0.0
-		for _, v := range values {
-			varianceSum += (v - mean) * (v - mean)
+		if fn != nil {
+			fn(t, numericVals)
 		}
-		stddev := math.Sqrt(varianceSum / numValues)
-
-		result[key] = map[string]float64{MEAN: mean, STDDEV: stddev}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return result
+	return info, nil
 }
 
-// Read CSV file and write to file statFilename per-column mean, stddev.
+// Read CSV file and write to file statFilename per-column mean, stddev, in
+// the format of the heap file's own stats file (see [writeSampleInfo]).
 func (f *HeapFile) StatFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, statFilename string) error {
-	f.bufPool.CanFlushWhenFull = true
-	defer func() { f.bufPool.CanFlushWhenFull = false }()
-	scanner := bufio.NewScanner(file)
-	cnt := 0
-
-	fieldValues := map[string][]float64{}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Split(line, sep)
-		if skipLastField {
-			fields = fields[0 : len(fields)-1]
-		}
-		numFields := len(fields)
-		cnt++
-		desc := f.Descriptor()
-		if desc == nil || desc.Fields == nil {
-			return GoDBError{MalformedDataError, "Descriptor was nil"}
-		}
-		if numFields != len(desc.Fields) {
-			return GoDBError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line %d (%s) does not have expected number of fields (expected %d, got %d)", cnt, line, len(f.Descriptor().Fields), numFields)}
-		}
-		if cnt == 1 && hasHeader {
-			continue
-		}
-		for fno, field := range fields {
-			switch f.Descriptor().Fields[fno].Ftype {
-			case IntType:
-				field = strings.TrimSpace(field)
-				floatVal, err := strconv.ParseFloat(field, 64)
-				if err != nil {
-					return GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int, tuple %d", field, cnt)}
-				}
-				fieldName := desc.Fields[fno].Fname
-				fieldValues[fieldName] = append(fieldValues[fieldName], floatVal)
-			case FloatType:
-				field = strings.TrimSpace(field)
-				floatVal, err := strconv.ParseFloat(field, 64)
-				if err != nil {
-					return GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int, tuple %d", field, cnt)}
-				}
-				fieldName := desc.Fields[fno].Fname
-				fieldValues[fieldName] = append(fieldValues[fieldName], floatVal)
-			}
-		}
+	info, err := f.statsFromCSV(file, hasHeader, sep, skipLastField, nil)
+	if err != nil {
+		return err
 	}
 
-	fieldStats := computeStats(fieldValues)
-
-	file, err := os.OpenFile(statFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	statFile, err := os.OpenFile(statFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open or create file: %w", err)
 	}
-	defer file.Close()
-
-	_, err = file.WriteString(fmt.Sprintf("FieldName,%v,%v\n", MEAN, STDDEV))
+	defer statFile.Close()
+	err = writeSampleInfo(statFile, info, 0)
 	if err != nil {
-		return err
-	}
-
-	// mark as complete so it's not updated
-	fieldStats[COMPLETE] = map[string]float64{MEAN: 1}
-	fieldStats[ESTIMATEDLINES] = map[string]float64{MEAN: float64(cnt - 1)}
-	// fmt.Printf("Done scanning count is %v for %v\n", cnt-1, statFilename)
-
-	for field, stats := range fieldStats {
-		line := fmt.Sprintf("%s,%.2f,%.2f\n",
-			field, stats[MEAN], stats[STDDEV])
-		_, err := file.WriteString(line)
-		if err != nil {
-			return fmt.Errorf("failed to write to file: %w", err)
-		}
+		return fmt.Errorf("failed to write to file: %w", err)
 	}
-	f.statistics = fieldStats
+	f.sampleInfo = info
 	return nil
 }
 
-// Return a map mapping field names to [mean, stddev] from a CSV file containing
-// comma-delimited stats.
-func LoadStat(statFilename string) (map[string]map[string]float64, error) {
+// Return the statistics in a stats file written by [HeapFile.StatFromCSV] or
+// kept by a heap file.
+func LoadStat(statFilename string) (*SampleInfo, error) {
 	file, err := os.Open(statFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	// skip the first line
-	// reader.Read()
-	records, err := reader.ReadAll()
+	info, _, err := readSampleInfo(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read CSV: %v", err)
+		return nil, fmt.Errorf("failed to read stats: %v", err)
 	}
-
-	var statNames []string
-	fieldStats := make(map[string]map[string]float64)
-	for i, record := range records {
-		if i == 0 {
-			statNames = make([]string, len(record))
-			copy(statNames, record)
-			continue
-		}
-		// if len(record) != 3 {
-		// 	return nil, fmt.Errorf("invalid record format: %v", record)
-		// }
-		fieldStats[record[0]] = make(map[string]float64)
-		for j, strVal := range record {
-			if j == 0 {
-				continue
-			}
-			val, err := strconv.ParseFloat(strVal, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse %v for key %v: %v", statNames[j], strVal, err)
-			}
-			fieldStats[record[0]][statNames[j]] = val
-		}
-	}
-
-	return fieldStats, nil
+	return info, nil
 }
 
-// Multi-pass random sampling.
+// Multi-pass random sampling with an outlier index (see [OutlierIndex]).
 //
 // In the first pass, compute and write to a file per-column mean, standard
-// deviation without loading any data into the database. In the second pass, for
-// each row in the CSV file, determine whether all numerical fields are within
-// two standard deviations. Repeatedly randomly sample until a sufficient subset
-// of (non-outlier) data is loaded into the database.
+// deviation without loading any data into the database. In the second pass,
+// load every row of the CSV file with a numerical field more than
+// [OutlierStdDevs] standard deviations from the mean into the outlier table.
+// Then repeatedly randomly sample until a sufficient subset of the other
+// (non-outlier) rows is loaded into the database.
 func (f *HeapFile) StatAndLoadFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, statFilename string) error {
 	// Get stats in initial read-only pass through CSV file
+	prevOutliers := f.sampleInfo.Outliers
 	err := f.StatFromCSV(file, hasHeader, sep, skipLastField, statFilename)
 	if err != nil {
 		return fmt.Errorf("failed to compute stats from file %v", file)
@@ -978,12 +956,152 @@ func (f *HeapFile) StatAndLoadFromCSV(file *os.File, hasHeader bool, sep string,
 		return fmt.Errorf("failed to read stats from file %v. %v", statFilename, err)
 	}
 
+	// Load all of the outliers, unless they already were
+	if f.outliers == nil {
+		err = f.loadOutliers(file, hasHeader, sep, skipLastField, fieldStats)
+		if err != nil {
+			return fmt.Errorf("failed to load outliers from file %v. %v", file.Name(), err)
+		}
+	} else {
+		f.sampleInfo.Outliers = prevOutliers
+	}
+
 	// Randomly sample rows (with non-outlier values) to insert into database
 	_ = f.LoadSomeFromCSV(file, hasHeader, sep, skipLastField, fieldStats)
 
 	return nil
 }
 
+// Load the rows of a CSV file with a numerical field that is an outlier by
+// the column statistics of stats into a new outlier table, and record the
+// outlier index in the heap file's sampling metadata.
+func (f *HeapFile) loadOutliers(file *os.File, hasHeader bool, sep string, skipLastField bool, stats *SampleInfo) error {
+	f.bufPool.CanFlushWhenFull = true
+	defer func() { f.bufPool.CanFlushWhenFull = false }()
+
+	name := outlierFileName(f.fileName)
+	if err := os.Truncate(name, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	outliers, err := NewHeapFile(name, f.desc, f.bufPool)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = f.scanCSV(file, hasHeader, sep, skipLastField, func(t *Tuple, numericVals map[string]float64) error {
+		if outlierField(stats, numericVals) == "" {
+			return nil
+		}
+		count++
+		return outliers.insertTuple(t, NewTID())
+	})
+	if err != nil {
+		return err
+	}
+	f.bufPool.FlushAllPages()
+
+	f.outliers = outliers
+	f.indexes = nil
+	f.sampleInfo.Outliers = &OutlierIndex{StdDevs: OutlierStdDevs, Count: float64(count)}
+	f.sampleInfo.SampleSize += float64(count)
+	return f.writeToStatsFile()
+}
+
+// Call fn with each row of a CSV file, from its start, as a tuple and the
+// values of its numeric fields by name.
+func (f *HeapFile) scanCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, fn func(*Tuple, map[string]float64) error) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if lineNo == 1 && hasHeader {
+			continue
+		}
+		line := scanner.Text()
+		if skipLastField {
+			line = line[:strings.LastIndex(line, sep)]
+		}
+		t, numericVals, err := f.parseLine(line, sep)
+		if err != nil {
+			return err
+		}
+		if err := fn(t, numericVals); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// The source of the random numbers that decide which rows
+// [HeapFile.MeasureBiasedLoadFromCSV] loads; tests replace it with a seeded
+// one.
+var measureSampleRand = rand.Float64
+
+// Load a sample of about [MeasureSampleRate] of the rows of a CSV file into
+// the heap file, loading each row with probability roughly proportional to
+// the absolute value of its measure column (see [MeasureBias]), or with the
+// same probability if measure is "". Small files are loaded entirely. The
+// first pass over the file counts its rows, totals the measure and computes
+// complete column statistics; the second loads the sample, recording the
+// probability that each row was loaded in a hidden column. The sample is only
+// loaded once.
+// Returns an error if the file cannot be read, a line is malformed, or the
+// measure isn't a numeric column of the heap file.
+func (f *HeapFile) MeasureBiasedLoadFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, measure string) error {
+	if f.sampleInfo.Measure != nil {
+		return nil
+	}
+	if measure != "" {
+		idx, err := findFieldInTd(FieldType{Fname: measure, Ftype: UnknownType}, f.desc)
+		if err != nil {
+			return err
+		}
+		if f.desc.Fields[idx].Ftype == StringType {
+			return GoDBError{TypeMismatchError, fmt.Sprintf("measure column %s isn't numeric", measure)}
+		}
+	}
+	f.bufPool.CanFlushWhenFull = true
+	defer func() { f.bufPool.CanFlushWhenFull = false }()
+
+	total := 0.0
+	info, err := f.statsFromCSV(file, hasHeader, sep, skipLastField, func(t *Tuple, numericVals map[string]float64) {
+		total += math.Abs(numericVals[measure])
+	})
+	if err != nil {
+		return err
+	}
+	info.Measure = &MeasureBias{Column: measure}
+
+	// small tables are loaded entirely
+	samplingThreshold := 1000.0
+	n := info.PopulationSize
+	sampleSize := MeasureSampleRate * n
+	f.sampleInfo = info
+	f.setMeasureBiased()
+	err = f.scanCSV(file, hasHeader, sep, skipLastField, func(t *Tuple, numericVals map[string]float64) error {
+		p := 1.0
+		if n >= samplingThreshold {
+			share := 1 / n
+			if total > 0 {
+				share = (1-MeasureUniformFraction)*math.Abs(numericVals[measure])/total + MeasureUniformFraction/n
+			}
+			p = math.Min(1, sampleSize*share)
+		}
+		if p < 1 && measureSampleRand() >= p {
+			return nil
+		}
+		info.SampleSize++
+		return f.insertTuple(&Tuple{*f.storedDesc, append(t.Fields, FloatField{p}), nil}, NewTID())
+	})
+	if err != nil {
+		return err
+	}
+	f.bufPool.FlushAllPages()
+	return f.writeToStatsFile()
+}
+
 // Load the contents of a heap file from a specified CSV file.  Parameters are as follows:
 // - hasHeader:  whether or not the CSV file has a header
 // - sep: the character to use to separate fields
@@ -1069,6 +1187,9 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 // This method will need to open the file supplied to the constructor, seek to
 // the appropriate offset, read the bytes in, and construct a [heapPage] object,
 // using the [heapPage.initFromBuffer] method.
+//
+// Returns a CorruptPageError if the checksum of the page doesn't match its
+// contents or the page is cut short (see [HeapFile.checkStoredPage]).
 func (f *HeapFile) readPage(pageNo int) (Page, error) {
 	// TODO: some code goes here
 
@@ -1076,20 +1197,30 @@ func (f *HeapFile) readPage(pageNo int) (Page, error) {
 	offset := int64(pageNo * PageSize)
 	pageData := make([]byte, PageSize)
 
-	_, err := f.file.ReadAt(pageData, offset)
-	if err != nil {
+	// a short read is a page cut short, which checkStoredPage reports
+	n, err := f.file.ReadAt(pageData, offset)
+	if err != nil && err != io.EOF {
 		DebugHeapFile("1 got err %v\n", err)
 		return nil, err
 	}
+	legacy, err := f.checkStoredPage(pageData[:n], pageNo)
+	if err != nil {
+		return nil, err
+	}
 
-	heapPage, err := newHeapPage(f.desc, pageNo, f)
+	heapPage, err := newHeapPage(f.pageDesc(), pageNo, f)
 	if err != nil {
 		DebugHeapFile("2 got err %v\n", err)
 
 		return nil, err
 	}
 
-	err = heapPage.initFromBuffer(bytes.NewBuffer(pageData))
+	if legacy {
+		err = heapPage.initFromLegacyBuffer(bytes.NewBuffer(pageData))
+	} else {
+		err = heapPage.initFromBuffer(bytes.NewBuffer(pageData))
+	}
+	f.lastLSN = max(f.lastLSN, heapPage.LSN)
 
 	return heapPage, err
 }
@@ -1112,11 +1243,16 @@ func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
 	// TODO: some code goes here
 	DebugHeapFile("here5\n")
 	f.numInserted += 1
+	f.indexes = nil
+	if f.storedDesc != nil && len(t.Fields) == len(f.desc.Fields) {
+		// tuples inserted into a measure-biased sample are certainly in the
+		// table
+		t = &Tuple{*f.storedDesc, append(slices.Clone(t.Fields), FloatField{1}), nil}
+	}
 
-	// look through each page sequentially for an empty slot
-	// TODO potential optimization to keep track of the lowest page No that has a free space
+	// fill the lowest numbered page with an empty slot
 	DebugHeapFile("Starting call to insert tuple last page is %v capcity is %v numPages  file is %v\n", f.bufPool.capacity, f.numPages, f.file.Name())
-	for pageNo := range f.pagesWithFreeSpace {
+	for pageNo, ok := f.pagesWithFreeSlots.first(); ok; pageNo, ok = f.pagesWithFreeSlots.first() {
 		DebugHeapFile("heapFile.insertTuple getting page\n")
 		page, err := f.bufPool.GetPage(f, pageNo, tid, ReadPerm)
 		if err != nil {
@@ -1147,12 +1283,12 @@ func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
 		}
 		DebugHeapFile("insert num %v, deleting page no %v\n", f.numInserted, pageNo)
 		// page no longer has free space
-		delete(f.pagesWithFreeSpace, pageNo)
+		f.pagesWithFreeSlots.remove(pageNo)
 	}
 
 	DebugHeapFile("gonna add another heap page page no %v. tuple size is %v bp capcity is %v\n", f.numPages, f.tupleSize, f.bufPool.capacity)
 	// make new heap page
-	heapPage, err := newHeapPage(f.desc, f.numPages, f)
+	heapPage, err := newHeapPage(f.pageDesc(), f.numPages, f)
 	if err != nil {
 		DebugHeapFile("here8\n")
 		return err
@@ -1166,7 +1302,7 @@ func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
 	}
 	DebugHeapFile("flushing heap page with no %v\n", heapPage.PageNo)
 	// TODO don't flush it here
-	DebugHeapFile("inset num %v, adding page cause all others full. %v\n", f.numInserted, len(f.pagesWithFreeSpace))
+	DebugHeapFile("inset num %v, adding page cause all others full. %v\n", f.numInserted, f.pagesWithFreeSlots.Len())
 	_, err = f.bufPool.AddPage(heapPage, f, f.numPages, tid, ReadPerm)
 	if err != nil {
 		DebugHeapFile("uhh err is %v\n", err)
@@ -1174,7 +1310,7 @@ func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
 	}
 	DebugHeapFile("gonna incremement num pages %v\n", f.numPages)
 
-	f.pagesWithFreeSpace[f.numPages] = true
+	f.pagesWithFreeSlots.add(f.numPages)
 	f.numPages++
 	DebugHeapFile("num pages is now %v\n", f.numPages)
 	return nil
@@ -1191,6 +1327,13 @@ func (f *HeapFile) insertTuple(t *Tuple, tid TransactionID) error {
 // The page the tuple is deleted from should be marked as dirty.
 func (f *HeapFile) deleteTuple(t *Tuple, tid TransactionID) error {
 	// TODO: some code goes here
+	f.indexes = nil
+	if rid, ok := t.Rid.(outlierRID); ok && f.outliers != nil {
+		return f.outliers.deleteTuple(&Tuple{t.Desc, t.Fields, rid.rid}, tid)
+	}
+	if rid, ok := t.Rid.(weightedRID); ok {
+		t = &Tuple{t.Desc, t.Fields, rid.rid}
+	}
 	ridPtr, ok := t.Rid.(*recordIDImpl)
 	if !ok {
 		return GoDBError{IncompatibleTypesError, fmt.Sprintf("In Heap file Couldn't convert rid %v into pointer to my record id impl", t.Rid)}
@@ -1206,7 +1349,7 @@ func (f *HeapFile) deleteTuple(t *Tuple, tid TransactionID) error {
 		return GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", page)}
 	}
 
-	f.pagesWithFreeSpace[ridPtr.pageNo] = true
+	f.pagesWithFreeSlots.add(ridPtr.pageNo)
 
 	return heapPage.deleteTuple(t.Rid)
 }
@@ -1223,6 +1366,11 @@ func (f *HeapFile) flushPage(p Page) error {
 		return GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", p)}
 	}
 
+	// there is no log yet, so the LSN of a page counts the writes to the
+	// heap file; a page is always read before it is written again, so each
+	// write of a page has a higher LSN than the last one
+	f.lastLSN++
+	heapPage.LSN = f.lastLSN
 	buf, err := heapPage.toBuffer()
 	if err != nil {
 		return err
@@ -1231,7 +1379,10 @@ func (f *HeapFile) flushPage(p Page) error {
 	offset := int64(heapPage.PageNo * PageSize)
 
 	_, err = f.file.WriteAt(buf.Bytes(), offset)
-	return err
+	if err != nil {
+		return err
+	}
+	return f.updateFreeSpaceMap(heapPage.PageNo, heapPage.NumSlots-heapPage.NumUsedSlots)
 }
 
 // [Operator] descriptor method -- return the TupleDesc for this HeapFile
@@ -1252,30 +1403,66 @@ func (f *HeapFile) Descriptor() *TupleDesc {
 // Make sure to set the returned tuple's TupleDescriptor to the TupleDescriptor of
 // the HeapFile. This allows it to correctly capture the table qualifier.
 func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	// TODO: some code goes here
-	// closure!
-	curPage := 0
+	iter, err := f.pageIterator(tid)
+	if err != nil || f.outliers == nil {
+		return iter, err
+	}
+	return f.withOutliers(iter, tid), nil
+}
 
-	// get the next heap page iter
-	getNextIter := func(pageNo int) (func() (*Tuple, error), error) {
-		page, err := f.bufPool.GetPage(f, pageNo, tid, ReadPerm)
-		DebugHeapFile("here1\n")
-		if err != nil {
-			DebugHeapFile("here2 %v %v\n", pageNo, f.numPages)
+// The record id of a tuple of the outlier table of a heap file.
+type outlierRID struct {
+	rid recordID
+}
 
-			return nil, err
+// The record id of a tuple of a measure-biased sample (see [MeasureBias]),
+// with the probability that it was loaded, from its hidden column.
+type weightedRID struct {
+	rid  recordID
+	prob float64
+}
+
+// Return an iterator over the tuples of iter followed by the tuples of the
+// outlier table, whose record ids are marked so that [HeapFile.deleteTuple]
+// deletes them from the outlier table.
+func (f *HeapFile) withOutliers(iter func() (*Tuple, error), tid TransactionID) func() (*Tuple, error) {
+	var outlierIter func() (*Tuple, error)
+	return func() (*Tuple, error) {
+		if outlierIter == nil {
+			t, err := iter()
+			if err != nil || t != nil {
+				return t, err
+			}
+			if f.outliers.NumPages() == 0 {
+				return nil, nil
+			}
+			outlierIter, err = f.outliers.Iterator(tid)
+			if err != nil {
+				return nil, err
+			}
 		}
-		heapPage, ok := page.(*heapPage)
-		if !ok {
-			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", page)}
+		t, err := outlierIter()
+		if t == nil || err != nil {
+			return t, err
 		}
+		// the tuple may be the one cached in the outlier table's page, so
+		// it's copied rather than changed
+		return &Tuple{*f.desc, t.Fields, outlierRID{t.Rid}}, nil
+	}
+}
 
-		return heapPage.tupleIter(), nil
+// Return an iterator over the tuples in the pages of the heap file.
+func (f *HeapFile) pageIterator(tid TransactionID) (func() (*Tuple, error), error) {
+	// TODO: some code goes here
+	// closure!
+	curPage := 0
+	if f.numPages == 0 {
+		return func() (*Tuple, error) { return nil, nil }, nil
 	}
 
 	// initialize first iter func
-	curIter, err := getNextIter(curPage)
-	if err != nil && err != io.EOF {
+	curIter, err := f.pageTupleIter(curPage, tid)
+	if err != nil {
 		DebugHeapFile("here3 %v\n", err)
 
 		return nil, err
@@ -1293,8 +1480,7 @@ func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 			// get next tuple from heapPage
 			tuple, err := curIter()
 			if tuple != nil || err != nil {
-				tuple.Desc = *f.desc
-				return tuple, nil
+				return tuple, err
 			}
 
 			// reached EOF
@@ -1305,7 +1491,7 @@ func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 
 			// grab next heapPage iterfunc
 			curPage++
-			curIter, err = getNextIter(curPage)
+			curIter, err = f.pageTupleIter(curPage, tid)
 			if err != nil {
 				DebugHeapFile("here4\n")
 
@@ -1318,6 +1504,45 @@ func (f *HeapFile) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 	return getTuple, nil
 }
 
+// Return an iterator over the tuples of a single page of the heap file, with
+// the heap file's descriptor and any hidden column moved into their record
+// ids.
+func (f *HeapFile) pageTupleIter(pageNo int, tid TransactionID) (func() (*Tuple, error), error) {
+	page, err := f.bufPool.GetPage(f, pageNo, tid, ReadPerm)
+	DebugHeapFile("here1\n")
+	if err != nil {
+		DebugHeapFile("here2 %v %v\n", pageNo, f.numPages)
+
+		return nil, err
+	}
+	heapPage, ok := page.(*heapPage)
+	if !ok {
+		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", page)}
+	}
+
+	iter := heapPage.tupleIter()
+	return func() (*Tuple, error) {
+		tuple, err := iter()
+		if tuple == nil || err != nil {
+			return tuple, err
+		}
+		return f.fromStoredTuple(tuple), nil
+	}, nil
+}
+
+// Return a tuple as stored in a page of the heap file with the heap file's
+// descriptor and any hidden column moved into its record id.
+func (f *HeapFile) fromStoredTuple(tuple *Tuple) *Tuple {
+	if f.storedDesc != nil {
+		// move the hidden column into the record id
+		hidden := len(f.desc.Fields)
+		prob := tuple.Fields[hidden].(FloatField).Value
+		return &Tuple{*f.desc, tuple.Fields[:hidden:hidden], weightedRID{tuple.Rid, prob}}
+	}
+	tuple.Desc = *f.desc
+	return tuple
+}
+
 // internal structure to use as key for a heap page
 type heapHash struct {
 	FileName string
@@ -315,3 +315,87 @@ func TestHeapFileIteratorExtra(t *testing.T) {
 		t.Fatalf("Iterator returned error at end, expected nil, nil, got nil, %s", err.Error())
 	}
 }
+
+func TestHeapFileReopen(t *testing.T) {
+	bp, hf := makeTestFile(t, 10)
+	td, t1, t2 := makeTupleTestVars()
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	n := 3 * hf.numSlots
+	for i := 0; i < n; i++ {
+		if err := hf.insertTuple(&t1, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// free a slot on one of the pages
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	first, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := hf.deleteTuple(first, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	freePage := first.Rid.(*recordIDImpl).pageNo
+	bp.CommitTransaction(tid)
+	bp.FlushAllPages()
+
+	reopen := func() *HeapFile {
+		bp2, err := NewBufferPool(10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		hf2, err := NewHeapFile(TestingFile, &td, bp2)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if hf2.NumPages() != 3 {
+			t.Fatalf("expected the reopened heap file to have 3 pages, got %d", hf2.NumPages())
+		}
+		return hf2
+	}
+	hf2 := reopen()
+	if hf2.pagesWithFreeSlots.Len() != 1 || !hf2.pagesWithFreeSlots.has(freePage) {
+		t.Errorf("expected only page %d to have free slots, got %v", freePage, hf2.pagesWithFreeSlots.pages)
+	}
+	tid = NewTID()
+	hf2.bufPool.BeginTransaction(tid)
+	if err := hf2.insertTuple(&t2, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hf2.NumPages() != 3 {
+		t.Errorf("expected the insert to reuse the free slot, got %d pages", hf2.NumPages())
+	}
+	cnt := 0
+	iter, err = hf2.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		cnt++
+	}
+	if cnt != n {
+		t.Errorf("expected %d tuples, got %d", n, cnt)
+	}
+	hf2.bufPool.CommitTransaction(tid)
+	hf2.bufPool.FlushAllPages()
+
+	// without a free space map, every page may have free slots
+	os.Remove(freeSpaceMapFileName(TestingFile))
+	if hf3 := reopen(); hf3.pagesWithFreeSlots.Len() != 3 {
+		t.Errorf("expected every page to be checked for free slots, got %v", hf3.pagesWithFreeSlots.pages)
+	}
+
+	// a damaged free space map is an error
+	os.WriteFile(freeSpaceMapFileName(TestingFile), []byte("not a free space map"), 0644)
+	if _, err := NewHeapFile(TestingFile, &td, bp); err == nil {
+		t.Errorf("expected an error opening a heap file with a damaged free space map")
+	}
+	os.Remove(freeSpaceMapFileName(TestingFile))
+}
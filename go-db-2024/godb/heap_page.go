@@ -25,9 +25,11 @@ tuples.
 In GoDB all tuples are fixed length, which means that given a TupleDesc it is
 possible to figure out how many tuple "slots" fit on a given page.
 
-In addition, all pages are PageSize bytes.  They begin with a header with a 32
-bit integer with the number of slots (tuples), and a second 32 bit integer with
-the number of used slots.
+In addition, all pages are PageSize bytes.  They begin with a header (see
+[heapPageHeader]) with a checksum of the page, the version of the page format,
+the LSN of the page, a 16 bit integer with the number of slots (tuples), and a
+second 16 bit integer with the number of used slots. Pages written before
+pages had checksums are still read (see [legacyHeaderSize]).
 
 Each tuple occupies the same number of bytes.  You can use the go function
 unsafe.Sizeof() to determine the size in bytes of an object.  So, a GoDB integer
@@ -39,7 +41,7 @@ tuple is just the sum of the size in bytes of its fields.
 Once you have figured out how big a record is, you can determine the number of
 slots on on the page as:
 
-remPageSize = PageSize - 8 // bytes after header
+remPageSize = PageSize - HeaderSize // bytes after header
 numSlots = remPageSize / bytesPerTuple //integer division will round down
 
 To serialize a page to a buffer, you can then:
@@ -57,6 +59,24 @@ dirty page, it's OK if tuples are renumbered when they are written back to disk.
 
 */
 
+// The header of a heap page on disk, written in LittleEndian order. The
+// checksum is the CRC32C of the rest of the page and of its page number (see
+// [pageChecksum]), so that a page that was only partly written, or written at
+// the wrong offset, is detected when it is read. The header fits in the bytes
+// left over after the slots of pages of the usual tuples of a string and an
+// int, so it doesn't take room from their tuples.
+type heapPageHeader struct {
+	Checksum     uint32
+	Version      uint8 // heapPageVersion, or 0 for a page that was never written
+	_            [3]byte
+	LSN          uint32 // see [heapPage.LSN]
+	NumSlots     uint16
+	NumUsedSlots uint16
+}
+
+// The version of the format of heap pages written by this version of GoDB.
+const heapPageVersion = 1
+
 type heapPage struct {
 	// TODO: some code goes here
 	NumSlots        int
@@ -68,6 +88,7 @@ type heapPage struct {
 	PageNo          int
 	File            *HeapFile
 	Dirty           bool
+	LSN             uint32 // the sequence number of the last write of the page (see [HeapFile.flushPage])
 }
 
 func (h *heapPage) checkRep() error {
@@ -179,17 +200,19 @@ func (p *heapPage) getFile() DBFile {
 // if the write to the the buffer fails. You will likely want to call this from
 // your [HeapFile.flushPage] method.  You should write the page header, using
 // the binary.Write method in LittleEndian order, followed by the tuples of the
-// page, written using the Tuple.writeTo method.
+// page, written using the Tuple.writeTo method. The checksum in the header is
+// computed last, over the whole page.
 func (h *heapPage) toBuffer() (*bytes.Buffer, error) {
 	// TODO: some code goes here
 	b := new(bytes.Buffer)
 
-	err := binary.Write(b, binary.LittleEndian, int32(h.NumSlots))
-	if err != nil {
-		return b, err
+	header := heapPageHeader{
+		Version:      heapPageVersion,
+		LSN:          h.LSN,
+		NumSlots:     uint16(h.NumSlots),
+		NumUsedSlots: uint16(h.NumUsedSlots),
 	}
-
-	err = binary.Write(b, binary.LittleEndian, int32(h.NumUsedSlots))
+	err := binary.Write(b, binary.LittleEndian, &header)
 	if err != nil {
 		return b, err
 	}
@@ -222,28 +245,42 @@ func (h *heapPage) toBuffer() (*bytes.Buffer, error) {
 		binary.Write(b, binary.LittleEndian, emptyTuple)
 	}
 
+	binary.LittleEndian.PutUint32(b.Bytes(), pageChecksum(b.Bytes(), h.PageNo))
 	return b, nil
 }
 
-// Read the contents of the HeapPage from the supplied buffer.
+// Read the contents of the HeapPage from the supplied buffer. The checksum
+// isn't verified here, but by [HeapFile.readPage] (see [checkPage]).
 func (h *heapPage) initFromBuffer(buf *bytes.Buffer) error {
 	// TODO: some code goes here
-	var numSlots int32
-	err := binary.Read(buf, binary.LittleEndian, &numSlots)
+	var header heapPageHeader
+	err := binary.Read(buf, binary.LittleEndian, &header)
 	if err != nil {
 		return err
 	}
-	h.NumSlots = int(numSlots)
+	h.LSN = header.LSN
+	h.NumSlots = int(header.NumSlots)
+	h.NumUsedSlots = int(header.NumUsedSlots)
 
-	var numUsedSlots int32
-	err = binary.Read(buf, binary.LittleEndian, &numUsedSlots)
-	if err != nil {
+	DebugHeapPage("init from buffer page %v num used slots is %v\n", h.PageNo, h.NumUsedSlots)
+	return h.readTuples(buf)
+}
+
+// Read the contents of the heap page from a page written by an earlier
+// version of GoDB (see [legacyHeaderSize]), whose tuples fit in the slots of
+// the page. The page keeps the number of slots of the current format.
+func (h *heapPage) initFromLegacyBuffer(buf *bytes.Buffer) error {
+	var header struct{ NumSlots, NumUsedSlots int32 }
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
 		return err
 	}
-	h.NumUsedSlots = int(numUsedSlots)
-
-	DebugHeapPage("init from buffer page %v num used slots is %v\n", h.PageNo, h.NumUsedSlots)
+	h.NumUsedSlots = int(header.NumUsedSlots)
+	return h.readTuples(buf)
+}
 
+// Read the used slots of the heap page from buf, which is positioned after
+// the page's header.
+func (h *heapPage) readTuples(buf *bytes.Buffer) error {
 	for i := 0; i < h.NumUsedSlots; i++ {
 		tuple, err := readTupleFrom(buf, h.Desc)
 		if err != nil {
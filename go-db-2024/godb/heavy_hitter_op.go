@@ -0,0 +1,299 @@
+package godb
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Top-k GROUP BY queries (ORDER BY COUNT(...) DESC LIMIT k) with the
+// SpaceSaving sketch (see A. Metwally, D. Agrawal and A. El Abbadi, "Efficient
+// computation of frequent and top-k elements in data streams", ICDT 2005).
+//
+// A [HeavyHitterAggregator] keeps counters for at most a fixed number of
+// groups. A tuple of a group with a counter increments it, and a tuple of any
+// other group takes over the smallest counter, adding one to its count and
+// remembering the count it took over as the error of the new group's count.
+// Counts are therefore never underestimated, and overestimated by at most
+// their error, and every group with more than 1/counters of the tuples has a
+// counter. The other aggregates of a group are computed over the tuples seen
+// since its counter was taken over, so they are exact for the groups whose
+// count has no error.
+
+// The number of groups the heavy hitter aggregations planned by the parser
+// keep counters for. Queries whose LIMIT is larger, or all queries if 0, are
+// aggregated as usual.
+var HeavyHitterCounters = 10000
+
+// The hint that asks for a top-k query over a table that isn't a sample to be
+// run as a heavy hitter aggregation; top-k queries over samples always are,
+// since their counts are estimates anyway.
+const heavyHittersHint = "heavy_hitters"
+
+// The counter of a group.
+type heavyHitter struct {
+	group  *Tuple     // the values of the group by fields
+	count  float64    // the estimated (weighted) number of tuples of the group
+	err    float64    // the most count can overestimate the number of tuples by
+	states []AggState // the aggregates of the tuples since the counter was taken over
+	index  int        // the position of the counter in the heap
+}
+
+// A min heap of counters, by count.
+type heavyHitterHeap []*heavyHitter
+
+func (h heavyHitterHeap) Len() int           { return len(h) }
+func (h heavyHitterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h heavyHitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *heavyHitterHeap) Push(x any) {
+	hh := x.(*heavyHitter)
+	hh.index = len(*h)
+	*h = append(*h, hh)
+}
+func (h *heavyHitterHeap) Pop() any {
+	old := *h
+	hh := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return hh
+}
+
+// A HeavyHitterAggregator outputs the k groups with the most tuples, and
+// their aggregates, estimated in a fixed amount of memory. Its output is
+// that of a grouped [Aggregator], in descending order of the count that ranks
+// the groups, followed by the error bound of that count.
+type HeavyHitterAggregator struct {
+	groupByFields []Expr
+	newAggState   []AggState
+	rank          int // the position in newAggState of the COUNT that ranks the groups
+	k             int
+	counters      int
+	child         Operator
+	desc          *TupleDesc
+}
+
+// Construct a heavy hitter aggregation of the tuples of child grouped by
+// groupByFields, outputting the k groups with the highest count estimated by
+// the COUNT state aggs[rank], keeping at most counters groups in memory.
+func NewHeavyHitterAggregator(aggs []AggState, groupByFields []Expr, rank int, k int, counters int, child Operator) (*HeavyHitterAggregator, error) {
+	if len(groupByFields) == 0 {
+		return nil, GoDBError{IllegalOperationError, "heavy hitter aggregation needs a group by"}
+	}
+	if rank < 0 || rank >= len(aggs) {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("no aggregate %d to rank groups by", rank)}
+	}
+	if _, ok := aggs[rank].(*CountAggState); !ok {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("heavy hitter aggregation ranks groups by COUNT, not %T", aggs[rank])}
+	}
+	if k <= 0 || counters < k {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("heavy hitter aggregation needs at least %d counters, got %d", k, counters)}
+	}
+	desc := NewGroupedAggregator(aggs, groupByFields, child).Descriptor().copy()
+	bound := FieldType{fmt.Sprintf("bound(%s)", aggs[rank].GetTupleDesc().Fields[0].Fname), "", FloatType}
+	desc.Fields = append(desc.Fields, bound)
+	return &HeavyHitterAggregator{groupByFields, aggs, rank, k, counters, child, desc}, nil
+}
+
+func (a *HeavyHitterAggregator) Descriptor() *TupleDesc {
+	return a.desc
+}
+
+// The output is the top groups, not a sample of the groups.
+func (a *HeavyHitterAggregator) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// Return the field of the error bound of the count that ranks the groups.
+func (a *HeavyHitterAggregator) boundField() FieldType {
+	return a.desc.Fields[len(a.desc.Fields)-1]
+}
+
+// Return the values of the group by fields of t.
+func (a *HeavyHitterAggregator) groupOf(t *Tuple) (*Tuple, error) {
+	group := &Tuple{Fields: make([]DBValue, len(a.groupByFields))}
+	for i, expr := range a.groupByFields {
+		v, err := expr.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		group.Desc.Fields = append(group.Desc.Fields, expr.GetExprType())
+		group.Fields[i] = v
+	}
+	return group, nil
+}
+
+// Read the whole input, then iterate over the k groups with the highest
+// estimated counts. Each tuple of a sample counts for the number of tuples of
+// the table it stands for, so counts (and their error bounds) are scaled up
+// like those of [CountAggState]. Tuples the ranking COUNT doesn't count (those
+// with a NULL argument) don't change the counters, and are only aggregated if
+// their group has one.
+func (a *HeavyHitterAggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := a.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	info := a.child.SampleInfo()
+	probs := info.inclusionProbabilities(a.child.Descriptor())
+	scale, ok := info.ScaleFactor()
+	if !ok {
+		scale = 1
+	}
+
+	groups := make(map[any]*heavyHitter)
+	var counters heavyHitterHeap
+	for {
+		t, err := childIter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		group, err := a.groupOf(t)
+		if err != nil {
+			return nil, err
+		}
+		weight, p := scale, 1.0
+		if probs != nil {
+			if p, err = probs(t); err != nil {
+				return nil, err
+			}
+			weight = 1 / p
+		}
+
+		key := group.tupleKey()
+		hh, ok := groups[key]
+		counted := a.newAggState[a.rank].(*CountAggState).counts(t)
+		if !counted {
+			weight = 0
+		}
+		switch {
+		case !ok && !counted && len(counters) >= a.counters:
+			continue
+		case ok:
+			hh.count += weight
+		case len(counters) < a.counters:
+			hh = &heavyHitter{group: group, count: weight}
+			heap.Push(&counters, hh)
+			groups[key] = hh
+		default:
+			// take over the smallest counter
+			hh = counters[0]
+			delete(groups, hh.group.tupleKey())
+			hh.group, hh.err, hh.states = group, hh.count, nil
+			hh.count += weight
+			groups[key] = hh
+		}
+		heap.Fix(&counters, hh.index)
+
+		if hh.states == nil {
+			for _, as := range a.newAggState {
+				hh.states = append(hh.states, as.Copy())
+			}
+		}
+		for _, state := range hh.states {
+			if probs != nil {
+				addSampledTuple(state, t, p)
+			} else {
+				state.AddTuple(t)
+			}
+		}
+	}
+
+	top := []*heavyHitter(counters)
+	sort.SliceStable(top, func(i, j int) bool { return top[i].count > top[j].count })
+	if len(top) > a.k {
+		top = top[:a.k]
+	}
+	i := 0
+	return func() (*Tuple, error) {
+		if i == len(top) {
+			return nil, nil
+		}
+		hh := top[i]
+		i++
+		tup := hh.group
+		for j, state := range hh.states {
+			aggTup := state.Finalize(info)
+			if j == a.rank {
+				aggTup = &Tuple{aggTup.Desc, []DBValue{IntField{int64(math.Round(hh.count))}}, nil}
+			}
+			tup = joinTuples(tup, aggTup)
+		}
+		return &Tuple{*a.desc, append(tup.Fields, FloatField{hh.err}), nil}, nil
+	}, nil
+}
+
+// Plan a heavy hitter aggregation for a query whose top operator is a grouped
+// [Aggregator] (possibly under a projection) that is sorted by orderBy in
+// descending order and limited to the first limit tuples, if orderBy is a
+// COUNT of the aggregation and the aggregation's input is a sample or hinted
+// is set (see [heavyHittersHint]), returning the plan with the heavy hitter
+// aggregation in place of the Aggregator and the error bound of the count
+// added to the projection. Returns nil if the query is planned as usual.
+func planHeavyHitters(topOp *OperatorCard, orderBy Expr, limit int, hinted bool) (*OperatorCard, error) {
+	if HeavyHitterCounters <= 0 || limit <= 0 || limit > HeavyHitterCounters {
+		return nil, nil
+	}
+	field, ok := orderBy.(*FieldExpr)
+	if !ok {
+		return nil, nil
+	}
+	project, _ := topOp.Op.(*Project)
+	aggOp := topOp
+	if project != nil {
+		if project.distinct {
+			return nil, nil
+		}
+		// find the aggregate the projection outputs as the ORDER BY field
+		var aggField *FieldExpr
+		for i, name := range project.outputNames {
+			if name == field.selectField.Fname {
+				aggField, _ = project.selectFields[i].(*FieldExpr)
+				break
+			}
+		}
+		if aggField == nil {
+			return nil, nil
+		}
+		field = aggField
+		aggOp, ok = project.child.(*OperatorCard)
+		if !ok {
+			return nil, nil
+		}
+	}
+	agg, ok := aggOp.Op.(*Aggregator)
+	if !ok || len(agg.groupByFields) == 0 || !hinted && !agg.child.SampleInfo().IsSample() {
+		return nil, nil
+	}
+	rank := -1
+	for i, as := range agg.newAggState {
+		if _, ok := as.(*CountAggState); ok && as.GetTupleDesc().Fields[0].Fname == field.selectField.Fname {
+			rank = i
+		}
+	}
+	if rank < 0 {
+		return nil, nil
+	}
+
+	hh, err := NewHeavyHitterAggregator(agg.newAggState, agg.groupByFields, rank, limit, HeavyHitterCounters, agg.child)
+	if err != nil {
+		return nil, err
+	}
+	newOp := NewOperatorCard(hh, limit)
+	if project == nil {
+		return newOp, nil
+	}
+	bound := hh.boundField()
+	exprs := append(append([]Expr{}, project.selectFields...), &FieldExpr{bound})
+	names := append(append([]string{}, project.outputNames...), bound.Fname)
+	projOp, err := NewProjectOp(exprs, names, false, newOp)
+	if err != nil {
+		return nil, err
+	}
+	return NewOperatorCard(projOp, limit), nil
+}
@@ -0,0 +1,117 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestHeavyHitterAggregator(t *testing.T) {
+	// groups 0 to 9 appear in proportion to 1 to 10 in every other tuple,
+	// and every other tuple is in a group of its own
+	key := func(i int) int64 {
+		if i%2 == 1 {
+			return int64(1000 + i)
+		}
+		j := (i / 2) % 55
+		g := 0
+		for (g+1)*(g+2)/2 <= j {
+			g++
+		}
+		return int64(g)
+	}
+	n := 4000
+	hf, _, bp, tid := makeJoinTestFiles(t, n, key, 0, key)
+	defer bp.CommitTransaction(tid)
+	counts := make(map[int64]int64)
+	for i := 0; i < n; i++ {
+		counts[key(i)]++
+	}
+
+	age := &FieldExpr{FieldType{"age", "l", IntType}}
+	cnt, total := &CountAggState{}, &SumAggState{}
+	cnt.Init("cnt", age)
+	total.Init("sum", age)
+	hh, err := NewHeavyHitterAggregator([]AggState{total, cnt}, []Expr{age}, 1, 3, 50, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(hh.Descriptor().Fields) != 4 {
+		t.Fatalf("expected the group, 2 aggregates and the bound, got %v", hh.Descriptor())
+	}
+	iter, err := hh.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var groups []int64
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		g := tup.Fields[0].(IntField).Value
+		groups = append(groups, g)
+		est := tup.Fields[2].(IntField).Value
+		bound := tup.Fields[3].(FloatField).Value
+		if est < counts[g] || float64(est) > float64(counts[g])+bound {
+			t.Errorf("expected the count of group %d to be between %d and %d + %v, got %d", g, counts[g], counts[g], bound, est)
+		}
+		if bound > float64(n)/50 {
+			t.Errorf("expected the error of group %d to be at most %v, got %v", g, float64(n)/50, bound)
+		}
+	}
+	if len(groups) != 3 || groups[0] != 9 || groups[1] != 8 || groups[2] != 7 {
+		t.Errorf("expected the top groups 9, 8 and 7, got %v", groups)
+	}
+
+	if _, err := NewHeavyHitterAggregator([]AggState{total, cnt}, []Expr{age}, 0, 3, 50, hf); err == nil {
+		t.Errorf("expected an error ranking groups by SUM")
+	}
+	if _, err := NewHeavyHitterAggregator([]AggState{cnt}, []Expr{age}, 0, 10, 5, hf); err == nil {
+		t.Errorf("expected an error with fewer counters than groups to output")
+	}
+}
+
+func TestParseHeavyHitters(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	defer func(counters int) { HeavyHitterCounters = counters }(HeavyHitterCounters)
+	for _, sql := range []string{
+		"select /*+ heavy_hitters */ name, count(*) as n from t group by name order by n desc limit 3",
+		// tuples with a NULL argument don't count
+		"select /*+ heavy_hitters */ name, count(case when age > 40 then age end) as n from t group by name order by n desc limit 3",
+	} {
+		HeavyHitterCounters = 0
+		exact := runHavingQuery(t, bp, c, sql)
+
+		HeavyHitterCounters = 10000
+		tups := runHavingQuery(t, bp, c, sql)
+		if len(tups) != len(exact) {
+			t.Fatalf("q=%s: expected %d groups, got %v", sql, len(exact), tups)
+		}
+		for i, tup := range tups {
+			if len(tup.Fields) != 3 {
+				t.Fatalf("q=%s: expected the name, count and error bound, got %v", sql, tup)
+			}
+			// with fewer groups than counters, the counts are exact
+			if tup.Fields[1] != exact[i].Fields[1] || tup.Fields[2] != (FloatField{0}) {
+				t.Errorf("q=%s: expected count %v with no error, got %v", sql, exact[i].Fields[1], tup)
+			}
+		}
+	}
+
+	// other orders, and exact tables without the hint, are aggregated as
+	// usual
+	for _, sql := range []string{
+		"select /*+ heavy_hitters */ name, count(*) as n from t group by name order by n limit 3",
+		"select /*+ heavy_hitters */ name, sum(age) as s from t group by name order by s desc limit 3",
+		"select name, count(*) as n from t group by name order by n desc limit 3",
+	} {
+		if tups := runHavingQuery(t, bp, c, sql); len(tups) == 0 || len(tups[0].Fields) != 2 {
+			t.Errorf("q=%s: expected the usual results, got %v", sql, tups)
+		}
+	}
+}
@@ -24,8 +24,8 @@ func NewInsertOp(insertFile DBFile, child Operator) *InsertOp {
 	return &InsertOp{insertFile, child}
 }
 
-func (i *InsertOp) Statistics() map[string]map[string]float64 {
-	return i.child.Statistics()
+func (i *InsertOp) SampleInfo() *SampleInfo {
+	return i.child.SampleInfo()
 }
 
 // The insert TupleDesc is a one column descriptor with an integer field named "count"
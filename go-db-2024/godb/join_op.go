@@ -11,6 +11,96 @@ func DebugJoin(format string, a ...any) (int, error) {
 	return 0, nil
 }
 
+// The kinds of joins supported by the join operators. Semi and anti joins
+// return only the fields of the left input.
+type JoinType int
+
+const (
+	InnerJoin      JoinType = iota
+	LeftOuterJoin  JoinType = iota // unmatched left tuples are padded with NULLs
+	RightOuterJoin JoinType = iota // unmatched right tuples are padded with NULLs
+	FullOuterJoin  JoinType = iota // unmatched tuples on either side are padded with NULLs
+	SemiJoin       JoinType = iota // left tuples with at least one match
+	AntiJoin       JoinType = iota // left tuples with no match
+	SingleJoin     JoinType = iota // a left outer join where left tuples may match at most once
+)
+
+func (jt JoinType) String() string {
+	switch jt {
+	case InnerJoin:
+		return "inner"
+	case LeftOuterJoin:
+		return "left outer"
+	case RightOuterJoin:
+		return "right outer"
+	case FullOuterJoin:
+		return "full outer"
+	case SemiJoin:
+		return "semi"
+	case AntiJoin:
+		return "anti"
+	case SingleJoin:
+		return "single"
+	}
+	return "unknown"
+}
+
+// Whether unmatched left (build side) tuples are output.
+func (jt JoinType) keepsUnmatchedLeft() bool {
+	return jt == LeftOuterJoin || jt == FullOuterJoin || jt == AntiJoin || jt == SingleJoin
+}
+
+// Whether unmatched right tuples are output.
+func (jt JoinType) keepsUnmatchedRight() bool {
+	return jt == RightOuterJoin || jt == FullOuterJoin
+}
+
+// Whether the join only outputs the left input's fields.
+func (jt JoinType) leftOnly() bool {
+	return jt == SemiJoin || jt == AntiJoin
+}
+
+// Return an error if a left tuple that already matched matches again in a
+// join of type jt; a single join computes a scalar subquery for each left
+// tuple, which may only return one row.
+func checkSingleMatch(jt JoinType, alreadyMatched bool) error {
+	if jt == SingleJoin && alreadyMatched {
+		return GoDBError{IllegalOperationError, "scalar subquery returned more than one row"}
+	}
+	return nil
+}
+
+// Check whether the joined tuple satisfies every join condition. Conditions
+// are predicates (see [CompareExpr]) evaluated on the joined tuple, so they
+// may refer to fields of either input.
+func evalJoinConditions(conds []Expr, t *Tuple) (bool, error) {
+	for _, cond := range conds {
+		ok, err := evalPredicate(cond, t)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Make a tuple with the given descriptor where every field is NULL, used to
+// pad the missing side of an outer join.
+func nullTuple(desc *TupleDesc) *Tuple {
+	fields := make([]DBValue, len(desc.Fields))
+	for i := range fields {
+		fields[i] = NullField{}
+	}
+	return &Tuple{*desc.copy(), fields, nil}
+}
+
+// Descriptor of the output of a join of type jt between left and right.
+func joinDescriptor(left, right *TupleDesc, jt JoinType) *TupleDesc {
+	if jt.leftOnly() {
+		return left.copy()
+	}
+	return left.merge(right)
+}
+
 type EqualityJoin struct {
 	// Expressions that when applied to tuples from the left or right operators,
 	// respectively, return the value of the left or right side of the join
@@ -39,24 +129,8 @@ func (hj *EqualityJoin) Descriptor() *TupleDesc {
 	return (*hj.left).Descriptor().merge((*hj.right).Descriptor())
 }
 
-func (hj *EqualityJoin) Statistics() map[string]map[string]float64 {
-	return make(map[string]map[string]float64)
-	// leftStat := (*hj.left).Statistics()
-	// rightStat := (*hj.right).Statistics()
-	// overallStat := make(map[string]map[string]float64)
-	// for k, v := range leftStat {
-	// 	overallStat[k] = make(map[string]float64)
-	// 	for k2, v2 := range v {
-	// 		overallStat[k][k2] = v2
-	// 	}
-	// }
-	// for k, v := range rightStat {
-	// 	overallStat[k] = make(map[string]float64)
-	// 	for k2, v2 := range v {
-	// 		overallStat[k][k2] = v2
-	// 	}
-	// }
-	// return overallStat
+func (hj *EqualityJoin) SampleInfo() *SampleInfo {
+	return nil
 }
 
 // Join operator implementation. This function should iterate over the results
@@ -3,6 +3,7 @@ package godb
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -307,3 +308,169 @@ func TestJoinTupleNil(t *testing.T) {
 		t.Fatalf("Unexpected output of joinTuple with nil")
 	}
 }
+
+func TestChooseJoinAlgorithm(t *testing.T) {
+	defer func(budget int) { JoinMemoryBudget = budget }(JoinMemoryBudget)
+	JoinMemoryBudget = 100
+
+	if alg := chooseJoinAlgorithm(10, false, false); alg != BlockHashJoin {
+		t.Errorf("expected in memory hash join for small input, got %v", alg)
+	}
+	if alg := chooseJoinAlgorithm(1000, false, false); alg != GraceJoin {
+		t.Errorf("expected grace hash join for large input, got %v", alg)
+	}
+	if alg := chooseJoinAlgorithm(-1, false, false); alg != GraceJoin {
+		t.Errorf("expected grace hash join for unknown input size, got %v", alg)
+	}
+	if alg := chooseJoinAlgorithm(1000, true, true); alg != MergeJoin {
+		t.Errorf("expected sort-merge join for sorted inputs, got %v", alg)
+	}
+	if alg, err := ParseJoinAlgorithm("Merge"); err != nil || alg != MergeJoin {
+		t.Errorf("failed to parse join algorithm name, got %v %v", alg, err)
+	}
+}
+
+func TestParseJoinAlgorithms(t *testing.T) {
+	defer func(budget int, alg JoinAlgorithm) {
+		JoinMemoryBudget = budget
+		PreferredJoinAlgorithm = alg
+	}(JoinMemoryBudget, PreferredJoinAlgorithm)
+	JoinMemoryBudget = 5
+
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	sql := "select t.name, t.age, t2.age from t join t2 on t.name = t2.name where t.age < 50"
+
+	counts := make(map[JoinAlgorithm]int)
+	for _, alg := range []JoinAlgorithm{BlockHashJoin, GraceJoin, MergeJoin} {
+		PreferredJoinAlgorithm = alg
+		tid := BeginTransactionForTest(t, bp)
+		_, _, plan, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+		}
+
+		var plainText strings.Builder
+		OutputPhysicalPlan(func(format string, a ...any) { fmt.Fprintf(&plainText, format, a...) }, plan, "")
+		expected := map[JoinAlgorithm]string{BlockHashJoin: "Join,", GraceJoin: "Grace Hash Join,", MergeJoin: "Sort Merge Join,"}[alg]
+		if !strings.Contains(plainText.String(), expected) {
+			t.Errorf("expected %v join in plan, got:\n%s", alg, plainText.String())
+		}
+
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if tup == nil {
+				break
+			}
+			counts[alg]++
+		}
+		bp.CommitTransaction(tid)
+	}
+
+	if counts[BlockHashJoin] == 0 {
+		t.Fatalf("expected join results")
+	}
+	if counts[GraceJoin] != counts[BlockHashJoin] || counts[MergeJoin] != counts[BlockHashJoin] {
+		t.Errorf("join algorithms disagree on result size: %v", counts)
+	}
+}
+
+func TestParseOuterAndThetaJoins(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql         string
+		rows, nulls int
+	}{
+		{"select t.name, t2.name from t join t2 on t.name = t2.name", 16, 0},
+		{"select t.name, t2.name from t straight_join t2 on t.name = t2.name", 16, 0},
+		{"select t.name, t2.name from t join t2 on t.name = t2.name and t.age = t2.age", 12, 0},
+		{"select t.name, t2.name from t join t2 on t.age < t2.age where t.name = 'mark'", 3, 0},
+		{"select t.name, t2.name from t, t2", 144, 0},
+		{"select t.name, t2.name from t cross join t2 where t.age > 90", 24, 0},
+		{"select t.name, t2.name from t left join t2 on t.name = t2.name and t2.age > 40", 12, 4},
+		{"select t.name, t2.name from t right join t2 on t.name = t2.name and t.age > 40", 12, 4},
+		{"select t.name, t2.name from t full outer join t2 on t.name = t2.name and t.age > 40 and t2.age > 40", 18, 12},
+		{"select t.name, t2.name from t left join t2 on t.name = t2.name and t2.age > 40 where t2.age > 50", 4, 0},
+		{"select t.name, t2.name from t left join t2 on t.age > t2.age where t.age < 25", 2, 2},
+	}
+
+	for _, q := range queries {
+		tid := BeginTransactionForTest(t, bp)
+		_, _, plan, err := Parse(c, q.sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", q.sql, err.Error())
+		}
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows, nulls := 0, 0
+		for {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if tup == nil {
+				break
+			}
+			rows++
+			for _, f := range tup.Fields {
+				if isNull(f) {
+					nulls++
+					break
+				}
+			}
+		}
+		bp.CommitTransaction(tid)
+		if rows != q.rows || nulls != q.nulls {
+			t.Errorf("q=%s: expected %d rows with %d NULLs, got %d rows with %d NULLs", q.sql, q.rows, q.nulls, rows, nulls)
+		}
+	}
+}
+
+func TestParseOuterJoinCount(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	join := "from t left join t2 on t.name = t2.name and t2.age > 40"
+
+	// count the matches of each name by hand
+	rows := runHavingQuery(t, bp, c, "select t.name, t2.name "+join)
+	all, matched := make(map[string]int64), make(map[string]int64)
+	for _, tup := range rows {
+		name := tup.Fields[0].(StringField).Value
+		all[name]++
+		if !isNull(tup.Fields[1]) {
+			matched[name]++
+		}
+	}
+
+	// COUNT(*) counts the rows of unmatched names, COUNT(t2.name) doesn't
+	tups := runHavingQuery(t, bp, c, "select t.name, count(*) as n, count(t2.name) as m, max(t2.age) as a "+join+" group by t.name")
+	if len(tups) != len(all) {
+		t.Fatalf("expected %d groups, got %v", len(all), tups)
+	}
+	for _, tup := range tups {
+		name := tup.Fields[0].(StringField).Value
+		if tup.Fields[1] != (IntField{all[name]}) || tup.Fields[2] != (IntField{matched[name]}) {
+			t.Errorf("expected %s to have %d rows and %d matches, got %v", name, all[name], matched[name], tup)
+		}
+		if matched[name] == 0 && !isNull(tup.Fields[3]) {
+			t.Errorf("expected the MAX of no values to be NULL, got %v", tup)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package godb
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Estimate the cost of a join j given the cardinalities (card1, card2) and
 // estimated costs (cost1, cost2) of the left and right sides of the join,
 // respectively.
@@ -34,6 +39,8 @@ type JoinNode struct {
 
 	rightTable TableInfo
 	rightField string
+
+	cond *LogicalJoinNode // the join predicate this node was made from
 }
 
 // Given a list of joins, table statistics, and selectivities, return the best
@@ -50,3 +57,61 @@ func OrderJoins(joins []*JoinNode) ([]*JoinNode, error) {
 	return joins, nil
 }
 
+// Physical join algorithms the planner can pick from.
+type JoinAlgorithm int
+
+const (
+	AutoJoin      JoinAlgorithm = iota // let the planner decide
+	BlockHashJoin JoinAlgorithm = iota // in memory blocked hash join ([EqualityJoin])
+	GraceJoin     JoinAlgorithm = iota // hash join that spills partitions to disk ([GraceHashJoin])
+	MergeJoin     JoinAlgorithm = iota // sort-merge join ([SortMergeJoin])
+)
+
+var joinAlgorithmNames = map[JoinAlgorithm]string{
+	AutoJoin:      "auto",
+	BlockHashJoin: "hash",
+	GraceJoin:     "grace",
+	MergeJoin:     "merge",
+}
+
+func (a JoinAlgorithm) String() string {
+	return joinAlgorithmNames[a]
+}
+
+// Parse the name of a join algorithm, as printed by [JoinAlgorithm.String].
+func ParseJoinAlgorithm(name string) (JoinAlgorithm, error) {
+	for alg, algName := range joinAlgorithmNames {
+		if algName == strings.ToLower(name) {
+			return alg, nil
+		}
+	}
+	return AutoJoin, GoDBError{ParseError, fmt.Sprintf("unknown join algorithm %s", name)}
+}
+
+// Join algorithm used for every join in a query. AutoJoin picks per join with
+// [chooseJoinAlgorithm].
+var PreferredJoinAlgorithm = AutoJoin
+
+// Number of build side tuples a hash join may hold in memory before it has to
+// spill partitions to disk.
+var JoinMemoryBudget = 1000000
+
+// Pick a join algorithm given the estimated cardinality of the build (left)
+// side, and whether each input is already sorted on its join attribute. A
+// negative cardinality means no estimate is available.
+//
+// Inputs that are both sorted are merged directly. Otherwise we hash, using the
+// blocked in memory join only when the build side is known to fit in the
+// memory budget.
+func chooseJoinAlgorithm(leftCard int, leftSorted bool, rightSorted bool) JoinAlgorithm {
+	if PreferredJoinAlgorithm != AutoJoin {
+		return PreferredJoinAlgorithm
+	}
+	if leftSorted && rightSorted {
+		return MergeJoin
+	}
+	if leftCard < 0 || leftCard > JoinMemoryBudget {
+		return GraceJoin
+	}
+	return BlockHashJoin
+}
@@ -23,7 +23,7 @@ func DebugLimit(format string, a ...any) (int, error) {
 // Construct a new limit operator. lim is how many tuples to return and child is
 // the child operator.
 func NewLimitOp(lim Expr, child Operator) *LimitOp {
-	return &LimitOp{child, lim}
+	return &LimitOp{child: child, limitTups: lim}
 }
 
 // Return a TupleDescriptor for this limit.
@@ -32,8 +32,17 @@ func (l *LimitOp) Descriptor() *TupleDesc {
 	return l.child.Descriptor()
 }
 
-func (l *LimitOp) Statistics() map[string]map[string]float64 {
-	return l.child.Statistics()
+// A limit that may cut off some of the input makes the output no longer a
+// sample of the input's table, so aggregates above it shouldn't be scaled up.
+// Limits that depend on the tuples are assumed to cut off some of the input.
+func (l *LimitOp) SampleInfo() *SampleInfo {
+	info := l.child.SampleInfo()
+	if c, ok := l.limitTups.(*ConstExpr); ok {
+		if n, ok := c.val.(IntField); ok {
+			return info.limitedTo(n.Value)
+		}
+	}
+	return info.withoutSampling()
 }
 
 // Limit operator implementation. This function should iterate over the results
@@ -18,7 +18,7 @@ func (mp *MemPage) isDirty() bool {
 func (mp *MemPage) setDirty(tid TransactionID, dirty bool) {
 }
 
-func (mp *MemFile) Statistics() map[string]map[string]float64 {
+func (mp *MemFile) SampleInfo() *SampleInfo {
 	return nil
 }
 
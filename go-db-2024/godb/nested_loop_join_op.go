@@ -0,0 +1,187 @@
+package godb
+
+import "fmt"
+
+// A NestedLoopJoin joins every pair of tuples from its inputs that satisfies
+// an arbitrary list of conditions (a theta join), or every pair if there are
+// no conditions (a cross product). It supports every [JoinType].
+//
+// The left input is read in blocks of up to maxBufferSize tuples, and the
+// right input is scanned once per block.
+type NestedLoopJoin struct {
+	left, right *Operator
+
+	conditions []Expr
+
+	joinType JoinType
+
+	// The maximum number of left tuples buffered at once
+	maxBufferSize int
+}
+
+// Constructor for a nested loop join. Each condition is evaluated on the
+// joined tuple, so its expressions may refer to fields of either input.
+func NewNestedLoopJoin(left Operator, right Operator, conditions []Expr, joinType JoinType, maxBufferSize int) (*NestedLoopJoin, error) {
+	if maxBufferSize <= 0 {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("nested loop join needs a positive buffer size, got %v", maxBufferSize)}
+	}
+	return &NestedLoopJoin{&left, &right, conditions, joinType, maxBufferSize}, nil
+}
+
+func (nl *NestedLoopJoin) Descriptor() *TupleDesc {
+	return joinDescriptor((*nl.left).Descriptor(), (*nl.right).Descriptor(), nl.joinType)
+}
+
+func (nl *NestedLoopJoin) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// Join operator implementation. Unmatched right tuples of right and full outer
+// joins are remembered by their position in the right input, and returned
+// after the last block of the left input.
+func (nl *NestedLoopJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	leftDesc := (*nl.left).Descriptor()
+	rightDesc := (*nl.right).Descriptor()
+
+	leftIter, err := (*nl.left).Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+
+	var block []*hashJoinEntry
+	var rightIter func() (*Tuple, error)
+	rightPos := 0
+	// for right and full outer joins, which right tuples have matched so far
+	var rightMatched []bool
+	leftDone := false
+	finished := false
+
+	var pending []*Tuple
+
+	// read the next block of left tuples, returning false if there are none
+	nextBlock := func() (bool, error) {
+		if leftDone {
+			return false, nil
+		}
+		tuples, exhausted, err := bufferTuples(leftIter, nl.maxBufferSize)
+		if err != nil {
+			return false, err
+		}
+		leftDone = exhausted
+		if len(tuples) == 0 {
+			return false, nil
+		}
+		block = make([]*hashJoinEntry, len(tuples))
+		for i, t := range tuples {
+			block[i] = &hashJoinEntry{t, false}
+		}
+		rightIter, err = (*nl.right).Iterator(tid)
+		rightPos = 0
+		return true, err
+	}
+
+	// output the left tuples of the finished block that semi, anti and left
+	// outer joins return
+	finishBlock := func() {
+		for _, entry := range block {
+			switch {
+			case nl.joinType == SemiJoin && entry.matched:
+				pending = append(pending, entry.tuple)
+			case nl.joinType == AntiJoin && !entry.matched:
+				pending = append(pending, entry.tuple)
+			case nl.joinType.keepsUnmatchedLeft() && !nl.joinType.leftOnly() && !entry.matched:
+				pending = append(pending, joinTuples(entry.tuple, nullTuple(rightDesc)))
+			}
+		}
+		block = nil
+	}
+
+	// once every block is done, the right tuples that never matched
+	finishRight := func() error {
+		if !nl.joinType.keepsUnmatchedRight() {
+			return nil
+		}
+		iter, err := (*nl.right).Iterator(tid)
+		if err != nil {
+			return err
+		}
+		for pos := 0; ; pos++ {
+			t, err := iter()
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				return nil
+			}
+			if pos >= len(rightMatched) || !rightMatched[pos] {
+				pending = append(pending, joinTuples(nullTuple(leftDesc), t))
+			}
+		}
+	}
+
+	return func() (*Tuple, error) {
+		for {
+			if len(pending) > 0 {
+				t := pending[0]
+				pending = pending[1:]
+				return t, nil
+			}
+			if finished {
+				return nil, nil
+			}
+
+			if rightIter == nil {
+				more, err := nextBlock()
+				if err != nil {
+					return nil, err
+				}
+				if !more {
+					finished = true
+					if err := finishRight(); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			r, err := rightIter()
+			if err != nil {
+				return nil, err
+			}
+			if r == nil {
+				rightIter = nil
+				finishBlock()
+				continue
+			}
+
+			for _, entry := range block {
+				// a semi join only needs one match per left tuple
+				if nl.joinType.leftOnly() && entry.matched {
+					continue
+				}
+				joined := joinTuples(entry.tuple, r)
+				ok, err := evalJoinConditions(nl.conditions, joined)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+				if err := checkSingleMatch(nl.joinType, entry.matched); err != nil {
+					return nil, err
+				}
+				entry.matched = true
+				if nl.joinType.keepsUnmatchedRight() {
+					for len(rightMatched) <= rightPos {
+						rightMatched = append(rightMatched, false)
+					}
+					rightMatched[rightPos] = true
+				}
+				if !nl.joinType.leftOnly() {
+					pending = append(pending, joined)
+				}
+			}
+			rightPos++
+		}
+	}, nil
+}
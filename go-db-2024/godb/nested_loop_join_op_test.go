@@ -0,0 +1,59 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestNestedLoopJoinTypes(t *testing.T) {
+	hf1, hf2, _, tid := makeJoinTestFiles(t,
+		10, func(i int) int64 { return int64(i) },
+		10, func(i int) int64 { return int64(i) })
+
+	leftAge := FieldExpr{hf1.Descriptor().Fields[1]}
+	rightAge := FieldExpr{hf2.Descriptor().Fields[1]}
+	greater := []Expr{&CompareExpr{&leftAge, OpGt, &rightAge}}
+	tests := []struct {
+		joinType    JoinType
+		conditions  []Expr
+		rows, nulls int
+	}{
+		{InnerJoin, nil, 100, 0},
+		{InnerJoin, greater, 45, 0},
+		{LeftOuterJoin, greater, 46, 1},
+		{RightOuterJoin, greater, 46, 1},
+		{FullOuterJoin, greater, 47, 2},
+		{SemiJoin, greater, 9, 0},
+		{AntiJoin, greater, 1, 0},
+	}
+	// small blocks so that the left input is read in several passes
+	for _, maxBufferSize := range []int{100, 3} {
+		for _, test := range tests {
+			join, err := NewNestedLoopJoin(hf1, hf2, test.conditions, test.joinType, maxBufferSize)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			iter, err := join.Iterator(tid)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			nFields := 4
+			if test.joinType.leftOnly() {
+				nFields = 2
+			}
+			rows, nulls := countJoinTypeResults(t, iter, nFields)
+			if rows != test.rows || nulls != test.nulls {
+				t.Errorf("%v join with %d conditions, buffer %d: expected %d results with %d NULLs, got %d with %d",
+					test.joinType, len(test.conditions), maxBufferSize, test.rows, test.nulls, rows, nulls)
+			}
+		}
+	}
+}
+
+func TestNestedLoopJoinBadBuffer(t *testing.T) {
+	hf1, hf2, _, _ := makeJoinTestFiles(t,
+		1, func(i int) int64 { return 0 },
+		1, func(i int) int64 { return 0 })
+	if _, err := NewNestedLoopJoin(hf1, hf2, nil, InnerJoin, 0); err == nil {
+		t.Errorf("expected error for a nested loop join without a buffer")
+	}
+}
@@ -0,0 +1,155 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Online aggregation: operators that estimate COUNT, SUM and AVG aggregates
+// over joins from a growing random sample of the joined tables, outputting a
+// tuple of running estimates every [OnlineReportInterval] until they are
+// done (or, in the REPL, interrupted). Each tuple has the estimates, named
+// like the aggregation states they were made from, then the error bound of
+// each estimate (see [ErrorBounder]), then a measure of the operator's
+// progress. See [RippleJoin] and [WanderJoin].
+
+// How often online aggregation operators output their running estimates. With
+// 0, they are output after every step once there is enough of a sample to
+// estimate the error.
+var OnlineReportInterval = 500 * time.Millisecond
+
+// Implemented by the online aggregation operators.
+type onlineAggregator interface {
+	Operator
+	// Return the fields of the error bounds of the estimates, and of the
+	// progress of the operator.
+	boundFields() []FieldType
+}
+
+// The aggregates online aggregation operators can estimate.
+type onlineAggKind int
+
+const (
+	onlineCount onlineAggKind = iota
+	onlineSum   onlineAggKind = iota
+	onlineAvg   onlineAggKind = iota
+)
+
+// An aggregate estimated by an online aggregation operator.
+type onlineAgg struct {
+	kind  onlineAggKind
+	expr  Expr
+	field FieldType // the field of the estimate, as output by the aggregation state
+}
+
+// Return the aggregates of aggs (which must be COUNT, SUM or AVG states), and
+// the descriptor of the output of an online aggregation operator named name
+// that estimates them, with a final field named progress.
+func newOnlineAggs(name string, aggs []AggState, progress FieldType) ([]onlineAgg, *TupleDesc, error) {
+	var result []onlineAgg
+	var bounds []FieldType
+	desc := &TupleDesc{}
+	for _, as := range aggs {
+		var agg onlineAgg
+		switch a := as.(type) {
+		case *CountAggState:
+			agg = onlineAgg{onlineCount, a.expr, a.GetTupleDesc().Fields[0]}
+		case *SumAggState:
+			agg = onlineAgg{onlineSum, a.expr, a.GetTupleDesc().Fields[0]}
+		case *AvgAggState:
+			agg = onlineAgg{onlineAvg, a.expr, a.GetTupleDesc().Fields[0]}
+		default:
+			return nil, nil, GoDBError{IllegalOperationError, fmt.Sprintf("%ss can't estimate aggregate %T", name, as)}
+		}
+		if agg.kind != onlineCount && agg.field.Ftype == StringType {
+			return nil, nil, GoDBError{TypeMismatchError, fmt.Sprintf("%ss can't estimate aggregates of strings (%s)", name, agg.field.Fname)}
+		}
+		result = append(result, agg)
+		desc.Fields = append(desc.Fields, agg.field)
+		bounds = append(bounds, FieldType{fmt.Sprintf("bound(%s)", agg.field.Fname), "", FloatType})
+	}
+	desc.Fields = append(desc.Fields, bounds...)
+	desc.Fields = append(desc.Fields, progress)
+	return result, desc, nil
+}
+
+// Evaluate the aggregate's expression on a joined tuple, returning its value
+// and whether the tuple counts towards the aggregate: those whose values
+// aren't NULL, as for [CountAggState].
+func (agg onlineAgg) eval(t *Tuple) (float64, bool, error) {
+	v, err := agg.expr.EvalExpr(t)
+	if err != nil {
+		return 0, false, err
+	}
+	if agg.kind == onlineCount {
+		return 0, !isNull(v), nil
+	}
+	y, ok := numericValue(v)
+	return y, ok, nil
+}
+
+// Return the estimate of the aggregate given the estimates of the total of
+// its values and of the number of them.
+func (agg onlineAgg) estimate(sum, count float64) DBValue {
+	var est float64
+	switch agg.kind {
+	case onlineCount:
+		est = count
+	case onlineSum:
+		est = sum
+	case onlineAvg:
+		if count == 0 {
+			return NullField{}
+		}
+		est = sum / count
+		if agg.field.Ftype == IntType {
+			// integer averages are truncated, as by [AvgAggState]
+			return IntField{int64(est)}
+		}
+	}
+	if agg.field.Ftype == IntType {
+		return IntField{int64(math.Round(est))}
+	}
+	return FloatField{est}
+}
+
+// Find the heap file under a chain of filters, returning the predicates of
+// the filters, or nil if op isn't a filtered heap file.
+func filteredHeapFile(op Operator) (*HeapFile, []Expr) {
+	switch o := op.(type) {
+	case *OperatorCard:
+		return filteredHeapFile(o.Op)
+	case *Filter:
+		file, filters := filteredHeapFile(o.child)
+		if file == nil {
+			return nil, nil
+		}
+		return file, append(filters, o.pred)
+	case *HeapFile:
+		return o, nil
+	}
+	return nil, nil
+}
+
+// Return the heap file that an input of an online aggregation operator
+// named name reads, the predicates of the filters over it, and the number of
+// tuples of the table that each of its tuples stands for.
+//
+// Returns an error if op isn't a filtered heap file sampled with equal
+// probabilities.
+func onlineSource(name string, op Operator) (*HeapFile, []Expr, float64, error) {
+	file, filters := filteredHeapFile(op)
+	if file == nil {
+		return nil, nil, 0, GoDBError{IllegalOperationError, fmt.Sprintf("%ss can only read heap files", name)}
+	}
+	info := file.SampleInfo()
+	if info.IsSample() && (info.Outliers != nil || info.Measure != nil) {
+		return nil, nil, 0, GoDBError{IllegalOperationError, fmt.Sprintf("%ss need tables sampled with equal probabilities", name)}
+	}
+	scale, ok := info.ScaleFactor()
+	if !ok {
+		scale = 1
+	}
+	return file, filters, scale, nil
+}
@@ -1,7 +1,9 @@
 package godb
 
 import (
+	"container/heap"
 	"fmt"
+	"math"
 	"sort"
 )
 
@@ -11,8 +13,22 @@ type OrderBy struct {
 	// TODO: You may want to add additional fields here
 	ascending []bool
 	tuples    []*Tuple
+
+	// Used to spill sorted runs to temporary files once more than
+	// maxBufferSize tuples have been read; if nil, the sort is done entirely
+	// in memory
+	bufPool       *BufferPool
+	maxBufferSize int
+
+	// If non-negative, only the first limit tuples of the sorted output are
+	// needed (set by the parser when the OrderBy is under a LIMIT)
+	limit int
 }
 
+// The maximum number of tuples an OrderBy planned by the parser keeps in
+// memory before it writes out a sorted run.
+var SortMemoryBudget = 1000000
+
 var DEBUGORDER = false
 
 func DebugOrder(format string, a ...any) (int, error) {
@@ -32,11 +48,40 @@ func NewOrderBy(orderByFields []Expr, child Operator, ascending []bool) (*OrderB
 	if len(orderByFields) != len(ascending) {
 		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Got wrong lengths %v %v", len(orderByFields), len(ascending))}
 	}
-	return &OrderBy{orderByFields, child, ascending, nil}, nil
+	return &OrderBy{orderByFields, child, ascending, nil, nil, SortMemoryBudget, -1}, nil
+}
+
+// Construct an order by operator that sorts inputs larger than maxBufferSize
+// tuples with an external merge sort, writing sorted runs to temporary heap
+// files read back through bp.
+func NewExternalOrderBy(orderByFields []Expr, child Operator, ascending []bool, bp *BufferPool, maxBufferSize int) (*OrderBy, error) {
+	if maxBufferSize <= 0 {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("order by needs a positive buffer size, got %v", maxBufferSize)}
+	}
+	o, err := NewOrderBy(orderByFields, child, ascending)
+	if err != nil {
+		return nil, err
+	}
+	o.bufPool = bp
+	o.maxBufferSize = maxBufferSize
+	return o, nil
 }
 
-func (o *OrderBy) Statistics() map[string]map[string]float64 {
-	return o.child.Statistics()
+// Only produce the first n tuples of the sorted output. Instead of sorting
+// the whole input, the order by keeps the best n tuples seen so far in a heap,
+// unless n is more than the tuples it may keep in memory, in which case it
+// sorts the whole input (externally) and stops after n tuples.
+func (o *OrderBy) setLimit(n int) {
+	o.limit = n
+}
+
+// Sorting doesn't change the sample the input is drawn from, but only
+// producing the first few tuples does.
+func (o *OrderBy) SampleInfo() *SampleInfo {
+	if o.limit >= 0 {
+		return o.child.SampleInfo().limitedTo(int64(o.limit))
+	}
+	return o.child.SampleInfo()
 }
 
 // Return the tuple descriptor.
@@ -65,40 +110,52 @@ func (o *OrderBy) Swap(i, j int) {
 	o.tuples[i], o.tuples[j] = o.tuples[j], o.tuples[i]
 }
 
-// Less is part of sort.Interface. It is implemented by looping along the
-// less functions until it finds a comparison that discriminates between
-// the two items (one is less than the other). Note that it can call the
-// less functions twice per call. We could change the functions to return
-// -1, 0, 1 and reduce the number of calls for greater efficiency: an
-// exercise for the reader.
+// Less is part of sort.Interface.
 func (o *OrderBy) Less(i, j int) bool {
-	p, q := o.tuples[i], o.tuples[j]
-	// Try all but the last comparison.
-	var k int
-	for k = 0; k < len(o.orderBy); k++ {
+	order, err := o.compare(o.tuples[i], o.tuples[j])
+	if err != nil {
+		DebugOrder("Got error while sorting %v", err)
+	}
+	return order == OrderedLessThan
+}
+
+// Compare two tuples on the order by expressions, in output order. It is
+// implemented by looping along the expressions until it finds one that
+// discriminates between the two tuples. NULLs sort after every other value,
+// so they come last in ascending order and first in descending order.
+func (o *OrderBy) compare(p, q *Tuple) (orderByState, error) {
+	for k := 0; k < len(o.orderBy); k++ {
 		pValue, err := o.orderBy[k].EvalExpr(p)
 		if err != nil {
-			DebugOrder("Got error while sorting %v", err)
+			return OrderedEqual, err
 		}
 		qValue, err := o.orderBy[k].EvalExpr(q)
-		// DebugOrder("vals are %v \n %v \n %v %v %v %v \n\n\n", *p, *q, pValue, qValue, pValue.EvalPred(qValue, OpLt), pValue.EvalPred(qValue, OpGt))
 		if err != nil {
-			DebugOrder("Got error while sorting %v", err)
+			return OrderedEqual, err
 		}
 
-		if pValue.EvalPred(qValue, OpLt) {
-			// p < q, so we have a decision.
-			return o.ascending[k]
+		var cmp orderByState
+		switch {
+		case isNull(pValue) && isNull(qValue):
+			continue
+		case isNull(pValue):
+			cmp = OrderedGreaterThan
+		case isNull(qValue):
+			cmp = OrderedLessThan
+		case pValue.EvalPred(qValue, OpLt):
+			cmp = OrderedLessThan
+		case pValue.EvalPred(qValue, OpGt):
+			cmp = OrderedGreaterThan
+		default:
+			// p == q; try the next comparison.
+			continue
 		}
-
-		if pValue.EvalPred(qValue, OpGt) {
-			// p > q, so we have a decision.
-			return !o.ascending[k]
+		if !o.ascending[k] {
+			cmp = OrderedLessThan + OrderedGreaterThan - cmp
 		}
-		// p == q; try the next comparison.
+		return cmp, nil
 	}
-	// All comparisons to here said "equal", so just output true
-	return false
+	return OrderedEqual, nil
 }
 
 // Return a function that iterates through the results of the child iterator in
@@ -113,6 +170,12 @@ func (o *OrderBy) Less(i, j int) bool {
 // the sort algorithm will invoke to produce a sorted list. See the first
 // example, example of SortMultiKeys, and documentation at:
 // https://pkg.go.dev/sort
+//
+// If the input has more than maxBufferSize tuples and the order by has a
+// BufferPool, it is sorted with an external merge sort instead: each buffer
+// full of tuples is sorted and written out as a run, and the runs are then
+// merged. If the order by has a limit that fits in the buffer, only the best
+// limit tuples are kept.
 func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 	// TODO: some code goes here
 	DebugOrder("in order iterator")
@@ -124,46 +187,282 @@ func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 		return nil, GoDBError{MalformedDataError, "child iter unexpectedly nil"}
 	}
 
-	var tupleList []*Tuple
-	collectedTuples := false
+	// the child is only read once the first tuple is requested
+	var sortedIter func() (*Tuple, error)
+	return func() (*Tuple, error) {
+		if sortedIter == nil {
+			sortedIter, err = o.sortInput(childIter, tid)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return sortedIter()
+	}, nil
+}
+
+// Read all of the tuples from childIter and return an iterator over them in
+// sorted order.
+func (o *OrderBy) sortInput(childIter func() (*Tuple, error), tid TransactionID) (func() (*Tuple, error), error) {
+	if o.limit >= 0 && (o.bufPool == nil || o.limit <= o.maxBufferSize) {
+		return o.topNIterator(childIter)
+	}
+
+	bufferSize := o.maxBufferSize
+	if o.bufPool == nil {
+		// no way to spill, so keep everything in memory
+		bufferSize = math.MaxInt
+	}
+	var runs []*tempHeapFile
+	for {
+		// collect a buffer full of child tuples
+		tuples, exhausted, err := bufferTuples(childIter, bufferSize)
+		if err != nil {
+			closeTempFiles(runs)
+			return nil, err
+		}
+		DebugOrder("Sorting%v %v", o.orderBy, o.ascending)
+		o.Sort(tuples)
+		DebugOrder("Done sorting")
+		if exhausted && runs == nil {
+			// everything fit in memory
+			if o.limit >= 0 && len(tuples) > o.limit {
+				tuples = tuples[:o.limit]
+			}
+			return sliceIterator(tuples), nil
+		}
+		if len(tuples) > 0 {
+			run, err := o.writeRun(sliceIterator(tuples))
+			if err != nil {
+				closeTempFiles(runs)
+				return nil, err
+			}
+			runs = append(runs, run)
+		}
+		if exhausted {
+			return o.mergeRuns(runs, tid)
+		}
+	}
+}
+
+// Return an iterator over a slice of tuples.
+func sliceIterator(tuples []*Tuple) func() (*Tuple, error) {
 	i := -1
 	return func() (*Tuple, error) {
-		// for when we first process, loop back and start returning tups
-		for {
-			// we've already sorted everything, return tup
-			if collectedTuples {
-				i++
-				if i >= len(tupleList) {
-					return nil, nil
-				}
-				return tupleList[i], nil
+		i++
+		if i >= len(tuples) {
+			return nil, nil
+		}
+		return tuples[i], nil
+	}
+}
+
+// Write the (already sorted) tuples from iter to a new run.
+func (o *OrderBy) writeRun(iter func() (*Tuple, error)) (*tempHeapFile, error) {
+	run, err := newTempHeapFile(o.Descriptor(), o.bufPool)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := iter()
+		if err == nil && t == nil {
+			err = run.finish()
+			if err != nil {
+				break
 			}
+			DebugOrder("wrote sorted run of %d tuples", run.NumTuples())
+			return run, nil
+		}
+		if err == nil {
+			err = run.append(t)
+		}
+		if err != nil {
+			break
+		}
+	}
+	run.close()
+	return nil, err
+}
+
+// A heap of sorted runs being merged, ordered by the next tuple of each run.
+// Ties are broken by run number so that equal tuples keep their input order.
+type runHeap struct {
+	o     *OrderBy
+	heads []*runHead
+	err   error
+}
+
+type runHead struct {
+	tuple *Tuple
+	iter  func() (*Tuple, error)
+	run   int
+}
 
-			// iterates thru all child tuples, collect them all
-			for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
-				if err != nil {
-					return nil, err
-				}
-
-				// done going through the tuples
-				if t == nil {
-					collectedTuples = true
-					break
-				}
-				tupleList = append(tupleList, t)
+func (h *runHeap) Len() int { return len(h.heads) }
+
+func (h *runHeap) Less(i, j int) bool {
+	order, err := h.o.compare(h.heads[i].tuple, h.heads[j].tuple)
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	if order == OrderedEqual {
+		return h.heads[i].run < h.heads[j].run
+	}
+	return order == OrderedLessThan
+}
+
+func (h *runHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *runHeap) Push(x any) { h.heads = append(h.heads, x.(*runHead)) }
+
+func (h *runHeap) Pop() any {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// Return an iterator that merges the sorted runs. Each run being merged needs
+// a page in the BufferPool, so if there are too many runs to merge at once,
+// groups of them are first merged into longer runs. The runs are closed
+// once they have been read, or once the order by's limit has been output.
+func (o *OrderBy) mergeRuns(runs []*tempHeapFile, tid TransactionID) (func() (*Tuple, error), error) {
+	fanIn := max(2, o.bufPool.capacity/2)
+	for len(runs) > fanIn {
+		var merged []*tempHeapFile
+		for start := 0; start < len(runs); start += fanIn {
+			group := runs[start:min(start+fanIn, len(runs))]
+			iter, err := o.mergeIterator(group, tid)
+			var run *tempHeapFile
+			if err == nil {
+				run, err = o.writeRun(iter)
 			}
-			collectedTuples = true
-
-			// collected all the tups, now sort them
-			DebugOrder("Sorting%v %v", o.orderBy, o.ascending)
-			// for _, tup := range tupleList {
-			// 	DebugOrder("%v", *tup)
-			// }
-			o.Sort(tupleList)
-			DebugOrder("Done sorting")
-			// for _, tup := range tupleList {
-			// 	DebugOrder("%v", *tup)
-			// }
+			closeTempFiles(group)
+			if err != nil {
+				closeTempFiles(merged)
+				closeTempFiles(runs[start+len(group):])
+				return nil, err
+			}
+			merged = append(merged, run)
 		}
+		DebugOrder("merged %d runs into %d", len(runs), len(merged))
+		runs = merged
+	}
+
+	iter, err := o.mergeIterator(runs, tid)
+	if err != nil {
+		closeTempFiles(runs)
+		return nil, err
+	}
+	n := 0
+	return func() (*Tuple, error) {
+		if runs == nil {
+			return nil, nil
+		}
+		t, err := iter()
+		n++
+		if err != nil || t == nil || n == o.limit {
+			closeTempFiles(runs)
+			runs = nil
+		}
+		return t, err
 	}, nil
 }
+
+// Return an iterator over the merged contents of the sorted runs.
+func (o *OrderBy) mergeIterator(runs []*tempHeapFile, tid TransactionID) (func() (*Tuple, error), error) {
+	h := &runHeap{o: o}
+	for i, run := range runs {
+		iter, err := run.Iterator(tid)
+		if err != nil {
+			return nil, err
+		}
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			h.heads = append(h.heads, &runHead{t, iter, i})
+		}
+	}
+	heap.Init(h)
+	return func() (*Tuple, error) {
+		if h.err != nil {
+			return nil, h.err
+		}
+		if h.Len() == 0 {
+			return nil, nil
+		}
+		head := h.heads[0]
+		t := head.tuple
+		next, err := head.iter()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			heap.Pop(h)
+		} else {
+			head.tuple = next
+			heap.Fix(h, 0)
+		}
+		return t, h.err
+	}, nil
+}
+
+// A heap of the best tuples seen so far by a top-n order by, with the worst
+// of them on top so it can be replaced when a better tuple shows up.
+type topNHeap struct {
+	o      *OrderBy
+	tuples []*Tuple
+	err    error
+}
+
+func (h *topNHeap) Len() int { return len(h.tuples) }
+
+func (h *topNHeap) Less(i, j int) bool {
+	order, err := h.o.compare(h.tuples[i], h.tuples[j])
+	if err != nil && h.err == nil {
+		h.err = err
+	}
+	return order == OrderedGreaterThan
+}
+
+func (h *topNHeap) Swap(i, j int) { h.tuples[i], h.tuples[j] = h.tuples[j], h.tuples[i] }
+
+func (h *topNHeap) Push(x any) { h.tuples = append(h.tuples, x.(*Tuple)) }
+
+func (h *topNHeap) Pop() any {
+	last := h.tuples[len(h.tuples)-1]
+	h.tuples = h.tuples[:len(h.tuples)-1]
+	return last
+}
+
+// Return an iterator over the first o.limit tuples of the sorted output of
+// childIter, keeping only that many tuples in memory.
+func (o *OrderBy) topNIterator(childIter func() (*Tuple, error)) (func() (*Tuple, error), error) {
+	h := &topNHeap{o: o}
+	for o.limit > 0 {
+		t, err := childIter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		if h.Len() < o.limit {
+			heap.Push(h, t)
+		} else {
+			order, err := o.compare(t, h.tuples[0])
+			if err != nil {
+				return nil, err
+			}
+			if order == OrderedLessThan {
+				h.tuples[0] = t
+				heap.Fix(h, 0)
+			}
+		}
+		if h.err != nil {
+			return nil, h.err
+		}
+	}
+	o.Sort(h.tuples)
+	return sliceIterator(h.tuples), nil
+}
@@ -1,7 +1,10 @@
 package godb
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -232,3 +235,207 @@ func TestOrderByFieldsOrder(t *testing.T) {
 		t.Fatalf("Unexpected descriptor of ordered tuple")
 	}
 }
+
+// Drain iter and check that the ages (field 1) come out in ascending order,
+// returning them.
+func checkAgesSorted(t *testing.T, iter func() (*Tuple, error)) []int64 {
+	var ages []int64
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		age := tup.Fields[1].(IntField).Value
+		if len(ages) > 0 && age < ages[len(ages)-1] {
+			t.Fatalf("order by returned %d after %d", age, ages[len(ages)-1])
+		}
+		ages = append(ages, age)
+	}
+	return ages
+}
+
+func TestExternalOrderBy(t *testing.T) {
+	hf, _, _, tid := makeJoinTestFiles(t,
+		2000, func(i int) int64 { return int64((i * 7919) % 1009) },
+		0, func(i int) int64 { return 0 })
+
+	// a small buffer pool, so the runs have to be merged in several passes
+	bp, err := NewBufferPool(6)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	age := FieldExpr{hf.Descriptor().Fields[1]}
+	oby, err := NewExternalOrderBy([]Expr{&age}, hf, []bool{true}, bp, 50)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := oby.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ages := checkAgesSorted(t, iter); len(ages) != 2000 {
+		t.Errorf("expected 2000 sorted tuples, got %d", len(ages))
+	}
+	checkNoSpillPages(t, bp)
+}
+
+func spillFiles(t *testing.T) []string {
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), "godb-spill-*"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return matches
+}
+
+// Check that an error merging runs closes every run, whether it hits the
+// first group of runs or a later one, by cutting one of the runs short.
+func TestExternalOrderByMergeError(t *testing.T) {
+	hf, _, _, tid := makeJoinTestFiles(t, 0, nil, 0, nil)
+
+	// fanIn is 3, so 7 runs are merged in groups of 3, 3 and 1
+	bp, err := NewBufferPool(6)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	age := FieldExpr{hf.Descriptor().Fields[1]}
+	oby, err := NewExternalOrderBy([]Expr{&age}, hf, []bool{true}, bp, 50)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	before := spillFiles(t)
+	for _, bad := range []int{0, 4} {
+		var runs []*tempHeapFile
+		for i := 0; i < 7; i++ {
+			run, err := newTempHeapFile(hf.Descriptor(), bp)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			runs = append(runs, run)
+			for j := 0; j < 10; j++ {
+				tup := Tuple{*hf.Descriptor(), []DBValue{StringField{"run"}, IntField{int64(j)}}, nil}
+				if err := run.append(&tup); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			if err := run.finish(); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		if err := os.Truncate(runs[bad].fileName, 10); err != nil {
+			t.Fatalf(err.Error())
+		}
+		names := make([]string, len(runs))
+		for i, run := range runs {
+			names[i] = run.fileName
+		}
+
+		if _, err := oby.mergeRuns(runs, tid); err == nil {
+			t.Fatalf("expected an error merging runs with run %d cut short", bad)
+		}
+		for _, name := range names {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("run %s was not removed after run %d failed to merge", name, bad)
+			}
+		}
+		if after := spillFiles(t); len(after) != len(before) {
+			t.Errorf("temporary files %v left after run %d failed to merge, had %v", after, bad, before)
+		}
+		checkNoSpillPages(t, bp)
+	}
+}
+
+func TestOrderByTopN(t *testing.T) {
+	hf, _, bp, tid := makeJoinTestFiles(t,
+		500, func(i int) int64 { return int64((i * 7919) % 101) },
+		0, func(i int) int64 { return 0 })
+
+	age := FieldExpr{hf.Descriptor().Fields[1]}
+	full, err := NewOrderBy([]Expr{&age}, hf, []bool{true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := full.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	allAges := checkAgesSorted(t, iter)
+
+	// (limits over the buffer size of 50 fall back to an external sort)
+	for _, n := range []int{0, 10, 100, 1000} {
+		top, err := NewExternalOrderBy([]Expr{&age}, hf, []bool{true}, bp, 50)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		top.setLimit(n)
+		iter, err := top.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ages := checkAgesSorted(t, iter)
+		if len(ages) != min(n, len(allAges)) {
+			t.Fatalf("expected %d tuples from top %d, got %d", min(n, len(allAges)), n, len(ages))
+		}
+		for i := range ages {
+			if ages[i] != allAges[i] {
+				t.Errorf("top %d tuple %d is %d, expected %d", n, i, ages[i], allAges[i])
+			}
+		}
+	}
+	checkNoSpillPages(t, bp)
+}
+
+func TestOrderByNulls(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "a", Ftype: IntType}}}
+	tuples := []*Tuple{
+		{td, []DBValue{IntField{2}}, nil},
+		{td, []DBValue{NullField{}}, nil},
+		{td, []DBValue{IntField{1}}, nil},
+	}
+	a := FieldExpr{td.Fields[0]}
+	for _, asc := range []bool{true, false} {
+		oby, err := NewOrderBy([]Expr{&a}, nil, []bool{asc})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sorted := append([]*Tuple{}, tuples...)
+		oby.Sort(sorted)
+		nullPos := 2
+		if !asc {
+			nullPos = 0
+		}
+		if !isNull(sorted[nullPos].Fields[0]) {
+			t.Errorf("expected NULL at position %d with ascending=%v, got %v", nullPos, asc, sorted)
+		}
+	}
+}
+
+func TestParseOrderByLimit(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	sql := "select t.name, t.age from t order by t.age limit 3"
+	_, _, plan, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+	}
+	var planText strings.Builder
+	OutputPhysicalPlan(func(format string, a ...any) { fmt.Fprintf(&planText, format, a...) }, plan, "")
+	if !strings.Contains(planText.String(), "top 3") {
+		t.Errorf("expected a top 3 order by in plan, got:\n%s", planText.String())
+	}
+
+	tid := BeginTransactionForTest(t, bp)
+	iter, err := plan.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ages := checkAgesSorted(t, iter)
+	if len(ages) != 3 || ages[0] != 22 || ages[1] != 22 || ages[2] != 25 {
+		t.Errorf("expected ages [22 22 25], got %v", ages)
+	}
+	bp.CommitTransaction(tid)
+}
@@ -0,0 +1,122 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Return the checksum of page pageNo of a heap file, serialized in data: the
+// CRC32C of the page after its checksum field, and of its page number.
+func pageChecksum(data []byte, pageNo int) uint32 {
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(pageNo))
+	return crc32.Update(crc32.Checksum(data[4:], castagnoliTable), castagnoliTable, n[:])
+}
+
+// Return a CorruptPageError unless data is page pageNo of a heap file as
+// written whole by [heapPage.toBuffer]. A page of zeros is a page that was
+// added to the heap file but never written (as when a later page was flushed
+// first), which reads as an empty page.
+func checkPage(data []byte, pageNo int) error {
+	if len(data) != PageSize {
+		return GoDBError{CorruptPageError, fmt.Sprintf("page %d has only %d of %d bytes", pageNo, len(data), PageSize)}
+	}
+	header := heapPageHeader{
+		Checksum: binary.LittleEndian.Uint32(data),
+		Version:  data[4],
+	}
+	if header.Version == 0 && allZero(data) {
+		return nil
+	}
+	if header.Version != heapPageVersion {
+		return GoDBError{CorruptPageError, fmt.Sprintf("page %d has unsupported version %d", pageNo, header.Version)}
+	}
+	if sum := pageChecksum(data, pageNo); sum != header.Checksum {
+		return GoDBError{CorruptPageError, fmt.Sprintf("page %d has checksum %08x, but its contents have checksum %08x", pageNo, header.Checksum, sum)}
+	}
+	return nil
+}
+
+// The size of the header of the heap pages written by versions of GoDB before
+// pages had checksums: an int32 with the number of slots of the page and one
+// with the number of used slots, in LittleEndian order.
+const legacyHeaderSize = 8
+
+// Return the number of used slots of data if it is a heap page written by a
+// version of GoDB before pages had checksums for tuples of tupleSize bytes:
+// one whose header has the number of slots of such a page, and at most that
+// many used slots.
+func legacyPageUsedSlots(data []byte, tupleSize int) (int, bool) {
+	if len(data) != PageSize || tupleSize <= 0 {
+		return 0, false
+	}
+	numSlots := int32(binary.LittleEndian.Uint32(data))
+	used := int32(binary.LittleEndian.Uint32(data[4:]))
+	if int(numSlots) != (PageSize-legacyHeaderSize)/tupleSize || used < 0 || used > numSlots {
+		return 0, false
+	}
+	return int(used), true
+}
+
+// Check page pageNo of the heap file as read from its backing file (see
+// [checkPage]), returning whether it is in the format of an earlier version
+// of GoDB (see [legacyPageUsedSlots]). Such pages are read, and written back
+// in the current format, if their tuples fit in a page of the current format;
+// otherwise reading them is a CorruptPageError asking for the table to be
+// reloaded.
+func (f *HeapFile) checkStoredPage(data []byte, pageNo int) (bool, error) {
+	err := checkPage(data, pageNo)
+	if err == nil {
+		return false, nil
+	}
+	used, ok := legacyPageUsedSlots(data, f.tupleSize)
+	if !ok {
+		return false, err
+	}
+	if used > f.numSlots {
+		return true, GoDBError{CorruptPageError, fmt.Sprintf("page %d is in the format of an earlier version of GoDB, with %d tuples where only %d fit now; reload the table", pageNo, used, f.numSlots)}
+	}
+	return true, nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A page of a heap file that fails [checkPage], and why.
+type CorruptPage struct {
+	PageNo int
+	Err    error
+}
+
+// Read every page of the heap file from its backing file, including a page
+// left incomplete at its end, and return the pages that are corrupt (see
+// [HeapFile.checkStoredPage]). Pages cached in the buffer pool are not
+// consulted: this checks what would be read after a restart.
+func (f *HeapFile) CheckPages() ([]CorruptPage, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var corrupt []CorruptPage
+	data := make([]byte, PageSize)
+	for pageNo := 0; int64(pageNo)*int64(PageSize) < info.Size(); pageNo++ {
+		n, err := f.file.ReadAt(data, int64(pageNo)*int64(PageSize))
+		if err != nil && err != io.EOF {
+			return corrupt, err
+		}
+		if _, err := f.checkStoredPage(data[:n], pageNo); err != nil {
+			corrupt = append(corrupt, CorruptPage{pageNo, err})
+		}
+	}
+	return corrupt, nil
+}
@@ -0,0 +1,229 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestCheckPages(t *testing.T) {
+	bp, hf := makeTestFile(t, 10)
+	td, t1, _ := makeTupleTestVars()
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for i := 0; i < 3*hf.numSlots; i++ {
+		if err := hf.insertTuple(&t1, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	bp.FlushAllPages()
+
+	corrupt, err := hf.CheckPages()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(corrupt) != 0 {
+		t.Fatalf("expected no corrupt pages, got %v", corrupt)
+	}
+
+	// rewriting a page raises its LSN
+	page, err := hf.readPage(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	lsn := page.(*heapPage).LSN
+	if err := hf.flushPage(page); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if page, err = hf.readPage(1); err != nil || page.(*heapPage).LSN <= lsn {
+		t.Errorf("expected the LSN of the rewritten page to be more than %d, got %v (%v)", lsn, page, err)
+	}
+
+	// flip a byte of a tuple of page 1, and leave half a page at the end,
+	// as when a write is interrupted
+	file, err := os.OpenFile(TestingFile, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	file.ReadAt(b, int64(PageSize+HeaderSize+1))
+	b[0] ^= 0xff
+	file.WriteAt(b, int64(PageSize+HeaderSize+1))
+	file.WriteAt(make([]byte, PageSize/2), int64(3*PageSize))
+	file.WriteAt([]byte{heapPageVersion}, int64(3*PageSize+4))
+
+	corrupt, err = hf.CheckPages()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(corrupt) != 2 || corrupt[0].PageNo != 1 || corrupt[1].PageNo != 3 {
+		t.Fatalf("expected pages 1 and 3 to be corrupt, got %v", corrupt)
+	}
+
+	bp2, err := NewBufferPool(10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf2, err := NewHeapFile(TestingFile, &td, bp2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := hf2.readPage(0); err != nil {
+		t.Errorf("expected page 0 to be read, got %v", err)
+	}
+	if _, err := hf2.readPage(1); err == nil || err.(GoDBError).code != CorruptPageError {
+		t.Errorf("expected a CorruptPageError reading page 1, got %v", err)
+	}
+	if _, err := hf2.readPage(3); err == nil || err.(GoDBError).code != CorruptPageError {
+		t.Errorf("expected a CorruptPageError reading the half page 3, got %v", err)
+	}
+	// the LSNs of the pages written before reopening aren't reused
+	if hf2.lastLSN != hf.lastLSN || hf2.lastLSN == 0 {
+		t.Errorf("expected the reopened heap file to remember LSN %d, got %d", hf.lastLSN, hf2.lastLSN)
+	}
+
+	// pages that were never written are empty, not corrupt
+	if err := checkPage(make([]byte, PageSize), 5); err != nil {
+		t.Errorf("expected a page of zeros to be empty, got %v", err)
+	}
+}
+
+// Write a page in the format of the versions of GoDB before pages had
+// checksums, with the given number of slots and copies of tup.
+func writeLegacyPage(t *testing.T, file *os.File, pageNo int, numSlots int, tup *Tuple, n int) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []int32{int32(numSlots), int32(n)})
+	for i := 0; i < n; i++ {
+		if err := tup.writeTo(&b); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	b.Write(make([]byte, PageSize-b.Len()))
+	if _, err := file.WriteAt(b.Bytes(), int64(pageNo*PageSize)); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestLegacyPages(t *testing.T) {
+	// a heap file of two pages in the legacy format, without a free space map
+	os.Remove(TestingFile)
+	os.Remove(freeSpaceMapFileName(TestingFile))
+	td, t1, _ := makeTupleTestVars()
+	tupleSize := StringLength + Int64Length
+	file, err := os.Create(TestingFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	writeLegacyPage(t, file, 0, (PageSize-legacyHeaderSize)/tupleSize, &t1, 3)
+	writeLegacyPage(t, file, 1, (PageSize-legacyHeaderSize)/tupleSize, &t1, 2)
+	file.Close()
+
+	bp, err := NewBufferPool(10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf, err := NewHeapFile(TestingFile, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if corrupt, err := hf.CheckPages(); err != nil || len(corrupt) != 0 {
+		t.Fatalf("expected legacy pages not to be corrupt, got %v %v", corrupt, err)
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	n := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !tup.equals(&t1) {
+			t.Errorf("expected %v, got %v", t1, tup)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("expected 5 tuples in the legacy pages, got %d", n)
+	}
+
+	// a page that is written again is in the current format
+	page, err := hf.readPage(0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := hf.flushPage(page); err != nil {
+		t.Fatalf(err.Error())
+	}
+	data := make([]byte, PageSize)
+	hf.file.ReadAt(data, 0)
+	if err := checkPage(data, 0); err != nil {
+		t.Errorf("expected page 0 to be rewritten in the current format, got %v", err)
+	}
+	bp.CommitTransaction(tid)
+
+	// legacy pages with more tuples than fit now have to be reloaded
+	intDesc := TupleDesc{Fields: []FieldType{{Fname: "age", Ftype: IntType}}}
+	intTup := Tuple{intDesc, []DBValue{IntField{1}}, nil}
+	intFile := t.TempDir() + "/ints.dat"
+	file, err = os.Create(intFile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	legacySlots := (PageSize - legacyHeaderSize) / Int64Length
+	writeLegacyPage(t, file, 0, legacySlots, &intTup, legacySlots)
+	file.Close()
+	ints, err := NewHeapFile(intFile, &intDesc, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ints.numSlots >= legacySlots {
+		t.Fatalf("expected fewer slots than legacy pages had, got %d", ints.numSlots)
+	}
+	if _, err := ints.readPage(0); err == nil || err.(GoDBError).code != CorruptPageError {
+		t.Errorf("expected a CorruptPageError reading an overfull legacy page, got %v", err)
+	}
+}
+
+func TestFreeSpaceMapV1(t *testing.T) {
+	bp, hf := makeTestFile(t, 10)
+	td, t1, _ := makeTupleTestVars()
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for i := 0; i < 2*hf.numSlots; i++ {
+		if err := hf.insertTuple(&t1, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	bp.FlushAllPages()
+
+	// a version 1 map, which records that page 0 is full and page 1 isn't
+	var b bytes.Buffer
+	b.WriteString(freeSpaceMapMagic)
+	binary.Write(&b, binary.LittleEndian, []int32{1, 2, 0, 5})
+	if err := os.WriteFile(freeSpaceMapFileName(TestingFile), b.Bytes(), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		// the second time, the map was rewritten in the current format
+		bp2, err := NewBufferPool(10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		hf2, err := NewHeapFile(TestingFile, &td, bp2)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if hf2.pagesWithFreeSlots.Len() != 1 || !hf2.pagesWithFreeSlots.has(1) || hf2.lastLSN != 0 {
+			t.Errorf("expected only page 1 to have free slots and LSN 0, got %v and %d", hf2.pagesWithFreeSlots.pages, hf2.lastLSN)
+		}
+		hf2.fsmFile.Close()
+	}
+	os.Remove(freeSpaceMapFileName(TestingFile))
+}
@@ -2,9 +2,12 @@ package godb
 
 import (
 	"fmt"
+	"maps"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/xwb1989/sqlparser"
@@ -23,21 +26,71 @@ type LogicalFilterNode struct {
 	fieldExpr LogicalSelectNode
 	constExpr LogicalSelectNode
 	predOp    BoolOp
+	pred      *LogicalSelectNode // if non-nil, a general predicate used instead of the comparison
 }
 
 type LogicalJoinNode struct {
 	left, right *LogicalSelectNode
 	predOp      BoolOp
+	pred        *LogicalSelectNode // if non-nil, a general predicate used instead of the comparison
+}
+
+// A LogicalJoinTree mirrors the structure of the FROM clause. It is used to
+// plan queries with outer joins, which can't be freely reordered.
+type LogicalJoinTree struct {
+	alias       string // table or subquery name, for leaves
+	left, right *LogicalJoinTree
+	joinType    JoinType
+	conds       []*LogicalJoinNode // the ON conditions of the join
+}
+
+// Return the names of the tables and subqueries in the tree.
+func (t *LogicalJoinTree) tableNames() []string {
+	if t.left == nil {
+		return []string{t.alias}
+	}
+	return append(t.left.tableNames(), t.right.tableNames()...)
+}
+
+// Add the names of the tables that are on the NULL padded side of an outer
+// join in the tree to tables. Predicates on these tables from the WHERE
+// clause can't be applied until after the outer join.
+func (t *LogicalJoinTree) nullSupplyingTables(tables map[string]bool) {
+	if t.left == nil {
+		return
+	}
+	if t.joinType == RightOuterJoin || t.joinType == FullOuterJoin {
+		for _, name := range t.left.tableNames() {
+			tables[name] = true
+		}
+	}
+	if t.joinType == LeftOuterJoin || t.joinType == FullOuterJoin {
+		for _, name := range t.right.tableNames() {
+			tables[name] = true
+		}
+	}
+	t.left.nullSupplyingTables(tables)
+	t.right.nullSupplyingTables(tables)
+}
+
+// Whether the tree contains any outer joins.
+func (t *LogicalJoinTree) hasOuterJoin() bool {
+	if t == nil || t.left == nil {
+		return false
+	}
+	return t.joinType != InnerJoin || t.left.hasOuterJoin() || t.right.hasOuterJoin()
 }
 
 type SelectExprType int
 
 const (
-	ExprField SelectExprType = iota
-	ExprConst SelectExprType = iota
-	ExprFunc  SelectExprType = iota
-	ExprStar  SelectExprType = iota
-	ExprAggr  SelectExprType = iota
+	ExprField  SelectExprType = iota
+	ExprConst  SelectExprType = iota
+	ExprFunc   SelectExprType = iota
+	ExprStar   SelectExprType = iota
+	ExprAggr   SelectExprType = iota
+	ExprPred   SelectExprType = iota // a predicate: a comparison, AND, OR, NOT, IN, BETWEEN or IS NULL
+	ExprWindow SelectExprType = iota // a window function
 )
 
 type LogicalSelectNode struct {
@@ -49,6 +102,7 @@ type LogicalSelectNode struct {
 	value       string
 	args        []*LogicalSelectNode //for functions other than aggregates
 	cachedField *FieldType
+	window      *LogicalWindow // the OVER clause of a window function
 }
 
 func NewFieldSelectNode(table string, field string, alias string) LogicalSelectNode {
@@ -76,6 +130,15 @@ func NewStarSelectNode(table string) LogicalSelectNode {
 	return lsn
 }
 
+// Whether the node is the * of COUNT(*).
+func (s *LogicalSelectNode) isStar() bool {
+	return s.exprType == ExprField && s.field == "*"
+}
+
+// The expression COUNT(*) counts: unlike the field the * is resolved to,
+// which may be NULL in the output of an outer join, it is never NULL.
+var countStarExpr Expr = &ConstExpr{IntField{1}, IntType}
+
 func NewAggrSelectNode(op string, arg *LogicalSelectNode, alias string) LogicalSelectNode {
 	lsn := LogicalSelectNode{}
 	lsn.exprType = ExprAggr
@@ -95,6 +158,16 @@ func NewFuncSelectNode(op string, args []*LogicalSelectNode, alias string) Logic
 	return lsn
 }
 
+// A predicate named by op (e.g. "and", "not in", or a comparison like "<=")
+// over args.
+func NewPredSelectNode(op string, args []*LogicalSelectNode) LogicalSelectNode {
+	lsn := LogicalSelectNode{}
+	lsn.exprType = ExprPred
+	lsn.funcOp = &op
+	lsn.args = args
+	return lsn
+}
+
 func (t SelectExprType) String() string {
 	switch t {
 	case ExprField:
@@ -107,6 +180,10 @@ func (t SelectExprType) String() string {
 		return "ExprStar"
 	case ExprAggr:
 		return "ExprAggr"
+	case ExprPred:
+		return "ExprPred"
+	case ExprWindow:
+		return "ExprWindow"
 	default:
 		return "Unknown"
 	}
@@ -128,6 +205,12 @@ func (op BoolOp) String() string {
 		return "<"
 	case OpLike:
 		return " LIKE "
+	case OpILike:
+		return " ILIKE "
+	case OpRegexp:
+		return " REGEXP "
+	case OpSimilarTo:
+		return " SIMILAR TO "
 	default:
 		return "??"
 	}
@@ -194,7 +277,7 @@ func (lsn *LogicalSelectNode) getTableField(c *Catalog, subqueries []*LogicalPla
 	if lsn.exprType == ExprConst {
 		return "", "", nil
 	}
-	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr {
+	if lsn.exprType == ExprFunc || lsn.exprType == ExprAggr || lsn.exprType == ExprPred || lsn.exprType == ExprWindow {
 		tabName := ""
 		fieldName := ""
 		for _, subLsn := range lsn.args {
@@ -230,6 +313,48 @@ func (lsn *LogicalSelectNode) getTableField(c *Catalog, subqueries []*LogicalPla
 	return tabName, field, nil
 }
 
+// A column referenced by an expression.
+type columnRef struct {
+	table, field string
+}
+
+// Return every column the expression references, with table names resolved
+// as in getTableField.
+func (lsn *LogicalSelectNode) columnRefs(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode) ([]columnRef, error) {
+	switch lsn.exprType {
+	case ExprConst:
+		return nil, nil
+	case ExprField, ExprStar:
+		tabName, fieldName, err := lsn.getTableField(c, subqueries, ts)
+		if err != nil {
+			return nil, err
+		}
+		return []columnRef{{tabName, fieldName}}, nil
+	}
+	var refs []columnRef
+	for _, arg := range lsn.args {
+		argRefs, err := arg.columnRefs(c, subqueries, ts)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, argRefs...)
+	}
+	return refs, nil
+}
+
+// Return the distinct tables referenced by refs.
+func refTables(refs []columnRef) []string {
+	var tables []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if !seen[ref.table] {
+			seen[ref.table] = true
+			tables = append(tables, ref.table)
+		}
+	}
+	return tables
+}
+
 type LogicalTableNode struct {
 	tableName string
 	alias     string
@@ -253,13 +378,47 @@ type LogicalPlan struct {
 	tables        []*LogicalTableNode
 	subqueries    []*LogicalPlan
 	groupByFields []*GroupBy
+	having        *LogicalSelectNode // the predicate of the HAVING clause, or nil
 	orderByFields []*OrderByNode
 	limit         *LogicalSelectNode
 	distinct      bool
 	alias         string
+	joinTree      *LogicalJoinTree       // only used to plan outer joins
+	subqueryJoins []*LogicalSubqueryJoin // subqueries of the WHERE clause and select list
+	setOp         *LogicalSetOp          // if non-nil, the plan is a set operation
+	windows       []*LogicalSelectNode   // the window functions of the select list
+	wanderJoin    bool                   // whether the query asked to be run as a wander join
+	heavyHitters  bool                   // whether the query asked for a heavy hitter aggregation
+}
+
+// Add the names of the tables that the plan reads, outside of subqueries, to
+// names.
+func (p *LogicalPlan) addTableNames(names map[string]bool) {
+	if p.setOp != nil {
+		p.setOp.left.addTableNames(names)
+		p.setOp.right.addTableNames(names)
+	}
+	for _, table := range p.tables {
+		names[table.tableName] = true
+	}
+}
+
+// A set operation combining the results of two queries; see [SetOp].
+type LogicalSetOp struct {
+	op          SetOpType
+	all         bool
+	left, right *LogicalPlan
 }
 
 func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
+	if p.setOp != nil {
+		// the output is named by the first query
+		nodes := p.setOp.left.getSubplanFields(c)
+		for _, f := range nodes {
+			f.TableQualifier = p.alias
+		}
+		return nodes
+	}
 	var nodes []*FieldType = make([]*FieldType, len(p.selects))
 	for i, s := range p.selects {
 		_, field, _ := s.getTableField(c, p.subqueries, p.tables)
@@ -269,132 +428,366 @@ func (p *LogicalPlan) getSubplanFields(c *Catalog) []*FieldType {
 }
 
 // Parse a where statement into a list of filters and joins.
+// Split a WHERE (or ON) clause into its conjuncts. Comparisons between a
+// single table and constants become filters, and comparisons between one
+// table on each side become joins. Anything else becomes a filter with a
+// general predicate, which is applied as soon as all of the tables it
+// references have been joined.
 func parseWhere(c *Catalog, subqueries []*LogicalPlan, ts []*LogicalTableNode, expr sqlparser.Expr) ([]*LogicalFilterNode, []*LogicalJoinNode, error) {
 	DebugParser("in parse where expr is %v\n", expr)
 	switch expr := expr.(type) {
 	case *sqlparser.AndExpr:
 		// Parse AND by parsing left and right sides
-		filterListLeft, joinListLeft, _ := parseWhere(c, subqueries, ts, expr.Left)
-		filterListRight, joinListRight, _ := parseWhere(c, subqueries, ts, expr.Right)
+		filterListLeft, joinListLeft, err := parseWhere(c, subqueries, ts, expr.Left)
+		if err != nil {
+			return nil, nil, err
+		}
+		filterListRight, joinListRight, err := parseWhere(c, subqueries, ts, expr.Right)
+		if err != nil {
+			return nil, nil, err
+		}
 		filterExprs := append(filterListLeft, filterListRight...)
 		joinExprs := append(joinListLeft, joinListRight...)
 		return filterExprs, joinExprs, nil
 
+	case *sqlparser.ParenExpr:
+		return parseWhere(c, subqueries, ts, expr.Expr)
+
 	case *sqlparser.ComparisonExpr:
-		op := BoolOpMap[expr.Operator]
+		opName, rightExpr, negated := comparisonOp(expr)
+		op, ok := BoolOpMap[opName]
+		if !ok || negated || expr.Escape != nil {
+			break
+		}
 		left, err := parseExpr(c, expr.Left, "")
 		if err != nil {
 			return nil, nil, err
 		}
-		right, err := parseExpr(c, expr.Right, "")
+		right, err := parseExpr(c, rightExpr, "")
 		if err != nil {
 			return nil, nil, err
 		}
 		//here we want to search the catalog for the table id, if it's not specified
-		lTable, _, err := left.getTableField(c, subqueries, ts)
+		lRefs, err := left.columnRefs(c, subqueries, ts)
 		if err != nil {
 			return nil, nil, err
 		}
-		rTable, _, err := right.getTableField(c, subqueries, ts)
+		rRefs, err := right.columnRefs(c, subqueries, ts)
 		if err != nil {
 			return nil, nil, err
 		}
+		if len(lRefs) == 0 && len(rRefs) > 0 {
+			// keep the columns on the left, e.g. 5 < t.a becomes t.a > 5
+			left, right, lRefs, rRefs = right, left, rRefs, lRefs
+			op = flipBoolOp(op)
+		}
 		DebugParser("in parseWhere right is %v\n", right.String())
-		if lTable != "" && rTable != "" && lTable != rTable { //join
-			if op != OpEq {
-				return nil, nil, GoDBError{IllegalOperationError, "only equality joins are supported"}
-			}
-			return nil, []*LogicalJoinNode{{left, right, op}}, nil
+		lTables, rTables := refTables(lRefs), refTables(rRefs)
+		if len(lTables) == 1 && len(rTables) == 1 && lTables[0] != rTables[0] { //join
+			return nil, []*LogicalJoinNode{{left, right, op, nil}}, nil
+		} else if len(refTables(append(lRefs, rRefs...))) == 1 {
+			return []*LogicalFilterNode{{*left, *right, op, nil}}, nil, nil
+		}
+	}
+
+	pred, err := parsePredicate(c, expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []*LogicalFilterNode{{pred: pred}}, nil, nil
+}
+
+// Swap the sides of a comparison, so a op b is the same as b flipBoolOp(op) a.
+func flipBoolOp(op BoolOp) BoolOp {
+	switch op {
+	case OpGt:
+		return OpLt
+	case OpLt:
+		return OpGt
+	case OpGe:
+		return OpLe
+	case OpLe:
+		return OpGe
+	}
+	return op
+}
+
+// Return the operator of a comparison and its right hand side, undoing the
+// rewrites of ILIKE and SIMILAR TO (see [rewriteQuery]), and whether the
+// comparison is negated (as in NOT LIKE).
+func comparisonOp(expr *sqlparser.ComparisonExpr) (string, sqlparser.Expr, bool) {
+	op, right := expr.Operator, expr.Right
+	negated := false
+	switch op {
+	case sqlparser.NotLikeStr:
+		op, negated = sqlparser.LikeStr, true
+	case sqlparser.NotRegexpStr:
+		op, negated = sqlparser.RegexpStr, true
+	}
+	if op != sqlparser.LikeStr && op != sqlparser.RegexpStr {
+		return expr.Operator, right, false
+	}
+	if unary, ok := right.(*sqlparser.UnaryExpr); ok && unary.Operator == sqlparser.UBinaryStr {
+		right = unary.Expr
+		if op == sqlparser.LikeStr {
+			op = "ilike"
 		} else {
-			return []*LogicalFilterNode{{*left, *right, op}}, nil, nil
+			op = "similar to"
+		}
+	}
+	return op, right, negated
+}
+
+// Parse a boolean expression into a predicate tree.
+func parsePredicate(c *Catalog, expr sqlparser.Expr) (*LogicalSelectNode, error) {
+	parseArgs := func(exprs ...sqlparser.Expr) ([]*LogicalSelectNode, error) {
+		args := make([]*LogicalSelectNode, len(exprs))
+		for i, e := range exprs {
+			var err error
+			args[i], err = parseExpr(c, e, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+	parsePreds := func(exprs ...sqlparser.Expr) ([]*LogicalSelectNode, error) {
+		args := make([]*LogicalSelectNode, len(exprs))
+		for i, e := range exprs {
+			var err error
+			args[i], err = parsePredicate(c, e)
+			if err != nil {
+				return nil, err
+			}
 		}
+		return args, nil
+	}
 
+	var op string
+	var args []*LogicalSelectNode
+	var err error
+	switch expr := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return parsePredicate(c, expr.Expr)
+	case *sqlparser.AndExpr:
+		op = "and"
+		args, err = parsePreds(expr.Left, expr.Right)
+	case *sqlparser.OrExpr:
+		op = "or"
+		args, err = parsePreds(expr.Left, expr.Right)
+	case *sqlparser.NotExpr:
+		op = "not"
+		args, err = parsePreds(expr.Expr)
+	case *sqlparser.ComparisonExpr:
+		op = expr.Operator
+		switch op {
+		case sqlparser.InStr, sqlparser.NotInStr:
+			list, ok := expr.Right.(sqlparser.ValTuple)
+			if !ok {
+				return nil, GoDBError{ParseError, fmt.Sprintf("unsupported IN list %s", sqlparser.String(expr.Right))}
+			}
+			args, err = parseArgs(append([]sqlparser.Expr{expr.Left}, list...)...)
+		case sqlparser.LikeStr, sqlparser.NotLikeStr, sqlparser.RegexpStr, sqlparser.NotRegexpStr:
+			var right sqlparser.Expr
+			var negated bool
+			op, right, negated = comparisonOp(expr)
+			matchArgs := []sqlparser.Expr{expr.Left, right}
+			if expr.Escape != nil {
+				matchArgs = append(matchArgs, expr.Escape)
+			}
+			args, err = parseArgs(matchArgs...)
+			if err == nil && negated {
+				match := NewPredSelectNode(op, args)
+				op, args = "not", []*LogicalSelectNode{&match}
+			}
+		default:
+			if _, ok := BoolOpMap[op]; !ok {
+				return nil, GoDBError{ParseError, fmt.Sprintf("unsupported comparison %s", op)}
+			}
+			args, err = parseArgs(expr.Left, expr.Right)
+		}
+	case *sqlparser.RangeCond:
+		op = expr.Operator
+		args, err = parseArgs(expr.Left, expr.From, expr.To)
+	case *sqlparser.IsExpr:
+		op = expr.Operator
+		if op != sqlparser.IsNullStr && op != sqlparser.IsNotNullStr {
+			return nil, GoDBError{ParseError, fmt.Sprintf("unsupported predicate %s", op)}
+		}
+		args, err = parseArgs(expr.Expr)
 	default:
-		return nil, nil, GoDBError{ParseError, "where expression with non value or column on RHS (disjunctions and nested where expressions are not supported)"}
+		return nil, GoDBError{ParseError, fmt.Sprintf("unsupported predicate %s", sqlparser.String(expr))}
+	}
+	if err != nil {
+		return nil, err
 	}
+	pred := NewPredSelectNode(op, args)
+	return &pred, nil
 }
 
-func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*LogicalPlan, []*LogicalJoinNode, error) {
+// Parse a FROM clause item, returning the tables and subqueries it reads,
+// the join and filter conditions of its inner joins, and a tree describing
+// its join structure (used for outer joins).
+func parseFrom(c *Catalog, t sqlparser.TableExpr) ([]*LogicalTableNode, []*LogicalPlan, []*LogicalJoinNode, []*LogicalFilterNode, *LogicalJoinTree, error) {
 	switch tableEx := t.(type) {
 	case *sqlparser.AliasedTableExpr:
 		switch tableEx.Expr.(type) {
 		case *sqlparser.Subquery:
 			sq := (tableEx.Expr).(*sqlparser.Subquery)
 			//print("got subquery")
-			switch stmt := sq.Select.(type) {
-			case *sqlparser.Select:
-				subplan, err := parseStatement(c, stmt)
-				if err != nil {
-					return nil, nil, nil, err
-				}
-				subplan.alias = strings.ToLower(sqlparser.String(tableEx.As))
-				return nil, []*LogicalPlan{subplan}, nil, nil
+			subplan, err := parseSelectStatement(c, sq.Select)
+			if err != nil {
+				return nil, nil, nil, nil, nil, err
 			}
+			subplan.alias = strings.ToLower(sqlparser.String(tableEx.As))
+			return nil, []*LogicalPlan{subplan}, nil, nil, &LogicalJoinTree{alias: subplan.alias}, nil
 		case sqlparser.SimpleTableExpr:
 			tableName := strings.ToLower(sqlparser.GetTableName(tableEx.Expr).CompliantName())
 			//fmt.Printf("got simple table, name %s\n", tableName)
 			dbFile, err := c.GetTable(tableName)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, nil, err
 			}
 			table := LogicalTableNode{tableName,
 				strings.ToLower(sqlparser.String(tableEx.As)),
 				&dbFile}
 			table.alias = strings.ToLower(sqlparser.String(tableEx.As))
-			return []*LogicalTableNode{&table}, nil, nil, nil
+			name := table.tableName
+			if table.alias != "" {
+				name = table.alias
+			}
+			return []*LogicalTableNode{&table}, nil, nil, nil, &LogicalJoinTree{alias: name}, nil
 		}
 	case *sqlparser.ParenTableExpr:
 		var (
 			tables   []*LogicalTableNode
 			subplans []*LogicalPlan
 			joins    []*LogicalJoinNode
+			filters  []*LogicalFilterNode
+			tree     *LogicalJoinTree
 		)
 		for _, e := range tableEx.Exprs {
-			newTables, newSubplans, newJoins, err := parseFrom(c, e)
+			newTables, newSubplans, newJoins, newFilters, newTree, err := parseFrom(c, e)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, nil, err
 			}
 			tables = append(tables, newTables...)
 			subplans = append(subplans, newSubplans...)
 			joins = append(joins, newJoins...)
+			filters = append(filters, newFilters...)
+			tree = crossJoinTree(tree, newTree)
 		}
-		return tables, subplans, joins, nil
+		return tables, subplans, joins, filters, tree, nil
 	case *sqlparser.JoinTableExpr:
 		joinTable, _ := t.(*sqlparser.JoinTableExpr)
-		leftTables, leftSubplans, leftJoins, err := parseFrom(c, joinTable.LeftExpr)
+		leftTables, leftSubplans, leftJoins, leftFilters, leftTree, err := parseFrom(c, joinTable.LeftExpr)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
 		}
 		DebugParser("In parser parsing %v\n", joinTable.RightExpr)
-		rightTables, rightSubplans, rightJoins, err := parseFrom(c, joinTable.RightExpr)
+		rightTables, rightSubplans, rightJoins, rightFilters, rightTree, err := parseFrom(c, joinTable.RightExpr)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
+		}
+		var joinType JoinType
+		switch joinTable.Join {
+		case sqlparser.JoinStr:
+			joinType = InnerJoin
+		case sqlparser.LeftJoinStr:
+			joinType = LeftOuterJoin
+		case sqlparser.RightJoinStr:
+			joinType = RightOuterJoin
+		case sqlparser.StraightJoinStr:
+			// FULL OUTER JOIN is rewritten to STRAIGHT_JOIN before parsing
+			joinType = FullOuterJoin
+		default:
+			return nil, nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported join type %s", joinTable.Join)}
+		}
+		if joinTable.Condition.Using != nil {
+			return nil, nil, nil, nil, nil, GoDBError{ParseError, "USING join conditions are not supported"}
 		}
-		if joinTable.Join != "join" {
-			return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported join type %s", joinTable.Join)}
+		if joinType != InnerJoin && joinTable.Condition.On == nil {
+			return nil, nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("%v requires an ON condition", joinType)}
 		}
 		tabList := append(leftTables, rightTables...)
 		subPlanList := append(leftSubplans, rightSubplans...)
-		_, joins, err := parseWhere(c, subPlanList, tabList, joinTable.Condition.On)
-		if err != nil {
-			return nil, nil, nil, err
+		var filters []*LogicalFilterNode
+		var joins []*LogicalJoinNode
+		if joinTable.Condition.On != nil {
+			filters, joins, err = parseWhere(c, subPlanList, tabList, joinTable.Condition.On)
+			if err != nil {
+				return nil, nil, nil, nil, nil, err
+			}
+		}
+		tree := &LogicalJoinTree{left: leftTree, right: rightTree, joinType: joinType}
+		tree.conds = append(tree.conds, joins...)
+		for _, f := range filters {
+			// single table ON conditions of outer joins only decide which
+			// tuples match, so they are kept as join conditions
+			fieldExpr, constExpr := f.fieldExpr, f.constExpr
+			tree.conds = append(tree.conds, &LogicalJoinNode{&fieldExpr, &constExpr, f.predOp, f.pred})
 		}
-		return tabList, subPlanList, append(leftJoins, append(rightJoins, joins...)...), nil
+		joins = append(leftJoins, append(rightJoins, joins...)...)
+		filters = append(leftFilters, append(rightFilters, filters...)...)
+		return tabList, subPlanList, joins, filters, tree, nil
 
 	}
-	return nil, nil, nil, GoDBError{ParseError, "unknown query type in parseFrom"}
+	return nil, nil, nil, nil, nil, GoDBError{ParseError, "unknown query type in parseFrom"}
+}
+
+// Combine two FROM clause items into an inner join tree without conditions;
+// left may be nil.
+func crossJoinTree(left, right *LogicalJoinTree) *LogicalJoinTree {
+	if left == nil {
+		return right
+	}
+	return &LogicalJoinTree{left: left, right: right, joinType: InnerJoin}
 }
 
 func isAgg(f string) bool {
-	return f == "count" || f == "sum" || f == "avg" || f == "min" || f == "max"
+	_, ok := aggregates[f]
+	return ok
 }
 
 func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNode, error) {
 	switch expr := expr.(type) {
 	case *sqlparser.FuncExpr:
 		funName := strings.ToLower(sqlparser.String(expr.Name))
+		if spec, ok := windowSpecArg(expr); ok {
+			if expr.Distinct {
+				return nil, GoDBError{ParseError, fmt.Sprintf("DISTINCT isn't supported in window function %s", funName)}
+			}
+			window, err := parseWindowSpec(c, spec)
+			if err != nil {
+				return nil, err
+			}
+			var args []*LogicalSelectNode
+			for _, subExpr := range expr.Exprs[:len(expr.Exprs)-1] {
+				var arg *LogicalSelectNode
+				if star, ok := subExpr.(*sqlparser.StarExpr); ok {
+					field := NewFieldSelectNode(strings.ToLower(sqlparser.String(star.TableName)), "*", "")
+					arg = &field
+				} else if arg, err = parseSelect(c, subExpr); err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+			}
+			outer := NewFuncSelectNode(funName, args, alias)
+			outer.exprType = ExprWindow
+			outer.window = window
+			return &outer, nil
+		}
+		if expr.Distinct {
+			if funName != "count" || len(expr.Exprs) != 1 {
+				return nil, GoDBError{ParseError, fmt.Sprintf("DISTINCT is only supported in COUNT of one expression, got %s", sqlparser.String(expr))}
+			}
+			if _, ok := expr.Exprs[0].(*sqlparser.StarExpr); ok {
+				return nil, GoDBError{ParseError, "can't count distinct *"}
+			}
+			funName = "count_distinct"
+		}
 		if isAgg(funName) {
-			if len(expr.Exprs) != 1 {
+			if len(expr.Exprs) != 1 && (funName == "count" || len(expr.Exprs) == 0) {
 				return nil, GoDBError{ParseError, fmt.Sprintf("expected one argument to aggregate %s in select list", sqlparser.String(expr.Name))}
 			}
 			star, ok := expr.Exprs[0].(*sqlparser.StarExpr)
@@ -411,9 +804,30 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 				return nil, err
 			}
 			outer := NewAggrSelectNode(funName, field, alias)
+			// the constant arguments of aggregates like PERCENTILE_CONT(x, p)
+			for _, subExpr := range expr.Exprs[1:] {
+				param, err := parseSelect(c, subExpr)
+				if err != nil {
+					return nil, err
+				}
+				if param.exprType != ExprConst {
+					return nil, GoDBError{ParseError, fmt.Sprintf("arguments of aggregate %s after the first must be constants", funName)}
+				}
+				outer.args = append(outer.args, param)
+			}
 			return &outer, nil
 		} else {
 			funName := strings.ToLower(sqlparser.String(expr.Name))
+			if (funName == "date_add" || funName == "date_sub") && len(expr.Exprs) == 2 {
+				// DATE_ADD(date, INTERVAL n unit)
+				if arg, ok := expr.Exprs[1].(*sqlparser.AliasedExpr); ok {
+					if interval, ok := arg.Expr.(*sqlparser.IntervalExpr); ok {
+						if date, ok := expr.Exprs[0].(*sqlparser.AliasedExpr); ok {
+							return parseDateArith(c, date.Expr, interval, funName == "date_sub", alias)
+						}
+					}
+				}
+			}
 			exprList := make([]*LogicalSelectNode, len(expr.Exprs))
 			for i, subExpr := range expr.Exprs {
 				e, err := parseSelect(c, subExpr)
@@ -425,11 +839,38 @@ func parseExpr(c *Catalog, expr sqlparser.Expr, alias string) (*LogicalSelectNod
 			if funName[0] == '\'' || funName[0] == '`' {
 				funName = funName[1 : len(funName)-1]
 			}
+			switch funName {
+			case "concat":
+				// CONCAT(a, b, c) is concat(concat(a, b), c)
+				for len(exprList) > 2 {
+					inner := NewFuncSelectNode(funName, exprList[:2], "")
+					exprList = append([]*LogicalSelectNode{&inner}, exprList[2:]...)
+				}
+			case "extract":
+				if len(exprList) == 2 && exprList[0].exprType == ExprConst && !isExtractUnit(exprList[0].value) {
+					return nil, GoDBError{ParseError, fmt.Sprintf("unsupported EXTRACT unit %s", exprList[0].value)}
+				}
+			}
 			outer := NewFuncSelectNode(funName, exprList, alias)
 			return &outer, nil
 		}
+	case *sqlparser.CaseExpr:
+		return parseCaseExpr(c, expr, alias)
+	case *sqlparser.ConvertExpr:
+		return parseCastExpr(c, expr, alias)
+	case *sqlparser.NullVal:
+		null := NewFuncSelectNode("null", nil, alias)
+		return &null, nil
+	case *sqlparser.IntervalExpr:
+		return nil, GoDBError{ParseError, fmt.Sprintf("INTERVAL %s may only be added to or subtracted from a date", sqlparser.String(expr.Expr))}
 	case *sqlparser.BinaryExpr:
 		opname := expr.Operator
+		if interval, ok := expr.Right.(*sqlparser.IntervalExpr); ok && (opname == "+" || opname == "-") {
+			return parseDateArith(c, expr.Left, interval, opname == "-", alias)
+		}
+		if interval, ok := expr.Left.(*sqlparser.IntervalExpr); ok && opname == "+" {
+			return parseDateArith(c, expr.Right, interval, false, alias)
+		}
 		left, err := parseExpr(c, expr.Left, "")
 		if err != nil {
 			return nil, err
@@ -489,16 +930,70 @@ func extractAggs(s *LogicalSelectNode) []*LogicalSelectNode {
 	switch s.exprType {
 	case ExprAggr:
 		return []*LogicalSelectNode{s}
-	case ExprFunc:
+	case ExprFunc, ExprPred:
+		var aggs []*LogicalSelectNode
+		for _, subs := range s.args {
+			aggs = append(aggs, extractAggs(subs)...)
+		}
+		return aggs
+	case ExprWindow:
+		// window functions are computed after aggregation, so may read
+		// aggregates
 		var aggs []*LogicalSelectNode
 		for _, subs := range s.args {
 			aggs = append(aggs, extractAggs(subs)...)
 		}
+		for _, p := range s.window.partitionBy {
+			aggs = append(aggs, extractAggs(p)...)
+		}
+		for _, o := range s.window.orderBy {
+			aggs = append(aggs, extractAggs(o.expr)...)
+		}
 		return aggs
 	}
 	return nil
 }
 
+// Make the aggregates of s that are the same as one of aggs refer to that one,
+// so it is only computed once, and return the aggregates of s that aren't.
+func shareAggs(s *LogicalSelectNode, aggs []*LogicalSelectNode) []*LogicalSelectNode {
+	var newAggs []*LogicalSelectNode
+	for i, arg := range s.args {
+		if arg.exprType != ExprAggr {
+			newAggs = append(newAggs, shareAggs(arg, append(aggs, newAggs...))...)
+			continue
+		}
+		shared := false
+		for _, agg := range append(aggs, newAggs...) {
+			if agg.exprKey() == arg.exprKey() {
+				s.args[i] = agg
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			newAggs = append(newAggs, arg)
+		}
+	}
+	return newAggs
+}
+
+// Describe the expression s computes (ignoring its alias), such that equal
+// descriptions mean equal expressions.
+func (s *LogicalSelectNode) exprKey() string {
+	switch s.exprType {
+	case ExprField, ExprStar:
+		return s.table + "." + s.field
+	case ExprConst:
+		return "'" + s.value + "'"
+	}
+	key := *s.funcOp + "("
+	for _, arg := range s.args {
+		key += arg.exprKey() + ","
+	}
+	return key + ")"
+}
+
 func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 	from := s.From
 	var (
@@ -507,17 +1002,29 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		joins    []*LogicalJoinNode
 		filters  []*LogicalFilterNode
 		aggs     []*LogicalSelectNode
+		windows  []*LogicalSelectNode
 	)
 
+	var joinTree *LogicalJoinTree
 	for _, t := range from {
-		newTables, newSubplans, newJoins, err := parseFrom(c, t)
+		newTables, newSubplans, newJoins, newFilters, newTree, err := parseFrom(c, t)
 		if err != nil {
 			return nil, err
 		}
 		tables = append(tables, newTables...)
 		subplans = append(subplans, newSubplans...)
 		joins = append(joins, newJoins...)
+		filters = append(filters, newFilters...)
+		joinTree = crossJoinTree(joinTree, newTree)
 	}
+	if joinTree.hasOuterJoin() {
+		// the ON conditions are planned from the join tree
+		joins = nil
+		filters = nil
+	} else {
+		joinTree = nil
+	}
+	subqueries := &subqueryPlanner{c: c, outer: queryScope{c, tables, subplans}}
 	where := s.Where
 	if where != nil {
 		//var newTs []*LogicalTableNode
@@ -529,23 +1036,47 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 					}
 		*/
 		//}
-		newFilters, newJoins, err := parseWhere(c, subplans, tables, where.Expr)
+		whereExpr, err := subqueries.planWhere(where.Expr)
 		if err != nil {
 			return nil, err
 		}
-		joins = append(joins, newJoins...)
-		filters = append(filters, newFilters...)
+		if whereExpr != nil {
+			newFilters, newJoins, err := parseWhere(c, subplans, tables, whereExpr)
+			if err != nil {
+				return nil, err
+			}
+			joins = append(joins, newJoins...)
+			filters = append(filters, newFilters...)
+		}
 	}
 	//extract select list
 
 	var selects = make([]*LogicalSelectNode, len(s.SelectExprs))
 	for i, stmt := range s.SelectExprs {
+		if aliased, ok := stmt.(*sqlparser.AliasedExpr); ok && len(findSubqueries(aliased.Expr)) > 0 {
+			expr, err := subqueries.planSelect(aliased.Expr)
+			if err != nil {
+				return nil, err
+			}
+			stmt = &sqlparser.AliasedExpr{Expr: expr, As: aliased.As}
+		}
 		sel, err := parseSelect(c, stmt)
 		if err != nil {
 			return nil, err
 		}
 		selects[i] = sel
 		aggs = append(aggs, extractAggs(sel)...)
+		windows = append(windows, extractWindows(sel)...)
+	}
+
+	var having *LogicalSelectNode
+	if s.Having != nil {
+		var err error
+		having, err = parsePredicate(c, s.Having.Expr)
+		if err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, shareAggs(having, aggs)...)
 	}
 
 	var groupBys = make([]*GroupBy, len(s.GroupBy))
@@ -557,28 +1088,140 @@ func parseStatement(c *Catalog, s *sqlparser.Select) (*LogicalPlan, error) {
 		groupBys[i] = &GroupBy{expr}
 	}
 
-	var orderBys = make([]*OrderByNode, len(s.OrderBy))
-	for i, oby := range s.OrderBy {
+	orderBys, limExpr, err := parseOrderByLimit(c, s.OrderBy, s.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	p := LogicalPlan{filters, joins, selects, aggs, tables, subplans, groupBys, having, orderBys, limExpr, s.Distinct != "", "", joinTree, subqueries.joins, nil, windows, hasHint(s.Comments, wanderJoinHint), hasHint(s.Comments, heavyHittersHint)}
+
+	return &p, nil
+}
+
+func parseOrderByLimit(c *Catalog, orderBy sqlparser.OrderBy, lim *sqlparser.Limit) ([]*OrderByNode, *LogicalSelectNode, error) {
+	var orderBys = make([]*OrderByNode, len(orderBy))
+	for i, oby := range orderBy {
 		expr, err := parseExpr(c, oby.Expr, "")
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		orderBys[i] = &OrderByNode{expr, oby.Direction == sqlparser.AscScr}
 	}
 
-	lim := s.Limit
 	var limExpr *LogicalSelectNode
 	if lim != nil {
 		var err error
 		limExpr, err = parseExpr(c, lim.Rowcount, "")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return orderBys, limExpr, nil
+}
+
+// Parse a query that may combine SELECTs with set operations. As in standard
+// SQL, INTERSECT binds more tightly than UNION and EXCEPT, which are evaluated
+// from left to right.
+func parseSelectStatement(c *Catalog, stmt sqlparser.SelectStatement) (*LogicalPlan, error) {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		return parseStatement(c, stmt)
+	case *sqlparser.ParenSelect:
+		return parseSelectStatement(c, stmt.Select)
+	case *sqlparser.Union:
+		// the parser nests a chain of set operations to the left, with
+		// parenthesized operands as ParenSelects
+		var operands []sqlparser.SelectStatement
+		var ops []*LogicalSetOp
+		var chain sqlparser.SelectStatement = stmt
+		for {
+			u, ok := chain.(*sqlparser.Union)
+			if !ok {
+				operands = append(operands, chain)
+				break
+			}
+			setOp := &LogicalSetOp{op: UnionOp, all: u.Type == sqlparser.UnionAllStr}
+			if op, all, ok := setOpMarker(u.Right); ok {
+				setOp.op, setOp.all = op, all
+			}
+			operands = append(operands, u.Right)
+			ops = append(ops, setOp)
+			chain = u.Left
+		}
+		slices.Reverse(operands)
+		slices.Reverse(ops)
+
+		// combine the operands of each INTERSECT first, then the results
+		// from left to right
+		terms := make([]*LogicalPlan, 1, len(operands))
+		var termOps []*LogicalSetOp
+		var err error
+		if terms[0], err = parseSelectStatement(c, operands[0]); err != nil {
+			return nil, err
+		}
+		for i, setOp := range ops {
+			right, err := parseSelectStatement(c, operands[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if setOp.op == IntersectOp {
+				setOp.left, setOp.right = terms[len(terms)-1], right
+				terms[len(terms)-1] = &LogicalPlan{setOp: setOp}
+			} else {
+				terms = append(terms, right)
+				termOps = append(termOps, setOp)
+			}
+		}
+		plan := terms[0]
+		for i, setOp := range termOps {
+			setOp.left, setOp.right = plan, terms[i+1]
+			plan = &LogicalPlan{setOp: setOp}
+		}
+
+		plan.orderByFields, plan.limit, err = parseOrderByLimit(c, stmt.OrderBy, stmt.Limit)
 		if err != nil {
 			return nil, err
 		}
+		return plan, nil
 	}
+	return nil, GoDBError{ParseError, fmt.Sprintf("unsupported query %s", sqlparser.String(stmt))}
+}
 
-	p := LogicalPlan{filters, joins, selects, aggs, tables, subplans, groupBys, orderBys, limExpr, s.Distinct != "", ""}
+// Return the first SELECT of a query.
+func leftmostSelect(stmt sqlparser.SelectStatement) *sqlparser.Select {
+	switch stmt := stmt.(type) {
+	case *sqlparser.ParenSelect:
+		return leftmostSelect(stmt.Select)
+	case *sqlparser.Union:
+		return leftmostSelect(stmt.Left)
+	}
+	sel, _ := stmt.(*sqlparser.Select)
+	return sel
+}
 
-	return &p, nil
+// Return the set operation that was rewritten to UNION ALL before the
+// right hand side of a UNION, if any, from the comment the rewrite left on
+// its first SELECT.
+func setOpMarker(right sqlparser.SelectStatement) (SetOpType, bool, bool) {
+	sel := leftmostSelect(right)
+	if sel == nil {
+		return UnionOp, false, false
+	}
+	for _, comment := range sel.Comments {
+		text := strings.ToLower(string(comment))
+		if !strings.HasPrefix(text, setOpCommentPrefix) {
+			continue
+		}
+		words := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(text, setOpCommentPrefix), "*/"))
+		all := len(words) == 2 && words[1] == "all"
+		switch words[0] {
+		case "intersect":
+			return IntersectOp, all, true
+		case "except":
+			return ExceptOp, all, true
+		}
+	}
+	return UnionOp, false, false
 }
 
 // Given a table name tab, a field name, and a map between table names and operators, do one of the following:
@@ -642,7 +1285,7 @@ type PlanNode struct {
 func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, tableMap map[string]*PlanNode) (Expr, string, error) {
 	DebugParser("in generate expr expr type is %v\n", s.exprType)
 	switch s.exprType {
-	case ExprAggr:
+	case ExprAggr, ExprWindow:
 		fallthrough
 	case ExprField:
 		var field FieldType
@@ -736,22 +1379,123 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 			}
 			exprs[i] = &newExpr
 		}
+		if makeExpr, ok := specialForms[*s.funcOp]; ok {
+			args := make([]Expr, len(exprs))
+			for i, e := range exprs {
+				args[i] = *e
+			}
+			e, err := makeExpr(args)
+			if err != nil {
+				return nil, "", err
+			}
+			return e, fieldName, nil
+		}
 
 		fe := FuncExpr{*s.funcOp, exprs}
 		return &fe, fieldName, nil
+	case ExprPred:
+		fieldName := *s.funcOp
+		if s.alias != "" {
+			fieldName = s.alias
+		}
+		args := make([]Expr, len(s.args))
+		for i, lsn := range s.args {
+			var err error
+			args[i], _, err = lsn.generateExpr(c, inputDesc, tableMap)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		pred, err := makePredExpr(*s.funcOp, args)
+		if err != nil {
+			return nil, "", err
+		}
+		return pred, fieldName, nil
 	}
 	return nil, "", GoDBError{ParseError, "unhandled expression type in select list"}
 
 }
 
-const JoinBufferSize int = 10000000
-
-func exprToStr(e Expr) string {
-	switch ex := e.(type) {
-	case *FieldExpr:
-		tbl := ""
-		if ex.selectField.TableQualifier != "" {
-			tbl = ex.selectField.TableQualifier + "."
+// Build the predicate named op (as produced by parsePredicate) over args.
+func makePredExpr(op string, args []Expr) (Expr, error) {
+	nArgs := map[string]int{"not": 1, "is null": 1, "is not null": 1, "between": 3, "not between": 3}
+	if n, ok := nArgs[op]; ok && len(args) != n {
+		return nil, GoDBError{ParseError, fmt.Sprintf("%s expects %d arguments, got %d", op, n, len(args))}
+	}
+	switch op {
+	case "and":
+		return &AndExpr{args}, nil
+	case "or":
+		return &OrExpr{args}, nil
+	case "not":
+		return &NotExpr{args[0]}, nil
+	case "in", "not in":
+		if len(args) < 1 {
+			return nil, GoDBError{ParseError, "IN without an expression"}
+		}
+		return &InExpr{args[0], args[1:], op == "not in"}, nil
+	case "between", "not between":
+		return &BetweenExpr{args[0], args[1], args[2], op == "not between"}, nil
+	case "is null", "is not null":
+		return &IsNullExpr{args[0], op == "is not null"}, nil
+	}
+	boolOp, ok := BoolOpMap[op]
+	if kind, isPattern := patternKind(boolOp); ok && isPattern && len(args) == 3 {
+		escape, err := escapeChar(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return NewMatchExpr(args[0], kind, args[1], escape)
+	}
+	if !ok || len(args) != 2 {
+		return nil, GoDBError{ParseError, fmt.Sprintf("unsupported predicate %s", op)}
+	}
+	return newComparison(args[0], boolOp, args[1])
+}
+
+// Return the character of an ESCAPE clause, which must be a single character
+// string constant.
+func escapeChar(e Expr) (rune, error) {
+	c, ok := e.(*ConstExpr)
+	if ok {
+		s, ok := c.val.(StringField)
+		if ok && utf8.RuneCountInString(s.Value) == 1 {
+			r, _ := utf8.DecodeRuneInString(s.Value)
+			return r, nil
+		}
+	}
+	return 0, GoDBError{ParseError, fmt.Sprintf("ESCAPE must be a single character, got %s", exprToStr(e))}
+}
+
+// Return a filter that applies f to the tuples of child, whose tuples are
+// described by desc.
+func makeFilterOp(c *Catalog, f *LogicalFilterNode, desc *TupleDesc, tableMap map[string]*PlanNode, child Operator) (*Filter, error) {
+	if f.pred != nil {
+		pred, _, err := f.pred.generateExpr(c, desc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		return NewPredicateFilter(pred, child)
+	}
+	leftExpr, _, err := f.fieldExpr.generateExpr(c, desc, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	rightExpr, _, err := f.constExpr.generateExpr(c, desc, tableMap)
+	if err != nil {
+		return nil, err
+	}
+	return NewFilter(rightExpr, f.predOp, leftExpr, child)
+}
+
+const JoinBufferSize int = 10000000
+
+func exprToStr(e Expr) string {
+	switch ex := e.(type) {
+	case *FieldExpr:
+		tbl := ""
+		if ex.selectField.TableQualifier != "" {
+			tbl = ex.selectField.TableQualifier + "."
 		}
 		return fmt.Sprintf("%s%s", tbl, ex.selectField.Fname)
 	case *ConstExpr:
@@ -763,10 +1507,24 @@ func exprToStr(e Expr) string {
 		}
 		return fmt.Sprintf("%s(%s)", ex.op, argStr)
 	default:
+		if s := predToStr(e); s != "" {
+			return s
+		}
+		if s := scalarExprToStr(e); s != "" {
+			return s
+		}
 		return fmt.Sprintf("%+v, ", e)
 	}
 }
 
+func exprListToStr(exprs []Expr) string {
+	strs := make([]string, len(exprs))
+	for i, e := range exprs {
+		strs[i] = exprToStr(e)
+	}
+	return strings.Join(strs, ", ")
+}
+
 func opToStr(op BoolOp) string {
 	switch op {
 	case OpEq:
@@ -783,11 +1541,39 @@ func opToStr(op BoolOp) string {
 		return "<"
 	case OpLike:
 		return " LIKE "
-
+	case OpILike:
+		return " ILIKE "
+	case OpRegexp:
+		return " REGEXP "
+	case OpSimilarTo:
+		return " SIMILAR TO "
 	}
 	return "??"
 }
 
+// Describe the type of a join in a query plan; inner joins aren't labeled.
+func joinTypeToStr(jt JoinType) string {
+	if jt == InnerJoin {
+		return ""
+	}
+	return fmt.Sprintf("%v, ", jt)
+}
+
+// Describe the equality keys and other conditions of a join.
+func joinConditionsToStr(leftKeys, rightKeys []Expr, conds []Expr) string {
+	var condStrs []string
+	for i := range leftKeys {
+		condStrs = append(condStrs, exprToStr(leftKeys[i])+" == "+exprToStr(rightKeys[i]))
+	}
+	for _, cond := range conds {
+		condStrs = append(condStrs, exprToStr(cond))
+	}
+	if len(condStrs) == 0 {
+		return "cross product"
+	}
+	return strings.Join(condStrs, " AND ")
+}
+
 // following is absolute grossness because we forgot to ask students
 // to expose heapfile name
 func GetUnexportedField(field reflect.Value) interface{} {
@@ -802,6 +1588,21 @@ func OutputPhysicalPlan(printf func(format string, a ...any), o Operator, indent
 		indent = indent + "\t"
 		OutputPhysicalPlan(printf, *op.left, indent)
 		OutputPhysicalPlan(printf, *op.right, indent)
+	case *GraceHashJoin:
+		printf("%sGrace Hash Join, %s%s, card:%d\n", indent, joinTypeToStr(op.joinType), joinConditionsToStr(op.leftFields, op.rightFields, op.residual), oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, *op.left, indent)
+		OutputPhysicalPlan(printf, *op.right, indent)
+	case *NestedLoopJoin:
+		printf("%sNested Loop Join, %s%s, card:%d\n", indent, joinTypeToStr(op.joinType), joinConditionsToStr(nil, nil, op.conditions), oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, *op.left, indent)
+		OutputPhysicalPlan(printf, *op.right, indent)
+	case *SortMergeJoin:
+		printf("%sSort Merge Join, %+v == %+v, card:%d\n", indent, exprToStr(op.leftField), exprToStr(op.rightField), oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, *op.left, indent)
+		OutputPhysicalPlan(printf, *op.right, indent)
 	case *Project:
 		selectStr := ""
 		for _, ex := range op.selectFields {
@@ -812,13 +1613,41 @@ func OutputPhysicalPlan(printf func(format string, a ...any), o Operator, indent
 		OutputPhysicalPlan(printf, op.child, indent)
 
 	case *Filter:
-		printf("%sFilter %s %s %s, card:%d", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right), oc.Cardinality)
+		if op.left == nil {
+			printf("%sFilter %s, card:%d", indent, exprToStr(op.pred), oc.Cardinality)
+		} else {
+			printf("%sFilter %s %s %s, card:%d", indent, exprToStr(op.left), opToStr(op.op), exprToStr(op.right), oc.Cardinality)
+		}
 		indent = indent + "\t"
 		OutputPhysicalPlan(printf, op.child, indent)
 
 	case *HeapFile:
 		printf("%sHeap Scan %s, card:%d\n", indent, op.BackingFile(), oc.Cardinality)
 
+	case *TableAliasOp:
+		printf("%sSubquery %s, card:%d\n", indent, op.alias, oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, op.child, indent)
+
+	case *Window:
+		funcs := ""
+		for _, f := range op.funcs {
+			funcs += f.name + ","
+		}
+		printf("%sWindow %s partition by %s order by %s, card:%d\n", indent, funcs, exprListToStr(op.partitionBy), exprListToStr(op.orderBy), oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, op.child, indent)
+
+	case *SetOp:
+		all := ""
+		if op.all {
+			all = " ALL"
+		}
+		printf("%s%v%s, card:%d\n", indent, op.op, all, oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, op.left, indent)
+		OutputPhysicalPlan(printf, op.right, indent)
+
 	case *OrderBy:
 		orderStr := ""
 		if len(op.orderBy) > 0 {
@@ -827,6 +1656,9 @@ func OutputPhysicalPlan(printf func(format string, a ...any), o Operator, indent
 				orderStr += ", " + exprToStr(op.orderBy[i])
 			}
 		}
+		if op.limit >= 0 {
+			orderStr += fmt.Sprintf(", top %d", op.limit)
+		}
 		printf("%sOrder By %s, card:%d\n", indent, orderStr, oc.Cardinality)
 		indent = indent + "\t"
 		OutputPhysicalPlan(printf, op.child, indent)
@@ -836,21 +1668,13 @@ func OutputPhysicalPlan(printf func(format string, a ...any), o Operator, indent
 		indent = indent + "\t"
 		OutputPhysicalPlan(printf, op.child, indent)
 
-	case *Aggregator:
-		gbyStr := ""
-		if len(op.groupByFields) > 0 {
-			gbyStr = "Group By "
-		}
-		for _, ex := range op.groupByFields {
-			gbyStr += exprToStr(ex) + ","
-		}
-
-		aggStr := ""
-		for _, ex := range op.newAggState {
-			aggStr += fmt.Sprintf("%s(%s),", reflect.TypeOf(ex), ex.GetTupleDesc().HeaderString(false))
-		}
+	case *SortAggregator:
+		printf("%sSort Aggregate, %s, card:%d\n", indent, aggregatorToStr(op.Aggregator), oc.Cardinality)
+		indent = indent + "\t"
+		OutputPhysicalPlan(printf, op.child, indent)
 
-		printf("%sAggregate, %s %s, card:%d\n", indent, aggStr, gbyStr, oc.Cardinality)
+	case *Aggregator:
+		printf("%sAggregate, %s, card:%d\n", indent, aggregatorToStr(op), oc.Cardinality)
 		indent = indent + "\t"
 		OutputPhysicalPlan(printf, op.child, indent)
 
@@ -859,6 +1683,23 @@ func OutputPhysicalPlan(printf func(format string, a ...any), o Operator, indent
 	}
 }
 
+func aggregatorToStr(op *Aggregator) string {
+	gbyStr := ""
+	if len(op.groupByFields) > 0 {
+		gbyStr = "Group By "
+	}
+	for _, ex := range op.groupByFields {
+		gbyStr += exprToStr(ex) + ","
+	}
+
+	aggStr := ""
+	for _, ex := range op.newAggState {
+		aggStr += fmt.Sprintf("%s(%s),", reflect.TypeOf(ex), ex.GetTupleDesc().HeaderString(false))
+	}
+
+	return aggStr + " " + gbyStr
+}
+
 func PrintPhysicalPlan(o Operator, indent string) {
 	OutputPhysicalPlan(func(s string, a ...any) { fmt.Printf(s, a...) }, o, indent)
 }
@@ -869,8 +1710,8 @@ type OperatorCard struct {
 	Op          Operator
 }
 
-func (o *OperatorCard) Statistics() map[string]map[string]float64 {
-	return o.Op.Statistics()
+func (o *OperatorCard) SampleInfo() *SampleInfo {
+	return o.Op.SampleInfo()
 }
 
 func (o *OperatorCard) Descriptor() *TupleDesc {
@@ -891,6 +1732,69 @@ func NewOperatorCard(op Operator, card int) *OperatorCard {
 
 var EnableJoinOptimization = true
 
+// Whether op produces tuples in ascending order of e.
+func isSortedOn(op Operator, e Expr) bool {
+	if oc, ok := op.(*OperatorCard); ok {
+		op = oc.Op
+	}
+	switch o := op.(type) {
+	case *OrderBy:
+		return len(o.orderBy) > 0 && o.ascending[0] && exprToStr(o.orderBy[0]) == exprToStr(e)
+	case *SortMergeJoin:
+		return exprToStr(o.leftField) == exprToStr(e) || exprToStr(o.rightField) == exprToStr(e)
+	}
+	return false
+}
+
+// Whether op returns all of the tuples with the same values of exprs
+// consecutively, so they can be aggregated without a hash table.
+func isGroupedOn(op Operator, exprs []Expr) bool {
+	if oc, ok := op.(*OperatorCard); ok {
+		op = oc.Op
+	}
+	switch o := op.(type) {
+	case *Filter:
+		return isGroupedOn(o.child, exprs)
+	case *OrderBy:
+		// the leading sort keys must be exactly the grouping expressions,
+		// in any order and direction
+		if len(o.orderBy) < len(exprs) {
+			return false
+		}
+		for _, e := range exprs {
+			found := false
+			for _, key := range o.orderBy[:len(exprs)] {
+				found = found || exprToStr(key) == exprToStr(e)
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case *SortMergeJoin:
+		return len(exprs) == 1 && isSortedOn(op, exprs[0])
+	}
+	return false
+}
+
+// Build the physical operator for an equality join between left and right,
+// using [chooseJoinAlgorithm] to decide which join implementation to use.
+func makeJoinOp(c *Catalog, left *OperatorCard, leftExpr Expr, right *OperatorCard, rightExpr Expr) (Operator, error) {
+	leftSorted := isSortedOn(left, leftExpr)
+	rightSorted := isSortedOn(right, rightExpr)
+	alg := chooseJoinAlgorithm(left.Cardinality, leftSorted, rightSorted)
+	DebugParser("joining %v and %v with %v join, left card is %v", exprToStr(leftExpr), exprToStr(rightExpr), alg, left.Cardinality)
+	switch alg {
+	case MergeJoin:
+		return NewSortMergeJoin(left, leftExpr, right, rightExpr, leftSorted, rightSorted)
+	case GraceJoin:
+		if c.bufferPool != nil {
+			return NewGraceHashJoin(left, leftExpr, right, rightExpr, c.bufferPool, JoinMemoryBudget)
+		}
+	}
+	return NewJoin(left, leftExpr, right, rightExpr, JoinBufferSize)
+}
+
 type DummyStats struct {
 }
 
@@ -906,24 +1810,360 @@ func (s *DummyStats) EstimateSelectivity(field string, op BoolOp, val DBValue) (
 	return 1.0, nil
 }
 
-type TableAndField struct {
-	table string
-	field string
+// Find the plan nodes that the two sides of a join predicate read from. A
+// side that doesn't read any table (a constant) has a nil node.
+func joinCondNodes(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode, j *LogicalJoinNode) (*PlanNode, *PlanNode, error) {
+	var nodes [2]*PlanNode
+	if j.pred != nil {
+		// general predicates are only ever join residuals
+		return nil, nil, nil
+	}
+	for i, side := range []*LogicalSelectNode{j.left, j.right} {
+		tabName, fieldName, err := side.getTableField(c, plan.subqueries, plan.tables)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tabName == "" && fieldName == "" {
+			continue
+		}
+		nodes[i], err = fieldToOp(tabName, fieldName, tableMap)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nodes[0], nodes[1], nil
+}
+
+// Point every table that was read by one of the old nodes at newNode.
+func replacePlanNodes(tableMap map[string]*PlanNode, newNode *PlanNode, oldNodes ...*PlanNode) {
+	for key, node := range tableMap {
+		for _, old := range oldNodes {
+			if node.op == old.op {
+				tableMap[key] = newNode
+			}
+		}
+	}
+}
+
+// Apply a join predicate whose sides can both be evaluated on node as a filter.
+func makeJoinFilter(c *Catalog, tableMap map[string]*PlanNode, node *PlanNode, j *LogicalJoinNode) (*PlanNode, error) {
+	var f LogicalFilterNode
+	if j.pred != nil {
+		f.pred = j.pred
+	} else {
+		f = LogicalFilterNode{fieldExpr: *j.left, constExpr: *j.right, predOp: j.predOp}
+	}
+	newOp, err := makeFilterOp(c, &f, node.desc, tableMap, node.op)
+	if err != nil {
+		return nil, err
+	}
+	return &PlanNode{NewOperatorCard(newOp, node.op.Cardinality), node.desc}, nil
+}
+
+// Join left and right on conds. Equalities between the two inputs become the
+// keys of a hash join, and the remaining predicates are checked on each
+// joined tuple. Without any equalities, a nested loop join is used.
+func makeJoinFromConds(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode, left *PlanNode, right *PlanNode, conds []*LogicalJoinNode, joinType JoinType) (*PlanNode, error) {
+	var leftKeys, rightKeys []Expr
+	var residual []Expr
+	joinedDesc := left.desc.merge(right.desc)
+	for _, j := range conds {
+		n1, n2, err := joinCondNodes(c, plan, tableMap, j)
+		if err != nil {
+			return nil, err
+		}
+		if j.predOp == OpEq && n1 != nil && n2 != nil {
+			var l, r *LogicalSelectNode
+			if n1.op == left.op && n2.op == right.op {
+				l, r = j.left, j.right
+			} else if n1.op == right.op && n2.op == left.op {
+				l, r = j.right, j.left
+			}
+			if l != nil {
+				leftExpr, _, err := l.generateExpr(c, left.desc, tableMap)
+				if err != nil {
+					return nil, err
+				}
+				rightExpr, _, err := r.generateExpr(c, right.desc, tableMap)
+				if err != nil {
+					return nil, err
+				}
+				leftKeys = append(leftKeys, leftExpr)
+				rightKeys = append(rightKeys, rightExpr)
+				continue
+			}
+		}
+		if j.pred != nil {
+			pred, _, err := j.pred.generateExpr(c, joinedDesc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			residual = append(residual, pred)
+			continue
+		}
+		leftExpr, _, err := j.left.generateExpr(c, joinedDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		rightExpr, _, err := j.right.generateExpr(c, joinedDesc, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		residual = append(residual, &CompareExpr{leftExpr, j.predOp, rightExpr})
+	}
+
+	card := EstimateJoinCardinality(left.op.Cardinality, right.op.Cardinality)
+	if joinType.leftOnly() || joinType == SingleJoin {
+		card = left.op.Cardinality
+	}
+	var newOp Operator
+	var err error
+	switch {
+	case joinType == InnerJoin && len(leftKeys) == 1 && len(residual) == 0:
+		newOp, err = makeJoinOp(c, left.op, leftKeys[0], right.op, rightKeys[0])
+	case len(leftKeys) > 0 && c.bufferPool != nil:
+		newOp, err = NewHashJoin(left.op, leftKeys, right.op, rightKeys, joinType, residual, c.bufferPool, JoinMemoryBudget)
+	default:
+		for i := range leftKeys {
+			residual = append(residual, &CompareExpr{leftKeys[i], OpEq, rightKeys[i]})
+		}
+		if len(residual) == 0 && left.op.Cardinality >= 0 && right.op.Cardinality >= 0 {
+			card = left.op.Cardinality * right.op.Cardinality
+		}
+		newOp, err = NewNestedLoopJoin(left.op, right.op, residual, joinType, JoinMemoryBudget)
+	}
+	if err != nil {
+		return nil, err
+	}
+	DebugParser("in makePhysicalPlan newOp is %v, %v join with %d keys\n", newOp.Descriptor(), joinType, len(leftKeys))
+	return &PlanNode{NewOperatorCard(newOp, card), newOp.Descriptor()}, nil
+}
+
+// Plan the joins of a query without outer joins, which may be done in any
+// order. All of the predicates between the same two inputs are applied by a
+// single join, and inputs with no predicates between them are combined with
+// cross products.
+func planJoins(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode, tableStats map[string]Stats, sel map[string]float64) (*OperatorCard, error) {
+	join_order := make([]*JoinNode, len(plan.joins))
+	for i, j := range plan.joins {
+		leftName, leftField, err := j.left.getTableField(c, plan.subqueries, plan.tables)
+		if err != nil {
+			return nil, err
+		}
+
+		rightName, rightField, err := j.right.getTableField(c, plan.subqueries, plan.tables)
+		if err != nil {
+			return nil, err
+		}
+
+		leftStats := tableStats[leftName]
+		if leftStats == nil {
+			return nil, GoDBError{ParseError, fmt.Sprintf("no stats for lhs table %s, join %v, tables %v", leftName, j.left, tableMap)}
+		}
+
+		rightStats := tableStats[rightName]
+		if rightStats == nil {
+			return nil, GoDBError{ParseError, fmt.Sprintf("no stats for rhs table %s, join %v, tables %v", rightName, j, tableMap)}
+		}
+
+		join_order[i] = &JoinNode{
+			leftTable:  TableInfo{leftName, leftStats, sel[leftName]},
+			leftField:  leftField,
+			rightTable: TableInfo{rightName, rightStats, sel[rightName]},
+			rightField: rightField,
+			cond:       j,
+		}
+	}
+
+	if EnableJoinOptimization {
+		var err error
+		join_order, err = OrderJoins(join_order)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//apply joins, grouping together the predicates between the same inputs
+	done := make(map[*LogicalJoinNode]bool)
+	for _, j := range join_order {
+		if done[j.cond] {
+			continue
+		}
+		node1, node2, err := joinCondNodes(c, plan, tableMap, j.cond)
+		if err != nil {
+			return nil, err
+		}
+		if node1.op == node2.op {
+			// both sides have already been joined together
+			newNode, err := makeJoinFilter(c, tableMap, node1, j.cond)
+			if err != nil {
+				return nil, err
+			}
+			replacePlanNodes(tableMap, newNode, node1)
+			done[j.cond] = true
+			continue
+		}
+
+		var conds []*LogicalJoinNode
+		for _, other := range join_order {
+			if done[other.cond] {
+				continue
+			}
+			n1, n2, err := joinCondNodes(c, plan, tableMap, other.cond)
+			if err != nil {
+				return nil, err
+			}
+			if (n1.op == node1.op && n2.op == node2.op) || (n1.op == node2.op && n2.op == node1.op) {
+				conds = append(conds, other.cond)
+				done[other.cond] = true
+			}
+		}
+
+		newNode, err := makeJoinFromConds(c, plan, tableMap, node1, node2, conds, InnerJoin)
+		if err != nil {
+			return nil, err
+		}
+		replacePlanNodes(tableMap, newNode, node1, node2)
+	}
+
+	//any inputs that still aren't joined are combined with cross products
+	var names []string
+	for _, p := range plan.subqueries {
+		names = append(names, p.alias)
+	}
+	for _, t := range plan.tables {
+		if t.alias != "" {
+			names = append(names, t.alias)
+		} else {
+			names = append(names, t.tableName)
+		}
+	}
+	var cur *PlanNode
+	for _, name := range names {
+		node := tableMap[name]
+		if cur == nil || node.op == cur.op {
+			cur = node
+			continue
+		}
+		newNode, err := makeJoinFromConds(c, plan, tableMap, cur, node, nil, InnerJoin)
+		if err != nil {
+			return nil, err
+		}
+		replacePlanNodes(tableMap, newNode, cur, node)
+		cur = newNode
+	}
+	if cur == nil {
+		return nil, nil
+	}
+	return cur.op, nil
+}
+
+// Plan the joins of a query with outer joins, following the structure of its
+// FROM clause. Join predicates from the WHERE clause are applied by an inner
+// join when no outer join above it pads its inputs with NULLs, and otherwise
+// as filters after all of the joins.
+func planJoinTree(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode) (*OperatorCard, error) {
+	whereDone := make(map[*LogicalJoinNode]bool)
+
+	var planTree func(t *LogicalJoinTree, padded bool) (*PlanNode, error)
+	planTree = func(t *LogicalJoinTree, padded bool) (*PlanNode, error) {
+		if t.left == nil {
+			node := tableMap[t.alias]
+			if node == nil {
+				return nil, GoDBError{ParseError, fmt.Sprintf("no table in catalog matching '%s'", t.alias)}
+			}
+			return node, nil
+		}
+		left, err := planTree(t.left, padded || t.joinType == RightOuterJoin || t.joinType == FullOuterJoin)
+		if err != nil {
+			return nil, err
+		}
+		right, err := planTree(t.right, padded || t.joinType == LeftOuterJoin || t.joinType == FullOuterJoin)
+		if err != nil {
+			return nil, err
+		}
+
+		conds := append([]*LogicalJoinNode{}, t.conds...)
+		if t.joinType == InnerJoin && !padded {
+			for _, j := range plan.joins {
+				if whereDone[j] {
+					continue
+				}
+				n1, n2, err := joinCondNodes(c, plan, tableMap, j)
+				if err != nil {
+					return nil, err
+				}
+				if (n1.op == left.op && n2.op == right.op) || (n1.op == right.op && n2.op == left.op) {
+					conds = append(conds, j)
+					whereDone[j] = true
+				}
+			}
+		}
+
+		newNode, err := makeJoinFromConds(c, plan, tableMap, left, right, conds, t.joinType)
+		if err != nil {
+			return nil, err
+		}
+		replacePlanNodes(tableMap, newNode, left, right)
+		return newNode, nil
+	}
+
+	top, err := planTree(plan.joinTree, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range plan.joins {
+		if whereDone[j] {
+			continue
+		}
+		newNode, err := makeJoinFilter(c, tableMap, top, j)
+		if err != nil {
+			return nil, err
+		}
+		replacePlanNodes(tableMap, newNode, top)
+		top = newNode
+	}
+	return top.op, nil
+}
+
+// Return the plan node for the single input that a predicate reads, or nil if
+// it reads more than one input (or none) or reads a table in skipTables.
+func predicateNode(c *Catalog, plan *LogicalPlan, tableMap map[string]*PlanNode, pred *LogicalSelectNode, skipTables map[string]bool) (*PlanNode, error) {
+	refs, err := pred.columnRefs(c, plan.subqueries, plan.tables)
+	if err != nil {
+		return nil, err
+	}
+	var node *PlanNode
+	for _, ref := range refs {
+		if skipTables[ref.table] {
+			return nil, nil
+		}
+		n, err := fieldToOp(ref.table, ref.field, tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil && n.op != node.op {
+			return nil, nil
+		}
+		node = n
+	}
+	return node, nil
 }
 
 func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
+	if plan.setOp != nil {
+		return makeSetOpPlan(c, plan)
+	}
 	tableMap := make(map[string]*PlanNode) // mapping from table aliases to operators
 	tableStats := make(map[string]Stats)   // mapping from table aliases to table stats
 	sel := make(map[string]float64)        // mapping from table aliases to selectivities
 
 	for _, p := range plan.subqueries {
-		subPhysP, err := makePhysicalPlan(c, p)
+		subPhysP, err := makeDerivedTablePlan(c, p)
 		if err != nil {
 			return nil, err
 		}
-		td := subPhysP.Descriptor()
-		td.setTableAlias(p.alias)
-		tableMap[p.alias] = &PlanNode{subPhysP, td}
+		tableMap[p.alias] = &PlanNode{subPhysP, subPhysP.Descriptor()}
 		tableStats[p.alias] = &DummyStats{}
 		sel[p.alias] = 1.0
 	}
@@ -948,12 +2188,42 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 		if stats != nil {
 			card = stats.EstimateCardinality(1.0)
 		}
+		if hf, ok := (*t.file).(*HeapFile); ok && card <= 0 {
+			// no stats computed, assume the pages we have are full
+			card = hf.NumPages() * hf.numSlots
+		}
 		tableMap[name] = &PlanNode{NewOperatorCard(*t.file, card), td}
 		sel[name] = 1.0
 	}
 
+	// WHERE conditions on tables that an outer join may pad with NULLs can't
+	// be applied until after the join
+	nullSupplying := make(map[string]bool)
+	if plan.joinTree != nil {
+		plan.joinTree.nullSupplyingTables(nullSupplying)
+	}
+	var deferredFilters []*LogicalFilterNode
+
 	//now apply each filter to appropriate table
 	for _, f := range plan.filters {
+		if f.pred != nil {
+			// a general predicate is pushed down to the one input it reads,
+			// or else applied after the joins
+			node, err := predicateNode(c, plan, tableMap, f.pred, nullSupplying)
+			if err != nil {
+				return nil, err
+			}
+			if node == nil {
+				deferredFilters = append(deferredFilters, f)
+				continue
+			}
+			newOp, err := makeFilterOp(c, f, node.desc, tableMap, node.op)
+			if err != nil {
+				return nil, err
+			}
+			replacePlanNodes(tableMap, &PlanNode{NewOperatorCard(newOp, node.op.Cardinality), node.desc}, node)
+			continue
+		}
 		tabName, fieldName, err := f.fieldExpr.getTableField(c, plan.subqueries, plan.tables)
 		if err != nil {
 			return nil, err
@@ -978,7 +2248,16 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 		fieldType := leftExpr.GetExprType()
 		table := fieldType.TableQualifier
 		field := fieldType.Fname
+		if table == "" {
+			// functions of functions of a field don't know the field's
+			// table, so use the table it was resolved to
+			table = tabName
+		}
 		table_stats := tableStats[table]
+		if nullSupplying[table] {
+			deferredFilters = append(deferredFilters, f)
+			continue
+		}
 
 		filterSel := 1.0
 		constExpr, ok := rightExpr.(*ConstExpr)
@@ -998,131 +2277,59 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 		tableMap[table] = &PlanNode{NewOperatorCard(newOp, int(float64(op.Cardinality)*filterSel)), &desc}
 	}
 
-	selects := make(map[TableAndField]*LogicalSelectNode)
-	join_order := make([]*JoinNode, len(plan.joins))
-	for i, j := range plan.joins {
-		leftName, leftField, err := j.left.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		rightName, rightField, err := j.right.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		leftStats := tableStats[leftName]
-		if leftStats == nil {
-			return nil, GoDBError{ParseError, fmt.Sprintf("no stats for lhs table %s, join %v, tables %v", leftName, j.left, tableMap)}
-		}
-
-		rightStats := tableStats[rightName]
-		if rightStats == nil {
-			return nil, GoDBError{ParseError, fmt.Sprintf("no stats for rhs table %s, join %v, tables %v", rightName, j, tableMap)}
-		}
-
-		join_order[i] = &JoinNode{
-			leftTable:  TableInfo{leftName, leftStats, sel[leftName]},
-			leftField:  leftField,
-			rightTable: TableInfo{rightName, rightStats, sel[rightName]},
-			rightField: rightField,
-		}
-		selects[TableAndField{leftName, leftField}] = j.left
-		selects[TableAndField{rightName, rightField}] = j.right
+	// the filtered tables, for wander joins, which do their own joining
+	var wanderInputs map[string]*PlanNode
+	if plan.wanderJoin {
+		wanderInputs = maps.Clone(tableMap)
 	}
 
-	if EnableJoinOptimization {
-		var err error
-		join_order, err = OrderJoins(join_order)
-		if err != nil {
-			return nil, err
-		}
+	var topOp *OperatorCard
+	var err error
+	if plan.joinTree != nil {
+		topOp, err = planJoinTree(c, plan, tableMap)
+	} else {
+		topOp, err = planJoins(c, plan, tableMap, tableStats, sel)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	//finally apply joins
-	for _, j := range join_order {
-		left := selects[TableAndField{j.leftTable.name, j.leftField}]
-		right := selects[TableAndField{j.rightTable.name, j.rightField}]
-
-		lTabName, lFieldName, err := left.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		node1, err := fieldToOp(lTabName, lFieldName, tableMap)
-		if err != nil {
-			return nil, err
-		}
-
-		DebugParser("in makePhysical plan right is %v\n", right.String())
-		rTabName, rFieldName, err := right.getTableField(c, plan.subqueries, plan.tables)
-		if err != nil {
-			return nil, err
-		}
-
-		node2, err := fieldToOp(rTabName, rFieldName, tableMap)
+	for _, f := range deferredFilters {
+		newOp, err := makeFilterOp(c, f, topOp.Descriptor(), tableMap, topOp)
 		if err != nil {
 			return nil, err
 		}
+		topOp = NewOperatorCard(newOp, topOp.Cardinality)
+	}
 
-		/*desc1 := *op1.Descriptor()
-		desc1.setTableAlias(j.t1)
-		desc2 := *op2.Descriptor()
-		desc2.setTableAlias(j.t2)
-		*/
-		op1 := node1.op
-		op2 := node2.op
-
-		/*
-			leftField, _ := fieldNameToField(j.t1, j.f1, node1)
-			rightField, _ := fieldNameToField(j.t2, j.f2, node2)
-		*/
-		leftExpr, _, err := left.generateExpr(c, node1.desc, tableMap)
+	// the subqueries of the WHERE clause and select list are joined with
+	// everything else
+	for _, sj := range plan.subqueryJoins {
+		subPhysP, err := makeDerivedTablePlan(c, sj.plan)
 		if err != nil {
 			return nil, err
 		}
-
-		DebugParser("uhh %v GAP %v\n", node2.desc, c)
-		rightExpr, _, err := right.generateExpr(c, node2.desc, tableMap)
-		if err != nil {
-			return nil, err
+		left := &PlanNode{topOp, topOp.Descriptor()}
+		for name := range tableMap {
+			tableMap[name] = left
 		}
-
-		newOp, err := NewJoin(op1, leftExpr, op2, rightExpr, JoinBufferSize)
+		right := &PlanNode{subPhysP, subPhysP.Descriptor()}
+		tableMap[sj.plan.alias] = right
+		newNode, err := makeJoinFromConds(c, plan, tableMap, left, right, sj.conds, sj.joinType)
 		if err != nil {
 			return nil, err
 		}
-		DebugParser("in makePhysicalPlan newOp is %v LEFT: %v RIGHT: %v\n", newOp.Descriptor(), newOp.leftField.GetExprType().Fname, newOp.rightField.GetExprType().Fname)
-
-		newNode := &PlanNode{NewOperatorCard(newOp, EstimateJoinCardinality(node1.op.Cardinality, node2.op.Cardinality)), newOp.Descriptor()}
-		for key, node := range tableMap {
-			if node.op == op1 {
-				tableMap[key] = newNode
-			}
-			if node.op == op2 {
-				tableMap[key] = newNode
-			}
-		}
-		tableMap[lTabName] = newNode
-		tableMap[rTabName] = newNode
-	}
-
-	//check that all tables have the same op (all tables are joined)
-	first := true
-	var curOp *OperatorCard
-	for _, node := range tableMap {
-		if first {
-			curOp = node.op
-			first = false
-		} else {
-			if curOp != node.op {
-				return nil, GoDBError{ParseError, "not all tables are joined, cross products are not supported in GoDB"}
+		replacePlanNodes(tableMap, newNode, left, right)
+		topOp = newNode.op
+		if sj.filter != nil {
+			newOp, err := makeFilterOp(c, &LogicalFilterNode{pred: sj.filter}, topOp.Descriptor(), tableMap, topOp)
+			if err != nil {
+				return nil, err
 			}
+			topOp = NewOperatorCard(newOp, topOp.Cardinality)
 		}
 	}
 
-	topOp := curOp
-
 	//var fieldList []FieldType
 	var fieldNames []string
 	hasAgg := len(plan.aggs) > 0
@@ -1137,6 +2344,25 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 		}
 	*/
 
+	// for comparisons with aggregates over their confidence intervals, the
+	// fields of the error bounds of the aggregates (which the HAVING clause
+	// may also refer to by their aliases in the select list)
+	var havingBounds map[FieldType]FieldType
+	if plan.having != nil && HavingConfidence != HavingEstimate {
+		havingBounds = make(map[FieldType]FieldType)
+	}
+	// estimates from a sample are output with their error bounds (see
+	// [ErrorBounder]), by the fields of the aggregates
+	var sampleBounds map[FieldType]FieldType
+	var sampleBoundAggs []AggState
+	if hasAgg && topOp.Op.SampleInfo().IsSample() {
+		sampleBounds = make(map[FieldType]FieldType)
+	}
+
+	// the operator running the query online, if any (see
+	// [OnlineAggregation] and [WanderJoin])
+	var online onlineAggregator
+
 	if hasAgg {
 		var gbys []Expr
 		var aggs []AggState
@@ -1155,8 +2381,6 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 			*/
 
 			if s.exprType == ExprAggr {
-				var as AggState
-
 				tabName, fieldName, err := s.args[0].getTableField(c, plan.subqueries, plan.tables)
 				if err != nil {
 					return nil, err
@@ -1169,21 +2393,24 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 				if err != nil {
 					return nil, err
 				}
+				if s.args[0].isStar() {
+					aggExpr = countStarExpr
+				}
 
-				switch *s.funcOp {
-				case "max":
-					as = &MaxAggState{}
-
-				case "min":
-					as = &MinAggState{}
-				case "avg":
-					as = &AvgAggState{}
-				case "sum":
-					as = &SumAggState{}
-				case "count":
-					as = &CountAggState{}
-				default:
-					return nil, GoDBError{IllegalOperationError, fmt.Sprintf("unknown aggregate function %s", *s.funcOp)}
+				as, err := newAggState(*s.funcOp)
+				if err != nil {
+					return nil, err
+				}
+				var params []Expr
+				for _, p := range s.args[1:] {
+					param, _, err := p.generateExpr(c, node.desc, tableMap)
+					if err != nil {
+						return nil, err
+					}
+					params = append(params, param)
+				}
+				if err := setAggParams(*s.funcOp, as, params); err != nil {
+					return nil, err
 				}
 
 				//make sure name has unique id
@@ -1203,6 +2430,21 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 					return nil, fmt.Errorf("Unexpected null tuple descriptor for aggregate %s", name)
 				}
 				s.cachedField = &td.Fields[0]
+
+				if havingBounds != nil || sampleBounds != nil {
+					if bound := NewErrorBoundAggState(fmt.Sprintf("bound(%s)", name), as); bound != nil {
+						boundField := bound.GetTupleDesc().Fields[0]
+						if havingBounds != nil {
+							aggs = append(aggs, bound)
+							havingBounds[td.Fields[0]] = boundField
+						} else {
+							sampleBoundAggs = append(sampleBoundAggs, bound)
+						}
+						if sampleBounds != nil {
+							sampleBounds[td.Fields[0]] = boundField
+						}
+					}
+				}
 			}
 		}
 
@@ -1214,10 +2456,71 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 			gbys = append(gbys, expr)
 		}
 
-		if len(gbys) == 0 {
+		if plan.wanderJoin {
+			wj, err := planWanderJoin(c, plan, wanderInputs, deferredFilters, gbys, aggs)
+			if err != nil {
+				return nil, err
+			}
+			online = wj
+		} else if len(gbys) == 0 && OnlineAggregation && plan.having == nil && len(plan.windows) == 0 {
+			if rj := planRippleJoin(aggs, topOp); rj != nil {
+				online = rj
+			}
+		}
+		if online != nil {
+			// online operators output their own error bounds
+			sampleBounds = nil
+		} else {
+			aggs = append(aggs, sampleBoundAggs...)
+		}
+		if online != nil {
+			topOp = NewOperatorCard(online, 1)
+		} else if len(gbys) == 0 {
 			topOp = NewOperatorCard(NewAggregator(aggs, topOp), 1)
 		} else {
-			topOp = NewOperatorCard(NewGroupedAggregator(aggs, gbys, topOp), 0)
+			var aggOp Operator
+			var err error
+			if isGroupedOn(topOp, gbys) {
+				aggOp, err = NewSortAggregator(aggs, gbys, topOp)
+			} else if c.bufferPool != nil {
+				aggOp, err = NewSpillingGroupedAggregator(aggs, gbys, topOp, c.bufferPool, AggMemoryBudget)
+			} else {
+				aggOp = NewGroupedAggregator(aggs, gbys, topOp)
+			}
+			if err != nil {
+				return nil, err
+			}
+			topOp = NewOperatorCard(aggOp, 0)
+		}
+	}
+
+	// the HAVING clause filters the output of the aggregation, before the
+	// select list is projected
+	var havingConfident Expr
+	if plan.having != nil {
+		pred, _, err := plan.having.generateExpr(c, topOp.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		if HavingConfidence != HavingEstimate {
+			pred = intervalPredicate(pred, havingBounds)
+		}
+		if HavingConfidence == HavingPossible {
+			// pass groups for which the predicate is true or unknown
+			havingConfident = &IsNullExpr{pred, true}
+			pred = &OrExpr{[]Expr{pred, &IsNullExpr{pred, false}}}
+		}
+		filterOp, err := NewPredicateFilter(pred, topOp)
+		if err != nil {
+			return nil, err
+		}
+		topOp = NewOperatorCard(filterOp, topOp.Cardinality)
+	}
+
+	if len(plan.windows) > 0 {
+		topOp, err = planWindows(c, plan, topOp, tableMap)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -1237,6 +2540,42 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 			fieldNames = append(fieldNames, field)
 		}
 	}
+	if sampleBounds != nil && !selectAll {
+		for _, s := range plan.selects {
+			if s.exprType != ExprAggr || s.cachedField == nil {
+				continue
+			}
+			if bound, ok := sampleBounds[*s.cachedField]; ok {
+				exprList = append(exprList, &FieldExpr{bound})
+				fieldNames = append(fieldNames, bound.Fname)
+			}
+		}
+	}
+	if havingConfident != nil && !selectAll {
+		exprList = append(exprList, havingConfident)
+		fieldNames = append(fieldNames, HavingConfidentField)
+	}
+	if online != nil && !selectAll {
+		// the running estimates are output with their error bounds and
+		// progress
+		for _, field := range online.boundFields() {
+			exprList = append(exprList, &FieldExpr{field})
+			fieldNames = append(fieldNames, field.Fname)
+		}
+	}
+	if selectAll {
+		// the values of the scalar subqueries of the WHERE clause, which are
+		// joined with the rows they filter, aren't part of *
+		exprList, fieldNames = nil, nil
+		for _, f := range topOp.Descriptor().Fields {
+			if plan.isWhereSubqueryField(f) {
+				selectAll = false
+				continue
+			}
+			exprList = append(exprList, &FieldExpr{f})
+			fieldNames = append(fieldNames, f.Fname)
+		}
+	}
 	if !selectAll {
 		projOp, err := NewProjectOp(exprList, fieldNames, plan.distinct, topOp)
 		if err != nil {
@@ -1245,6 +2584,26 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 		topOp = NewOperatorCard(projOp, topOp.Cardinality)
 	}
 
+	return planOrderByLimit(c, plan, topOp, tableMap)
+}
+
+// Sort and limit the output of a plan, topOp.
+func planOrderByLimit(c *Catalog, plan *LogicalPlan, topOp *OperatorCard, tableMap map[string]*PlanNode) (*OperatorCard, error) {
+	var limitExpr Expr
+	var numTups int64
+	if plan.limit != nil {
+		var err error
+		limitExpr, _, err = plan.limit.generateExpr(c, topOp.Descriptor(), tableMap)
+		if err != nil {
+			return nil, err
+		}
+		numTupsExpr, err := limitExpr.EvalExpr(&Tuple{})
+		if err != nil {
+			return nil, err
+		}
+		numTups = numTupsExpr.(IntField).Value
+	}
+
 	if len(plan.orderByFields) > 0 {
 		var ascs []bool
 
@@ -1258,7 +2617,24 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 			ascs = append(ascs, oby.ascending)
 
 		}
-		orderOp, err := NewOrderBy(exprs, topOp, ascs)
+		if plan.limit != nil && len(exprs) == 1 && !ascs[0] {
+			// the groups with the highest counts can be found without
+			// keeping every group
+			hhOp, err := planHeavyHitters(topOp, exprs[0], int(numTups), plan.heavyHitters)
+			if err != nil {
+				return nil, err
+			}
+			if hhOp != nil {
+				topOp = hhOp
+			}
+		}
+		var orderOp *OrderBy
+		var err error
+		if c.bufferPool != nil {
+			orderOp, err = NewExternalOrderBy(exprs, topOp, ascs, c.bufferPool, SortMemoryBudget)
+		} else {
+			orderOp, err = NewOrderBy(exprs, topOp, ascs)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -1266,20 +2642,50 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
 	}
 
 	if plan.limit != nil {
-		expr, _, err := plan.limit.generateExpr(c, topOp.Descriptor(), tableMap)
-		if err != nil {
-			return nil, err
-		}
-		numTupsExpr, err := expr.EvalExpr(&Tuple{})
-		if err != nil {
-			return nil, err
+		if orderOp, ok := topOp.Op.(*OrderBy); ok {
+			// only the first numTups tuples of the sort are needed
+			orderOp.setLimit(int(numTups))
 		}
-		numTups := numTupsExpr.(IntField).Value
-		topOp = NewOperatorCard(NewLimitOp(expr, topOp), min(int(numTups), topOp.Cardinality))
+		topOp = NewOperatorCard(NewLimitOp(limitExpr, topOp), min(int(numTups), topOp.Cardinality))
 	}
 	return topOp, nil
 }
 
+// Plan a subquery whose output is read as a table named by its alias.
+func makeDerivedTablePlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
+	subPhysP, err := makePhysicalPlan(c, plan)
+	if err != nil {
+		return nil, err
+	}
+	return NewOperatorCard(NewTableAliasOp(plan.alias, subPhysP), subPhysP.Cardinality), nil
+}
+
+func makeSetOpPlan(c *Catalog, plan *LogicalPlan) (*OperatorCard, error) {
+	left, err := makePhysicalPlan(c, plan.setOp.left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := makePhysicalPlan(c, plan.setOp.right)
+	if err != nil {
+		return nil, err
+	}
+	setOp, err := NewSetOp(plan.setOp.op, plan.setOp.all, left, right)
+	if err != nil {
+		return nil, err
+	}
+	var card int
+	switch plan.setOp.op {
+	case UnionOp:
+		card = left.Cardinality + right.Cardinality
+	case IntersectOp:
+		card = min(left.Cardinality, right.Cardinality)
+	case ExceptOp:
+		card = left.Cardinality
+	}
+	// ORDER BY and LIMIT refer to the output fields by name
+	return planOrderByLimit(c, plan, NewOperatorCard(setOp, card), make(map[string]*PlanNode))
+}
+
 func parseInsert(c *Catalog, insStmt *sqlparser.Insert, tableNames map[string]bool) (Operator, error) {
 	if insStmt.Columns != nil {
 		return nil, GoDBError{ParseError, "GoDB doesn't support inserts of incomplete tuples"}
@@ -1338,7 +2744,7 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete, tableNames map[string]bo
 	if len(delStmt.TableExprs) > 1 {
 		return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
 	}
-	tables, subplans, joins, err := parseFrom(c, delStmt.TableExprs[0])
+	tables, subplans, joins, _, _, err := parseFrom(c, delStmt.TableExprs[0])
 	if tableNames != nil {
 		for _, table := range tables {
 			tableNames[table.tableName] = true
@@ -1369,29 +2775,9 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete, tableNames map[string]bo
 	}
 	var newOp Operator
 	newOp = *tables[0].file
+	node := tableMap[tables[0].tableName]
 	for _, f := range filters {
-		tabName, fieldName, err := f.fieldExpr.getTableField(c, subplans, tables)
-		if err != nil {
-			return nil, err
-		}
-		node, err := fieldToOp(tabName, fieldName, tableMap)
-		if err != nil {
-			return nil, err
-		}
-		leftExpr, _, err := f.fieldExpr.generateExpr(c, node.desc, tableMap)
-		if err != nil {
-			return nil, err
-		}
-		rightExpr, _, err := f.constExpr.generateExpr(c, node.desc, tableMap)
-		if err != nil {
-			return nil, err
-		}
-
-		//op := node.op
-		//dbField, _ := fieldNameToField(f.table, f.field, &PlanNode{op, &desc})
-
-		//newInt, _ := strconv.Atoi(f.constVal)
-		newOp, err = NewFilter(rightExpr, f.predOp, leftExpr, newOp)
+		newOp, err = makeFilterOp(c, f, node.desc, tableMap, newOp)
 		if err != nil {
 			return nil, err
 		}
@@ -1461,21 +2847,34 @@ func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
 }
 
 func Parse(c *Catalog, query string) (map[string]bool, QueryType, Operator, error) {
+	if table, ok := vacuumStatement(query); ok {
+		tableNames := make(map[string]bool)
+		op, err := parseVacuum(c, table, tableNames)
+		if err != nil {
+			return tableNames, UnknownQueryType, nil, err
+		}
+		return tableNames, IteratorType, op, nil
+	}
+	query, ctes, err := splitWith(rewriteQuery(query))
+	if err != nil {
+		return nil, UnknownQueryType, nil, err
+	}
 	stmt, err := sqlparser.Parse(query)
 	if err != nil {
 		return nil, UnknownQueryType, nil, err
 	}
+	if err := inlineCTEs(stmt, ctes); err != nil {
+		return nil, UnknownQueryType, nil, err
+	}
 	tableNames := make(map[string]bool)
 	switch stmt := stmt.(type) {
-	case *sqlparser.Select:
-		plan, err := parseStatement(c, stmt)
+	case sqlparser.SelectStatement:
+		plan, err := parseSelectStatement(c, stmt)
 		if err != nil {
 			//fmt.Printf("Err: %s\n", err.Error())
 			return tableNames, UnknownQueryType, nil, err
 		}
-		for _, table := range plan.tables {
-			tableNames[table.tableName] = true
-		}
+		plan.addTableNames(tableNames)
 		op, err := makePhysicalPlan(c, plan)
 		if err != nil {
 			//fmt.Printf("Err: %s\n", err.Error())
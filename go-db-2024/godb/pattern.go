@@ -0,0 +1,293 @@
+package godb
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+// Pattern matching predicates on strings:
+//
+//   - x LIKE p [ESCAPE e] matches all of x against p, where % matches any
+//     sequence of characters and _ matches any single character. The escape
+//     character (a backslash unless an ESCAPE clause is given) makes the next
+//     character of the pattern match itself. Note that the SQL parser already
+//     uses backslashes to escape characters in string literals, so a literal
+//     % is written as '\\%'.
+//   - x ILIKE p is the same as LIKE, but ignores case.
+//   - x REGEXP p is true if p, a regular expression in Go's syntax (see
+//     [regexp/syntax]), matches any part of x.
+//   - x SIMILAR TO p [ESCAPE e] matches all of x against p, which is a LIKE
+//     pattern that may also use the regular expression operators |, *, +, ?,
+//     {m,n}, parentheses and bracket expressions.
+//
+// When the pattern is a constant, as it almost always is, it is compiled once
+// when the predicate is built rather than for every tuple.
+
+type PatternKind int
+
+const (
+	PatternLike PatternKind = iota
+	PatternILike
+	PatternRegexp
+	PatternSimilarTo
+)
+
+func (k PatternKind) String() string {
+	switch k {
+	case PatternLike:
+		return "LIKE"
+	case PatternILike:
+		return "ILIKE"
+	case PatternRegexp:
+		return "REGEXP"
+	case PatternSimilarTo:
+		return "SIMILAR TO"
+	}
+	return "??"
+}
+
+// The kind of pattern matched by a [BoolOp], if it is a pattern matching
+// operator.
+func patternKind(op BoolOp) (PatternKind, bool) {
+	switch op {
+	case OpLike:
+		return PatternLike, true
+	case OpILike:
+		return PatternILike, true
+	case OpRegexp:
+		return PatternRegexp, true
+	case OpSimilarTo:
+		return PatternSimilarTo, true
+	}
+	return 0, false
+}
+
+// A pattern ready to be matched against strings.
+type compiledPattern struct {
+	// every matching string starts with prefix
+	prefix string
+	// if nil, a string matches if it starts with prefix (and, if exact, is
+	// no longer than prefix)
+	re    *regexp.Regexp
+	exact bool
+}
+
+func (p *compiledPattern) match(s string) bool {
+	if !strings.HasPrefix(s, p.prefix) {
+		return false
+	}
+	if p.re == nil {
+		return !p.exact || len(s) == len(p.prefix)
+	}
+	return p.re.MatchString(s)
+}
+
+// Compile pattern, a pattern of the given kind. escape is the escape character
+// of LIKE and SIMILAR TO patterns, or -1 for none.
+func compilePattern(kind PatternKind, pattern string, escape rune) (*compiledPattern, error) {
+	if kind == PatternRegexp {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, GoDBError{ParseError, fmt.Sprintf("invalid regular expression %s: %s", pattern, err.Error())}
+		}
+		return &compiledPattern{prefix: regexpPrefix(pattern), re: re}, nil
+	}
+
+	var b strings.Builder
+	prefix := ""
+	// whether everything so far has been a literal, and so is part of the
+	// prefix
+	literal := true
+	// whether the pattern is a literal followed by a single final %
+	prefixOnly := false
+	for i := 0; i < len(pattern); {
+		ch, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch {
+		case ch == escape:
+			if i >= len(pattern) {
+				return nil, GoDBError{ParseError, fmt.Sprintf("%s pattern %s ends with the escape character", kind, pattern)}
+			}
+			ch, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+			if literal {
+				prefix += string(ch)
+			}
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		case ch == '%':
+			prefixOnly = literal && i == len(pattern)
+			literal = false
+			b.WriteString("(?s:.*)")
+		case ch == '_':
+			literal = false
+			b.WriteString("(?s:.)")
+		case kind == PatternSimilarTo && ch == '[':
+			// bracket expressions are passed on as is, up to the closing
+			// bracket (which may be the first character of the set)
+			end := -1
+			if i < len(pattern) {
+				end = strings.IndexByte(pattern[i+1:], ']')
+			}
+			if end < 0 {
+				return nil, GoDBError{ParseError, fmt.Sprintf("unterminated bracket expression in %s", pattern)}
+			}
+			end += i + 2
+			literal = false
+			b.WriteString("[" + pattern[i:end])
+			i = end
+		case kind == PatternSimilarTo && strings.ContainsRune("|*+?{}()", ch):
+			if literal && strings.ContainsRune("*+?{", ch) && prefix != "" {
+				// the operator applies to the last character, so that
+				// isn't necessarily part of every match
+				_, last := utf8.DecodeLastRuneInString(prefix)
+				prefix = prefix[:len(prefix)-last]
+			}
+			if ch == '|' {
+				// the alternatives don't share a prefix
+				prefix = ""
+			}
+			literal = false
+			b.WriteRune(ch)
+		default:
+			if literal {
+				prefix += string(ch)
+			}
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	switch {
+	case kind == PatternLike && literal:
+		return &compiledPattern{prefix: prefix, exact: true}, nil
+	case kind == PatternLike && prefixOnly:
+		return &compiledPattern{prefix: prefix}, nil
+	}
+	flags := ""
+	if kind == PatternILike {
+		// case insensitive matches don't share a byte prefix
+		prefix = ""
+		flags = "(?i)"
+	}
+	re, err := regexp.Compile(flags + "^(?:" + b.String() + ")$")
+	if err != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid %s pattern %s: %s", kind, pattern, err.Error())}
+	}
+	return &compiledPattern{prefix: prefix, re: re}, nil
+}
+
+// Return the literal that every string matched by a regular expression starts
+// with. A match may start anywhere in the string, so that is empty unless the
+// expression is anchored to the start of the string.
+func regexpPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return ""
+	}
+	begin, lit := re.Sub[0], re.Sub[1]
+	if begin.Op != syntax.OpBeginText || lit.Op != syntax.OpLiteral || lit.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	return string(lit.Rune)
+}
+
+// Match s against a pattern that hasn't been compiled in advance, for the
+// pattern matching operators of [StringField.EvalPred]. Invalid patterns
+// match nothing.
+func matchPattern(kind PatternKind, s string, pattern string) bool {
+	p, err := compilePattern(kind, pattern, '\\')
+	return err == nil && p.match(s)
+}
+
+// A pattern matching predicate, expr kind pattern [ESCAPE escape].
+type MatchExpr struct {
+	expr    Expr
+	kind    PatternKind
+	pattern Expr
+	escape  rune
+
+	// the compiled pattern, if pattern is a constant, or the last pattern
+	// that was compiled
+	compiled     *compiledPattern
+	compiledFrom string
+}
+
+// Construct a pattern matching predicate. escape is the escape character of
+// LIKE and SIMILAR TO patterns; pass '\\' for the default. Constant patterns
+// are compiled (and checked) right away.
+func NewMatchExpr(expr Expr, kind PatternKind, pattern Expr, escape rune) (*MatchExpr, error) {
+	if kind == PatternRegexp && escape != '\\' {
+		return nil, GoDBError{ParseError, "REGEXP doesn't take an escape character"}
+	}
+	e := &MatchExpr{expr: expr, kind: kind, pattern: pattern, escape: escape}
+	if c, ok := pattern.(*ConstExpr); ok {
+		s, ok := c.val.(StringField)
+		if !ok {
+			if isNull(c.val) {
+				return e, nil
+			}
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("%s pattern must be a string, got %v", kind, c.val)}
+		}
+		compiled, err := compilePattern(kind, s.Value, escape)
+		if err != nil {
+			return nil, err
+		}
+		e.compiled, e.compiledFrom = compiled, s.Value
+	}
+	return e, nil
+}
+
+func (e *MatchExpr) GetExprType() FieldType {
+	return predExprType(strings.ToLower(e.kind.String()))
+}
+
+// Unknown if either the string or the pattern is NULL; false if the string
+// isn't a string.
+func (e *MatchExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.pattern.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if isNull(v) || isNull(p) {
+		return NullField{}, nil
+	}
+	s, ok := v.(StringField)
+	ps, pok := p.(StringField)
+	if !ok || !pok {
+		return predFalse, nil
+	}
+	if e.compiled == nil || e.compiledFrom != ps.Value {
+		e.compiled, err = compilePattern(e.kind, ps.Value, e.escape)
+		if err != nil {
+			return nil, err
+		}
+		e.compiledFrom = ps.Value
+	}
+	return predValue(e.compiled.match(s.Value)), nil
+}
+
+// Return the literal prefix that every string matched by a constant pattern
+// starts with, and whether the pattern matches only that string, so that an
+// index could answer the predicate with a range scan instead of testing every
+// string. The prefix is empty for non-constant patterns and for ILIKE.
+func (e *MatchExpr) LiteralPrefix() (prefix string, complete bool) {
+	if _, ok := e.pattern.(*ConstExpr); !ok || e.compiled == nil {
+		return "", false
+	}
+	return e.compiled.prefix, e.compiled.exact
+}
+
+// Return a predicate comparing left and right with op, compiling the pattern
+// in advance for pattern matching operators.
+func newComparison(left Expr, op BoolOp, right Expr) (Expr, error) {
+	if kind, ok := patternKind(op); ok {
+		return NewMatchExpr(left, kind, right, '\\')
+	}
+	return &CompareExpr{left, op, right}, nil
+}
@@ -0,0 +1,197 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestPatternMatching(t *testing.T) {
+	tests := []struct {
+		kind    PatternKind
+		pattern string
+		escape  rune
+		s       string
+		want    bool
+	}{
+		{PatternLike, "sam", '\\', "sam", true},
+		{PatternLike, "sam", '\\', "samuel", false},
+		{PatternLike, "sa%", '\\', "sarah", true},
+		{PatternLike, "sa%", '\\', "Sarah", false},
+		{PatternLike, "%BRASS", '\\', "LARGE POLISHED BRASS", true},
+		{PatternLike, "%BRASS", '\\', "LARGE BRASS TIN", false},
+		{PatternLike, "_a%", '\\', "kathy", true},
+		{PatternLike, "_a%", '\\', "a", false},
+		{PatternLike, "a.c", '\\', "abc", false},
+		{PatternLike, "a%c", '\\', "a\nbc", true},
+		{PatternLike, "100\\%", '\\', "100%", true},
+		{PatternLike, "100\\%", '\\', "1000", false},
+		{PatternLike, "a!_b", '!', "a_b", true},
+		{PatternLike, "a!_b", '!', "axb", false},
+		{PatternLike, "a\\_b", '!', "a\\xb", true},
+		{PatternILike, "SA%", '\\', "sarah", true},
+		{PatternILike, "%ÄB", '\\', "xäb", true},
+		{PatternRegexp, "a+b", '\\', "xxaab", true},
+		{PatternRegexp, "^a+b$", '\\', "xxaab", false},
+		{PatternRegexp, "^ab", '\\', "abc", true},
+		{PatternSimilarTo, "(sam|bo)%", '\\', "bob", true},
+		{PatternSimilarTo, "(sam|bo)%", '\\', "sarah", false},
+		{PatternSimilarTo, "[a-c]%", '\\', "bill", true},
+		{PatternSimilarTo, "ab*c", '\\', "ac", true},
+		{PatternSimilarTo, "a.c", '\\', "abc", false},
+		{PatternSimilarTo, "a\\*", '\\', "a*", true},
+	}
+	for _, test := range tests {
+		p, err := compilePattern(test.kind, test.pattern, test.escape)
+		if err != nil {
+			t.Fatalf("failed to compile %s %s: %s", test.kind, test.pattern, err.Error())
+		}
+		if got := p.match(test.s); got != test.want {
+			t.Errorf("%q %s %q: expected %v, got %v", test.s, test.kind, test.pattern, test.want, got)
+		}
+	}
+
+	for _, bad := range []struct {
+		kind    PatternKind
+		pattern string
+	}{{PatternLike, "abc\\"}, {PatternRegexp, "a("}, {PatternSimilarTo, "[abc"}} {
+		if _, err := compilePattern(bad.kind, bad.pattern, '\\'); err == nil {
+			t.Errorf("expected error compiling %s %q", bad.kind, bad.pattern)
+		}
+	}
+
+	// the old LIKE operator of EvalPred works too
+	if !(StringField{"sarah"}).EvalPred(StringField{"sa%"}, OpLike) {
+		t.Errorf("expected 'sarah' LIKE 'sa%%'")
+	}
+}
+
+func TestPatternPrefix(t *testing.T) {
+	_, t1, _ := makeTupleTestVars()
+	name := &FieldExpr{t1.Desc.Fields[0]}
+	tests := []struct {
+		kind     PatternKind
+		pattern  string
+		prefix   string
+		complete bool
+	}{
+		{PatternLike, "sam", "sam", true},
+		{PatternLike, "sam%", "sam", false},
+		{PatternLike, "sa_m%", "sa", false},
+		{PatternLike, "%sam", "", false},
+		{PatternLike, "s\\%a%", "s%a", false},
+		{PatternILike, "sam%", "", false},
+		{PatternRegexp, "^sam.*", "sam", false},
+		{PatternRegexp, "sam.*", "", false},
+		{PatternRegexp, "^sam*", "sa", false},
+		{PatternRegexp, "^(?i)sam", "", false},
+		{PatternSimilarTo, "sam*", "sa", false},
+		{PatternSimilarTo, "ab|cd", "", false},
+	}
+	for _, test := range tests {
+		e, err := NewMatchExpr(name, test.kind, &ConstExpr{StringField{test.pattern}, StringType}, '\\')
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		prefix, complete := e.LiteralPrefix()
+		if prefix != test.prefix || complete != test.complete {
+			t.Errorf("%s %q: expected prefix %q (%v), got %q (%v)", test.kind, test.pattern, test.prefix, test.complete, prefix, complete)
+		}
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	td, t1, t2 := makeTupleTestVars()
+	name := &FieldExpr{td.Fields[0]}
+
+	// a pattern that changes from tuple to tuple
+	e, err := NewMatchExpr(&ConstExpr{StringField{"sam"}, StringType}, PatternLike, name, '\\')
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, tc := range []struct {
+		tup  *Tuple
+		want bool
+	}{{&t1, t1.Fields[0].(StringField).Value == "sam"}, {&t2, t2.Fields[0].(StringField).Value == "sam"}} {
+		ok, err := evalPredicate(e, tc.tup)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if ok != tc.want {
+			t.Errorf("'sam' LIKE %v: expected %v, got %v", tc.tup.Fields[0], tc.want, ok)
+		}
+	}
+
+	// NULL patterns match nothing
+	e, err = NewMatchExpr(name, PatternLike, &ConstExpr{NullField{}, StringType}, '\\')
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if v, _ := e.EvalExpr(&t1); !isNull(v) {
+		t.Errorf("expected LIKE NULL to be unknown, got %v", v)
+	}
+
+	// constant patterns are checked when the predicate is built
+	if _, err := NewMatchExpr(name, PatternRegexp, &ConstExpr{StringField{"a("}, StringType}, '\\'); err == nil {
+		t.Errorf("expected error for an invalid regular expression")
+	}
+	if _, err := NewFilter(&ConstExpr{StringField{"[x"}, StringType}, OpSimilarTo, name, nil); err == nil {
+		t.Errorf("expected error creating a filter with an invalid pattern")
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql  string
+		rows int
+	}{
+		{"select name from t where name like 's%'", 3},
+		{"select name from t where name like '_a%'", 6},
+		{"select name from t where name not like '%a%'", 3},
+		{"select name from t where name like 'b!o' escape '!'", 1},
+		{"select name from t where name ilike 'SAM'", 2},
+		{"select name from t where name not ilike '%A%'", 3},
+		// a _binary introducer doesn't make a LIKE case insensitive
+		{"select name from t where name like _binary 'SAM'", 0},
+		{"select name from t where name regexp _binary '^(BO|joe)$'", 1},
+		{"select name from t where name regexp '^(bo|joe)$'", 2},
+		{"select name from t where name not regexp 'a'", 3},
+		{"select name from t where name similar to '(sam|bo)%'", 3},
+		{"select name from t where name similar to '[a-c]%' or age > 90", 4},
+		{"select t.name from t, t2 where t.name = t2.name and t2.name like 'ri%'", 4},
+	}
+
+	for _, q := range queries {
+		tid := BeginTransactionForTest(t, bp)
+		_, _, plan, err := Parse(c, q.sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", q.sql, err.Error())
+		}
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows := 0
+		for {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if tup == nil {
+				break
+			}
+			rows++
+		}
+		bp.CommitTransaction(tid)
+		if rows != q.rows {
+			t.Errorf("q=%s: expected %d rows, got %d", q.sql, q.rows, rows)
+		}
+	}
+
+	if _, _, _, err := Parse(c, "select name from t where name like 'a' escape 'ab'"); err == nil {
+		t.Errorf("expected error for a multi-character escape")
+	}
+}
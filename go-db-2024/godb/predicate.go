@@ -0,0 +1,284 @@
+package godb
+
+import "fmt"
+
+// Predicates are expressions that evaluate to a truth value: IntField{1} for
+// true, IntField{0} for false, or NULL when the result is unknown (e.g. when
+// comparing with a NULL). They follow SQL's three valued logic, and a
+// [Filter] only passes tuples for which its predicate is true.
+//
+// AND and OR evaluate their arguments left to right and stop as soon as the
+// result is decided, so cheap or selective conditions should come first.
+
+var (
+	predTrue  DBValue = IntField{1}
+	predFalse DBValue = IntField{0}
+)
+
+func predValue(b bool) DBValue {
+	if b {
+		return predTrue
+	}
+	return predFalse
+}
+
+// Evaluate a predicate on t, returning whether it is true (false and unknown
+// both count as not passing).
+func evalPredicate(pred Expr, t *Tuple) (bool, error) {
+	v, err := pred.EvalExpr(t)
+	if err != nil {
+		return false, err
+	}
+	i, ok := v.(IntField)
+	return ok && i.Value != 0, nil
+}
+
+func predExprType(name string) FieldType {
+	return FieldType{name, "", IntType}
+}
+
+// A comparison between two arbitrary expressions.
+type CompareExpr struct {
+	left  Expr
+	op    BoolOp
+	right Expr
+}
+
+func (e *CompareExpr) GetExprType() FieldType {
+	return predExprType("compare")
+}
+
+func (e *CompareExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v1, err := e.left.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	v2, err := e.right.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if isNull(v1) || isNull(v2) {
+		return NullField{}, nil
+	}
+	return predValue(v1.EvalPred(v2, e.op)), nil
+}
+
+// The conjunction of a list of predicates.
+type AndExpr struct {
+	exprs []Expr
+}
+
+func (e *AndExpr) GetExprType() FieldType {
+	return predExprType("and")
+}
+
+// False if any argument is false, otherwise unknown if any argument is
+// unknown, otherwise true.
+func (e *AndExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	var result DBValue = predTrue
+	for _, expr := range e.exprs {
+		v, err := expr.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(v) {
+			result = NullField{}
+		} else if v.EvalPred(predFalse, OpEq) {
+			return predFalse, nil
+		}
+	}
+	return result, nil
+}
+
+// The disjunction of a list of predicates.
+type OrExpr struct {
+	exprs []Expr
+}
+
+func (e *OrExpr) GetExprType() FieldType {
+	return predExprType("or")
+}
+
+// True if any argument is true, otherwise unknown if any argument is unknown,
+// otherwise false.
+func (e *OrExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	var result DBValue = predFalse
+	for _, expr := range e.exprs {
+		v, err := expr.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(v) {
+			result = NullField{}
+		} else if !v.EvalPred(predFalse, OpEq) {
+			return predTrue, nil
+		}
+	}
+	return result, nil
+}
+
+// The negation of a predicate; the negation of unknown is unknown.
+type NotExpr struct {
+	expr Expr
+}
+
+func (e *NotExpr) GetExprType() FieldType {
+	return predExprType("not")
+}
+
+func (e *NotExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil || isNull(v) {
+		return v, err
+	}
+	return predValue(v.EvalPred(predFalse, OpEq)), nil
+}
+
+// expr [NOT] IN (list...). The list is checked in order, stopping at the
+// first match.
+type InExpr struct {
+	expr    Expr
+	list    []Expr
+	negated bool
+}
+
+func (e *InExpr) GetExprType() FieldType {
+	return predExprType("in")
+}
+
+// Like SQL, x IN (...) is unknown rather than false if x is NULL or if there
+// is no match but the list contains a NULL.
+func (e *InExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if isNull(v) {
+		return NullField{}, nil
+	}
+	sawNull := false
+	for _, item := range e.list {
+		iv, err := item.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(iv) {
+			sawNull = true
+		} else if v.EvalPred(iv, OpEq) {
+			return predValue(!e.negated), nil
+		}
+	}
+	if sawNull {
+		return NullField{}, nil
+	}
+	return predValue(e.negated), nil
+}
+
+// expr [NOT] BETWEEN low AND high, inclusive of both ends.
+type BetweenExpr struct {
+	expr, low, high Expr
+	negated         bool
+}
+
+func (e *BetweenExpr) GetExprType() FieldType {
+	return predExprType("between")
+}
+
+func (e *BetweenExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	inRange := AndExpr{[]Expr{&CompareExpr{e.expr, OpGe, e.low}, &CompareExpr{e.expr, OpLe, e.high}}}
+	v, err := inRange.EvalExpr(t)
+	if err != nil || !e.negated || isNull(v) {
+		return v, err
+	}
+	return predValue(v.EvalPred(predFalse, OpEq)), nil
+}
+
+// expr IS [NOT] NULL. Unlike the other predicates, never unknown.
+type IsNullExpr struct {
+	expr    Expr
+	negated bool
+}
+
+func (e *IsNullExpr) GetExprType() FieldType {
+	return predExprType("is null")
+}
+
+func (e *IsNullExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	return predValue(isNull(v) != e.negated), nil
+}
+
+// Combine a list of predicates into one that is true when all of them are.
+func conjunction(preds []Expr) Expr {
+	if len(preds) == 1 {
+		return preds[0]
+	}
+	return &AndExpr{preds}
+}
+
+// Describe a predicate for query plans.
+func predToStr(e Expr) string {
+	switch ex := e.(type) {
+	case *CompareExpr:
+		return fmt.Sprintf("%s %s %s", exprToStr(ex.left), opToStr(ex.op), exprToStr(ex.right))
+	case *AndExpr, *OrExpr:
+		var exprs []Expr
+		sep := " AND "
+		if and, ok := ex.(*AndExpr); ok {
+			exprs = and.exprs
+		} else {
+			exprs = ex.(*OrExpr).exprs
+			sep = " OR "
+		}
+		s := "("
+		for i, sub := range exprs {
+			if i > 0 {
+				s += sep
+			}
+			s += exprToStr(sub)
+		}
+		return s + ")"
+	case *NotExpr:
+		return "NOT " + exprToStr(ex.expr)
+	case *InExpr:
+		s := exprToStr(ex.expr)
+		if ex.negated {
+			s += " NOT"
+		}
+		s += " IN ("
+		for i, item := range ex.list {
+			if i > 0 {
+				s += ", "
+			}
+			s += exprToStr(item)
+		}
+		return s + ")"
+	case *BetweenExpr:
+		s := exprToStr(ex.expr)
+		if ex.negated {
+			s += " NOT"
+		}
+		return s + " BETWEEN " + exprToStr(ex.low) + " AND " + exprToStr(ex.high)
+	case *IntervalCompareExpr:
+		estimate := exprToStr(ex.estimate) + "±" + exprToStr(ex.bound)
+		if ex.flipped {
+			return fmt.Sprintf("%s %s %s", exprToStr(ex.other), opToStr(ex.op), estimate)
+		}
+		return fmt.Sprintf("%s %s %s", estimate, opToStr(ex.op), exprToStr(ex.other))
+	case *MatchExpr:
+		s := exprToStr(ex.expr) + " " + ex.kind.String() + " " + exprToStr(ex.pattern)
+		if ex.escape != '\\' {
+			s += fmt.Sprintf(" ESCAPE '%c'", ex.escape)
+		}
+		return s
+	case *IsNullExpr:
+		if ex.negated {
+			return exprToStr(ex.expr) + " IS NOT NULL"
+		}
+		return exprToStr(ex.expr) + " IS NULL"
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package godb
+
+import (
+	"testing"
+)
+
+// An expression that counts how many times it is evaluated.
+type countingExpr struct {
+	val   DBValue
+	evals int
+}
+
+func (e *countingExpr) GetExprType() FieldType {
+	return FieldType{"counting", "", IntType}
+}
+
+func (e *countingExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	e.evals++
+	return e.val, nil
+}
+
+func TestPredicateThreeValuedLogic(t *testing.T) {
+	_, t1, _ := makeTupleTestVars()
+	tr := &ConstExpr{predTrue, IntType}
+	fa := &ConstExpr{predFalse, IntType}
+	null := &ConstExpr{NullField{}, IntType}
+
+	tests := []struct {
+		pred Expr
+		want DBValue
+	}{
+		{&AndExpr{[]Expr{tr, tr}}, predTrue},
+		{&AndExpr{[]Expr{tr, null}}, NullField{}},
+		{&AndExpr{[]Expr{null, fa}}, predFalse},
+		{&OrExpr{[]Expr{fa, null}}, NullField{}},
+		{&OrExpr{[]Expr{null, tr}}, predTrue},
+		{&OrExpr{[]Expr{fa, fa}}, predFalse},
+		{&NotExpr{fa}, predTrue},
+		{&NotExpr{null}, NullField{}},
+		{&CompareExpr{null, OpEq, null}, NullField{}},
+		{&IsNullExpr{null, false}, predTrue},
+		{&IsNullExpr{tr, true}, predTrue},
+	}
+	for i, test := range tests {
+		v, err := test.pred.EvalExpr(&t1)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if isNull(v) != isNull(test.want) || (!isNull(v) && !v.EvalPred(test.want, OpEq)) {
+			t.Errorf("test %d (%s): expected %v, got %v", i, predToStr(test.pred), test.want, v)
+		}
+	}
+}
+
+func TestPredicateShortCircuit(t *testing.T) {
+	_, t1, _ := makeTupleTestVars()
+	first := &countingExpr{val: predFalse}
+	second := &countingExpr{val: predTrue}
+	if ok, _ := evalPredicate(&AndExpr{[]Expr{first, second}}, &t1); ok {
+		t.Errorf("expected false AND true to be false")
+	}
+	if first.evals != 1 || second.evals != 0 {
+		t.Errorf("AND evaluated past a false argument (%d, %d evaluations)", first.evals, second.evals)
+	}
+
+	first.val = predTrue
+	if ok, _ := evalPredicate(&OrExpr{[]Expr{first, second}}, &t1); !ok {
+		t.Errorf("expected true OR true to be true")
+	}
+	if first.evals != 2 || second.evals != 0 {
+		t.Errorf("OR evaluated past a true argument (%d, %d evaluations)", first.evals, second.evals)
+	}
+}
+
+func TestPredicateInBetween(t *testing.T) {
+	td, t1, t2 := makeTupleTestVars()
+	age := &FieldExpr{td.Fields[1]}
+	c := func(i int64) Expr { return &ConstExpr{IntField{i}, IntType} }
+	null := &ConstExpr{NullField{}, IntType}
+
+	tests := []struct {
+		pred     Expr
+		t1, t2   bool
+		t1IsNull bool
+	}{
+		{&InExpr{age, []Expr{c(1), c(25)}, false}, true, false, false},
+		{&InExpr{age, []Expr{c(1), c(25)}, true}, false, true, false},
+		{&InExpr{age, []Expr{c(1), null}, true}, false, false, true},
+		{&BetweenExpr{age, c(20), c(25), false}, true, false, false},
+		{&BetweenExpr{age, c(20), c(25), true}, false, true, false},
+		{&BetweenExpr{age, null, c(30), false}, false, false, true},
+	}
+	for i, test := range tests {
+		for _, tc := range []struct {
+			tup  *Tuple
+			want bool
+		}{{&t1, test.t1}, {&t2, test.t2}} {
+			ok, err := evalPredicate(test.pred, tc.tup)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if ok != tc.want {
+				t.Errorf("test %d (%s) on %v: expected %v, got %v", i, predToStr(test.pred), tc.tup, tc.want, ok)
+			}
+		}
+		v, _ := test.pred.EvalExpr(&t1)
+		if isNull(v) != test.t1IsNull {
+			t.Errorf("test %d (%s): expected unknown result %v, got %v", i, predToStr(test.pred), test.t1IsNull, v)
+		}
+	}
+}
+
+func TestPredicateFilter(t *testing.T) {
+	td, t1, t2, hf, _, tid := makeTestVars(t)
+	insertTupleForTest(t, hf, &t1, tid)
+	insertTupleForTest(t, hf, &t2, tid)
+
+	name := &FieldExpr{td.Fields[0]}
+	age := &FieldExpr{td.Fields[1]}
+	pred := &OrExpr{[]Expr{
+		&CompareExpr{name, OpEq, &ConstExpr{StringField{"nobody"}, StringType}},
+		&NotExpr{&CompareExpr{age, OpLt, &ConstExpr{IntField{100}, IntType}}},
+	}}
+	filt, err := NewPredicateFilter(pred, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := filt.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cnt := 0
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		if !tup.equals(&t2) {
+			t.Errorf("filter passed unexpected tuple %v", tup)
+		}
+		cnt++
+	}
+	if cnt != 1 {
+		t.Errorf("unexpected number of results (%d, expected 1)", cnt)
+	}
+
+	if _, err := NewPredicateFilter(nil, hf); err == nil {
+		t.Errorf("expected error creating a filter without a predicate")
+	}
+}
+
+func TestParsePredicates(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql  string
+		rows int
+	}{
+		{"select name from t where age < 25 or age > 90", 4},
+		{"select name from t where not (age < 30)", 9},
+		{"select name from t where age in (22, 99)", 4},
+		{"select name from t where name not in ('sam', 'riza')", 8},
+		{"select name from t where age between 30 and 45", 5},
+		{"select name from t where age not between 30 and 45", 7},
+		{"select name from t where name not like 'sa%'", 9},
+		{"select name from t where 50 < age", 3},
+		{"select name from t where age + 5 > 50", 4},
+		{"select name from t where age * 2 = age + 25", 1},
+		{"select name from t where (name = 'sam' or name = 'bo') and age > 30", 2},
+		{"select t.name from t, t2 where t.age = t2.age and (t.name = 'sam' or t2.name = 'bo')", 4},
+		{"select t.name from t, t2 where t.age + t2.age < 45", 4},
+		{"select t.name from t, t2 where t.age > 40 or t2.age > 90", 84},
+		{"select t.name from t left join t2 on t.name = t2.name and (t2.age < 25 or t2.age > 90)", 12},
+		{"select t.name from t left join t2 on t.name = t2.name and t2.age > 40 where t2.name is null", 4},
+	}
+
+	for _, q := range queries {
+		tid := BeginTransactionForTest(t, bp)
+		_, _, plan, err := Parse(c, q.sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", q.sql, err.Error())
+		}
+		iter, err := plan.Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rows := 0
+		for {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if tup == nil {
+				break
+			}
+			rows++
+		}
+		bp.CommitTransaction(tid)
+		if rows != q.rows {
+			t.Errorf("q=%s: expected %d rows, got %d", q.sql, q.rows, rows)
+		}
+	}
+}
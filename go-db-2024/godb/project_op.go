@@ -31,8 +31,25 @@ func NewProjectOp(selectFields []Expr, outputNames []string, distinct bool, chil
 	return &Project{selectFields, outputNames, child, distinct}, nil
 }
 
-func (p *Project) Statistics() map[string]map[string]float64 {
-	return p.child.Statistics()
+// The statistics of the projected fields are renamed to the output names, so
+// aggregates above the projection find them. The distinct tuples of a sample
+// aren't a sample of the distinct tuples of the table, so a distinct
+// projection drops the sampling metadata.
+func (p *Project) SampleInfo() *SampleInfo {
+	childInfo := p.child.SampleInfo()
+	if childInfo == nil {
+		return nil
+	}
+	info := childInfo.Copy()
+	if p.distinct {
+		info = info.withoutSampling()
+	}
+	for i, field := range p.selectFields {
+		if fe, ok := field.(*FieldExpr); ok && childInfo.Columns[fe.selectField.Fname] != nil {
+			info.Columns[p.outputNames[i]] = childInfo.Columns[fe.selectField.Fname].copy()
+		}
+	}
+	return info
 }
 
 // Return a TupleDescriptor for this projection. The returned descriptor should
@@ -82,7 +99,9 @@ func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
 			}
 
 			DebugProject("child tuple is %v\n", childTup)
-			projectedTup := &Tuple{*desc, make([]DBValue, len(desc.Fields)), nil}
+			// the projected tuple keeps the record id, which may carry its
+			// probability of having been sampled (see [weightedRID])
+			projectedTup := &Tuple{*desc, make([]DBValue, len(desc.Fields)), childTup.Rid}
 			for i := 0; i < len(desc.Fields); i++ {
 				dbValue, err := p.selectFields[i].EvalExpr(childTup)
 				if err != nil {
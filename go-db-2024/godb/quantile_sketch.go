@@ -0,0 +1,145 @@
+package godb
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// A KLL quantile sketch (Z. Karnin, K. Lang and E. Liberty, "Optimal quantile
+// approximation in streams", FOCS 2016), which summarizes any number of values
+// in O(k) memory so that the rank of any value is known to within about
+// kllRankError(k) of the number of values.
+//
+// The sketch is a stack of compactors. Values are added to the bottom one;
+// when a compactor is over its capacity, its values are sorted and every
+// other one is promoted to the compactor above, where each stands for twice
+// as many values. Capacities shrink geometrically down the stack, so the
+// sketch stays small. Two sketches merge by merging their compactors level by
+// level and compacting again.
+type kllSketch struct {
+	k      int
+	levels [][]float64 // the values of each compactor, from the bottom
+	n      float64     // the number of values summarized
+	coin   uint64      // the state of the generator of compaction offsets
+}
+
+// The default accuracy parameter of sketches.
+const kllDefaultK = 200
+
+func newKLLSketch(k int) *kllSketch {
+	return &kllSketch{k: k, levels: [][]float64{nil}, coin: 0x9e3779b97f4a7c15}
+}
+
+// The normalized rank error of a sketch with parameter k, with about 99%
+// confidence (the empirical fit used by the Apache DataSketches library).
+func kllRankError(k int) float64 {
+	return 2.446 / math.Pow(float64(k), 0.9433)
+}
+
+func (s *kllSketch) copy() *kllSketch {
+	c := *s
+	c.levels = make([][]float64, len(s.levels))
+	for i, l := range s.levels {
+		c.levels[i] = slices.Clone(l)
+	}
+	return &c
+}
+
+// The capacity of compactor h.
+func (s *kllSketch) capacity(h int) int {
+	depth := len(s.levels) - h - 1
+	return max(2, int(math.Ceil(float64(s.k)*math.Pow(2.0/3.0, float64(depth)))))
+}
+
+func (s *kllSketch) add(v float64) {
+	s.levels[0] = append(s.levels[0], v)
+	s.n++
+	s.compress()
+}
+
+// Return a pseudo-random bit, to pick which half of a compactor is promoted.
+func (s *kllSketch) flip() int {
+	s.coin ^= s.coin << 13
+	s.coin ^= s.coin >> 7
+	s.coin ^= s.coin << 17
+	return int(s.coin & 1)
+}
+
+// Compact the lowest compactor over its capacity until all of them fit.
+func (s *kllSketch) compress() {
+	for h := 0; h < len(s.levels); h++ {
+		if len(s.levels[h]) < s.capacity(h) {
+			continue
+		}
+		if h+1 == len(s.levels) {
+			s.levels = append(s.levels, nil)
+		}
+		level := s.levels[h]
+		slices.Sort(level)
+		// an odd value out stays behind
+		keep := len(level) % 2
+		for i := keep + s.flip(); i < len(level); i += 2 {
+			s.levels[h+1] = append(s.levels[h+1], level[i])
+		}
+		s.levels[h] = append(level[:0], level[:keep]...)
+	}
+}
+
+func (s *kllSketch) merge(o *kllSketch) {
+	for len(s.levels) < len(o.levels) {
+		s.levels = append(s.levels, nil)
+	}
+	for h, l := range o.levels {
+		s.levels[h] = append(s.levels[h], l...)
+	}
+	s.n += o.n
+	s.compress()
+}
+
+// Return the value a fraction p of the way through the values summarized
+// (clamped to [0, 1]), or false if there are none.
+func (s *kllSketch) quantile(p float64) (float64, bool) {
+	type weighted struct {
+		v float64
+		w float64
+	}
+	var items []weighted
+	total := 0.0
+	for h, l := range s.levels {
+		w := math.Ldexp(1, h)
+		for _, v := range l {
+			items = append(items, weighted{v, w})
+			total += w
+		}
+	}
+	if len(items) == 0 {
+		return 0, false
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].v < items[j].v })
+	target := math.Max(0, math.Min(1, p)) * total
+	seen := 0.0
+	for _, it := range items {
+		seen += it.w
+		if seen >= target {
+			return it.v, true
+		}
+	}
+	return items[len(items)-1].v, true
+}
+
+// Return the fractions of the way through a sample of n values between which
+// the value a fraction p of the way through the table (see [SampleInfo]) lies
+// with the confidence of [ConfidenceZ], widened by rankError for the error of
+// a sketch of the sample. The number of sampled values below the table's
+// quantile is (approximately) binomially distributed, whatever the
+// distribution of the values, so the normal approximation of its standard
+// deviation, sqrt(n p (1-p)) corrected for the sampled fraction of the table,
+// bounds the rank of the quantile in the sample.
+func quantileRankBounds(p, n float64, info *SampleInfo, rankError float64) (float64, float64) {
+	width := rankError
+	if info.IsSample() && n > 0 {
+		width += ConfidenceZ*math.Sqrt(p*(1-p)/n*finitePopulationCorrection(info.SampleSize, info.PopulationSize)) + 1/n
+	}
+	return math.Max(0, p-width), math.Min(1, p+width)
+}
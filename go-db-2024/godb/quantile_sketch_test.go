@@ -0,0 +1,116 @@
+package godb
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestKLLSketch(t *testing.T) {
+	const n = 100000
+	whole := newKLLSketch(kllDefaultK)
+	halves := []*kllSketch{newKLLSketch(kllDefaultK), newKLLSketch(kllDefaultK)}
+	for i, v := range rand.New(rand.NewSource(1)).Perm(n) {
+		whole.add(float64(v))
+		halves[i%2].add(float64(v))
+	}
+	halves[0].merge(halves[1])
+
+	retained := 0
+	for _, l := range whole.levels {
+		retained += len(l)
+	}
+	if retained > 10*kllDefaultK {
+		t.Errorf("expected the sketch to keep O(k) values, kept %d", retained)
+	}
+	for _, s := range []*kllSketch{whole, halves[0]} {
+		if s.n != n {
+			t.Errorf("expected the sketch to summarize %d values, got %v", n, s.n)
+		}
+		for _, p := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+			v, ok := s.quantile(p)
+			if !ok || math.Abs(v/n-p) > kllRankError(kllDefaultK) {
+				t.Errorf("expected quantile %v to be about %v, got %v", p, p*n, v)
+			}
+		}
+	}
+	if _, ok := newKLLSketch(kllDefaultK).quantile(0.5); ok {
+		t.Errorf("expected no quantile of an empty sketch")
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	// the sorted ages are 22 22 25 30 38 40 43 45 50 60 99 99
+	// which fit in a sketch, so the percentiles are exact
+	tups := runHavingQuery(t, bp, c, "select median(age), percentile(age, 0.25), approx_percentile(age, 0.5), percentile_cont(age, 0.5) from t")
+	want := []DBValue{FloatField{41.5}, FloatField{28.75}, FloatField{41.5}, FloatField{41.5}}
+	if len(tups) != 1 {
+		t.Fatalf("expected one row, got %v", tups)
+	}
+	for i, w := range want {
+		if tups[0].Fields[i] != w {
+			t.Errorf("column %d: expected %v, got %v", i, w, tups[0].Fields[i])
+		}
+	}
+	tups = runHavingQuery(t, bp, c, "select name, median(age) from t group by name having median(age) > 60")
+	if len(tups) != 2 {
+		t.Errorf("expected 2 names with median age over 60, got %v", tups)
+	}
+
+	for _, sql := range []string{
+		"select median(age, 0.5) from t",
+		"select approx_percentile(age) from t",
+		"select percentile(name, 0.5) from t",
+	} {
+		if _, _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
+
+func TestPercentileFromSample(t *testing.T) {
+	// a sample of 10000 of 1000000 values uniform in [0, 1)
+	td := &TupleDesc{[]FieldType{{"x", "", FloatType}}}
+	var expr Expr = &FieldExpr{td.Fields[0]}
+	exact, _ := newAggState("percentile_cont")
+	setAggParams("percentile_cont", exact, []Expr{&ConstExpr{FloatField{0.5}, FloatType}})
+	approx, _ := newAggState("median")
+	exact.Init("m", expr)
+	approx.Init("m", expr)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		tup := &Tuple{*td, []DBValue{FloatField{r.Float64()}}, nil}
+		exact.AddTuple(tup)
+		approx.AddTuple(tup)
+	}
+	info := &SampleInfo{PopulationSize: 1000000, SampleSize: 10000}
+
+	var bounds []float64
+	for _, state := range []AggState{exact, approx} {
+		est := state.Finalize(info).Fields[0].(FloatField).Value
+		bound := state.(ErrorBounder).ErrorBound(info)
+		// the standard error of the median is about sqrt(0.25 / 10000)
+		if bound <= 0 || bound > 0.05 || math.Abs(est-0.5) > bound {
+			t.Errorf("expected an interval around %v of width about 0.01 to include 0.5, got %v", est, bound)
+		}
+		bounds = append(bounds, bound)
+	}
+	if bounds[1] <= bounds[0] {
+		t.Errorf("expected the sketch to widen the interval, got %v", bounds)
+	}
+	if bound := exact.(ErrorBounder).ErrorBound(nil); bound != 0 {
+		t.Errorf("expected an exact median of the whole table, got bound %v", bound)
+	}
+	// MEDIAN keeps a sketch rather than every value
+	retained := 0
+	for _, l := range approx.(*ApproxPercentileAggState).sketch.levels {
+		retained += len(l)
+	}
+	if retained > 10*kllDefaultK {
+		t.Errorf("expected MEDIAN to keep O(k) values, kept %d", retained)
+	}
+}
@@ -0,0 +1,365 @@
+package godb
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Online aggregation over joins with ripple joins (see P. Haas and J.
+// Hellerstein, "Ripple joins for online aggregation", SIGMOD 1999).
+//
+// Rather than joining the tables and then aggregating the result, a
+// [RippleJoin] reads the pages of both tables in a random order, alternating
+// between them. Each page read is joined with every page already read from
+// the other table, so after reading n pages of the left table and m of the
+// right, it has joined a random n by m rectangle of pages, and the aggregates
+// of that rectangle scaled up by the fractions of the tables read estimate the
+// aggregates of the whole join. The estimates, with confidence intervals, are
+// output every [OnlineReportInterval] until both tables have been read, when
+// they are exact (or as exact as the tables' own samples allow). The
+// estimates assume that the pages of each table hold about the same number of
+// tuples, so they are only accurate for tables of many full pages.
+
+// Whether queries that aggregate (with COUNT, SUM and AVG) a single equality
+// join of two tables, without GROUP BY or HAVING, are run as ripple joins.
+var OnlineAggregation = false
+
+// The name of the column of ripple join results with the fraction of the
+// pages of the joined tables read so far.
+const RippleProgressField = "ripple_progress"
+
+// The totals of the values of an aggregate's expression over some joined
+// tuples, and how many of them weren't NULL.
+type rippleSums struct {
+	sum, count float64
+}
+
+// A tuple read by a ripple join, and the index of its page in the order the
+// pages of its table were read.
+type rippleTuple struct {
+	t    *Tuple
+	page int
+}
+
+// One of the inputs of a ripple join: a heap file and the filters applied to
+// its tuples.
+type rippleInput struct {
+	op      Operator  // the filtered heap file
+	file    *HeapFile // the heap file whose pages are sampled
+	filters []Expr    // the predicates tuples of the file must pass
+	keys    []Expr    // the join keys
+	scale   float64   // the number of tuples of the table each tuple of the heap file stands for
+	order   []int     // the pages in the order they are read
+	table   map[string][]rippleTuple
+	sums    [][]rippleSums // for each page read, the totals of each aggregate over its joined tuples
+}
+
+func newRippleInput(op Operator, keys []Expr) (*rippleInput, error) {
+	file, filters, scale, err := onlineSource("ripple join", op)
+	if err != nil {
+		return nil, err
+	}
+	return &rippleInput{op: op, file: file, filters: filters, keys: keys, scale: scale}, nil
+}
+
+// Whether every page of the input has been read.
+func (in *rippleInput) done() bool {
+	return len(in.sums) == len(in.order)
+}
+
+// Read the next page of the input, returning the tuples that pass its
+// filters.
+func (in *rippleInput) readPage(tid TransactionID) ([]*Tuple, error) {
+	iter, err := in.file.pageTupleIter(in.order[len(in.sums)], tid)
+	if err != nil {
+		return nil, err
+	}
+	desc := in.op.Descriptor()
+	var tuples []*Tuple
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return tuples, nil
+		}
+		t = &Tuple{*desc, t.Fields, t.Rid}
+		pass, err := evalJoinConditions(in.filters, t)
+		if err != nil {
+			return nil, err
+		}
+		if pass {
+			tuples = append(tuples, t)
+		}
+	}
+}
+
+// The variance of the estimate of a total over the join that is due to the
+// pages read from the input, where vals are the totals of the pages read
+// scaled up to estimates of the whole total.
+func (in *rippleInput) variance(vals []float64) float64 {
+	n := float64(len(vals))
+	if n < 2 {
+		return 0
+	}
+	mean, sumSquares := 0.0, 0.0
+	for i, v := range vals {
+		// Welford's algorithm, as in [ColumnStats]
+		newMean := mean + (v-mean)/float64(i+1)
+		sumSquares += (v - mean) * (v - newMean)
+		mean = newMean
+	}
+	// the fraction of the table read, including the sampling of the heap
+	// file itself
+	fraction := n / (float64(len(in.order)) * in.scale)
+	return sumSquares / (n - 1) / n * math.Max(0, 1-fraction)
+}
+
+// A RippleJoin estimates COUNT, SUM and AVG aggregates over an equality join
+// of two (filtered) heap files, outputting a tuple of running estimates each
+// time it has read more of the tables (see [OnlineAggregation]). Each tuple
+// has the estimates, named like the aggregation states they were made from,
+// then the error bound of each estimate (see [ErrorBounder]), then the
+// fraction of the tables read so far (see [RippleProgressField]).
+type RippleJoin struct {
+	left, right             Operator
+	leftFields, rightFields []Expr
+	aggs                    []onlineAgg
+	desc                    *TupleDesc
+}
+
+// Construct a ripple join of left and right on the equality of leftFields and
+// rightFields, estimating the aggregates of aggs (which must be COUNT, SUM or
+// AVG states, initialized with expressions over the joined tuples).
+//
+// Returns an error if an input isn't a filtered heap file sampled with equal
+// probabilities, or an aggregate can't be estimated.
+func NewRippleJoin(left Operator, leftFields []Expr, right Operator, rightFields []Expr, aggs []AggState) (*RippleJoin, error) {
+	if len(leftFields) == 0 || len(leftFields) != len(rightFields) {
+		return nil, GoDBError{IllegalOperationError, "ripple joins need equality join keys"}
+	}
+	for _, in := range []Operator{left, right} {
+		if _, err := newRippleInput(in, nil); err != nil {
+			return nil, err
+		}
+	}
+	aggStates, desc, err := newOnlineAggs("ripple join", aggs, FieldType{RippleProgressField, "", FloatType})
+	if err != nil {
+		return nil, err
+	}
+	return &RippleJoin{left, right, leftFields, rightFields, aggStates, desc}, nil
+}
+
+func (rj *RippleJoin) Descriptor() *TupleDesc {
+	return rj.desc
+}
+
+// The estimates are already scaled up to the whole join.
+func (rj *RippleJoin) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// Return the fields of the error bounds of the estimates, and of the progress
+// of the join.
+func (rj *RippleJoin) boundFields() []FieldType {
+	return rj.desc.Fields[len(rj.aggs):]
+}
+
+// Add the contributions of a joined tuple to the totals of each aggregate.
+func (rj *RippleJoin) addJoined(t *Tuple, sums []rippleSums, other []rippleSums) error {
+	for i, agg := range rj.aggs {
+		y, counted, err := agg.eval(t)
+		if err != nil {
+			return err
+		}
+		if !counted {
+			continue
+		}
+		sums[i].sum += y
+		sums[i].count++
+		other[i].sum += y
+		other[i].count++
+	}
+	return nil
+}
+
+// Read the next page of in and join its tuples with the tuples read from
+// other. in is the left input if isLeft.
+func (rj *RippleJoin) step(in, other *rippleInput, isLeft bool, asFloat []bool, tid TransactionID) error {
+	tuples, err := in.readPage(tid)
+	if err != nil {
+		return err
+	}
+	page := len(in.sums)
+	sums := make([]rippleSums, len(rj.aggs))
+	for _, t := range tuples {
+		key, null, err := evalJoinKey(t, in.keys, asFloat)
+		if err != nil {
+			return err
+		}
+		if null {
+			continue
+		}
+		for _, match := range other.table[key] {
+			joined := joinTuples(t, match.t)
+			if !isLeft {
+				joined = joinTuples(match.t, t)
+			}
+			if err := rj.addJoined(joined, sums, other.sums[match.page]); err != nil {
+				return err
+			}
+		}
+		in.table[key] = append(in.table[key], rippleTuple{t, page})
+	}
+	in.sums = append(in.sums, sums)
+	return nil
+}
+
+// Make a tuple of the estimates of the aggregates from the pages read so far.
+func (rj *RippleJoin) estimates(left, right *rippleInput) *Tuple {
+	fields := make([]DBValue, 0, len(rj.desc.Fields))
+	bounds := make([]DBValue, 0, len(rj.aggs))
+	nl, nr := float64(len(left.sums)), float64(len(right.sums))
+	// each joined tuple read stands for this many joined tuples of the
+	// tables
+	scale := 0.0
+	if nl > 0 && nr > 0 {
+		scale = float64(len(left.order)) / nl * left.scale * float64(len(right.order)) / nr * right.scale
+	}
+
+	for i, agg := range rj.aggs {
+		var total rippleSums
+		for _, s := range left.sums {
+			total.sum += s[i].sum
+			total.count += s[i].count
+		}
+		sum, count := total.sum*scale, total.count*scale
+
+		// the estimate of the total from each page read is scaled up by
+		// the fraction of its table read, and the variance of the
+		// estimate over those of the pages of both tables
+		variance := 0.0
+		for _, in := range []*rippleInput{left, right} {
+			n := float64(len(in.sums))
+			vals := make([]float64, len(in.sums))
+			for j, s := range in.sums {
+				switch agg.kind {
+				case onlineCount:
+					vals[j] = s[i].count * scale * n
+				case onlineSum:
+					vals[j] = s[i].sum * scale * n
+				case onlineAvg:
+					// the delta method, for the ratio of the
+					// estimates of the sum and the count
+					if count > 0 {
+						vals[j] = (s[i].sum - sum/count*s[i].count) * scale * n / count
+					}
+				}
+			}
+			variance += in.variance(vals)
+		}
+		bounds = append(bounds, FloatField{ConfidenceZ * math.Sqrt(variance)})
+
+		fields = append(fields, agg.estimate(sum, count))
+	}
+
+	pages := len(left.order) + len(right.order)
+	progress := 1.0
+	if pages > 0 {
+		progress = float64(len(left.sums)+len(right.sums)) / float64(pages)
+	}
+	fields = append(fields, bounds...)
+	fields = append(fields, FloatField{progress})
+	return &Tuple{*rj.desc, fields, nil}
+}
+
+// Iterate over the running estimates of the aggregates. The pages of the
+// inputs are read in a random order, one page of each input at a time, and
+// the estimates are output every [OnlineReportInterval] once at least two
+// pages of each input have been read (or all of them, if it has fewer), and
+// when every page has been read.
+func (rj *RippleJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	left, err := newRippleInput(rj.left, rj.leftFields)
+	if err != nil {
+		return nil, err
+	}
+	right, err := newRippleInput(rj.right, rj.rightFields)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range []*rippleInput{left, right} {
+		in.order = rand.Perm(in.file.NumPages())
+		in.table = make(map[string][]rippleTuple)
+	}
+	asFloat := make([]bool, len(rj.leftFields))
+	for i := range rj.leftFields {
+		asFloat[i] = rj.leftFields[i].GetExprType().Ftype == FloatType || rj.rightFields[i].GetExprType().Ftype == FloatType
+	}
+
+	var lastReport time.Time
+	finished := false
+	return func() (*Tuple, error) {
+		for !finished {
+			if left.done() && right.done() {
+				finished = true
+				return rj.estimates(left, right), nil
+			}
+			// alternate between the inputs, reading the rest of one
+			// input once the other is done
+			readLeft := !left.done() && (right.done() || len(left.sums) <= len(right.sums))
+			if readLeft {
+				err = rj.step(left, right, true, asFloat, tid)
+			} else {
+				err = rj.step(right, left, false, asFloat, tid)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			ready := true
+			for _, in := range []*rippleInput{left, right} {
+				ready = ready && len(in.sums) >= min(2, len(in.order))
+			}
+			if ready && time.Since(lastReport) >= OnlineReportInterval && !(left.done() && right.done()) {
+				lastReport = time.Now()
+				return rj.estimates(left, right), nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// Plan a ripple join estimating aggs over op, if op is an inner equality join
+// of two filtered heap files that a ripple join can read, or return nil so
+// that the query is run as usual.
+func planRippleJoin(aggs []AggState, op Operator) *RippleJoin {
+	if oc, ok := op.(*OperatorCard); ok {
+		op = oc.Op
+	}
+	var left, right Operator
+	var leftFields, rightFields []Expr
+	switch j := op.(type) {
+	case *EqualityJoin:
+		left, right = *j.left, *j.right
+		leftFields, rightFields = []Expr{j.leftField}, []Expr{j.rightField}
+	case *SortMergeJoin:
+		left, right = *j.left, *j.right
+		leftFields, rightFields = []Expr{j.leftField}, []Expr{j.rightField}
+	case *GraceHashJoin:
+		if j.joinType != InnerJoin || len(j.residual) > 0 {
+			return nil
+		}
+		left, right = *j.left, *j.right
+		leftFields, rightFields = j.leftFields, j.rightFields
+	default:
+		return nil
+	}
+	rj, err := NewRippleJoin(left, leftFields, right, rightFields, aggs)
+	if err != nil {
+		DebugParser("not running the query online: %v", err)
+		return nil
+	}
+	return rj
+}
@@ -0,0 +1,130 @@
+package godb
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRippleJoin(t *testing.T) {
+	leftKey := func(i int) int64 { return int64(i % 100) }
+	rightKey := func(i int) int64 { return int64(i % 50) }
+	// 40 full pages of each
+	n := 40 * ((PageSize - 8) / (StringLength + Int64Length))
+	hf1, hf2, bp, tid := makeJoinTestFiles(t, n, leftKey, n, rightKey)
+	defer bp.CommitTransaction(tid)
+
+	count, sum := 0.0, 0.0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if leftKey(i) == rightKey(j) {
+				count++
+				sum += float64(leftKey(i))
+			}
+		}
+	}
+
+	leftAge := &FieldExpr{FieldType{"age", "l", IntType}}
+	rightAge := &FieldExpr{FieldType{"age", "r", IntType}}
+	cnt, total, avg := &CountAggState{}, &SumAggState{}, &AvgAggState{}
+	cnt.Init("cnt", leftAge)
+	total.Init("sum", leftAge)
+	avg.Init("avg", rightAge)
+	rj, err := NewRippleJoin(hf1, []Expr{leftAge}, hf2, []Expr{rightAge}, []AggState{cnt, total, avg})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(rj.Descriptor().Fields) != 7 {
+		t.Fatalf("expected 3 estimates, 3 bounds and the progress, got %v", rj.Descriptor())
+	}
+
+	defer func(interval time.Duration) { OnlineReportInterval = interval }(OnlineReportInterval)
+	OnlineReportInterval = 0
+	iter, err := rj.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var reports []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		reports = append(reports, tup)
+	}
+	if len(reports) < 10 {
+		t.Fatalf("expected running estimates as the pages are read, got %d", len(reports))
+	}
+
+	// halfway through, the estimates are close to the true values
+	mid := reports[len(reports)/2].Fields
+	for i, want := range []float64{count, sum, sum / count} {
+		est, _ := numericValue(mid[i])
+		bound := mid[3+i].(FloatField).Value
+		// (the average is truncated to an int)
+		if bound <= 0 || math.Abs(est-want) > 4*bound+1 {
+			t.Errorf("expected estimate %d to be near %v, got %v ± %v", i, want, est, bound)
+		}
+	}
+	progress := -1.0
+	for _, r := range reports {
+		p := r.Fields[6].(FloatField).Value
+		if p <= progress {
+			t.Errorf("expected progress to increase, got %v after %v", p, progress)
+		}
+		progress = p
+	}
+
+	// once everything is read, the estimates are exact
+	last := reports[len(reports)-1].Fields
+	if last[0] != (IntField{int64(count)}) || last[1] != (IntField{int64(sum)}) || last[2] != (IntField{int64(sum / count)}) {
+		t.Errorf("expected exact results %v %v %v, got %v", count, sum, int64(sum/count), last)
+	}
+	for i := 3; i < 6; i++ {
+		if last[i].(FloatField).Value != 0 {
+			t.Errorf("expected exact results to have no error, got %v", last)
+		}
+	}
+	if last[6] != (FloatField{1}) {
+		t.Errorf("expected to have read every page, got %v", last[6])
+	}
+
+	// only COUNT, SUM and AVG can be estimated
+	max := &MaxAggState{}
+	max.Init("max", leftAge)
+	if _, err := NewRippleJoin(hf1, []Expr{leftAge}, hf2, []Expr{rightAge}, []AggState{max}); err == nil {
+		t.Errorf("expected an error estimating MAX")
+	}
+}
+
+func TestParseOnlineAggregation(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	sql := "select count(*), sum(t.age) from t, t2 where t.name = t2.name and t2.age > 20"
+	exact := runHavingQuery(t, bp, c, sql)
+
+	defer func(online bool) { OnlineAggregation = online }(OnlineAggregation)
+	OnlineAggregation = true
+	tups := runHavingQuery(t, bp, c, sql)
+	if len(tups) != 1 || len(tups[0].Fields) != 5 {
+		t.Fatalf("expected a single report of 2 estimates, 2 bounds and the progress, got %v", tups)
+	}
+	if !tups[0].Fields[0].EvalPred(exact[0].Fields[0], OpEq) || !tups[0].Fields[1].EvalPred(exact[0].Fields[1], OpEq) {
+		t.Errorf("expected the exact results %v once every page was read, got %v", exact[0], tups[0])
+	}
+
+	// queries a ripple join can't run are run as usual
+	for _, sql := range []string{
+		"select name, count(*) from t group by name",
+		"select max(t.age) from t, t2 where t.name = t2.name",
+	} {
+		if tups := runHavingQuery(t, bp, c, sql); len(tups) == 0 || len(tups[0].Fields) > 2 {
+			t.Errorf("q=%s: expected the usual results, got %v", sql, tups)
+		}
+	}
+}
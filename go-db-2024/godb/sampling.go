@@ -0,0 +1,610 @@
+package godb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tables are often only partially loaded from their CSV files, so queries run
+// over a sample of each table. The [SampleInfo] of a table (see
+// [HeapFile.SampleInfo]) says how many tuples were loaded out of about how
+// many; each tuple was included in the sample with probability SampleSize /
+// PopulationSize. Operators pass this metadata up to the aggregates above
+// them, which scale their results up to the whole table and estimate the error
+// in doing so. The parser outputs the error bound of each estimated aggregate
+// in a bound(name) column after the select list.
+//
+// Operators whose output is no longer a sample of the table (e.g. a LIMIT that
+// may cut off its input) drop the sampling metadata, so aggregates above them
+// report the values they saw.
+
+// The z-value of the confidence intervals reported by [ErrorBounder]s (1.96 is
+// a 95% confidence interval).
+var ConfidenceZ = 1.96
+
+// Summary statistics of the values of a numeric column, kept up to date with
+// Welford's online algorithm as values are added (see
+// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm).
+type ColumnStats struct {
+	Count          float64 // the number of values summarized
+	Mean           float64
+	StdDev         float64
+	SumSquaresDiff float64 // the sum of squared differences from the mean
+	Min, Max       float64 // of the values summarized, if Count > 0
+	// A sketch of the distribution of the values summarized (see
+	// [ColumnStats.Quantile]), or nil if unknown, as for statistics read
+	// from older stats files
+	Quantiles *kllSketch
+}
+
+// Add a value to the statistics.
+func (c *ColumnStats) add(v float64) {
+	if c.Count == 0 {
+		c.Min, c.Max = v, v
+		if c.Quantiles == nil {
+			c.Quantiles = newKLLSketch(kllDefaultK)
+		}
+	}
+	c.Min, c.Max = math.Min(c.Min, v), math.Max(c.Max, v)
+	if c.Quantiles != nil {
+		c.Quantiles.add(v)
+	}
+	c.Count++
+	newMean := c.Mean + (v-c.Mean)/c.Count
+	c.SumSquaresDiff += (v - c.Mean) * (v - newMean)
+	c.Mean = newMean
+	c.StdDev = math.Sqrt(c.SumSquaresDiff / c.Count)
+}
+
+// Return the value a fraction p of the way through the values summarized, to
+// within the rank error of the sketch, or false if there is no sketch or no
+// values.
+func (c *ColumnStats) Quantile(p float64) (float64, bool) {
+	if c.Quantiles == nil {
+		return 0, false
+	}
+	return c.Quantiles.quantile(p)
+}
+
+func (c *ColumnStats) copy() *ColumnStats {
+	newCol := *c
+	if c.Quantiles != nil {
+		newCol.Quantiles = c.Quantiles.copy()
+	}
+	return &newCol
+}
+
+// Sampling metadata about the tuples an operator produces.
+type SampleInfo struct {
+	// The (estimated) number of tuples in the table the tuples are sampled
+	// from, or 0 if unknown
+	PopulationSize float64
+	// The number of tuples that were sampled
+	SampleSize float64
+	// Whether the column statistics describe the whole table, rather than
+	// just the sample
+	Complete bool
+	// Statistics of the numeric columns, by field name
+	Columns map[string]*ColumnStats
+	// If not nil, the outliers of the table were all loaded, rather than
+	// sampled (see [OutlierIndex]); PopulationSize and SampleSize count them
+	Outliers *OutlierIndex
+	// If not nil, the tuples were sampled with probability proportional to
+	// a measure column (see [MeasureBias])
+	Measure *MeasureBias
+}
+
+// How many standard deviations from its column's mean a value must be for the
+// Stat load mode to treat its row as an outlier (see
+// [HeapFile.StatAndLoadFromCSV]).
+var OutlierStdDevs = 2.0
+
+// An outlier index. Aggregates over a sample of a skewed column are dominated
+// by the few extreme values that the sample happens to include, so rather than
+// being sampled, the outliers of a table (the rows with a numeric value more
+// than StdDevs standard deviations from its column's mean, by the complete
+// column statistics) are all loaded, into a separate outlier table (see
+// [HeapFile.Outliers]). Only the other rows are sampled. Aggregates then add
+// up the exact contribution of the outliers, and estimate the contribution of
+// the others from the sample, by weighting each tuple by one over the
+// probability that it was loaded (see [WeightedAggState]).
+//
+// See S. Chaudhuri, G. Das, M. Datar, R. Motwani and V. Narasayya,
+// "Overcoming limitations of sampling for aggregation queries", ICDE 2001.
+type OutlierIndex struct {
+	StdDevs float64
+	Count   float64 // the number of outliers in the table
+}
+
+// The fraction of the rows of a table that measure-biased sampling loads (see
+// [HeapFile.MeasureBiasedLoadFromCSV]).
+var MeasureSampleRate = 0.01
+
+// The fraction of the probability of loading each row that measure-biased
+// sampling spreads evenly over the rows, so that rows with small measures
+// still have some chance of being loaded.
+var MeasureUniformFraction = 0.1
+
+// The name of the hidden column in which a table loaded by measure-biased
+// sampling records the probability that each of its tuples was loaded.
+const InclusionProbabilityField = "_inclusion_probability"
+
+// Measure-biased (importance) sampling. Aggregates like SUM(price) over a
+// uniform sample are dominated by the few large values the sample happens to
+// include, so rather than loading each row with the same probability, rows are
+// loaded with probability roughly proportional to the absolute value of a
+// measure column, mixed with [MeasureUniformFraction] of a uniform probability.
+// Each tuple keeps the probability it was loaded with in a hidden column (see
+// [InclusionProbabilityField]), which aggregates weight it by (see
+// [WeightedAggState]). The variance of the estimate of the total of the
+// measure is then much smaller than with uniform sampling.
+//
+// See D. Horvitz and D. Thompson, "A generalization of sampling without
+// replacement from a finite universe", JASA 1952.
+type MeasureBias struct {
+	Column string // the measure column, or "" if the rows were loaded uniformly
+}
+
+// Whether v is an outlier of the column, i.e. more than stdDevs standard
+// deviations from its mean.
+func (c *ColumnStats) isOutlier(v float64, stdDevs float64) bool {
+	return math.Abs(v-c.Mean) > stdDevs*c.StdDev
+}
+
+func NewSampleInfo() *SampleInfo {
+	return &SampleInfo{Columns: make(map[string]*ColumnStats)}
+}
+
+// Whether the tuples are a sample whose totals can be scaled up to the table.
+func (s *SampleInfo) IsSample() bool {
+	return s != nil && s.SampleSize > 0 && s.PopulationSize > 0
+}
+
+// The probability that a tuple of the table was included in the sample.
+func (s *SampleInfo) InclusionProbability() float64 {
+	if !s.IsSample() {
+		return 1
+	}
+	return s.SampleSize / s.PopulationSize
+}
+
+// Return the factor that totals over the sample are multiplied by to estimate
+// the totals over the table, i.e. one over the inclusion probability, and
+// whether the tuples are a sample at all.
+func (s *SampleInfo) ScaleFactor() (float64, bool) {
+	if !s.IsSample() {
+		return 1, false
+	}
+	return s.PopulationSize / s.SampleSize, true
+}
+
+// Return the statistics of a column, or nil if there are none.
+func (s *SampleInfo) Column(name string) *ColumnStats {
+	if s == nil {
+		return nil
+	}
+	return s.Columns[name]
+}
+
+// Return a copy that can be changed without changing s.
+func (s *SampleInfo) Copy() *SampleInfo {
+	if s == nil {
+		return nil
+	}
+	newInfo := *s
+	newInfo.Columns = make(map[string]*ColumnStats, len(s.Columns))
+	for name, col := range s.Columns {
+		newInfo.Columns[name] = col.copy()
+	}
+	if s.Outliers != nil {
+		outliers := *s.Outliers
+		newInfo.Outliers = &outliers
+	}
+	if s.Measure != nil {
+		measure := *s.Measure
+		newInfo.Measure = &measure
+	}
+	return &newInfo
+}
+
+// Return a function that gives the probability that a tuple (of desc) was
+// included in the sample, or nil if every tuple had the same probability,
+// InclusionProbability(). Tuples read from a table with an outlier index
+// were loaded for sure if they are outliers, and otherwise sampled from the
+// rest of the table. Tuples read from a table loaded by measure-biased
+// sampling carry the probability they were loaded with (or 1, if inserted
+// since) in their record ids, which filters, projections, aliases, limits and
+// in-memory sorts pass on; the function returns an error for tuples that lost
+// it (e.g. by being written to a temporary file), rather than guessing.
+func (s *SampleInfo) inclusionProbabilities(desc *TupleDesc) func(*Tuple) (float64, error) {
+	if s.IsSample() && s.Measure != nil {
+		return func(t *Tuple) (float64, error) {
+			if rid, ok := t.Rid.(weightedRID); ok {
+				return rid.prob, nil
+			}
+			return 0, GoDBError{IllegalOperationError, fmt.Sprintf("the probability that tuple %v of a measure-biased sample was loaded was lost before it was aggregated", t.Fields)}
+		}
+	}
+	if !s.IsSample() || s.Outliers == nil || desc == nil {
+		return nil
+	}
+	type column struct {
+		index int
+		stats *ColumnStats
+	}
+	var cols []column
+	for i, field := range desc.Fields {
+		if stats := s.Column(field.Fname); stats != nil && field.Ftype != StringType {
+			cols = append(cols, column{i, stats})
+		}
+	}
+	stdDevs := s.Outliers.StdDevs
+	inlierProb := 1.0
+	if s.PopulationSize > s.Outliers.Count {
+		inlierProb = math.Min(1, (s.SampleSize-s.Outliers.Count)/(s.PopulationSize-s.Outliers.Count))
+	}
+	return func(t *Tuple) (float64, error) {
+		for _, col := range cols {
+			if v, ok := numericValue(t.Fields[col.index]); ok && col.stats.isOutlier(v, stdDevs) {
+				return 1, nil
+			}
+		}
+		return inlierProb, nil
+	}
+}
+
+// Return a copy without the sampling metadata, for operators whose output
+// isn't a sample of their input's table.
+func (s *SampleInfo) withoutSampling() *SampleInfo {
+	newInfo := s.Copy()
+	if newInfo != nil {
+		newInfo.PopulationSize = 0
+		newInfo.SampleSize = 0
+	}
+	return newInfo
+}
+
+// Return the sampling metadata of the first limit tuples of an input with
+// sampling metadata s. Unless the limit is at least the number of sampled
+// tuples, it may cut off some of the input, whose output is then no longer a
+// sample of the table.
+func (s *SampleInfo) limitedTo(limit int64) *SampleInfo {
+	if s.IsSample() && float64(limit) < s.SampleSize {
+		return s.withoutSampling()
+	}
+	return s
+}
+
+// The finite population correction to the variance of an estimate from a
+// sample of n out of total tuples.
+func finitePopulationCorrection(n, total float64) float64 {
+	return math.Max(0, 1-n/total)
+}
+
+// Implemented by aggregation states whose results may be estimates from a
+// sample.
+type ErrorBounder interface {
+	// Returns the half-width of a confidence interval (see [ConfidenceZ])
+	// around the result of Finalize(info); zero if the result is exact.
+	ErrorBound(*SampleInfo) float64
+}
+
+// Return the error bound of an estimate of the total of y over the table from
+// the sum and sum of squares of y over a sample, where tuples that didn't pass
+// the filters count as zero. For a COUNT, y is one for the tuples that passed,
+// so the bound follows from the observed selectivity.
+func totalErrorBound(sum, sumSquares float64, info *SampleInfo) float64 {
+	if !info.IsSample() || info.SampleSize < 2 {
+		return 0
+	}
+	n, total := info.SampleSize, info.PopulationSize
+	mean := sum / n
+	variance := math.Max(0, (sumSquares/n-mean*mean)*n/(n-1))
+	return ConfidenceZ * total * math.Sqrt(variance/n*finitePopulationCorrection(n, total))
+}
+
+// Implemented by aggregation states that can estimate their result from a
+// sample whose tuples were included with different probabilities (see
+// [OutlierIndex] and [MeasureBias]). Aggregators use AddSampledTuple instead of AddTuple when
+// the probabilities differ, after which Finalize and ErrorBound should use the
+// probabilities rather than [SampleInfo.ScaleFactor].
+type WeightedAggState interface {
+	// Adds a tuple that was included in the sample with probability p.
+	AddSampledTuple(t *Tuple, p float64)
+}
+
+// Add t, included in the sample with probability p, to state, with
+// AddSampledTuple if it is a [WeightedAggState].
+func addSampledTuple(state AggState, t *Tuple, p float64) {
+	if w, ok := state.(WeightedAggState); ok {
+		w.AddSampledTuple(t, p)
+	} else {
+		state.AddTuple(t)
+	}
+}
+
+// The Horvitz-Thompson estimate of the total of some value y over a table,
+// from a sample whose tuples were included with different probabilities p:
+// the sum of y/p over the sample. Its variance is estimated as the sum of
+// (1-p)/p^2 y^2, as for Poisson sampling, so tuples that were included for
+// sure (p = 1) add no uncertainty. The estimate of the number of tuples, the
+// sum of 1/p, is kept too, for averages.
+type htEstimate struct {
+	weighted bool    // whether any tuples were added
+	total    float64 // sum of y/p
+	count    float64 // sum of 1/p
+	// sums of (1-p)/p^2, times 1, y and y^2
+	v0, v1, v2 float64
+}
+
+func (h *htEstimate) add(y, p float64) {
+	c := (1 - p) / (p * p)
+	h.weighted = true
+	h.total += y / p
+	h.count += 1 / p
+	h.v0 += c
+	h.v1 += c * y
+	h.v2 += c * y * y
+}
+
+func (h *htEstimate) merge(o htEstimate) {
+	h.weighted = h.weighted || o.weighted
+	h.total += o.total
+	h.count += o.count
+	h.v0 += o.v0
+	h.v1 += o.v1
+	h.v2 += o.v2
+}
+
+// The error bound of the estimate of the total.
+func (h *htEstimate) totalBound() float64 {
+	return ConfidenceZ * math.Sqrt(h.v2)
+}
+
+// The error bound of the estimate of the mean, total/count, which is
+// linearized as the total of (y - mean)/count.
+func (h *htEstimate) meanBound() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	mean := h.total / h.count
+	variance := math.Max(0, h.v2-2*mean*h.v1+mean*mean*h.v0)
+	return ConfidenceZ * math.Sqrt(variance) / h.count
+}
+
+// The first line of a stats file in the current format.
+const statsFileHeader = "godb-stats,5"
+
+// The first lines of stats files in previous formats: version 4 didn't record
+// measure-biased sampling, version 3 didn't record the ranges and sketches of
+// columns either, and version 2 didn't record outlier indexes either.
+const (
+	statsFileHeaderV4 = "godb-stats,4"
+	statsFileHeaderV3 = "godb-stats,3"
+	statsFileHeaderV2 = "godb-stats,2"
+)
+
+// Write info in the stats file format, along with the offset that a
+// contiguous load of the table left off at. Each line is a comma separated
+// record whose first field says what it describes:
+//
+//	godb-stats,<version>
+//	population,<estimated tuples in the table>
+//	sampled,<tuples loaded>
+//	complete,<1 if the column statistics are over the whole table>
+//	offset,<byte offset of the next line to load>
+//	column,<name>,<count>,<mean>,<stddev>,<sum of squared differences>,<min>,<max>
+//	sketch,<name>,<k>,<count>,<values of compactor 0>,<values of compactor 1>,...
+//	outliers,<standard deviations>,<outliers in the table>
+//	measure,<measure column>
+//
+// where the values of each compactor of a column's quantile sketch are
+// separated by spaces, the outliers line is only written for tables with an
+// outlier index, and the measure line for tables loaded by measure-biased
+// sampling.
+func writeSampleInfo(w io.Writer, info *SampleInfo, offset int64) error {
+	complete := 0
+	if info.Complete {
+		complete = 1
+	}
+	content := fmt.Sprintf("%s\npopulation,%v\nsampled,%v\ncomplete,%d\noffset,%d\n", statsFileHeader, info.PopulationSize, info.SampleSize, complete, offset)
+	names := make([]string, 0, len(info.Columns))
+	for name := range info.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		col := info.Columns[name]
+		content += fmt.Sprintf("column,%s,%v,%v,%v,%v,%v,%v\n", name, col.Count, col.Mean, col.StdDev, col.SumSquaresDiff, col.Min, col.Max)
+		if col.Quantiles != nil {
+			content += fmt.Sprintf("sketch,%s,%d,%v", name, col.Quantiles.k, col.Quantiles.n)
+			for _, level := range col.Quantiles.levels {
+				vals := make([]string, len(level))
+				for i, v := range level {
+					vals[i] = strconv.FormatFloat(v, 'g', -1, 64)
+				}
+				content += "," + strings.Join(vals, " ")
+			}
+			content += "\n"
+		}
+	}
+	if info.Outliers != nil {
+		content += fmt.Sprintf("outliers,%v,%v\n", info.Outliers.StdDevs, info.Outliers.Count)
+	}
+	if info.Measure != nil {
+		content += fmt.Sprintf("measure,%s\n", info.Measure.Column)
+	}
+	_, err := io.WriteString(w, content)
+	return err
+}
+
+// Read a stats file written by [writeSampleInfo], returning the sampling
+// metadata and the offset a contiguous load left off at. Files in the older
+// format, a CSV of statistics by key with the sampling metadata stored under
+// the keys "n", "estimatedLines", "complete" and "offset", are also accepted.
+func readSampleInfo(r io.Reader) (*SampleInfo, int64, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		// an empty file
+		return NewSampleInfo(), 0, scanner.Err()
+	}
+	header := strings.TrimSpace(scanner.Text())
+	if header != statsFileHeader && header != statsFileHeaderV4 && header != statsFileHeaderV3 && header != statsFileHeaderV2 {
+		if strings.HasPrefix(header, "godb-stats,") {
+			return nil, 0, GoDBError{MalformedDataError, fmt.Sprintf("unsupported stats file version %s", strings.TrimPrefix(header, "godb-stats,"))}
+		}
+		return readLegacySampleInfo(header, scanner)
+	}
+
+	info := NewSampleInfo()
+	var offset int64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		vals := strings.Split(line, ",")
+		var nums []float64
+		var err error
+		switch {
+		case vals[0] == "column" && (len(vals) == 8 || (header == statsFileHeaderV3 || header == statsFileHeaderV2) && len(vals) == 6):
+			nums, err = parseStatValues(vals[2:])
+		case vals[0] == "sketch" && len(vals) >= 5 && header != statsFileHeaderV3 && header != statsFileHeaderV2:
+			if info.Columns[vals[1]] == nil {
+				return nil, 0, GoDBError{MalformedDataError, fmt.Sprintf("sketch of unknown column %s", vals[1])}
+			}
+			info.Columns[vals[1]].Quantiles, err = parseSketch(vals[2:])
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		case vals[0] == "outliers" && len(vals) == 3:
+			nums, err = parseStatValues(vals[1:])
+		case vals[0] == "measure" && len(vals) == 2 && header == statsFileHeader:
+			info.Measure = &MeasureBias{Column: vals[1]}
+			continue
+		case vals[0] != "column" && vals[0] != "sketch" && vals[0] != "outliers" && len(vals) == 2:
+			nums, err = parseStatValues(vals[1:])
+		default:
+			return nil, 0, GoDBError{MalformedDataError, fmt.Sprintf("malformed statistic %s", line)}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch vals[0] {
+		case "population":
+			info.PopulationSize = nums[0]
+		case "sampled":
+			info.SampleSize = nums[0]
+		case "complete":
+			info.Complete = nums[0] == 1
+		case "offset":
+			offset = int64(nums[0])
+		case "column":
+			col := &ColumnStats{Count: nums[0], Mean: nums[1], StdDev: nums[2], SumSquaresDiff: nums[3]}
+			if len(nums) == 6 {
+				col.Min, col.Max = nums[4], nums[5]
+			} else {
+				// the range of the values is unknown
+				col.Min, col.Max = math.Inf(-1), math.Inf(1)
+			}
+			info.Columns[vals[1]] = col
+		case "outliers":
+			info.Outliers = &OutlierIndex{StdDevs: nums[0], Count: nums[1]}
+		default:
+			return nil, 0, GoDBError{MalformedDataError, fmt.Sprintf("unknown statistic %s", vals[0])}
+		}
+	}
+	return info, offset, scanner.Err()
+}
+
+// Parse the fields of a sketch record after the column name: the sketch's
+// accuracy parameter, the number of values it summarizes, and the values of
+// each of its compactors, separated by spaces.
+func parseSketch(vals []string) (*kllSketch, error) {
+	nums, err := parseStatValues(vals[:2])
+	if err != nil {
+		return nil, err
+	}
+	if nums[0] < 1 {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("invalid sketch parameter %v", nums[0])}
+	}
+	s := newKLLSketch(int(nums[0]))
+	s.n = nums[1]
+	s.levels = make([][]float64, len(vals)-2)
+	for h, level := range vals[2:] {
+		if s.levels[h], err = parseStatValues(strings.Fields(level)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func parseStatValues(vals []string) ([]float64, error) {
+	nums := make([]float64, len(vals))
+	for i, v := range vals {
+		var err error
+		nums[i], err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("couldn't parse statistic %s", v)}
+		}
+	}
+	return nums, nil
+}
+
+// Read the rest of a stats file in the older format, given its header line of
+// statistic names.
+func readLegacySampleInfo(header string, scanner *bufio.Scanner) (*SampleInfo, int64, error) {
+	const (
+		mean           = "mean"
+		stdDev         = "standardDeviation"
+		sumSquaresDiff = "SumSquaresDiff"
+	)
+	statNames := strings.Split(header, ",")
+	info := NewSampleInfo()
+	var offset int64
+	for scanner.Scan() {
+		vals := strings.Split(scanner.Text(), ",")
+		if len(vals) != len(statNames) {
+			continue
+		}
+		nums, err := parseStatValues(vals[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		stats := make(map[string]float64)
+		for i, v := range nums {
+			stats[statNames[i+1]] = v
+		}
+		switch vals[0] {
+		case "n":
+			info.SampleSize = stats[mean]
+		case "estimatedLines":
+			info.PopulationSize = stats[mean]
+		case "complete":
+			info.Complete = stats[mean] == 1
+		case "offset":
+			offset = int64(stats[mean])
+		default:
+			info.Columns[vals[0]] = &ColumnStats{StdDev: stats[stdDev], Mean: stats[mean], SumSquaresDiff: stats[sumSquaresDiff], Min: math.Inf(-1), Max: math.Inf(1)}
+		}
+	}
+	// the old format didn't record how many values each column summarizes,
+	// which is the number of tuples loaded (or in the table, if complete)
+	for _, col := range info.Columns {
+		col.Count = info.SampleSize
+		if info.Complete {
+			col.Count = info.PopulationSize
+		}
+		// nor the standard deviation of columns, which it stored as -1
+		if col.StdDev < 0 && col.Count > 0 {
+			col.StdDev = math.Sqrt(col.SumSquaresDiff / col.Count)
+		}
+	}
+	return info, offset, scanner.Err()
+}
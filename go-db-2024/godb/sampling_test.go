@@ -0,0 +1,628 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Make a heap file with ages 0 through 99 whose statistics say it is a sample
+// of 100 out of 1000 tuples.
+func makeSampledTestFile(t *testing.T) (*HeapFile, TransactionID) {
+	bp, hf := makeTestFile(t, 10)
+	td, _, _ := makeTupleTestVars()
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for i := 0; i < 100; i++ {
+		tup := Tuple{td, []DBValue{StringField{"sam"}, IntField{int64(i)}}, nil}
+		insertTupleForTest(t, hf, &tup, tid)
+	}
+	hf.sampleInfo.SampleSize = 100
+	hf.sampleInfo.PopulationSize = 1000
+	hf.sampleInfo.Columns["age"] = &ColumnStats{Count: 100, Mean: 49.5}
+	return hf, tid
+}
+
+// Run a COUNT(*) and SUM(age) over child, returning the results and the
+// error bounds of the aggregation states.
+func sampledCountSum(t *testing.T, child Operator, tid TransactionID) (int64, int64, float64, float64) {
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	cnt := &CountAggState{}
+	cnt.Init("cnt", age)
+	sum := &SumAggState{}
+	sum.Init("sum", age)
+	agg := NewAggregator([]AggState{cnt, sum}, child)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the iterator finalizes copies of the states, so redo that here to get
+	// at the error bounds
+	cntState, sumState := cnt.Copy(), sum.Copy()
+	info := child.SampleInfo()
+	probs := info.inclusionProbabilities(child.Descriptor())
+	childIter, _ := child.Iterator(tid)
+	for ct, _ := childIter(); ct != nil; ct, _ = childIter() {
+		if probs != nil {
+			p, err := probs(ct)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			addSampledTuple(cntState, ct, p)
+			addSampledTuple(sumState, ct, p)
+		} else {
+			cntState.AddTuple(ct)
+			sumState.AddTuple(ct)
+		}
+	}
+	return tup.Fields[0].(IntField).Value, tup.Fields[1].(IntField).Value,
+		cntState.(ErrorBounder).ErrorBound(info), sumState.(ErrorBounder).ErrorBound(info)
+}
+
+func TestSamplingFilterScaleUp(t *testing.T) {
+	hf, tid := makeSampledTestFile(t)
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	filt, err := NewFilter(&ConstExpr{IntField{30}, IntType}, OpLt, age, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cnt, sum, cntBound, sumBound := sampledCountSum(t, filt, tid)
+	if cnt != 300 {
+		t.Errorf("expected filtered count to be scaled up to 300, got %d", cnt)
+	}
+	if sum != 4350 {
+		t.Errorf("expected filtered sum to be scaled up to 4350, got %d", sum)
+	}
+	// p = 0.3, so the bound is 1.96 * 1000 * sqrt(0.3 * 0.7 * 100/99 / 100 * 0.9)
+	expected := ConfidenceZ * 1000 * math.Sqrt(0.3*0.7*100/99/100*0.9)
+	if math.Abs(cntBound-expected) > 0.01 {
+		t.Errorf("expected count error bound %f, got %f", expected, cntBound)
+	}
+	if sumBound <= 0 || sumBound >= float64(sum) {
+		t.Errorf("unexpected sum error bound %f for sum %d", sumBound, sum)
+	}
+
+	// without the filter, the count is exact
+	_, _, cntBound, _ = sampledCountSum(t, hf, tid)
+	if cntBound != 0 {
+		t.Errorf("expected unfiltered count to have no error, got %f", cntBound)
+	}
+}
+
+func TestSamplingProjectLimit(t *testing.T) {
+	hf, tid := makeSampledTestFile(t)
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+
+	// a renamed field keeps its statistics
+	proj, err := NewProjectOp([]Expr{age}, []string{"years"}, false, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	info := proj.SampleInfo()
+	if info.Column("years") == nil || info.SampleSize != 100 {
+		t.Errorf("expected projection to pass on sampling metadata and rename column statistics, got %v", info)
+	}
+	proj, _ = NewProjectOp([]Expr{age}, []string{"age"}, true, hf)
+	if proj.SampleInfo().IsSample() {
+		t.Errorf("expected distinct projection to drop sampling metadata")
+	}
+
+	// a limit that cuts off its input isn't scaled up, which is known before
+	// it is iterated over
+	limit := NewLimitOp(&ConstExpr{IntField{10}, IntType}, hf)
+	if limit.SampleInfo().IsSample() {
+		t.Errorf("expected a limit below the sample size to drop sampling metadata")
+	}
+	cnt, _, _, _ := sampledCountSum(t, limit, tid)
+	if cnt != 10 {
+		t.Errorf("expected count under a limit to be 10, got %d", cnt)
+	}
+	limit = NewLimitOp(&ConstExpr{IntField{200}, IntType}, hf)
+	cnt, _, _, _ = sampledCountSum(t, limit, tid)
+	if cnt != 1000 {
+		t.Errorf("expected count under a limit that keeps everything to be 1000, got %d", cnt)
+	}
+}
+
+func TestSampledQueryErrorBounds(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	hf, _ := c.GetTable("t")
+	hf.(*HeapFile).sampleInfo.SampleSize = 12
+	hf.(*HeapFile).sampleInfo.PopulationSize = 120
+
+	// 8 of the 12 tuples pass the filter
+	tups := runHavingQuery(t, bp, c, "select count(*) c, avg(age) a from t where age > 30")
+	if len(tups) != 1 || len(tups[0].Fields) != 4 {
+		t.Fatalf("expected one tuple of estimates and their bounds, got %v", tups)
+	}
+	desc := tups[0].Desc.Fields
+	if desc[2].Fname != "bound(c)" || desc[3].Fname != "bound(a)" {
+		t.Errorf("expected bound columns after the select list, got %v", desc)
+	}
+	if cnt := tups[0].Fields[0].(IntField).Value; cnt != 80 {
+		t.Errorf("expected an estimated count of 80, got %d", cnt)
+	}
+	for _, f := range tups[0].Fields[2:] {
+		if bound, ok := f.(FloatField); !ok || bound.Value <= 0 {
+			t.Errorf("expected a positive error bound, got %v", f)
+		}
+	}
+
+	// exact queries have no bounds
+	hf.(*HeapFile).sampleInfo.SampleSize = 0
+	hf.(*HeapFile).sampleInfo.PopulationSize = 0
+	tups = runHavingQuery(t, bp, c, "select count(*) c from t")
+	if len(tups) != 1 || len(tups[0].Fields) != 1 || tups[0].Fields[0].(IntField).Value != 12 {
+		t.Errorf("expected an exact count of 12 without a bound, got %v", tups)
+	}
+}
+
+func TestSampleInfoStatsFile(t *testing.T) {
+	info := NewSampleInfo()
+	info.PopulationSize = 1000
+	info.SampleSize = 10
+	info.Columns["age"] = &ColumnStats{}
+	for _, v := range []float64{1, 2, 3, 4} {
+		info.Columns["age"].add(v)
+	}
+	// a column named like one of the sampling statistics doesn't collide
+	// with it
+	info.Columns["sampled"] = &ColumnStats{Count: 1, Mean: 7}
+
+	var buf bytes.Buffer
+	if err := writeSampleInfo(&buf, info, 1234); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.HasPrefix(buf.String(), statsFileHeader+"\n") {
+		t.Errorf("expected stats file to start with a version header, got %s", buf.String())
+	}
+	readInfo, offset, err := readSampleInfo(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if offset != 1234 || readInfo.PopulationSize != 1000 || readInfo.SampleSize != 10 || readInfo.Complete {
+		t.Errorf("stats file didn't round trip, got %+v at offset %d", readInfo, offset)
+	}
+	age := readInfo.Column("age")
+	if age == nil || age.Count != 4 || age.Mean != 2.5 || math.Abs(age.StdDev-math.Sqrt(1.25)) > 1e-9 {
+		t.Errorf("unexpected column statistics %+v", age)
+	}
+	if age.Min != 1 || age.Max != 4 {
+		t.Errorf("expected the range of age to be [1, 4], got [%v, %v]", age.Min, age.Max)
+	}
+	if median, ok := age.Quantile(0.5); !ok || median < 2 || median > 3 {
+		t.Errorf("expected the sketch of age to round trip with a median of 2 or 3, got %v", median)
+	}
+	if col := readInfo.Column("sampled"); col == nil || col.Mean != 7 || col.Quantiles != nil {
+		t.Errorf("unexpected column statistics %+v", col)
+	}
+
+	// files of the previous version, without column ranges or sketches, can
+	// still be read
+	v3 := statsFileHeaderV3 + "\npopulation,10\nsampled,10\ncomplete,1\noffset,0\ncolumn,age,10,5,2,40\n"
+	readInfo, _, err = readSampleInfo(strings.NewReader(v3))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if age := readInfo.Column("age"); age == nil || age.StdDev != 2 || !math.IsInf(age.Max, 1) || age.Quantiles != nil {
+		t.Errorf("unexpected version 3 column statistics %+v", age)
+	}
+
+	// files in the old format can still be read
+	legacy := "FieldName,mean,standardDeviation,SumSquaresDiff,n\n" +
+		"n,100.00,0.00,0.00,0.00\n" +
+		"estimatedLines,5000.00,0.00,0.00,0.00\n" +
+		"offset,2048.00,0.00,0.00,0.00\n" +
+		"age,40.00,-1.00,250.00,0.00\n"
+	readInfo, offset, err = readSampleInfo(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if offset != 2048 || readInfo.PopulationSize != 5000 || readInfo.SampleSize != 100 {
+		t.Errorf("legacy stats file read incorrectly, got %+v at offset %d", readInfo, offset)
+	}
+	// whose standard deviations, stored as -1, are recomputed
+	if age := readInfo.Column("age"); age == nil || age.Mean != 40 || age.Count != 100 || age.StdDev != math.Sqrt(2.5) {
+		t.Errorf("unexpected legacy column statistics %+v", age)
+	}
+
+	if _, _, err := readSampleInfo(strings.NewReader("godb-stats,99\n")); err == nil {
+		t.Errorf("expected error reading an unknown stats file version")
+	}
+}
+
+func TestStatFromCSV(t *testing.T) {
+	_, hf := makeTestFile(t, 10)
+	dir := t.TempDir()
+	csv, err := os.Create(dir + "/test.csv")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	sum, sumSquares := 0.0, 0.0
+	for i := 0; i < 10000; i++ {
+		age := float64(1e9 + i%100)
+		sum += age
+		sumSquares += (age - 1e9) * (age - 1e9)
+		csv.WriteString(fmt.Sprintf("sam,%d\n", int64(age)))
+	}
+	if err := hf.StatFromCSV(csv, true, ",", false, dir+"/testStat.txt"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the stats file is read the same way as a heap file's own
+	statFile, err := os.Open(dir + "/testStat.txt")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer statFile.Close()
+	if err := hf.ProcessStatsFile(statFile); err != nil {
+		t.Fatalf(err.Error())
+	}
+	info := hf.SampleInfo()
+	if !info.Complete || info.PopulationSize != 10000 {
+		t.Errorf("expected complete statistics of 10000 rows, got %+v", info)
+	}
+	// the single pass keeps its precision for large values
+	mean := sum / 10000
+	variance := sumSquares/10000 - (mean-1e9)*(mean-1e9)
+	age := info.Column("age")
+	if age == nil || age.Count != 10000 || math.Abs(age.Mean-mean) > 1e-6 || math.Abs(age.StdDev-math.Sqrt(variance)) > 1e-6 {
+		t.Errorf("expected mean %v and stddev %v, got %+v", mean, math.Sqrt(variance), age)
+	}
+	if info.Column("name") != nil {
+		t.Errorf("expected no statistics of string columns")
+	}
+}
+
+func TestOutlierIndex(t *testing.T) {
+	// 20000 ages of 100 and 20 of 100000, which a sample of 40 would likely
+	// miss
+	bp, hf := makeTestFile(t, 50)
+	dir := t.TempDir()
+	csv, err := os.Create(dir + "/test.csv")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	for i := 0; i < 20000; i++ {
+		csv.WriteString("sam,100\n")
+		if i%1000 == 0 {
+			csv.WriteString("bo,100000\n")
+		}
+	}
+	csv.Seek(0, io.SeekStart)
+	if err := hf.StatAndLoadFromCSV(csv, true, ",", false, dir+"/testStat.txt"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(outlierFileName(hf.BackingFile()))
+
+	info := hf.SampleInfo()
+	if info.Outliers == nil || info.Outliers.Count != 20 {
+		t.Fatalf("expected an outlier index of 20 outliers, got %v", info.Outliers)
+	}
+	if info.SampleSize != 60 || info.PopulationSize != 20020 {
+		t.Errorf("expected 40 sampled tuples and 20 outliers of 20020, got %v of %v", info.SampleSize, info.PopulationSize)
+	}
+	stats, err := LoadStat(dir + "/testStat.txt")
+	if err != nil || stats.Outliers != nil {
+		t.Errorf("expected the stats pass to write plain statistics, got %v %v", stats, err)
+	}
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	// the outliers count once, and the sampled tuples for 500 each
+	cnt, sum, _, _ := sampledCountSum(t, hf, tid)
+	if cnt != 20020 || sum != 20000*100+20*100000 {
+		t.Errorf("expected count 20020 and sum 4000000, got %d and %d", cnt, sum)
+	}
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	avg, max := &AvgAggState{}, &MaxAggState{}
+	avg.Init("avg", age)
+	max.Init("max", age)
+	iter, _ := NewAggregator([]AggState{avg, max}, hf).Iterator(tid)
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup.Fields[0] != (IntField{4000000 / 20020}) || tup.Fields[1] != (IntField{100000}) {
+		t.Errorf("expected avg 199 and exact max 100000, got %v", tup.Fields)
+	}
+
+	// the outliers add no uncertainty
+	bound := &SumAggState{}
+	bound.Init("sum", age)
+	probs := info.inclusionProbabilities(hf.Descriptor())
+	childIter, _ := hf.Iterator(tid)
+	for ct, _ := childIter(); ct != nil; ct, _ = childIter() {
+		p, err := probs(ct)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		bound.AddSampledTuple(ct, p)
+	}
+	inliers := math.Sqrt(40 * (1 - 0.002) / (0.002 * 0.002) * 100 * 100)
+	if b := bound.ErrorBound(info); math.Abs(b-ConfidenceZ*inliers) > 1e-6 {
+		t.Errorf("expected sum error bound %v, got %v", ConfidenceZ*inliers, b)
+	}
+
+	// hash indexes find the outliers, and drop them when they are deleted
+	defer func(n int) { MaxHashIndexes = n }(MaxHashIndexes)
+	MaxHashIndexes = 1
+	idx, err := hf.hashIndex("name", tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	bos := idx.lookup(StringField{"bo"})
+	if idx.size() != 60 || len(bos) != 20 {
+		t.Fatalf("expected 20 of 60 indexed tuples named bo, got %d of %d", len(bos), idx.size())
+	}
+	bo, err := idx.tuple(bos[0], tid)
+	if err != nil || bo == nil || bo.Fields[1] != (IntField{100000}) {
+		t.Fatalf("expected an outlier named bo, got %v %v", bo, err)
+	}
+	if err := hf.deleteTuple(bo, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if idx, err = hf.hashIndex("name", tid); err != nil || len(idx.lookup(StringField{"bo"})) != 19 {
+		t.Errorf("expected the index to be rebuilt without the deleted outlier, got %v %v", idx, err)
+	}
+	if _, err := hf.hashIndex("age", tid); err != nil || len(hf.indexes) != 1 || hf.indexes[0].column != "age" {
+		t.Errorf("expected only the most recently used index to be kept, got %v %v", hf.indexes, err)
+	}
+
+	// the stats file records the outlier index
+	var buf bytes.Buffer
+	if err := writeSampleInfo(&buf, info, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	read, _, err := readSampleInfo(&buf)
+	if err != nil || read.Outliers == nil || *read.Outliers != *info.Outliers {
+		t.Errorf("expected to read back the outlier index, got %v %v", read, err)
+	}
+}
+
+// Return the weighted sum of the ages of each age group of child, aggregating
+// with an aggregator that keeps at most maxGroups groups in memory.
+func sampledAgeSums(t *testing.T, child Operator, bp *BufferPool, maxGroups int, tid TransactionID) map[int64]int64 {
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	sum := &SumAggState{}
+	sum.Init("sum", age)
+	agg, err := NewSpillingGroupedAggregator([]AggState{sum}, []Expr{age}, child, bp, maxGroups)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sums := make(map[int64]int64)
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			return sums
+		}
+		sums[tup.Fields[0].(IntField).Value] = tup.Fields[1].(IntField).Value
+	}
+}
+
+func TestMeasureBiasedSampling(t *testing.T) {
+	defer func(f func() float64) { measureSampleRand = f }(measureSampleRand)
+	measureSampleRand = rand.New(rand.NewSource(1)).Float64
+
+	// 99000 ages from 1 to 10 and 1000 of 10000, which contribute most of the
+	// sum
+	bp, hf := makeTestFile(t, 100)
+	dir := t.TempDir()
+	csv, err := os.Create(dir + "/test.csv")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	var total int64
+	for i := 0; i < 100000; i++ {
+		age := int64(1 + i%10)
+		if i%100 == 0 {
+			age = 10000
+		}
+		total += age
+		csv.WriteString(fmt.Sprintf("sam,%d\n", age))
+	}
+	if err := hf.MeasureBiasedLoadFromCSV(csv, true, ",", false, "age"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	uniform, err := NewHeapFile(dir+"/uniform.dat", hf.Descriptor(), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := uniform.MeasureBiasedLoadFromCSV(csv, true, ",", false, ""); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := hf.MeasureBiasedLoadFromCSV(csv, true, ",", false, "name"); err != nil {
+		t.Errorf("expected a sample to only be loaded once, got %v", err)
+	}
+
+	info := hf.SampleInfo()
+	if info.Measure == nil || info.Measure.Column != "age" || info.PopulationSize != 100000 || !info.Complete {
+		t.Fatalf("unexpected sampling metadata %v", info)
+	}
+	if info.SampleSize < 500 || info.SampleSize > 1500 {
+		t.Errorf("expected a sample of about 1000 tuples, got %v", info.SampleSize)
+	}
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	iter, _ := hf.Iterator(tid)
+	if tup, _ := iter(); tup == nil || len(tup.Fields) != 2 {
+		t.Errorf("expected tuples without the hidden column, got %v", tup)
+	}
+	cnt, sum, cntBound, sumBound := sampledCountSum(t, hf, tid)
+	cnt0, sum0 := cnt, sum
+	if math.Abs(float64(cnt-100000)) > 2*cntBound || math.Abs(float64(sum-total)) > 2*sumBound {
+		t.Errorf("expected count 100000 and sum %d, got %d ± %v and %d ± %v", total, cnt, cntBound, sum, sumBound)
+	}
+	_, _, _, uniformBound := sampledCountSum(t, uniform, tid)
+	if sumBound > uniformBound/5 {
+		t.Errorf("expected a much smaller error bound than uniform sampling's %v, got %v", uniformBound, sumBound)
+	}
+
+	// the probabilities pass through filters
+	age := &FieldExpr{FieldType{"age", "", IntType}}
+	filt, _ := NewFilter(&ConstExpr{IntField{100}, IntType}, OpGt, age, hf)
+	cnt, _, cntBound, _ = sampledCountSum(t, filt, tid)
+	if math.Abs(float64(cnt-1000)) > 2*cntBound || cntBound > 100 {
+		t.Errorf("expected about 1000 large ages, got %d ± %v", cnt, cntBound)
+	}
+
+	// and through projections, and spilled groups keep them
+	proj, err := NewProjectOp([]Expr{age}, []string{"age"}, false, hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if projCnt, projSum, _, _ := sampledCountSum(t, proj, tid); projCnt != cnt0 || projSum != sum0 {
+		t.Errorf("expected the projection to estimate count %d and sum %d, got %d and %d", cnt0, sum0, projCnt, projSum)
+	}
+	inMemory := sampledAgeSums(t, hf, bp, 100, tid)
+	if spilled := sampledAgeSums(t, hf, bp, 2, tid); len(inMemory) != 11 || !maps.Equal(spilled, inMemory) {
+		t.Errorf("expected spilled groups to have sums %v, got %v", inMemory, spilled)
+	}
+
+	// tuples whose probabilities were lost can't be aggregated
+	probs := info.inclusionProbabilities(hf.Descriptor())
+	if _, err := probs(&Tuple{*hf.Descriptor(), []DBValue{StringField{"sam"}, IntField{1}}, nil}); err == nil {
+		t.Errorf("expected an error for a tuple without its probability")
+	}
+
+	var buf bytes.Buffer
+	if err := writeSampleInfo(&buf, info, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	read, _, err := readSampleInfo(&buf)
+	if err != nil || read.Measure == nil || *read.Measure != *info.Measure {
+		t.Errorf("expected to read back the measure, got %v %v", read, err)
+	}
+	// files of earlier versions can't have a measure
+	v4 := statsFileHeaderV4 + "\npopulation,10\nsampled,10\ncomplete,1\noffset,0\nmeasure,age\n"
+	if _, _, err := readSampleInfo(strings.NewReader(v4)); err == nil {
+		t.Errorf("expected an error reading a measure from a version 4 stats file")
+	}
+}
+
+func TestMeasureBiasedSamplingThreshold(t *testing.T) {
+	// tables smaller than the sample are loaded whole, with probability 1
+	bp, hf := makeTestFile(t, 100)
+	csv, err := os.Create(t.TempDir() + "/test.csv")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	var total int64
+	for i := 0; i < 500; i++ {
+		age := int64(1 + i%10)
+		if i%100 == 0 {
+			age = 10000
+		}
+		total += age
+		csv.WriteString(fmt.Sprintf("sam,%d\n", age))
+	}
+	if err := hf.MeasureBiasedLoadFromCSV(csv, true, ",", false, "age"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if info := hf.SampleInfo(); info.SampleSize != 500 || info.PopulationSize != 500 {
+		t.Errorf("expected all 500 tuples to be loaded, got %v of %v", info.SampleSize, info.PopulationSize)
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	if cnt, sum, _, _ := sampledCountSum(t, hf, tid); cnt != 500 || sum != total {
+		t.Errorf("expected count 500 and sum %d, got %d and %d", total, cnt, sum)
+	}
+}
+
+func TestTruncateSample(t *testing.T) {
+	// a table of 20000 ages of 100 and 20 of 100000, loaded in the Stat mode
+	td, _, _ := makeTupleTestVars()
+	dir := t.TempDir()
+	csv, err := os.Create(dir + "/t.tbl")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	for i := 0; i < 20000; i++ {
+		csv.WriteString("sam,100\n")
+		if i%1000 == 0 {
+			csv.WriteString("bo,100000\n")
+		}
+	}
+	open := func() *HeapFile {
+		bp, err := NewBufferPool(50)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		hf, err := NewHeapFile(dir+"/t.dat", &td, bp, dir+"/tMeta.txt", dir+"/tStats.txt")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return hf
+	}
+	load := func(hf *HeapFile) {
+		if err := hf.StatAndLoadFromCSV(csv, true, ",", false, dir+"/tStat.txt"); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if info := hf.SampleInfo(); info.Outliers == nil || info.Outliers.Count != 20 || info.SampleSize != 60 {
+			t.Fatalf("expected 40 sampled tuples and 20 outliers, got %v", info)
+		}
+	}
+	hf := open()
+	load(hf)
+
+	if err := hf.Truncate(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hf.Outliers() != nil || hf.NumPages() != 0 || len(hf.offSetsLoaded) != 0 {
+		t.Errorf("expected the tuples, outliers and loaded offsets to be gone, got %v %v %v", hf.Outliers(), hf.NumPages(), len(hf.offSetsLoaded))
+	}
+	if _, err := os.Stat(outlierFileName(hf.BackingFile())); !os.IsNotExist(err) {
+		t.Errorf("expected the outlier table to be deleted, got %v", err)
+	}
+	if meta, err := os.ReadFile(dir + "/tMeta.txt"); err != nil || len(meta) != 0 {
+		t.Errorf("expected an empty metadata file, got %q %v", meta, err)
+	}
+
+	// the reset survives reopening the heap file, and the table can be
+	// loaded again from scratch
+	hf = open()
+	if info := hf.SampleInfo(); info.Outliers != nil || info.SampleSize != 0 || hf.NumPages() != 0 {
+		t.Errorf("expected a reopened empty heap file without a sample, got %v with %d pages", info, hf.NumPages())
+	}
+	load(hf)
+	tid := NewTID()
+	hf.bufPool.BeginTransaction(tid)
+	defer hf.bufPool.CommitTransaction(tid)
+	if cnt, _, _, _ := sampledCountSum(t, hf, tid); cnt != 20020 {
+		t.Errorf("expected count 20020, got %d", cnt)
+	}
+}
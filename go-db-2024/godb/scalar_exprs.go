@@ -0,0 +1,379 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// CASE, COALESCE, CAST and NULL aren't functions of the function tables in
+// exprs.go: CASE and COALESCE only evaluate the arguments they need and
+// aren't NULL just because an argument is, and the type of a CAST is the type
+// it names. They are parsed into calls of special forms with these names,
+// which [LogicalSelectNode.generateExpr] builds with specialForms instead of
+// making a [FuncExpr].
+var specialForms = map[string]func(args []Expr) (Expr, error){
+	"case":     makeCaseExpr,
+	"coalesce": NewCoalesceExpr,
+	"cast":     makeCastExpr,
+	"null": func(args []Expr) (Expr, error) {
+		return &ConstExpr{NullField{}, UnknownType}, nil
+	},
+}
+
+// Return the type of values that may come from any of exprs: their common
+// type, with integers promoted to floats if some of them are floats. NULLs
+// (of unknown type) fit any type.
+func commonType(what string, exprs []Expr) (DBType, error) {
+	t := UnknownType
+	for _, e := range exprs {
+		et := e.GetExprType().Ftype
+		switch {
+		case et == UnknownType || et == t:
+		case t == UnknownType:
+			t = et
+		case t == IntType && et == FloatType || t == FloatType && et == IntType:
+			t = FloatType
+		default:
+			return UnknownType, GoDBError{IncompatibleTypesError, fmt.Sprintf("%s mixes values of types %v and %v", what, t, et)}
+		}
+	}
+	return t, nil
+}
+
+// Convert v to t, which is its type or, for integers, FloatType (see
+// [commonType]).
+func promoteValue(v DBValue, t DBType) DBValue {
+	if i, ok := v.(IntField); ok && t == FloatType {
+		return FloatField{float64(i.Value)}
+	}
+	return v
+}
+
+// CASE WHEN cond THEN val ... [ELSE elseExpr] END: the value of the first
+// condition that is true, or elseExpr (by default NULL) if none is. The
+// simple form CASE x WHEN a THEN ... is parsed into conditions x = a.
+type CaseExpr struct {
+	conds    []Expr
+	vals     []Expr
+	elseExpr Expr // nil for NULL
+	outType  DBType
+}
+
+func NewCaseExpr(conds []Expr, vals []Expr, elseExpr Expr) (*CaseExpr, error) {
+	if len(conds) == 0 || len(conds) != len(vals) {
+		return nil, GoDBError{ParseError, "CASE needs a THEN for each of one or more WHENs"}
+	}
+	results := vals
+	if elseExpr != nil {
+		results = append(append([]Expr{}, vals...), elseExpr)
+	}
+	outType, err := commonType("CASE", results)
+	if err != nil {
+		return nil, err
+	}
+	return &CaseExpr{conds, vals, elseExpr, outType}, nil
+}
+
+// Make a CASE expression from the arguments of the case special form:
+// alternating conditions and values, followed by the ELSE value if there is
+// one.
+func makeCaseExpr(args []Expr) (Expr, error) {
+	var conds, vals []Expr
+	for i := 0; i+1 < len(args); i += 2 {
+		conds = append(conds, args[i])
+		vals = append(vals, args[i+1])
+	}
+	var elseExpr Expr
+	if len(args)%2 == 1 {
+		elseExpr = args[len(args)-1]
+	}
+	return NewCaseExpr(conds, vals, elseExpr)
+}
+
+func (e *CaseExpr) GetExprType() FieldType {
+	return FieldType{"case", "", e.outType}
+}
+
+func (e *CaseExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	for i, cond := range e.conds {
+		ok, err := evalPredicate(cond, t)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			v, err := e.vals[i].EvalExpr(t)
+			if err != nil {
+				return nil, err
+			}
+			return promoteValue(v, e.outType), nil
+		}
+	}
+	if e.elseExpr == nil {
+		return NullField{}, nil
+	}
+	v, err := e.elseExpr.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	return promoteValue(v, e.outType), nil
+}
+
+// COALESCE(args...): the first argument that isn't NULL, or NULL if they all
+// are. Arguments after it aren't evaluated.
+type CoalesceExpr struct {
+	args    []Expr
+	outType DBType
+}
+
+func NewCoalesceExpr(args []Expr) (Expr, error) {
+	if len(args) == 0 {
+		return nil, GoDBError{ParseError, "COALESCE needs at least one argument"}
+	}
+	outType, err := commonType("COALESCE", args)
+	if err != nil {
+		return nil, err
+	}
+	return &CoalesceExpr{args, outType}, nil
+}
+
+func (e *CoalesceExpr) GetExprType() FieldType {
+	ft := e.args[0].GetExprType()
+	if _, ok := e.args[0].(*FieldExpr); !ok {
+		ft = FieldType{"coalesce", "", e.outType}
+	}
+	ft.Ftype = e.outType
+	return ft
+}
+
+func (e *CoalesceExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	for _, arg := range e.args {
+		v, err := arg.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		if !isNull(v) {
+			return promoteValue(v, e.outType), nil
+		}
+	}
+	return NullField{}, nil
+}
+
+// The types CAST can convert to, by the names the parser accepts (see
+// [rewriteQuery] for the names it is taught).
+var castTypes = map[string]DBType{
+	"signed":   IntType,
+	"unsigned": IntType,
+	"decimal":  FloatType,
+	"char":     StringType,
+	"nchar":    StringType,
+	"binary":   StringType,
+	"date":     StringType,
+	"datetime": StringType,
+}
+
+// CAST(expr AS type). Strings are cast to numbers by parsing them, and it is
+// an error if they aren't numbers; floats are cast to integers by rounding
+// half away from zero. Casts to DATE and DATETIME make date strings (see
+// scalar_funcs.go), or NULL if the value isn't a date.
+type CastExpr struct {
+	expr     Expr
+	typeName string
+	to       DBType
+}
+
+func NewCastExpr(expr Expr, typeName string) (*CastExpr, error) {
+	typeName = strings.ToLower(typeName)
+	to, ok := castTypes[typeName]
+	if !ok {
+		return nil, GoDBError{ParseError, fmt.Sprintf("can't cast to type %s", typeName)}
+	}
+	return &CastExpr{expr, typeName, to}, nil
+}
+
+// Make a CAST from the arguments of the cast special form: the expression,
+// and a string constant naming the type.
+func makeCastExpr(args []Expr) (Expr, error) {
+	if len(args) == 2 {
+		if c, ok := args[1].(*ConstExpr); ok {
+			if typeName, ok := c.val.(StringField); ok {
+				return NewCastExpr(args[0], typeName.Value)
+			}
+		}
+	}
+	return nil, GoDBError{ParseError, "CAST needs an expression and a type"}
+}
+
+func (e *CastExpr) GetExprType() FieldType {
+	ft := e.expr.GetExprType()
+	if _, ok := e.expr.(*FieldExpr); !ok {
+		ft = FieldType{"cast", "", e.to}
+	}
+	ft.Ftype = e.to
+	return ft
+}
+
+func (e *CastExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	v, err := e.expr.EvalExpr(t)
+	if err != nil || isNull(v) {
+		return v, err
+	}
+	if e.typeName == "date" || e.typeName == "datetime" {
+		var date any
+		switch v := v.(type) {
+		case IntField:
+			date = v.Value
+		case StringField:
+			date = v.Value
+		}
+		d, _, ok := dateArg(date)
+		if !ok {
+			return NullField{}, nil
+		}
+		if e.typeName == "date" {
+			return StringField{d.Format(dateLayout)}, nil
+		}
+		return StringField{d.Format(datetimeLayout)}, nil
+	}
+
+	switch v := v.(type) {
+	case IntField:
+		switch e.to {
+		case FloatType:
+			return FloatField{float64(v.Value)}, nil
+		case StringType:
+			return StringField{strconv.FormatInt(v.Value, 10)}, nil
+		}
+	case FloatField:
+		switch e.to {
+		case IntType:
+			return IntField{int64(math.Round(v.Value))}, nil
+		case StringType:
+			return StringField{strconv.FormatFloat(v.Value, 'f', -1, 64)}, nil
+		}
+	case StringField:
+		s := strings.TrimSpace(v.Value)
+		switch e.to {
+		case IntType:
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return IntField{i}, nil
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return IntField{int64(math.Round(f))}, nil
+			}
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("can't cast '%s' to an integer", v.Value)}
+		case FloatType:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, GoDBError{TypeMismatchError, fmt.Sprintf("can't cast '%s' to a float", v.Value)}
+			}
+			return FloatField{f}, nil
+		}
+	}
+	return v, nil
+}
+
+// Describe a CASE, COALESCE or CAST for query plans, or return "" if e isn't
+// one.
+func scalarExprToStr(e Expr) string {
+	switch ex := e.(type) {
+	case *CaseExpr:
+		s := "CASE"
+		for i := range ex.conds {
+			s += fmt.Sprintf(" WHEN %s THEN %s", exprToStr(ex.conds[i]), exprToStr(ex.vals[i]))
+		}
+		if ex.elseExpr != nil {
+			s += " ELSE " + exprToStr(ex.elseExpr)
+		}
+		return s + " END"
+	case *CoalesceExpr:
+		return "COALESCE(" + exprListToStr(ex.args) + ")"
+	case *CastExpr:
+		return fmt.Sprintf("CAST(%s AS %s)", exprToStr(ex.expr), strings.ToUpper(ex.typeName))
+	}
+	return ""
+}
+
+// Parse a CASE expression into a call of the case special form.
+func parseCaseExpr(c *Catalog, expr *sqlparser.CaseExpr, alias string) (*LogicalSelectNode, error) {
+	var subject *LogicalSelectNode
+	if expr.Expr != nil {
+		var err error
+		subject, err = parseExpr(c, expr.Expr, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	var args []*LogicalSelectNode
+	for _, when := range expr.Whens {
+		var cond *LogicalSelectNode
+		var err error
+		if subject != nil {
+			var val *LogicalSelectNode
+			val, err = parseExpr(c, when.Cond, "")
+			if err != nil {
+				return nil, err
+			}
+			eq := NewPredSelectNode("=", []*LogicalSelectNode{subject, val})
+			cond = &eq
+		} else if cond, err = parsePredicate(c, when.Cond); err != nil {
+			return nil, err
+		}
+		val, err := parseExpr(c, when.Val, "")
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cond, val)
+	}
+	if expr.Else != nil {
+		elseVal, err := parseExpr(c, expr.Else, "")
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, elseVal)
+	}
+	node := NewFuncSelectNode("case", args, alias)
+	return &node, nil
+}
+
+// Parse a CAST into a call of the cast special form.
+func parseCastExpr(c *Catalog, expr *sqlparser.ConvertExpr, alias string) (*LogicalSelectNode, error) {
+	typeName := strings.ToLower(expr.Type.Type)
+	if _, ok := castTypes[typeName]; !ok {
+		return nil, GoDBError{ParseError, fmt.Sprintf("can't cast to type %s", typeName)}
+	}
+	arg, err := parseExpr(c, expr.Expr, "")
+	if err != nil {
+		return nil, err
+	}
+	typeNode := NewConstSelectNode(typeName, "")
+	node := NewFuncSelectNode("cast", []*LogicalSelectNode{arg, &typeNode}, alias)
+	return &node, nil
+}
+
+// Parse date + INTERVAL n unit, or date - INTERVAL n unit if subtract is
+// set, into a call of DATE_ADD or DATE_SUB.
+func parseDateArith(c *Catalog, date sqlparser.Expr, interval *sqlparser.IntervalExpr, subtract bool, alias string) (*LogicalSelectNode, error) {
+	unit := strings.ToLower(interval.Unit)
+	if !intervalUnits[unit] {
+		return nil, GoDBError{ParseError, fmt.Sprintf("unsupported INTERVAL unit %s", interval.Unit)}
+	}
+	dateArg, err := parseExpr(c, date, "")
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseExpr(c, interval.Expr, "")
+	if err != nil {
+		return nil, err
+	}
+	unitNode := NewConstSelectNode(unit, "")
+	op := "date_add"
+	if subtract {
+		op = "date_sub"
+	}
+	node := NewFuncSelectNode(op, []*LogicalSelectNode{dateArg, n, &unitNode}, alias)
+	return &node, nil
+}
@@ -0,0 +1,174 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestScalarFunctions(t *testing.T) {
+	call := func(op string, args ...any) DBValue {
+		var exprs []*Expr
+		for _, a := range args {
+			var e Expr
+			switch a := a.(type) {
+			case int:
+				e = &ConstExpr{IntField{int64(a)}, IntType}
+			case float64:
+				e = &ConstExpr{FloatField{a}, FloatType}
+			case string:
+				e = &ConstExpr{StringField{a}, StringType}
+			case nil:
+				e = &ConstExpr{NullField{}, UnknownType}
+			}
+			exprs = append(exprs, &e)
+		}
+		v, err := (&FuncExpr{op, exprs}).EvalExpr(nil)
+		if err != nil {
+			t.Fatalf("%s%v: %s", op, args, err.Error())
+		}
+		return v
+	}
+
+	tests := []struct {
+		got, want DBValue
+	}{
+		{call("fmax", 1.5, 2.5), FloatField{2.5}},
+		{call("abs", -3), IntField{3}},
+		{call("abs", -3.5), FloatField{3.5}},
+		{call("round", 2.5), FloatField{3}},
+		{call("round", 3.14159, 2), FloatField{3.14}},
+		{call("round", 1250, -2), IntField{1300}},
+		{call("round", -1250, -2), IntField{-1300}},
+		{call("floor", -1.5), FloatField{-2}},
+		{call("ceil", 1.2), FloatField{2}},
+		{call("lower", "SaM"), StringField{"sam"}},
+		{call("upper", "sam"), StringField{"SAM"}},
+		{call("length", "héllo"), IntField{5}},
+		{call("concat", "a", "b"), StringField{"ab"}},
+		{call("trim", "  a b "), StringField{"a b"}},
+		{call("abs", nil), NullField{}},
+		{call("extract", "year", "1998-12-01"), IntField{1998}},
+		{call("extract", "quarter", "1998-12-01"), IntField{4}},
+		{call("extract", "dow", "2024-01-07"), IntField{0}},
+		{call("extract", "hour", 3600), IntField{1}},
+		{call("extract", "year", "not a date"), NullField{}},
+		{call("date_sub", "1998-12-01", 90, "day"), StringField{"1998-09-02"}},
+		{call("date_add", "1998-12-01", 1, "month"), StringField{"1999-01-01"}},
+		{call("date_add", "1998-12-01", 2, "hour"), StringField{"1998-12-01 02:00:00"}},
+		{call("date_add", 0, 1, "day"), IntField{86400}},
+		{call("datediff", "1998-12-01", "1998-11-01 23:00:00"), IntField{30}},
+	}
+	for i, test := range tests {
+		if test.got != test.want {
+			t.Errorf("test %d: expected %v, got %v", i, test.want, test.got)
+		}
+	}
+
+	// float arguments make the overloads return floats
+	var arg Expr = &ConstExpr{FloatField{2.5}, FloatType}
+	if typ := (&FuncExpr{"round", []*Expr{&arg}}).GetExprType().Ftype; typ != FloatType {
+		t.Errorf("expected round of a float to be a float, got %v", typ)
+	}
+	arg = &ConstExpr{StringField{"a"}, StringType}
+	if typ := (&FuncExpr{"lower", []*Expr{&arg}}).GetExprType().Ftype; typ != StringType {
+		t.Errorf("expected lower to be a string, got %v", typ)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	name := "test_reverse"
+	defer delete(overloadedFuncs, name)
+	reverse := func(args []any) any {
+		r := []rune(args[0].(string))
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	}
+	if err := RegisterFunction("TEST_REVERSE", []DBType{StringType}, StringType, reverse); err != nil {
+		t.Fatalf(err.Error())
+	}
+	negate := func(args []any) any { return -args[0].(int64) }
+	if err := RegisterFunction(name, []DBType{IntType}, IntType, negate); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := RegisterFunction(name, []DBType{IntType}, IntType, negate); err == nil {
+		t.Errorf("expected error registering an overload twice")
+	}
+	for _, bad := range []string{"sum", "coalesce"} {
+		if err := RegisterFunction(bad, []DBType{IntType}, IntType, negate); err == nil {
+			t.Errorf("expected error registering %s", bad)
+		}
+	}
+
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	tups := runHavingQuery(t, bp, c, "select test_reverse(name), test_reverse(age) from t where name = 'kathy'")
+	if len(tups) != 1 || tups[0].Fields[0] != (StringField{"yhtak"}) || tups[0].Fields[1] != (IntField{-45}) {
+		t.Errorf("unexpected results of registered functions %v", tups)
+	}
+}
+
+func TestParseScalarExprs(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	// the value of the last column for each name (of names that appear once)
+	values := func(sql string) map[string]DBValue {
+		vals := make(map[string]DBValue)
+		for _, tup := range runHavingQuery(t, bp, c, sql) {
+			vals[tup.Fields[0].(StringField).Value] = tup.Fields[len(tup.Fields)-1]
+		}
+		return vals
+	}
+
+	vals := values("select name, case when age < 30 then 'young' when age < 50 then 'middle' else 'old' end from t")
+	if vals["ang"] != (StringField{"young"}) || vals["kathy"] != (StringField{"middle"}) || vals["sarah"] != (StringField{"old"}) {
+		t.Errorf("unexpected searched CASE results %v", vals)
+	}
+	vals = values("select name, case age when 45 then 1.5 when 30 then 2 end x from t")
+	if vals["kathy"] != (FloatField{1.5}) || vals["bill"] != (FloatField{2}) || !isNull(vals["mark"]) {
+		t.Errorf("unexpected simple CASE results %v", vals)
+	}
+	vals = values("select name, sum(case when age > 40 then 1 else 0 end) from t group by name")
+	if vals["sam"] != (IntField{1}) || vals["ang"] != (IntField{0}) {
+		t.Errorf("unexpected sums of CASE %v", vals)
+	}
+	vals = values("select name, cast(age as char) a, cast(age as float) / 2, cast('7' as int) + age from t")
+	if vals["kathy"] != (IntField{52}) {
+		t.Errorf("unexpected CAST results %v", vals)
+	}
+	vals = values("select name, cast(age as char) from t")
+	if vals["kathy"] != (StringField{"45"}) {
+		t.Errorf("unexpected CAST to CHAR results %v", vals)
+	}
+	vals = values("select name, coalesce(null, upper(concat(name, '-', 'x'))) from t")
+	if vals["bo"] != (StringField{"BO-X"}) {
+		t.Errorf("unexpected COALESCE results %v", vals)
+	}
+	vals = values("select name, extract(year from '1998-12-01' - interval age day), date_add('2024-01-31', interval 1 month) from t")
+	if vals["bo"] != (StringField{"2024-03-02"}) {
+		t.Errorf("unexpected DATE_ADD results %v", vals)
+	}
+	vals = values("select name, extract(year from '1998-12-01' - interval age * 10 day) from t")
+	if vals["kathy"] != (IntField{1997}) || vals["bo"] != (IntField{1996}) {
+		t.Errorf("unexpected EXTRACT results %v", vals)
+	}
+	if tups := runHavingQuery(t, bp, c, "select name from t where abs(age - 50) <= 5 and length(trim(name)) > 2"); len(tups) != 2 {
+		t.Errorf("expected 2 names with ages near 50, got %v", tups)
+	}
+
+	for _, sql := range []string{
+		"select case when age > 1 then 'a' else 1 end from t",
+		"select cast(age as json) from t",
+		"select extract(fortnight from name) from t",
+		"select name + interval 1 fortnight from t",
+	} {
+		if _, _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
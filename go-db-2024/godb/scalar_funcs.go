@@ -0,0 +1,234 @@
+package godb
+
+import (
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The math, string and date functions of the function tables in exprs.go.
+//
+// Dates are either strings, formatted like '2006-01-02' or
+// '2006-01-02 15:04:05' (or in RFC 3339 or Unix date format), or integer
+// seconds since the Unix epoch. They are in UTC. Date functions are NULL for
+// strings that aren't dates.
+
+func identityFunc(args []any) any {
+	return args[0]
+}
+
+func absFuncInt(args []any) any {
+	v := args[0].(int64)
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func absFuncFloat(args []any) any {
+	return math.Abs(args[0].(float64))
+}
+
+// ROUND(x [, digits]) rounds half away from zero to digits (by default 0)
+// digits after the decimal point, or to a power of ten if digits is negative.
+func roundFuncFloat(args []any) any {
+	x := args[0].(float64)
+	if len(args) == 1 {
+		return math.Round(x)
+	}
+	scale := math.Pow(10, float64(args[1].(int64)))
+	return math.Round(x*scale) / scale
+}
+
+func roundFuncInt(args []any) any {
+	x := args[0].(int64)
+	if len(args) == 1 || args[1].(int64) >= 0 {
+		return x
+	}
+	if args[1].(int64) < -18 {
+		return int64(0)
+	}
+	scale := int64(math.Pow10(int(-args[1].(int64))))
+	half := scale / 2
+	if x < 0 {
+		half = -half
+	}
+	return (x + half) / scale * scale
+}
+
+func floorFuncFloat(args []any) any {
+	return math.Floor(args[0].(float64))
+}
+
+func ceilFuncFloat(args []any) any {
+	return math.Ceil(args[0].(float64))
+}
+
+func lowerFunc(args []any) any {
+	return strings.ToLower(args[0].(string))
+}
+
+func upperFunc(args []any) any {
+	return strings.ToUpper(args[0].(string))
+}
+
+// The length of a string in characters, not bytes.
+func lengthFunc(args []any) any {
+	return int64(utf8.RuneCountInString(args[0].(string)))
+}
+
+func concatFunc(args []any) any {
+	return args[0].(string) + args[1].(string)
+}
+
+func trimFunc(args []any) any {
+	return strings.TrimSpace(args[0].(string))
+}
+
+func ltrimFunc(args []any) any {
+	return strings.TrimLeftFunc(args[0].(string), unicode.IsSpace)
+}
+
+func rtrimFunc(args []any) any {
+	return strings.TrimRightFunc(args[0].(string), unicode.IsSpace)
+}
+
+const (
+	dateLayout     = "2006-01-02"
+	datetimeLayout = "2006-01-02 15:04:05"
+)
+
+var dateLayouts = []string{dateLayout, datetimeLayout, time.RFC3339, time.UnixDate}
+
+// Return the date that arg (a string or an integer) is, and for strings, the
+// layout it is formatted in.
+func dateArg(arg any) (time.Time, string, bool) {
+	switch v := arg.(type) {
+	case int64:
+		return time.Unix(v, 0).UTC(), "", true
+	case string:
+		v = strings.TrimSpace(v)
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC(), layout, true
+			}
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// The units of INTERVALs, which EXTRACT also accepts.
+var intervalUnits = map[string]bool{"year": true, "quarter": true, "month": true, "week": true, "day": true, "hour": true, "minute": true, "second": true}
+
+// The units EXTRACT accepts besides those of INTERVALs: the day of the week
+// (0 for Sunday), the day of the year, and seconds since the Unix epoch.
+var extractOnlyUnits = map[string]bool{"dow": true, "doy": true, "epoch": true}
+
+func isExtractUnit(unit string) bool {
+	unit = strings.ToLower(unit)
+	return intervalUnits[unit] || extractOnlyUnits[unit]
+}
+
+// EXTRACT(unit FROM date), which is rewritten to extract('unit', date).
+func extractFunc(args []any) any {
+	t, _, ok := dateArg(args[1])
+	if !ok {
+		return nil
+	}
+	switch strings.ToLower(args[0].(string)) {
+	case "year":
+		return int64(t.Year())
+	case "quarter":
+		return int64((t.Month()-1)/3 + 1)
+	case "month":
+		return int64(t.Month())
+	case "week":
+		_, week := t.ISOWeek()
+		return int64(week)
+	case "day":
+		return int64(t.Day())
+	case "hour":
+		return int64(t.Hour())
+	case "minute":
+		return int64(t.Minute())
+	case "second":
+		return int64(t.Second())
+	case "dow":
+		return int64(t.Weekday())
+	case "doy":
+		return int64(t.YearDay())
+	case "epoch":
+		return t.Unix()
+	}
+	return nil
+}
+
+// Add n units to t. Adding months or years to the end of a month may
+// overflow into the next month, as in Go's [time.Time.AddDate].
+func addInterval(t time.Time, n int64, unit string) (time.Time, bool) {
+	switch strings.ToLower(unit) {
+	case "year":
+		return t.AddDate(int(n), 0, 0), true
+	case "quarter":
+		return t.AddDate(0, 3*int(n), 0), true
+	case "month":
+		return t.AddDate(0, int(n), 0), true
+	case "week":
+		return t.AddDate(0, 0, 7*int(n)), true
+	case "day":
+		return t.AddDate(0, 0, int(n)), true
+	case "hour":
+		return t.Add(time.Duration(n) * time.Hour), true
+	case "minute":
+		return t.Add(time.Duration(n) * time.Minute), true
+	case "second":
+		return t.Add(time.Duration(n) * time.Second), true
+	}
+	return t, false
+}
+
+// DATE_ADD(date, n, unit), which date + INTERVAL n unit is parsed into. The
+// result has the type of date, and string dates keep their format, except
+// that dates without a time get one when hours, minutes or seconds are added.
+func dateAddFunc(args []any) any {
+	t, layout, ok := dateArg(args[0])
+	if !ok {
+		return nil
+	}
+	unit := args[2].(string)
+	t, ok = addInterval(t, args[1].(int64), unit)
+	if !ok {
+		return nil
+	}
+	if layout == "" {
+		return t.Unix()
+	}
+	if layout == dateLayout && isTimeUnit(unit) {
+		layout = datetimeLayout
+	}
+	return t.Format(layout)
+}
+
+func isTimeUnit(unit string) bool {
+	unit = strings.ToLower(unit)
+	return unit == "hour" || unit == "minute" || unit == "second"
+}
+
+// DATE_SUB(date, n, unit), which date - INTERVAL n unit is parsed into.
+func dateSubFunc(args []any) any {
+	return dateAddFunc([]any{args[0], -args[1].(int64), args[2]})
+}
+
+// DATEDIFF(a, b), the number of days from date b to date a, ignoring their
+// times.
+func dateDiffFunc(args []any) any {
+	a, _, okA := dateArg(args[0])
+	b, _, okB := dateArg(args[1])
+	if !okA || !okB {
+		return nil
+	}
+	day := 24 * time.Hour
+	return int64(a.Truncate(day).Sub(b.Truncate(day)) / day)
+}
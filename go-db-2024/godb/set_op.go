@@ -0,0 +1,161 @@
+package godb
+
+import (
+	"fmt"
+)
+
+type SetOpType int
+
+const (
+	UnionOp     SetOpType = iota // tuples of either input
+	IntersectOp SetOpType = iota // tuples of both inputs
+	ExceptOp    SetOpType = iota // tuples of the left input but not the right
+)
+
+func (op SetOpType) String() string {
+	switch op {
+	case UnionOp:
+		return "UNION"
+	case IntersectOp:
+		return "INTERSECT"
+	case ExceptOp:
+		return "EXCEPT"
+	}
+	return "unknown set operation"
+}
+
+// SetOp combines the tuples of two inputs with the same number and types of
+// fields. Without all, duplicates are removed from its output. With all,
+// INTERSECT outputs a tuple as many times as the smaller of the number of
+// times it appears in each input, and EXCEPT as many times as it appears in
+// the left input more than in the right. Tuples are compared by
+// [Tuple.tupleKey], so NULLs are equal to each other.
+//
+// The right input is read into memory for INTERSECT and EXCEPT, and the
+// distinct tuples of the output are kept in memory without all.
+type SetOp struct {
+	op          SetOpType
+	all         bool
+	left, right Operator
+}
+
+var DEBUGSETOP = false
+
+func DebugSetOp(format string, a ...any) (int, error) {
+	if DEBUGSETOP || GLOBALDEBUG {
+		return fmt.Println(fmt.Sprintf(format, a...))
+	}
+	return 0, nil
+}
+
+// Construct a new set operation. The output has the field names of the left
+// input.
+func NewSetOp(op SetOpType, all bool, left Operator, right Operator) (*SetOp, error) {
+	lFields, rFields := left.Descriptor().Fields, right.Descriptor().Fields
+	if len(lFields) != len(rFields) {
+		return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("inputs of %v have %d and %d fields", op, len(lFields), len(rFields))}
+	}
+	for i := range lFields {
+		lType, rType := lFields[i].Ftype, rFields[i].Ftype
+		if lType != rType && lType != UnknownType && rType != UnknownType {
+			return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("field %d of the inputs of %v have different types", i+1, op)}
+		}
+	}
+	return &SetOp{op, all, left, right}, nil
+}
+
+func (s *SetOp) Descriptor() *TupleDesc {
+	return s.left.Descriptor()
+}
+
+// Neither input's sampling applies to the combined tuples.
+func (s *SetOp) SampleInfo() *SampleInfo {
+	return nil
+}
+
+func (s *SetOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	leftIter, err := s.left.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	desc := s.Descriptor()
+
+	// how many times each tuple of the right input appears
+	var rightCounts map[any]int
+	var rightIter func() (*Tuple, error)
+	if s.op == UnionOp {
+		rightIter, err = s.right.Iterator(tid)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rightCounts = make(map[any]int)
+		iter, err := s.right.Iterator(tid)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				break
+			}
+			rightCounts[t.tupleKey()]++
+		}
+		DebugSetOp("%v read %d distinct right tuples", s.op, len(rightCounts))
+	}
+
+	seen := make(map[any]bool)
+	leftDone := false
+	return func() (*Tuple, error) {
+		for {
+			var t *Tuple
+			var err error
+			if !leftDone {
+				t, err = leftIter()
+				if err != nil {
+					return nil, err
+				}
+				leftDone = t == nil
+			}
+			if leftDone {
+				if rightIter == nil {
+					return nil, nil
+				}
+				t, err = rightIter()
+				if err != nil || t == nil {
+					return nil, err
+				}
+				t = &Tuple{*desc, t.Fields, nil}
+			}
+
+			key := t.tupleKey()
+			switch s.op {
+			case IntersectOp:
+				if rightCounts[key] == 0 {
+					continue
+				}
+				if s.all {
+					rightCounts[key]--
+				}
+			case ExceptOp:
+				if s.all && rightCounts[key] > 0 {
+					rightCounts[key]--
+					continue
+				}
+				if !s.all && rightCounts[key] > 0 {
+					continue
+				}
+			}
+			if !s.all {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			return t, nil
+		}
+	}, nil
+}
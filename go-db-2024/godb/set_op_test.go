@@ -0,0 +1,128 @@
+package godb
+
+import (
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestSetOp(t *testing.T) {
+	values := func(vs ...int64) *ValueOp {
+		exprs := make([][]Expr, len(vs))
+		for i, v := range vs {
+			exprs[i] = []Expr{&ConstExpr{IntField{v}, IntType}}
+		}
+		return NewValueOp(exprs)
+	}
+	tests := []struct {
+		op   SetOpType
+		all  bool
+		want []int64
+	}{
+		{UnionOp, true, []int64{1, 1, 2, 3, 2, 3, 3, 4}},
+		{UnionOp, false, []int64{1, 2, 3, 4}},
+		{IntersectOp, true, []int64{2, 3}},
+		{IntersectOp, false, []int64{2, 3}},
+		{ExceptOp, true, []int64{1, 1}},
+		{ExceptOp, false, []int64{1}},
+	}
+	for _, test := range tests {
+		op, err := NewSetOp(test.op, test.all, values(1, 1, 2, 3), values(2, 3, 3, 4))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, err := op.Iterator(NewTID())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []int64
+		for {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if tup == nil {
+				break
+			}
+			got = append(got, tup.Fields[0].(IntField).Value)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v (all=%v): expected %v, got %v", test.op, test.all, test.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v (all=%v): expected %v, got %v", test.op, test.all, test.want, got)
+				break
+			}
+		}
+	}
+
+	wide := NewValueOp([][]Expr{{&ConstExpr{IntField{1}, IntType}, &ConstExpr{IntField{2}, IntType}}})
+	if _, err := NewSetOp(UnionOp, true, values(1), wide); err == nil {
+		t.Errorf("expected error combining inputs with different numbers of fields")
+	}
+}
+
+func TestParseSetOps(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql  string
+		rows int
+	}{
+		{"select name from t union all select name from t2", 24},
+		{"select name from t union select name from t2", 10},
+		{"select name from t where age > 40 intersect select name from t2 where age < 30", 2},
+		{"select name from t except select name from t2 where age < 40", 5},
+		{"select name from t except all select name from t2 where age < 40", 7},
+		{"select name from t except (select name from t2 where age < 30 union select name from t2 where age > 90)", 6},
+		{"select count(*) from (select name from t union select name from t2) u", 1},
+	}
+	for _, q := range queries {
+		if tups := runHavingQuery(t, bp, c, q.sql); len(tups) != q.rows {
+			t.Errorf("q=%s: expected %d rows, got %d", q.sql, q.rows, len(tups))
+		}
+	}
+
+	tups := runHavingQuery(t, bp, c, "select count(*) from (select name from t union select name from t2) u")
+	if tups[0].Fields[0].(IntField).Value != 10 {
+		t.Errorf("expected 10 distinct names, got %v", tups[0].Fields[0])
+	}
+	tups = runHavingQuery(t, bp, c, "select name from t union select name from t2 order by name limit 3")
+	if len(tups) != 3 || tups[0].Fields[0].(StringField).Value != "ang" {
+		t.Errorf("expected the first 3 names starting with ang, got %v", tups)
+	}
+
+	// INTERSECT binds more tightly than UNION and EXCEPT, unless parenthesized
+	young := "select name from t where age < 30"  // sam, ang, riza
+	old := "select name from t where age > 90"    // bo, sam
+	t2Old := "select name from t2 where age > 50" // sarah, bo, sam
+	precedence := []struct {
+		sql   string
+		names []string
+	}{
+		{young + " union " + old + " intersect " + t2Old, []string{"ang", "bo", "riza", "sam"}},
+		{"(" + young + " union " + old + ") intersect " + t2Old, []string{"bo", "sam"}},
+		{young + " except " + old + " intersect " + t2Old, []string{"ang", "riza"}},
+		{old + " intersect " + t2Old + " union " + young, []string{"ang", "bo", "riza", "sam"}},
+		{young + " except " + old + " union " + old, []string{"ang", "bo", "riza", "sam"}},
+	}
+	for _, q := range precedence {
+		var names []string
+		for _, tup := range runHavingQuery(t, bp, c, q.sql) {
+			names = append(names, tup.Fields[0].(StringField).Value)
+		}
+		sort.Strings(names)
+		if !slices.Equal(names, q.names) {
+			t.Errorf("q=%s: expected %v, got %v", q.sql, q.names, names)
+		}
+	}
+
+	if _, _, _, err := Parse(c, "select name from t union select name, age from t2"); err == nil {
+		t.Errorf("expected error for a union of queries with different numbers of fields")
+	}
+}
@@ -0,0 +1,89 @@
+package godb
+
+// A SortAggregator is a grouped aggregation over an input that is already
+// ordered (or at least grouped) on the group by fields, e.g. because it comes
+// from an ORDER BY or a sort-merge join. Each group's tuples arrive together,
+// so only one group's state is kept at a time and groups are output as soon
+// as they end.
+type SortAggregator struct {
+	*Aggregator
+}
+
+// Construct a sort-based aggregator. The child must return all of the tuples
+// of each group consecutively.
+func NewSortAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator) (*SortAggregator, error) {
+	if len(groupByFields) == 0 {
+		return nil, GoDBError{IllegalOperationError, "sort-based aggregation needs a group by"}
+	}
+	return &SortAggregator{NewGroupedAggregator(emptyAggState, groupByFields, child)}, nil
+}
+
+// Returns an iterator over the groups of the child, in the order they appear
+// in the child.
+func (sa *SortAggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := sa.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	if childIter == nil {
+		return nil, GoDBError{MalformedDataError, "child iter unexpectedly nil"}
+	}
+	sa.probs = sa.child.SampleInfo().inclusionProbabilities(sa.child.Descriptor())
+
+	// the group currently being aggregated
+	var curKey any
+	var curGroup *Tuple
+	var curState *[]AggState
+
+	finalize := func() *Tuple {
+		tup := curGroup
+		for _, aggState := range *curState {
+			tup = joinTuples(tup, aggState.Finalize(sa.child.SampleInfo()))
+		}
+		curState = nil
+		return tup
+	}
+
+	done := false
+	return func() (*Tuple, error) {
+		for !done {
+			t, err := childIter()
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				done = true
+				break
+			}
+			keygenTup, err := extractGroupByKeyTuple(sa.Aggregator, t)
+			if err != nil {
+				return nil, err
+			}
+			key := keygenTup.tupleKey()
+			if curState != nil && key == curKey {
+				if err := addTupleToGrpAggState(sa.Aggregator, t, curState); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			// a new group starts, so the previous one is complete
+			var out *Tuple
+			if curState != nil {
+				out = finalize()
+			}
+			asNew := make([]AggState, len(sa.newAggState))
+			curKey, curGroup, curState = key, keygenTup, &asNew
+			if err := addTupleToGrpAggState(sa.Aggregator, t, curState); err != nil {
+				return nil, err
+			}
+			if out != nil {
+				return out, nil
+			}
+		}
+		if curState != nil {
+			return finalize(), nil
+		}
+		return nil, nil
+	}, nil
+}
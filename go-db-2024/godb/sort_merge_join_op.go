@@ -0,0 +1,166 @@
+package godb
+
+import "fmt"
+
+// A SortMergeJoin is an equality join that sorts both inputs on their join
+// attribute and merges them. Inputs that are already sorted on the join
+// attribute (e.g. because they come from an ORDER BY) can skip the sort.
+// Unlike the hash joins, the output is ordered on the join attribute.
+type SortMergeJoin struct {
+	leftField, rightField Expr
+
+	left, right *Operator
+
+	// whether each input already arrives sorted ascending on its join field
+	leftSorted, rightSorted bool
+}
+
+// Constructor for a sort-merge join. leftSorted and rightSorted indicate that
+// the corresponding input is already in ascending order of its join field and
+// doesn't need to be sorted again.
+//
+// Returns an error if the join expressions have incompatible types.
+func NewSortMergeJoin(left Operator, leftField Expr, right Operator, rightField Expr, leftSorted bool, rightSorted bool) (*SortMergeJoin, error) {
+	if !joinTypesCompatible(leftField.GetExprType().Ftype, rightField.GetExprType().Ftype) {
+		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("cannot join %v with %v", leftField.GetExprType(), rightField.GetExprType())}
+	}
+	return &SortMergeJoin{leftField, rightField, &left, &right, leftSorted, rightSorted}, nil
+}
+
+func (sj *SortMergeJoin) Descriptor() *TupleDesc {
+	return (*sj.left).Descriptor().merge((*sj.right).Descriptor())
+}
+
+func (sj *SortMergeJoin) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// Compare two join attribute values, treating ints and floats as comparable.
+// NULL never equals a value, not even NULL, and sorts after every value, as
+// in an [OrderBy].
+func compareJoinValues(v1, v2 DBValue) orderByState {
+	if isNull(v1) {
+		return OrderedGreaterThan
+	}
+	if isNull(v2) {
+		return OrderedLessThan
+	}
+	if v1.EvalPred(v2, OpLt) {
+		return OrderedLessThan
+	}
+	if v1.EvalPred(v2, OpGt) {
+		return OrderedGreaterThan
+	}
+	return OrderedEqual
+}
+
+// Return an iterator over op sorted ascending on field, sorting only if needed.
+func sortedIterator(op Operator, field Expr, sorted bool, tid TransactionID) (func() (*Tuple, error), error) {
+	if sorted {
+		return op.Iterator(tid)
+	}
+	orderBy, err := NewOrderBy([]Expr{field}, op, []bool{true})
+	if err != nil {
+		return nil, err
+	}
+	return orderBy.Iterator(tid)
+}
+
+// Join operator implementation. Both inputs are advanced in lockstep; when
+// their keys are equal, the group of right tuples sharing that key is
+// buffered and joined with every left tuple that has the same key.
+func (sj *SortMergeJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	leftIter, err := sortedIterator(*sj.left, sj.leftField, sj.leftSorted, tid)
+	if err != nil {
+		return nil, err
+	}
+	rightIter, err := sortedIterator(*sj.right, sj.rightField, sj.rightSorted, tid)
+	if err != nil {
+		return nil, err
+	}
+
+	var leftTup, rightTup *Tuple
+	var leftVal, rightVal DBValue
+
+	nextLeft := func() error {
+		leftTup, err = leftIter()
+		if err != nil || leftTup == nil {
+			return err
+		}
+		leftVal, err = sj.leftField.EvalExpr(leftTup)
+		return err
+	}
+	nextRight := func() error {
+		rightTup, err = rightIter()
+		if err != nil || rightTup == nil {
+			return err
+		}
+		rightVal, err = sj.rightField.EvalExpr(rightTup)
+		return err
+	}
+
+	// the current group of right tuples with equal keys, and the key itself
+	var group []*Tuple
+	var groupVal DBValue
+	groupIdx := 0
+
+	started := false
+	return func() (*Tuple, error) {
+		if !started {
+			started = true
+			if err := nextLeft(); err != nil {
+				return nil, err
+			}
+			if err := nextRight(); err != nil {
+				return nil, err
+			}
+		}
+
+		for {
+			// still joining the current left tuple with the buffered group
+			if groupIdx < len(group) {
+				groupIdx++
+				return joinTuples(leftTup, group[groupIdx-1]), nil
+			}
+
+			// done with this left tuple, see if the next one matches the group too
+			if group != nil {
+				if err := nextLeft(); err != nil {
+					return nil, err
+				}
+				if leftTup != nil && compareJoinValues(leftVal, groupVal) == OrderedEqual {
+					groupIdx = 0
+					continue
+				}
+				group = nil
+			}
+
+			// the NULL keys, which join with nothing, come last
+			if leftTup == nil || rightTup == nil || isNull(leftVal) || isNull(rightVal) {
+				return nil, nil
+			}
+
+			switch compareJoinValues(leftVal, rightVal) {
+			case OrderedLessThan:
+				if err := nextLeft(); err != nil {
+					return nil, err
+				}
+			case OrderedGreaterThan:
+				if err := nextRight(); err != nil {
+					return nil, err
+				}
+			case OrderedEqual:
+				// buffer every right tuple with this key
+				groupVal = rightVal
+				group = []*Tuple{}
+				for rightTup != nil && compareJoinValues(rightVal, groupVal) == OrderedEqual {
+					group = append(group, rightTup)
+					if err := nextRight(); err != nil {
+						return nil, err
+					}
+				}
+				groupIdx = 0
+			}
+		}
+	}, nil
+}
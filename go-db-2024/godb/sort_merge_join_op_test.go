@@ -0,0 +1,89 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestSortMergeJoin(t *testing.T) {
+	// keys 0..49 appear 4 times on the left, keys 25..74 appear twice on the
+	// right, so the 25 shared keys produce 8 results each
+	hf1, hf2, _, tid := makeJoinTestFiles(t,
+		200, func(i int) int64 { return int64((i * 7) % 50) },
+		100, func(i int) int64 { return int64(25 + i%50) })
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewSortMergeJoin(hf1, &field, hf2, &field, false, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	cnt := 0
+	var last DBValue
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		if !tup.Fields[1].EvalPred(tup.Fields[3], OpEq) {
+			t.Fatalf("join returned non matching tuple %v", tup)
+		}
+		if last != nil && tup.Fields[1].EvalPred(last, OpLt) {
+			t.Fatalf("sort-merge join output not sorted, %v after %v", tup.Fields[1], last)
+		}
+		last = tup.Fields[1]
+		cnt++
+	}
+	if cnt != 200 {
+		t.Errorf("unexpected number of join results (%d, expected 200)", cnt)
+	}
+}
+
+func TestSortMergeJoinPresorted(t *testing.T) {
+	hf1, hf2, _, tid := makeJoinTestFiles(t,
+		30, func(i int) int64 { return int64(i / 3) },
+		10, func(i int) int64 { return int64(i) })
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewSortMergeJoin(hf1, &field, hf2, &field, true, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cnt := countJoinResults(t, iter); cnt != 30 {
+		t.Errorf("unexpected number of join results (%d, expected 30)", cnt)
+	}
+}
+
+func TestSortMergeJoinNulls(t *testing.T) {
+	hf1, hf2, _, tid := makeJoinTestFiles(t,
+		10, func(i int) int64 { return int64(i % 5) },
+		10, func(i int) int64 { return int64(i % 5) })
+	for i := 0; i < 3; i++ {
+		insertTupleForTest(t, hf1, &Tuple{*hf1.Descriptor(), []DBValue{StringField{"left"}, NullField{}}, nil}, tid)
+		insertTupleForTest(t, hf2, &Tuple{*hf2.Descriptor(), []DBValue{StringField{"right"}, NullField{}}, nil}, tid)
+	}
+
+	field := FieldExpr{hf1.Descriptor().Fields[1]}
+	join, err := NewSortMergeJoin(hf1, &field, hf2, &field, false, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err := join.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// NULL keys match nothing, not even each other
+	if cnt := countJoinResults(t, iter); cnt != 20 {
+		t.Errorf("unexpected number of join results (%d, expected 20)", cnt)
+	}
+}
@@ -0,0 +1,208 @@
+package godb
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The SQL parser we use only understands MySQL's dialect. Before a query is
+// parsed, it is run through a few textual rewrites that map syntax the parser
+// doesn't know onto syntax it does know, but that GoDB doesn't otherwise use.
+//
+//   - The _binary introducer, which means nothing to GoDB (whose strings are
+//     all compared byte by byte), is dropped from the query first, so that
+//     the _binary introducers the rewrites below add can't be confused with
+//     ones in the query itself.
+//   - FULL [OUTER] JOIN becomes STRAIGHT_JOIN, which is planned as a full outer
+//     join. A STRAIGHT_JOIN in the query itself, which is an inner join that
+//     keeps the order of its tables, becomes JOIN first, so that only
+//     rewritten full joins are STRAIGHT_JOINs.
+//   - x ILIKE p becomes x LIKE _binary p, and x SIMILAR TO p becomes
+//     x REGEXP _binary p; the _binary introducer on the pattern marks which
+//     of the two operators was meant.
+//   - INTERSECT [ALL] and EXCEPT [ALL] become UNION ALL, with a comment naming
+//     the operator that was meant on the SELECT that follows them (see
+//     [setOpMarker]); the parser only keeps comments right after SELECT.
+//   - f(args) OVER (spec) becomes f(args, _binary 'spec'); a window function's
+//     last argument is its OVER clause if it has the _binary introducer.
+//   - EXTRACT(unit FROM date) becomes extract('unit', date).
+//   - The types INT, INTEGER and BIGINT that end the arguments of a CAST
+//     become SIGNED, FLOAT, DOUBLE and REAL become DECIMAL, and VARCHAR and
+//     TEXT become CHAR.
+
+var fullJoinRegexp = regexp.MustCompile(`(?i)\bfull\s+(outer\s+)?join\b`)
+var straightJoinRegexp = regexp.MustCompile(`(?i)(\bselect\s+)?\bstraight_join\b`)
+var ilikeRegexp = regexp.MustCompile(`(?i)\bilike\b`)
+var similarToRegexp = regexp.MustCompile(`(?i)\bsimilar\s+to\b`)
+var overRegexp = regexp.MustCompile(`(?i)^over\s*\(`)
+var extractRegexp = regexp.MustCompile(`(?i)\bextract\s*\(\s*([a-z_]+)\s+from\b`)
+var binaryIntroducerRegexp = regexp.MustCompile(`(?i)\b_binary\b`)
+var castRegexp = regexp.MustCompile(`(?i)^cast\s*\(`)
+var castTypeRegexp = regexp.MustCompile(`(?i)(\bas\s+)(int|integer|bigint|float|double|real|varchar|text)\b(\s*\(\s*\d+\s*\))?(\s*)$`)
+var setOpRegexp = regexp.MustCompile(`(?i)\b(intersect|except)(\s+all)?\b([\s(]*)select\b`)
+
+// The prefix of the comments that mark rewritten set operations.
+const setOpCommentPrefix = "/*godb:"
+
+// Apply all of the rewrites to query.
+func rewriteQuery(query string) string {
+	query = rewriteOutsideQuotes(query, func(s string) string {
+		return binaryIntroducerRegexp.ReplaceAllString(s, " ")
+	})
+	return rewriteOutsideQuotes(rewriteCasts(rewriteWindows(query)), func(s string) string {
+		s = straightJoinRegexp.ReplaceAllStringFunc(s, rewriteStraightJoin)
+		s = fullJoinRegexp.ReplaceAllString(s, "straight_join")
+		s = ilikeRegexp.ReplaceAllString(s, "like _binary")
+		s = setOpRegexp.ReplaceAllString(s, "union all${3}select "+setOpCommentPrefix+"${1}${2}*/")
+		s = extractRegexp.ReplaceAllString(s, "extract('${1}',")
+		return similarToRegexp.ReplaceAllString(s, "regexp _binary")
+	})
+}
+
+// Rewrite a STRAIGHT_JOIN (as matched by straightJoinRegexp) to JOIN, unless
+// it is the SELECT option of the same name.
+func rewriteStraightJoin(s string) string {
+	if strings.HasPrefix(strings.ToLower(s), "select") {
+		return s
+	}
+	return "join"
+}
+
+// Rewrite the types that end the arguments of CASTs to ones the parser knows.
+// The arguments may have quoted strings and other CASTs in them, so this is
+// done on the whole query.
+func rewriteCasts(query string) string {
+	var out []byte
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0 && ch == '\\' && i+1 < len(query):
+			out = append(out, ch, query[i+1])
+			i++
+			continue
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '\'' || ch == '"' || ch == '`'):
+			quote = ch
+		case quote == 0 && (i == 0 || !isIdentChar(query[i-1])) && castRegexp.MatchString(query[i:]):
+			open := i + len(castRegexp.FindString(query[i:]))
+			end := matchingParen(query, open)
+			if end < 0 {
+				break
+			}
+			args := castTypeRegexp.ReplaceAllStringFunc(rewriteCasts(query[open:end]), rewriteCastType)
+			out = append(out, query[i:open]+args+")"...)
+			i = end
+			continue
+		}
+		out = append(out, ch)
+	}
+	return string(out)
+}
+
+// Rewrite the type at the end of the arguments of a CAST (as matched by
+// castTypeRegexp) to one the parser knows. SIGNED doesn't take a length.
+func rewriteCastType(s string) string {
+	m := castTypeRegexp.FindStringSubmatch(s)
+	switch strings.ToLower(m[2]) {
+	case "int", "integer", "bigint":
+		return m[1] + "signed" + m[4]
+	case "float", "double", "real":
+		return m[1] + "decimal" + m[3] + m[4]
+	}
+	return m[1] + "char" + m[3] + m[4]
+}
+
+// Apply f to each part of query that isn't inside a quoted string or
+// identifier, leaving the quoted parts alone.
+func rewriteOutsideQuotes(query string, f func(string) string) string {
+	out := ""
+	start := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote == 0 && (ch == '\'' || ch == '"' || ch == '`'):
+			out += f(query[start:i])
+			start = i
+			quote = ch
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0 && ch == quote:
+			out += query[start : i+1]
+			start = i + 1
+			quote = 0
+		}
+	}
+	if quote != 0 {
+		// unterminated quote, let the parser complain about it
+		return out + query[start:]
+	}
+	return out + f(query[start:])
+}
+
+// Move the OVER clauses of window functions into their arguments. OVER
+// clauses may have quoted strings in them, so this is done on the whole query.
+func rewriteWindows(query string) string {
+	var out []byte
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0 && ch == '\\' && i+1 < len(query):
+			out = append(out, ch, query[i+1])
+			i++
+			continue
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '\'' || ch == '"' || ch == '`'):
+			quote = ch
+		case quote == 0 && (i == 0 || !isIdentChar(query[i-1])) && overRegexp.MatchString(query[i:]):
+			call := strings.TrimRight(string(out), " \t\r\n")
+			open := i + len(overRegexp.FindString(query[i:]))
+			end := matchingParen(query, open)
+			if !strings.HasSuffix(call, ")") || end < 0 {
+				break
+			}
+			spec := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(query[open:end])
+			sep := ", "
+			if strings.HasSuffix(strings.TrimRight(call[:len(call)-1], " \t\r\n"), "(") {
+				sep = ""
+			}
+			out = []byte(call[:len(call)-1] + sep + "_binary '" + spec + "')")
+			i = end
+			continue
+		}
+		out = append(out, ch)
+	}
+	return string(out)
+}
+
+// Return the index of the parenthesis closing the one just before start, or
+// -1 if there isn't one. Parentheses inside of quotes don't count.
+func matchingParen(s string, start int) int {
+	depth := 1
+	var quote byte
+	for i := start; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,29 @@
+package godb
+
+import "testing"
+
+func TestRewriteQuery(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"select * from t full join t2 on t.a = t2.a", "select * from t straight_join t2 on t.a = t2.a"},
+		{"select * from t FULL OUTER JOIN t2 on t.a = t2.a", "select * from t straight_join t2 on t.a = t2.a"},
+		{"select straight_join * from t STRAIGHT_JOIN t2 on t.a = t2.a", "select straight_join * from t join t2 on t.a = t2.a"},
+		{"select * from t where t.name = 'full join'", "select * from t where t.name = 'full join'"},
+		{"select * from t where t.name = 'it\\'s a full join' or t.fulljoin = 1", "select * from t where t.name = 'it\\'s a full join' or t.fulljoin = 1"},
+		{"select * from t where name ILIKE 'sam%' and name not ilike 'similar to'", "select * from t where name like _binary 'sam%' and name not like _binary 'similar to'"},
+		{"select * from t where name similar   to '(sam|bo)%'", "select * from t where name regexp _binary '(sam|bo)%'"},
+		// _binary introducers in the query are dropped, so they aren't
+		// mistaken for the rewritten ILIKE, SIMILAR TO or OVER
+		{"select f(a, _BINARY 'x') from t where name like _binary 'sam%' or name regexp _binary'b' and `_binary` = '_binary'", "select f(a,   'x') from t where name like   'sam%' or name regexp  'b' and `_binary` = '_binary'"},
+		{"select rank() over (partition by a order by b) r, lag(a, 1) OVER(order by c = 'x)') from t", "select rank(_binary 'partition by a order by b') r, lag(a, 1, _binary 'order by c = \\'x)\\'') from t"},
+		{"select extract(YEAR from d), cast(a as int(11)), CAST(b AS double), cast(c as varchar(20)), x as text from t", "select extract('YEAR', d), cast(a as signed), CAST(b AS decimal), cast(c as char(20)), x as text from t"},
+		// only the type at the end of a CAST's arguments is rewritten, not
+		// aliases inside of them or elsewhere
+		{"select cast((select price as real from t limit 1) as int), (select price as real) x, cast(cast('a)' as text) as bigint) from t", "select cast((select price as real from t limit 1) as signed), (select price as real) x, cast(cast('a)' as char) as signed) from t"},
+		{"select a from t INTERSECT select a from t2 except all (select a from t3)", "select a from t union all select /*godb:INTERSECT*/ a from t2 union all (select /*godb:except all*/ a from t3)"},
+	}
+	for _, test := range tests {
+		if got := rewriteQuery(test.in); got != test.out {
+			t.Errorf("rewriteQuery(%q) = %q, expected %q", test.in, got, test.out)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Statistical aggregates, registered in agg_registry.go.
+
+// Implements the aggregation states for VARIANCE and STDDEV, of a sample
+// (dividing by the number of values minus one) or of a population (dividing
+// by the number of values). NULLs are ignored.
+//
+// The central moments of the values are kept up to date as values are added,
+// as in Welford's algorithm, and the moments of two states are combined
+// exactly by Merge (see
+// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Higher-order_statistics).
+// The fourth moment gives the variance of the estimate from a sample.
+type VarianceAggState struct {
+	alias      string
+	expr       Expr
+	stddev     bool // the square root of the variance
+	population bool // the population variance rather than the sample variance
+	n          float64
+	mean       float64
+	m2, m3, m4 float64 // sums of the second, third and fourth powers of differences from the mean
+}
+
+func (a *VarianceAggState) Copy() AggState {
+	c := *a
+	return &c
+}
+
+func (a *VarianceAggState) Init(alias string, expr Expr) error {
+	if expr.GetExprType().Ftype == StringType {
+		return GoDBError{TypeMismatchError, "can't compute the variance of a string column"}
+	}
+	*a = VarianceAggState{alias: alias, expr: expr, stddev: a.stddev, population: a.population}
+	return nil
+}
+
+func (a *VarianceAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+		return
+	}
+	x, ok := numericValue(v)
+	if !ok {
+		return
+	}
+	n1 := a.n
+	a.n++
+	delta := x - a.mean
+	deltaN := delta / a.n
+	deltaN2 := deltaN * deltaN
+	term1 := delta * deltaN * n1
+	a.mean += deltaN
+	a.m4 += term1*deltaN2*(a.n*a.n-3*a.n+3) + 6*deltaN2*a.m2 - 4*deltaN*a.m3
+	a.m3 += term1*deltaN*(a.n-2) - 3*deltaN*a.m2
+	a.m2 += term1
+}
+
+func (a *VarianceAggState) Merge(other AggState) error {
+	o, ok := other.(*VarianceAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	if o.n == 0 {
+		return nil
+	}
+	if a.n == 0 {
+		a.n, a.mean, a.m2, a.m3, a.m4 = o.n, o.mean, o.m2, o.m3, o.m4
+		return nil
+	}
+	na, nb := a.n, o.n
+	n := na + nb
+	delta := o.mean - a.mean
+	delta2 := delta * delta
+	m2 := a.m2 + o.m2 + delta2*na*nb/n
+	m3 := a.m3 + o.m3 + delta*delta2*na*nb*(na-nb)/(n*n) + 3*delta*(na*o.m2-nb*a.m2)/n
+	m4 := a.m4 + o.m4 + delta2*delta2*na*nb*(na*na-na*nb+nb*nb)/(n*n*n) +
+		6*delta2*(na*na*o.m2+nb*nb*a.m2)/(n*n) + 4*delta*(na*o.m3-nb*a.m3)/n
+	a.n, a.mean, a.m2, a.m3, a.m4 = n, a.mean+delta*nb/n, m2, m3, m4
+	return nil
+}
+
+func (a *VarianceAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", FloatType}}}
+}
+
+// Return the variance (or standard deviation) of a variance, or NULL if
+// there are too few values for it.
+func (a *VarianceAggState) result(variance float64, ok bool) DBValue {
+	if !ok {
+		return NullField{}
+	}
+	if a.stddev {
+		return FloatField{math.Sqrt(variance)}
+	}
+	return FloatField{variance}
+}
+
+func (a *VarianceAggState) Finalize(info *SampleInfo) *Tuple {
+	var v DBValue
+	if a.population {
+		v = a.result(a.m2/a.n, a.n > 0)
+	} else {
+		v = a.result(a.m2/(a.n-1), a.n > 1)
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{v}, nil}
+}
+
+// The sample variance estimates the variance of the table (the population
+// variance scaled by N/(N-1)) without bias. Its variance is approximately
+// (m4/n - s^4 (n-3)/(n-1)) / n, corrected for the sampled fraction of the
+// table; for the standard deviation, the delta method divides it by 4 s^2.
+func (a *VarianceAggState) EstimateFromSample(info *SampleInfo) (DBValue, float64) {
+	if a.n < 2 {
+		return NullField{}, 0
+	}
+	s2 := a.m2 / (a.n - 1)
+	estimate := s2
+	if a.population {
+		estimate = s2 * (info.PopulationSize - 1) / info.PopulationSize
+	}
+	variance := math.Max(0, (a.m4/a.n-s2*s2*(a.n-3)/(a.n-1))/a.n)
+	variance *= finitePopulationCorrection(info.SampleSize, info.PopulationSize)
+	if a.stddev {
+		if estimate == 0 {
+			return FloatField{0}, 0
+		}
+		return FloatField{math.Sqrt(estimate)}, variance / (4 * estimate)
+	}
+	return FloatField{estimate}, variance
+}
+
+// Set the fraction p of the aggregate name from its constant arguments, for
+// percentile aggregates that take one.
+func setFractionParam(name string, fraction *float64, hasParam *bool, params []DBValue) error {
+	if *hasParam {
+		return GoDBError{ParseError, fmt.Sprintf("%s takes one argument", name)}
+	}
+	if len(params) != 1 {
+		return GoDBError{ParseError, fmt.Sprintf("%s takes an expression and a fraction", name)}
+	}
+	p, ok := numericValue(params[0])
+	if !ok || p < 0 || p > 1 {
+		return GoDBError{ParseError, fmt.Sprintf("the fraction of %s must be between 0 and 1, got %v", name, params[0])}
+	}
+	*fraction, *hasParam = p, true
+	return nil
+}
+
+// Implements the aggregation state for PERCENTILE_CONT(x, p), the value at
+// fraction p of the way through the sorted values of x, interpolating linearly
+// between the two values nearest to it. NULLs are ignored. The result is
+// exact, so every value is kept in memory; MEDIAN and PERCENTILE use a sketch
+// in a fixed amount of memory instead (see [ApproxPercentileAggState]).
+//
+// The percentile of a sample estimates the percentile of the table; its
+// confidence interval is between the values at the bounds of the rank of the
+// table's percentile in the sample (see [quantileRankBounds]), which hold
+// whatever the distribution of the values.
+type PercentileContAggState struct {
+	name     string // the name of the aggregate, for errors
+	alias    string
+	expr     Expr
+	fraction float64
+	hasParam bool
+	values   []float64
+	sorted   bool
+}
+
+func (a *PercentileContAggState) Copy() AggState {
+	c := *a
+	c.values = slices.Clone(a.values)
+	return &c
+}
+
+func (a *PercentileContAggState) SetParams(params []DBValue) error {
+	return setFractionParam(a.name, &a.fraction, &a.hasParam, params)
+}
+
+func (a *PercentileContAggState) Init(alias string, expr Expr) error {
+	if !a.hasParam {
+		return GoDBError{ParseError, fmt.Sprintf("%s takes an expression and a fraction", a.name)}
+	}
+	if expr.GetExprType().Ftype == StringType {
+		return GoDBError{TypeMismatchError, "can't compute a percentile of a string column"}
+	}
+	a.alias, a.expr, a.values, a.sorted = alias, expr, nil, true
+	return nil
+}
+
+func (a *PercentileContAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+		return
+	}
+	if x, ok := numericValue(v); ok {
+		a.values = append(a.values, x)
+		a.sorted = false
+	}
+}
+
+func (a *PercentileContAggState) Merge(other AggState) error {
+	o, ok := other.(*PercentileContAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.values = append(a.values, o.values...)
+	a.sorted = false
+	return nil
+}
+
+func (a *PercentileContAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", FloatType}}}
+}
+
+// Return the value at fraction p of the way through the values, which there
+// must be some of.
+func (a *PercentileContAggState) valueAt(p float64) float64 {
+	if !a.sorted {
+		slices.Sort(a.values)
+		a.sorted = true
+	}
+	return interpolatedValue(a.values, p)
+}
+
+// Return the value at fraction p of the way through sorted, which must not be
+// empty, interpolating linearly between the two values nearest to it.
+func interpolatedValue(sorted []float64, p float64) float64 {
+	pos := p * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := min(lo+1, len(sorted)-1)
+	return sorted[lo] + (pos-float64(lo))*(sorted[hi]-sorted[lo])
+}
+
+func (a *PercentileContAggState) Finalize(info *SampleInfo) *Tuple {
+	if len(a.values) == 0 {
+		return &Tuple{*a.GetTupleDesc(), []DBValue{NullField{}}, nil}
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{FloatField{a.valueAt(a.fraction)}}, nil}
+}
+
+func (a *PercentileContAggState) ErrorBound(info *SampleInfo) float64 {
+	if !info.IsSample() || len(a.values) == 0 {
+		return 0
+	}
+	est := a.valueAt(a.fraction)
+	lo, hi := quantileRankBounds(a.fraction, float64(len(a.values)), info, 0)
+	return math.Max(est-a.valueAt(lo), a.valueAt(hi)-est)
+}
+
+// Implements the aggregation state for APPROX_PERCENTILE(x, p) (and its
+// aliases PERCENTILE(x, p), and MEDIAN(x) for p = 0.5), the value about
+// fraction p of the way through the sorted values of x, in a fixed amount of
+// memory with a KLL sketch (see [kllSketch]). NULLs are ignored. Until there
+// are more values than fit in the sketch's bottom compactor, the sketch holds
+// every value, and the result is exact, interpolated as by PERCENTILE_CONT.
+//
+// The confidence interval is between the values at the bounds of the rank of
+// the percentile, allowing for the error of the sketch and, if the input is a
+// sample, of the sample (see [quantileRankBounds]).
+type ApproxPercentileAggState struct {
+	name     string // the name of the aggregate, for errors
+	alias    string
+	expr     Expr
+	fraction float64
+	hasParam bool
+	sketch   *kllSketch
+}
+
+func (a *ApproxPercentileAggState) Copy() AggState {
+	c := *a
+	if a.sketch != nil {
+		c.sketch = a.sketch.copy()
+	}
+	return &c
+}
+
+func (a *ApproxPercentileAggState) SetParams(params []DBValue) error {
+	return setFractionParam(a.name, &a.fraction, &a.hasParam, params)
+}
+
+func (a *ApproxPercentileAggState) Init(alias string, expr Expr) error {
+	if !a.hasParam {
+		return GoDBError{ParseError, fmt.Sprintf("%s takes an expression and a fraction", a.name)}
+	}
+	if expr.GetExprType().Ftype == StringType {
+		return GoDBError{TypeMismatchError, "can't compute a percentile of a string column"}
+	}
+	a.alias, a.expr, a.sketch = alias, expr, newKLLSketch(kllDefaultK)
+	return nil
+}
+
+func (a *ApproxPercentileAggState) AddTuple(t *Tuple) {
+	v, err := a.expr.EvalExpr(t)
+	if err != nil {
+		DebugAggState("Got err: %v", err)
+		return
+	}
+	if x, ok := numericValue(v); ok {
+		a.sketch.add(x)
+	}
+}
+
+func (a *ApproxPercentileAggState) Merge(other AggState) error {
+	o, ok := other.(*ApproxPercentileAggState)
+	if !ok {
+		return mergeMismatch(a, other)
+	}
+	a.sketch.merge(o.sketch)
+	return nil
+}
+
+func (a *ApproxPercentileAggState) GetTupleDesc() *TupleDesc {
+	return &TupleDesc{[]FieldType{{a.alias, "", FloatType}}}
+}
+
+// Return the value about fraction p of the way through the values, or false
+// if there are none.
+func (a *ApproxPercentileAggState) valueAt(p float64) (float64, bool) {
+	if a.sketch.n == 0 || a.sketch.n != float64(len(a.sketch.levels[0])) {
+		return a.sketch.quantile(p)
+	}
+	values := slices.Clone(a.sketch.levels[0])
+	slices.Sort(values)
+	return interpolatedValue(values, math.Max(0, math.Min(1, p))), true
+}
+
+func (a *ApproxPercentileAggState) Finalize(info *SampleInfo) *Tuple {
+	v, ok := a.valueAt(a.fraction)
+	if !ok {
+		return &Tuple{*a.GetTupleDesc(), []DBValue{NullField{}}, nil}
+	}
+	return &Tuple{*a.GetTupleDesc(), []DBValue{FloatField{v}}, nil}
+}
+
+func (a *ApproxPercentileAggState) ErrorBound(info *SampleInfo) float64 {
+	est, ok := a.valueAt(a.fraction)
+	if !ok {
+		return 0
+	}
+	lo, hi := quantileRankBounds(a.fraction, a.sketch.n, info, kllRankError(a.sketch.k))
+	loVal, _ := a.valueAt(lo)
+	hiVal, _ := a.valueAt(hi)
+	return math.Max(est-loVal, hiVal-est)
+}
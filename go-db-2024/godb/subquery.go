@@ -0,0 +1,484 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Subqueries in the WHERE clause and the select list are planned as derived
+// tables that are joined with the result of the FROM clause, after all of its
+// joins:
+//
+//   - EXISTS (q) and x IN (q) become semi joins with q, and NOT EXISTS
+//     becomes an anti join.
+//   - x NOT IN (q) becomes an anti join on x = q OR q IS NULL OR x IS NULL,
+//     so that no rows pass once q returns a NULL, and rows with a NULL x
+//     only pass if q returns no rows.
+//   - Scalar subqueries become single joins, left outer joins that fail if a
+//     row matches more than one row of the subquery, so rows without a match
+//     see NULL. A condition with a scalar subquery, such as x > (q), is then
+//     applied to the joined rows.
+//
+// Conjuncts of a subquery's WHERE clause that refer to the outer query
+// (correlated predicates) are removed from it and become conditions of the
+// join instead, on the columns of the subquery that they read, which are
+// added to the subquery's select list. When the subquery aggregates, it is
+// also grouped by those columns, computing the aggregate for every value of
+// the outer columns at once; only equalities may be correlated then.
+//
+// An aggregate subquery without a GROUP BY returns exactly one row, so x IN
+// (q) and x NOT IN (q) are planned as x = (q) and x <> (q). When it is
+// correlated, rows of the outer query without a group see NULL, which is the
+// aggregate of no rows except for counts, so counts are replaced with 0 if
+// they're NULL. Other expressions of the aggregates, HAVING clauses, and
+// EXISTS, can't be computed for rows without a group, and aren't supported.
+// A join with a subquery of the WHERE clause or the select list.
+type LogicalSubqueryJoin struct {
+	plan     *LogicalPlan // named by a generated alias
+	joinType JoinType
+	conds    []*LogicalJoinNode
+	filter   *LogicalSelectNode // a predicate on the joined rows, or nil
+}
+
+// The field that the value of a scalar or IN subquery is output as, and the
+// prefix of the fields of the columns its correlated predicates read.
+const (
+	subqueryValueField = "val"
+	subqueryCorrField  = "corr"
+)
+
+// The tables and subqueries of a FROM clause.
+type queryScope struct {
+	c        *Catalog
+	tables   []*LogicalTableNode
+	subplans []*LogicalPlan
+}
+
+func (sc *queryScope) hasTable(name string) bool {
+	for _, t := range sc.tables {
+		if t.alias == name || (t.alias == "" && t.tableName == name) {
+			return true
+		}
+	}
+	for _, p := range sc.subplans {
+		if p.alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *queryScope) hasColumn(name string) bool {
+	for _, t := range sc.tables {
+		for _, f := range (*t.file).Descriptor().Fields {
+			if f.Fname == name {
+				return true
+			}
+		}
+	}
+	for _, p := range sc.subplans {
+		for _, f := range p.getSubplanFields(sc.c) {
+			if f.Fname == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Plans the subqueries of one query as joins.
+type subqueryPlanner struct {
+	c     *Catalog
+	outer queryScope
+	joins []*LogicalSubqueryJoin
+}
+
+// Plan the subqueries of the conjuncts of a WHERE clause, returning the
+// conjuncts without subqueries (or nil if there aren't any).
+func (sp *subqueryPlanner) planWhere(expr sqlparser.Expr) (sqlparser.Expr, error) {
+	var rest []sqlparser.Expr
+	for _, conj := range splitConjuncts(expr) {
+		if len(findSubqueries(conj)) == 0 {
+			rest = append(rest, conj)
+			continue
+		}
+		if err := sp.planConjunct(conj); err != nil {
+			return nil, err
+		}
+	}
+	return joinConjuncts(rest), nil
+}
+
+func (sp *subqueryPlanner) planConjunct(conj sqlparser.Expr) error {
+	joinType := SemiJoin
+	if not, ok := conj.(*sqlparser.NotExpr); ok {
+		if exists, ok := not.Expr.(*sqlparser.ExistsExpr); ok {
+			conj = exists
+			joinType = AntiJoin
+		}
+	}
+	switch e := conj.(type) {
+	case *sqlparser.ExistsExpr:
+		text := sqlparser.String(e.Subquery)
+		plan, _, conds, err := sp.decorrelate(e.Subquery, false)
+		if err != nil {
+			return err
+		}
+		if len(conds) > 0 && returnsOneRow(e.Subquery) {
+			return GoDBError{ParseError, fmt.Sprintf("unsupported EXISTS of the correlated aggregate subquery %s, which always returns a row", text)}
+		}
+		return sp.addJoin(plan, joinType, conds, nil)
+	case *sqlparser.ComparisonExpr:
+		sq, ok := e.Right.(*sqlparser.Subquery)
+		if !ok || (e.Operator != sqlparser.InStr && e.Operator != sqlparser.NotInStr) {
+			break
+		}
+		if len(findSubqueries(e.Left)) > 0 {
+			return GoDBError{ParseError, fmt.Sprintf("unsupported subquery in %s", sqlparser.String(e))}
+		}
+		if returnsOneRow(sq) {
+			op := sqlparser.EqualStr
+			if e.Operator == sqlparser.NotInStr {
+				op = sqlparser.NotEqualStr
+			}
+			conj = &sqlparser.ComparisonExpr{Operator: op, Left: e.Left, Right: sq}
+			break
+		}
+		plan, val, conds, err := sp.decorrelate(sq, true)
+		if err != nil {
+			return err
+		}
+		var cond sqlparser.Expr = &sqlparser.ComparisonExpr{Operator: sqlparser.EqualStr, Left: e.Left, Right: val}
+		if e.Operator == sqlparser.NotInStr {
+			joinType = AntiJoin
+			cond = &sqlparser.ParenExpr{Expr: &sqlparser.OrExpr{
+				Left: &sqlparser.OrExpr{
+					Left:  cond,
+					Right: &sqlparser.IsExpr{Operator: sqlparser.IsNullStr, Expr: val},
+				},
+				Right: &sqlparser.IsExpr{Operator: sqlparser.IsNullStr, Expr: e.Left},
+			}}
+		}
+		return sp.addJoin(plan, joinType, append(conds, cond), nil)
+	}
+
+	// anything else may use the value of one scalar subquery
+	sqs := findSubqueries(conj)
+	if len(sqs) != 1 || hasSetSubquery(conj) {
+		return GoDBError{ParseError, fmt.Sprintf("unsupported subqueries in %s; EXISTS and IN subqueries must be conjuncts of the WHERE clause, and other conditions may only have one subquery", sqlparser.String(conj))}
+	}
+	plan, val, conds, err := sp.decorrelate(sqs[0], true)
+	if err != nil {
+		return err
+	}
+	conj = sqlparser.ReplaceExpr(conj, sqs[0], val)
+	return sp.addJoin(plan, SingleJoin, conds, conj)
+}
+
+// Plan the scalar subqueries of an expression of the select list, returning
+// the expression with their values in their place.
+func (sp *subqueryPlanner) planSelect(expr sqlparser.Expr) (sqlparser.Expr, error) {
+	if hasSetSubquery(expr) {
+		return nil, GoDBError{ParseError, fmt.Sprintf("unsupported subquery in select list expression %s", sqlparser.String(expr))}
+	}
+	for _, sq := range findSubqueries(expr) {
+		plan, val, conds, err := sp.decorrelate(sq, true)
+		if err != nil {
+			return nil, err
+		}
+		expr = sqlparser.ReplaceExpr(expr, sq, val)
+		if err := sp.addJoin(plan, SingleJoin, conds, nil); err != nil {
+			return nil, err
+		}
+	}
+	return expr, nil
+}
+
+// Plan sq as a derived table, removing the conjuncts of its WHERE clause that
+// refer to the outer query and returning them as join conditions. If value is
+// set, the first column of its select list is output as subqueryValueField,
+// and the expression that the outer query reads its value with is returned.
+func (sp *subqueryPlanner) decorrelate(sq *sqlparser.Subquery, value bool) (*LogicalPlan, sqlparser.Expr, []sqlparser.Expr, error) {
+	sel, ok := sq.Select.(*sqlparser.Select)
+	if !ok {
+		return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported subquery %s", sqlparser.String(sq))}
+	}
+	// as written, for errors (correlated columns are renamed below)
+	text := sqlparser.String(sq)
+	alias := fmt.Sprintf("subquery%d", len(sp.joins))
+	inner := queryScope{c: sp.c}
+	for _, t := range sel.From {
+		tables, subplans, _, _, _, err := parseFrom(sp.c, t)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		inner.tables = append(inner.tables, tables...)
+		inner.subplans = append(inner.subplans, subplans...)
+	}
+
+	newSel := *sel
+	newSel.SelectExprs = nil
+	newSel.GroupBy = append(sqlparser.GroupBy{}, sel.GroupBy...)
+	var first *sqlparser.AliasedExpr
+	if value {
+		first, ok = sel.SelectExprs[0].(*sqlparser.AliasedExpr)
+		if !ok || len(sel.SelectExprs) != 1 {
+			return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("subquery %s must return a single column", sqlparser.String(sq))}
+		}
+		newSel.SelectExprs = sqlparser.SelectExprs{&sqlparser.AliasedExpr{Expr: first.Expr, As: sqlparser.NewColIdent(subqueryValueField)}}
+	}
+	grouped := len(sel.GroupBy) > 0 || hasAggregate(sel.SelectExprs)
+
+	var where, conds []sqlparser.Expr
+	exported := make(map[string]string)
+	if sel.Where != nil {
+		for _, conj := range splitConjuncts(sel.Where.Expr) {
+			var innerCols []*sqlparser.ColName
+			correlated := false
+			for _, col := range columnNames(conj) {
+				if sp.isOuter(col, &inner) {
+					correlated = true
+				} else {
+					innerCols = append(innerCols, col)
+				}
+			}
+			if !correlated {
+				where = append(where, conj)
+				continue
+			}
+			if grouped && !sp.isEquiCorrelation(conj, &inner) {
+				return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("correlated predicate %s of an aggregate subquery must be an equality between the subquery and the outer query", sqlparser.String(conj))}
+			}
+			for _, col := range innerCols {
+				key := sqlparser.String(col)
+				name, ok := exported[key]
+				if !ok {
+					name = fmt.Sprintf("%s%d", subqueryCorrField, len(exported))
+					exported[key] = name
+					orig := *col
+					newSel.SelectExprs = append(newSel.SelectExprs, &sqlparser.AliasedExpr{Expr: &orig, As: sqlparser.NewColIdent(name)})
+					if grouped {
+						newSel.GroupBy = append(newSel.GroupBy, &orig)
+					}
+				}
+				// the condition reads the exported column instead
+				*col = *subqueryColumn(alias, name)
+			}
+			conds = append(conds, conj)
+		}
+	}
+	if len(newSel.SelectExprs) == 0 {
+		// an uncorrelated EXISTS
+		newSel.SelectExprs = sel.SelectExprs
+	}
+	newSel.Where = sqlparser.NewWhere(sqlparser.WhereStr, joinConjuncts(where))
+
+	var val sqlparser.Expr
+	if value {
+		val = subqueryColumn(alias, subqueryValueField)
+	}
+	if value && len(conds) > 0 && returnsOneRow(sq) {
+		// rows of the outer query without a group read NULL, which is only
+		// the right value for aggregates other than counts
+		agg, ok := first.Expr.(*sqlparser.FuncExpr)
+		if !ok || !isAgg(agg.Name.Lowered()) || sel.Having != nil {
+			return nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unsupported correlated aggregate subquery %s; without a GROUP BY, it may only return a single aggregate, and can't have a HAVING clause", text)}
+		}
+		if countAggregates[agg.Name.Lowered()] {
+			val = &sqlparser.FuncExpr{Name: sqlparser.NewColIdent("coalesce"), Exprs: sqlparser.SelectExprs{
+				&sqlparser.AliasedExpr{Expr: val},
+				&sqlparser.AliasedExpr{Expr: sqlparser.NewIntVal([]byte("0"))},
+			}}
+		}
+	}
+
+	plan, err := parseStatement(sp.c, &newSel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	plan.alias = alias
+	return plan, val, conds, nil
+}
+
+// The aggregates that count rows, which are 0 rather than NULL over no rows.
+var countAggregates = map[string]bool{
+	"count":                 true,
+	"count_distinct":        true,
+	"approx_count_distinct": true,
+}
+
+// Whether a subquery aggregates without a GROUP BY, and so returns exactly
+// one row.
+func returnsOneRow(sq *sqlparser.Subquery) bool {
+	sel, ok := sq.Select.(*sqlparser.Select)
+	return ok && len(sel.GroupBy) == 0 && hasAggregate(sel.SelectExprs)
+}
+
+// Whether col refers to the outer query rather than to the subquery with the
+// tables of inner.
+func (sp *subqueryPlanner) isOuter(col *sqlparser.ColName, inner *queryScope) bool {
+	table := strings.ToLower(col.Qualifier.Name.String())
+	if table != "" {
+		return !inner.hasTable(table) && sp.outer.hasTable(table)
+	}
+	field := col.Name.Lowered()
+	return !inner.hasColumn(field) && sp.outer.hasColumn(field)
+}
+
+// Whether conj is an equality between an expression of the subquery and an
+// expression of the outer query.
+func (sp *subqueryPlanner) isEquiCorrelation(conj sqlparser.Expr, inner *queryScope) bool {
+	cmp, ok := conj.(*sqlparser.ComparisonExpr)
+	if !ok || cmp.Operator != sqlparser.EqualStr {
+		return false
+	}
+	side := func(e sqlparser.Expr) (outer bool, innerRefs bool) {
+		for _, col := range columnNames(e) {
+			if sp.isOuter(col, inner) {
+				outer = true
+			} else {
+				innerRefs = true
+			}
+		}
+		return outer, innerRefs
+	}
+	lOuter, lInner := side(cmp.Left)
+	rOuter, rInner := side(cmp.Right)
+	return (lOuter && !lInner && rInner && !rOuter) || (rOuter && !rInner && lInner && !lOuter)
+}
+
+// Add a join with plan on conds, which refer to the outer query and to the
+// columns of plan. If filter isn't nil, it is applied to the joined rows.
+func (sp *subqueryPlanner) addJoin(plan *LogicalPlan, joinType JoinType, conds []sqlparser.Expr, filter sqlparser.Expr) error {
+	join := &LogicalSubqueryJoin{plan: plan, joinType: joinType}
+	sp.joins = append(sp.joins, join)
+	if filter != nil {
+		pred, err := parsePredicate(sp.c, filter)
+		if err != nil {
+			return err
+		}
+		join.filter = pred
+	}
+	if len(conds) == 0 {
+		return nil
+	}
+	filters, joins, err := parseWhere(sp.c, sp.outer.subplans, sp.outer.tables, joinConjuncts(conds))
+	if err != nil {
+		return err
+	}
+	join.conds = joins
+	for _, f := range filters {
+		fieldExpr, constExpr := f.fieldExpr, f.constExpr
+		join.conds = append(join.conds, &LogicalJoinNode{&fieldExpr, &constExpr, f.predOp, f.pred})
+	}
+	return nil
+}
+
+// Whether f is a field of a subquery joined with the rows of the plan to
+// filter them.
+func (p *LogicalPlan) isWhereSubqueryField(f FieldType) bool {
+	for _, sj := range p.subqueryJoins {
+		if sj.filter != nil && f.TableQualifier == sj.plan.alias {
+			return true
+		}
+	}
+	return false
+}
+
+// A reference to a column of a subquery.
+func subqueryColumn(alias string, field string) *sqlparser.ColName {
+	return &sqlparser.ColName{Name: sqlparser.NewColIdent(field), Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(alias)}}
+}
+
+// Split an expression into its conjuncts.
+func splitConjuncts(expr sqlparser.Expr) []sqlparser.Expr {
+	switch e := expr.(type) {
+	case *sqlparser.AndExpr:
+		return append(splitConjuncts(e.Left), splitConjuncts(e.Right)...)
+	case *sqlparser.ParenExpr:
+		if _, ok := e.Expr.(*sqlparser.AndExpr); ok {
+			return splitConjuncts(e.Expr)
+		}
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// AND together exprs, returning nil if there aren't any.
+func joinConjuncts(exprs []sqlparser.Expr) sqlparser.Expr {
+	var expr sqlparser.Expr
+	for _, e := range exprs {
+		if expr == nil {
+			expr = e
+		} else {
+			expr = &sqlparser.AndExpr{Left: expr, Right: e}
+		}
+	}
+	return expr
+}
+
+// Return the subqueries of an expression, not including those nested inside
+// of other subqueries.
+func findSubqueries(node sqlparser.SQLNode) []*sqlparser.Subquery {
+	var sqs []*sqlparser.Subquery
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if sq, ok := node.(*sqlparser.Subquery); ok {
+			sqs = append(sqs, sq)
+			return false, nil
+		}
+		return true, nil
+	}, node)
+	return sqs
+}
+
+// Whether an expression has an EXISTS or IN subquery.
+func hasSetSubquery(node sqlparser.SQLNode) bool {
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.ExistsExpr:
+			found = true
+		case *sqlparser.ComparisonExpr:
+			if _, ok := n.Right.(*sqlparser.Subquery); ok && (n.Operator == sqlparser.InStr || n.Operator == sqlparser.NotInStr) {
+				found = true
+			}
+		case *sqlparser.Subquery:
+			return false, nil
+		}
+		return !found, nil
+	}, node)
+	return found
+}
+
+// Return the columns an expression reads, not including those of subqueries.
+func columnNames(node sqlparser.SQLNode) []*sqlparser.ColName {
+	var cols []*sqlparser.ColName
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.ColName:
+			cols = append(cols, n)
+		case *sqlparser.Subquery:
+			return false, nil
+		}
+		return true, nil
+	}, node)
+	return cols
+}
+
+// Whether a select list has an aggregate.
+func hasAggregate(exprs sqlparser.SelectExprs) bool {
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.FuncExpr:
+			if isAgg(n.Name.Lowered()) {
+				found = true
+			}
+		case *sqlparser.Subquery:
+			return false, nil
+		}
+		return !found, nil
+	}, exprs)
+	return found
+}
@@ -0,0 +1,116 @@
+package godb
+
+import (
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestParseSubqueries(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	queries := []struct {
+		sql  string
+		rows []string // sorted
+	}{
+		{"select name from t where name in (select name from t2 where age > 50)", []string{"bo", "sam", "sam", "sarah"}},
+		{"select name from t where name not in (select name from t2 where age > 50)", []string{"ang", "bill", "joe", "kathy", "mark", "pat", "riza", "riza"}},
+		{"select name from t where age > (select avg(age) from t2)", []string{"bo", "mark", "sam", "sarah"}},
+		{"select * from t where age > (select avg(age) from t2)", []string{"bo,99", "mark,50", "sam,99", "sarah,60"}},
+		{"select name from t where exists (select * from t2 where t2.name = t.name and t2.age < t.age)", []string{"riza", "sam"}},
+		{"select name from t where not exists (select * from t2 where t2.name = t.name and t2.age < t.age)", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "sam", "sarah"}},
+		{"select name from t where exists (select * from t2 where age > 100)", nil},
+		{"select name from t where not exists (select * from t2 where age > 100)", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "riza", "sam", "sam", "sarah"}},
+		// the maximum age of each name
+		{"select name, age from t where age = (select max(t2.age) from t2 where t2.name = t.name)", []string{"ang,22", "bill,30", "bo,99", "joe,40", "kathy,45", "mark,50", "pat,38", "riza,43", "sam,99", "sarah,60"}},
+		{"select name from t where name in (select name from t2 where age > (select avg(age) from t2))", []string{"bo", "mark", "sam", "sam", "sarah"}},
+		{"select count(*) from t where name in (select name from t2 where age > 50)", []string{"4"}},
+		// an uncorrelated scalar subquery in the select list
+		{"select name, (select max(age) from t2) from t where age > 55", []string{"bo,99", "sam,99", "sarah,99"}},
+		// a correlated count is 0 for the rows without a match, not NULL
+		{"select name from t where 0 = (select count(*) from t2 where t2.name = t.name and t2.age > 100)", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "riza", "sam", "sam", "sarah"}},
+		{"select name from t where 0 = (select count(*) from t2 where t2.name = t.name and t2.age > 50)", []string{"ang", "bill", "joe", "kathy", "mark", "pat", "riza", "riza"}},
+		{"select name from t where 0 in (select count(*) from t2 where t2.name = t.name and t2.age > 50)", []string{"ang", "bill", "joe", "kathy", "mark", "pat", "riza", "riza"}},
+		{"select name from t where 1 not in (select count(*) from t2 where t2.name = t.name and t2.age > 50)", []string{"ang", "bill", "joe", "kathy", "mark", "pat", "riza", "riza"}},
+		{"select name, (select count(*) from t2 where t2.name = t.name and t2.age > 50) from t", []string{"ang,0", "bill,0", "bo,1", "joe,0", "kathy,0", "mark,0", "pat,0", "riza,0", "riza,0", "sam,1", "sam,1", "sarah,1"}},
+		// other aggregates are NULL for them, so NOT IN is unknown
+		{"select name from t where age not in (select max(age) from t2 where t2.name = t.name and t2.age > 50)", []string{"sam"}},
+		// NOT IN passes no rows if the subquery returns a NULL, and rows with
+		// a NULL only if it returns no rows
+		{"select name from t where name not in (select case when name = 'bo' then null else name end from t2 where age > 50)", nil},
+		{"select name from t where (case when age = 99 then null else age end) not in (select age from t2 where age < 30)", []string{"bill", "joe", "kathy", "mark", "pat", "riza", "sarah"}},
+		{"select name from t where (case when age = 99 then null else age end) not in (select age from t2 where age > 100)", []string{"ang", "bill", "bo", "joe", "kathy", "mark", "pat", "riza", "riza", "sam", "sam", "sarah"}},
+		{"select name from t where name not in (select t2.name from t2 where t2.age = t.age and t2.age > 50)", []string{"ang", "bill", "joe", "kathy", "mark", "pat", "riza", "riza", "sam"}},
+	}
+	for _, q := range queries {
+		tups := runHavingQuery(t, bp, c, q.sql)
+		rows := make([]string, len(tups))
+		for i, tup := range tups {
+			rows[i] = tup.PrettyPrintString(false)
+		}
+		sort.Strings(rows)
+		if !slices.Equal(rows, q.rows) {
+			t.Errorf("q=%s: expected rows %v, got %v", q.sql, q.rows, rows)
+		}
+	}
+
+	// a correlated scalar subquery in the select list
+	tups := runHavingQuery(t, bp, c, "select name, (select count(*) from t2 where t2.name = t.name) from t")
+	if len(tups) != 12 {
+		t.Fatalf("expected 12 rows, got %d", len(tups))
+	}
+	for _, tup := range tups {
+		name := tup.Fields[0].(StringField).Value
+		want := int64(1)
+		if name == "sam" || name == "riza" {
+			want = 2
+		}
+		if tup.Fields[1].(IntField).Value != want {
+			t.Errorf("expected %d tuples of t2 named %s, got %v", want, name, tup.Fields[1])
+		}
+	}
+
+	// a scalar subquery that returns more than one row is an error, rather
+	// than duplicating the rows it matches or passing them if any row does
+	for _, sql := range []string{
+		"select name, (select age from t2 where t2.name = t.name) from t",
+		"select name, (select age from t2 where age > 90) from t",
+		"select name from t where age >= (select age from t2 where t2.name = t.name)",
+		"select name from t where age = (select age from t2 where age > 90)",
+	} {
+		_, _, plan, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf("failed to parse, q=%s, %s", sql, err.Error())
+		}
+		tid := BeginTransactionForTest(t, bp)
+		iter, err := plan.Iterator(tid)
+		for err == nil {
+			var tup *Tuple
+			if tup, err = iter(); tup == nil {
+				break
+			}
+		}
+		bp.CommitTransaction(tid)
+		if err == nil {
+			t.Errorf("expected an error running %s", sql)
+		}
+	}
+
+	for _, sql := range []string{
+		"select name from t where age > 50 or name in (select name from t2)",
+		"select name from t where name in (select name, age from t2)",
+		"select name from t where age > (select avg(age) from t2 where t2.age > t.age)",
+		// the value of a correlated aggregate subquery without a match
+		// can't be computed
+		"select name from t where 1 = (select count(*) + 1 from t2 where t2.name = t.name)",
+		"select name from t where 0 = (select count(*) from t2 where t2.name = t.name having count(*) > 1)",
+		"select name from t where exists (select count(*) from t2 where t2.name = t.name)",
+	} {
+		if _, _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+var DEBUGTEMPFILE = false
+
+func DebugTempFile(format string, a ...any) (int, error) {
+	if DEBUGTEMPFILE || GLOBALDEBUG {
+		return fmt.Println(fmt.Sprintf(format, a...))
+	}
+	return 0, nil
+}
+
+// A tempHeapFile is a scratch HeapFile used by operators that need to spill
+// intermediate state to disk (partitions of a grace hash join, sorted runs of
+// an external sort, etc).
+//
+// Tuples are appended a page at a time: the page being filled is kept
+// privately and written straight to disk once it is full, so spilling never
+// fills the BufferPool with dirty pages. Reading the file back goes through
+// the regular [HeapFile.Iterator], and therefore through the BufferPool.
+type tempHeapFile struct {
+	*HeapFile
+	curPage   *heapPage
+	numTuples int
+	closed    bool
+}
+
+// Create a new, empty temporary heap file for tuples of the given TupleDesc.
+// The backing file lives in the OS temp directory and is removed by
+// [tempHeapFile.close].
+func newTempHeapFile(desc *TupleDesc, bp *BufferPool) (*tempHeapFile, error) {
+	if bp == nil {
+		return nil, GoDBError{IllegalOperationError, "cannot create a temporary heap file without a buffer pool"}
+	}
+	f, err := os.CreateTemp("", "godb-spill-*.dat")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+
+	hf, err := NewHeapFile(name, desc.copy(), bp)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	if err := hf.dropFreeSpaceMap(); err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	DebugTempFile("created temp heap file %v", name)
+	return &tempHeapFile{HeapFile: hf}, nil
+}
+
+// Append a tuple to the end of the temporary file.
+func (tf *tempHeapFile) append(t *Tuple) error {
+	if tf.closed {
+		return GoDBError{IllegalOperationError, "append to a closed temporary file"}
+	}
+	if tf.curPage == nil {
+		page, err := newHeapPage(tf.desc, tf.numPages, tf.HeapFile)
+		if err != nil {
+			return err
+		}
+		tf.curPage = page
+	}
+
+	// the tuple is stored by reference in the page, so give it the file's
+	// descriptor rather than whatever the caller handed us
+	stored := &Tuple{*tf.desc, t.Fields, nil}
+	_, err := tf.curPage.insertTuple(stored)
+	if err != nil {
+		return err
+	}
+	tf.numTuples++
+
+	if tf.curPage.NumUsedSlots == tf.curPage.NumSlots {
+		return tf.flushCurrentPage()
+	}
+	return nil
+}
+
+func (tf *tempHeapFile) flushCurrentPage() error {
+	if tf.curPage == nil {
+		return nil
+	}
+	err := tf.flushPage(tf.curPage)
+	if err != nil {
+		return err
+	}
+	tf.curPage = nil
+	tf.numPages++
+	return nil
+}
+
+// Write out any partially filled page. Must be called after the last append
+// and before iterating through the file.
+func (tf *tempHeapFile) finish() error {
+	return tf.flushCurrentPage()
+}
+
+// Number of tuples appended to the file.
+func (tf *tempHeapFile) NumTuples() int {
+	return tf.numTuples
+}
+
+// Drop any of the file's pages cached in the BufferPool and delete the file
+// from disk.
+func (tf *tempHeapFile) close() error {
+	if tf.closed {
+		return nil
+	}
+	tf.closed = true
+	tf.curPage = nil
+	tf.bufPool.discardFilePages(tf.HeapFile)
+	tf.file.Close()
+	DebugTempFile("removing temp heap file %v", tf.fileName)
+	return os.Remove(tf.fileName)
+}
+
+// Pick the partition for a key at the given recursion level, for operators
+// that hash partition their input into temporary files. The level is mixed
+// into the hash so that re-partitioning actually splits the keys.
+func hashPartition(key string, level int, numPartitions int) int {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(level))
+	h.Write(buf[:])
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(numPartitions))
+}
@@ -232,7 +232,7 @@ type Singleton struct {
 	ran bool
 }
 
-func (i *Singleton) Statistics() map[string]map[string]float64 {
+func (i *Singleton) SampleInfo() *SampleInfo {
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -15,11 +16,12 @@ import (
 // Define these here instead of types.go cause it seems autograder overwrites types.go with base version
 const (
 	// PageSize     int = 4096
-	HeaderSize int = 8
+	HeaderSize int = 16 // the size of a heapPageHeader
 	// StringLength int = 32
 	Int64Length          int           = 8
 	Float64Lengh         int           = 8
 	RepInvariantViolated GoDBErrorCode = 13
+	CorruptPageError     GoDBErrorCode = 14
 )
 
 var DEBUGTUPLE = false
@@ -192,6 +194,21 @@ type FloatField struct {
 	Value float64
 }
 
+// SQL NULL, e.g. the missing side of an outer join. NULL never compares equal
+// (or unequal) to anything, including another NULL.
+type NullField struct{}
+
+// Values stored on disk in place of NULL for each field type. They are picked
+// to be values that real data is very unlikely to contain.
+const nullIntSentinel int64 = math.MinInt64
+const nullFloatSentinelBits uint64 = 0x7ff8_0000_6e75_6c6c // a NaN spelling "null"
+const nullStringSentinel = "\xff\x00null"
+
+func isNull(v DBValue) bool {
+	_, ok := v.(NullField)
+	return ok
+}
+
 // Tuple represents the contents of a tuple read from a database
 // It includes the tuple descriptor, and the value of the fields
 type Tuple struct {
@@ -259,6 +276,19 @@ func (t *Tuple) writeTo(b *bytes.Buffer) error {
 				return GoDBError{TypeMismatchError, fmt.Sprintf("Should be float type here %v", descType)}
 			}
 			binary.Write(b, binary.LittleEndian, fieldType.Value)
+		case NullField:
+			switch t.Desc.Fields[i].Ftype {
+			case StringType:
+				byteString := make([]byte, StringLength)
+				copy(byteString, []byte(nullStringSentinel))
+				binary.Write(b, binary.LittleEndian, byteString)
+			case IntType:
+				binary.Write(b, binary.LittleEndian, nullIntSentinel)
+			case FloatType:
+				binary.Write(b, binary.LittleEndian, nullFloatSentinelBits)
+			default:
+				return GoDBError{TypeMismatchError, fmt.Sprintf("can't write NULL for field of type %v", t.Desc.Fields[i].Ftype)}
+			}
 		}
 	}
 
@@ -304,7 +334,12 @@ func readTupleFrom(b *bytes.Buffer, desc *TupleDesc) (*Tuple, error) {
 			}
 
 			// only use the non padded string
-			tuple.Fields[i] = StringField{Value: string(bytes.TrimRight(byteString, "\x00"))}
+			str := string(bytes.TrimRight(byteString, "\x00"))
+			if str == nullStringSentinel {
+				tuple.Fields[i] = NullField{}
+			} else {
+				tuple.Fields[i] = StringField{Value: str}
+			}
 		case IntType:
 
 			var intValue int64
@@ -313,7 +348,11 @@ func readTupleFrom(b *bytes.Buffer, desc *TupleDesc) (*Tuple, error) {
 				return &tuple, err
 			}
 
-			tuple.Fields[i] = IntField{Value: intValue}
+			if intValue == nullIntSentinel {
+				tuple.Fields[i] = NullField{}
+			} else {
+				tuple.Fields[i] = IntField{Value: intValue}
+			}
 		case FloatType:
 
 			var floatValue float64
@@ -322,7 +361,11 @@ func readTupleFrom(b *bytes.Buffer, desc *TupleDesc) (*Tuple, error) {
 				return &tuple, err
 			}
 
-			tuple.Fields[i] = FloatField{Value: floatValue}
+			if math.Float64bits(floatValue) == nullFloatSentinelBits {
+				tuple.Fields[i] = NullField{}
+			} else {
+				tuple.Fields[i] = FloatField{Value: floatValue}
+			}
 		}
 	}
 
@@ -581,6 +624,8 @@ func (t *Tuple) PrettyPrintString(aligned bool) string {
 			str = strconv.FormatFloat(f.Value, 'g', -1, 64)
 		case StringField:
 			str = f.Value
+		case NullField:
+			str = "NULL"
 		}
 		if aligned {
 			outstr = fmt.Sprintf("%s %s", outstr, fmtCol(str, len(t.Fields)))
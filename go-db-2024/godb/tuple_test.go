@@ -113,6 +113,32 @@ func TestTupleSerialization(t *testing.T) {
 	}
 }
 
+// Check that NULLs of every type survive serialization
+func TestTupleSerializationNull(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "name", Ftype: StringType},
+		{Fname: "age", Ftype: IntType},
+		{Fname: "score", Ftype: FloatType},
+	}}
+	tup := Tuple{Desc: td, Fields: []DBValue{NullField{}, NullField{}, NullField{}}}
+	b := new(bytes.Buffer)
+	if err := tup.writeTo(b); err != nil {
+		t.Fatalf("Error writing tuple with NULLs: %v", err.Error())
+	}
+	t2, err := readTupleFrom(b, &td)
+	if err != nil {
+		t.Fatalf("Error loading tuple from saved buffer: %v", err.Error())
+	}
+	for i, f := range t2.Fields {
+		if !isNull(f) {
+			t.Errorf("field %d should be NULL, got %v", i, f)
+		}
+	}
+	if (NullField{}).EvalPred(NullField{}, OpEq) || (IntField{1}).EvalPred(NullField{}, OpNeq) {
+		t.Errorf("comparisons with NULL should never be true")
+	}
+}
+
 // Unit test for Tuple.compareField()
 func TestTupleExpr(t *testing.T) {
 	td, t1, t2 := makeTupleTestVars()
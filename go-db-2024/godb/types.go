@@ -1,10 +1,6 @@
 package godb
 
-import (
-	"fmt"
-	"regexp"
-	"strings"
-)
+import "fmt"
 
 type GoDBErrorCode int
 
@@ -76,7 +72,9 @@ type DBFile interface {
 type Operator interface {
 	Descriptor() *TupleDesc
 	Iterator(tid TransactionID) (func() (*Tuple, error), error)
-	Statistics() map[string]map[string]float64
+	// Returns the sampling metadata of the operator's output, or nil if
+	// there is none.
+	SampleInfo() *SampleInfo
 }
 
 type BoolOp int
@@ -89,17 +87,24 @@ const (
 	OpEq   BoolOp = iota
 	OpNeq  BoolOp = iota
 	OpLike BoolOp = iota
+	// Pattern matching operators, see [MatchExpr]
+	OpILike     BoolOp = iota
+	OpRegexp    BoolOp = iota
+	OpSimilarTo BoolOp = iota
 )
 
 var BoolOpMap = map[string]BoolOp{
-	">":    OpGt,
-	"<":    OpLt,
-	"<=":   OpLe,
-	">=":   OpGe,
-	"=":    OpEq,
-	"<>":   OpNeq,
-	"!=":   OpNeq,
-	"like": OpLike,
+	">":          OpGt,
+	"<":          OpLt,
+	"<=":         OpLe,
+	">=":         OpGe,
+	"=":          OpEq,
+	"<>":         OpNeq,
+	"!=":         OpNeq,
+	"like":       OpLike,
+	"ilike":      OpILike,
+	"regexp":     OpRegexp,
+	"similar to": OpSimilarTo,
 }
 
 func (i1 IntField) EvalPred(v2 DBValue, op BoolOp) bool {
@@ -154,6 +159,11 @@ func (i1 FloatField) EvalPred(v2 DBValue, op BoolOp) bool {
 	}
 }
 
+// Comparisons with NULL are never true.
+func (i1 NullField) EvalPred(v2 DBValue, op BoolOp) bool {
+	return false
+}
+
 func (i1 StringField) EvalPred(v2 DBValue, op BoolOp) bool {
 	i2, ok := v2.(StringField)
 	if !ok {
@@ -174,19 +184,9 @@ func (i1 StringField) EvalPred(v2 DBValue, op BoolOp) bool {
 		return x1 < x2
 	case OpLe:
 		return x1 <= x2
-	case OpLike:
-		s1, ok := any(i1).(string)
-		if !ok {
-			return false
-		}
-		regex, ok := any(i2).(string)
-		if !ok {
-			return false
-		}
-		regex = "^" + regex + "$"
-		regex = strings.Replace(regex, "%", ".*?", -1)
-		match, _ := regexp.MatchString(regex, s1)
-		return match
+	case OpLike, OpILike, OpRegexp, OpSimilarTo:
+		kind, _ := patternKind(op)
+		return matchPattern(kind, x1, x2)
 	default:
 		return false
 	}
@@ -0,0 +1,188 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What a [HeapFile.Vacuum] did.
+type VacuumStats struct {
+	PagesBefore, PagesAfter int
+	TuplesMoved             int
+}
+
+// The number of bytes of the backing file a vacuum freed.
+func (s VacuumStats) ReclaimedBytes() int {
+	return (s.PagesBefore - s.PagesAfter) * PageSize
+}
+
+// Compact the heap file after deletes have left its pages sparsely filled:
+// move the tuples of its last pages into the free slots of its first pages,
+// until its tuples fill as few pages as they can, then cut the emptied pages
+// off the end of the backing file. The moved tuples get new record ids, and
+// the heap file's dirty pages are written to disk. The outlier table, if
+// any, is compacted too, and counted in the stats.
+func (f *HeapFile) Vacuum(tid TransactionID) (VacuumStats, error) {
+	f.bufPool.CanFlushWhenFull = true
+	defer func() { f.bufPool.CanFlushWhenFull = false }()
+	stats := VacuumStats{PagesBefore: f.numPages}
+
+	getPage := func(pageNo int) (*heapPage, error) {
+		page, err := f.bufPool.GetPage(f, pageNo, tid, WritePerm)
+		if err != nil {
+			return nil, err
+		}
+		heapPage, ok := page.(*heapPage)
+		if !ok {
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("Couldn't convert page to heap page pointer. %v\n", page)}
+		}
+		return heapPage, nil
+	}
+
+	// count the tuples, and find the pages with free slots exactly
+	used := 0
+	f.pagesWithFreeSlots = freePageSet{}
+	for pageNo := 0; pageNo < f.numPages; pageNo++ {
+		page, err := getPage(pageNo)
+		if err != nil {
+			return stats, err
+		}
+		used += page.NumUsedSlots
+		if page.NumUsedSlots < page.NumSlots {
+			f.pagesWithFreeSlots.add(pageNo)
+		}
+	}
+	keep := (used + f.numSlots - 1) / f.numSlots
+
+	for src := keep; src < f.numPages; src++ {
+		page, err := getPage(src)
+		if err != nil {
+			return stats, err
+		}
+		for slot, t := range page.Tuples {
+			if t == nil {
+				continue
+			}
+			dstNo, ok := f.pagesWithFreeSlots.first()
+			if !ok || dstNo >= keep {
+				return stats, GoDBError{MalformedDataError, fmt.Sprintf("no room for the tuples of page %d in the first %d pages", src, keep)}
+			}
+			dst, err := getPage(dstNo)
+			if err != nil {
+				return stats, err
+			}
+			if _, err := dst.insertTuple(&Tuple{t.Desc, t.Fields, nil}); err != nil {
+				return stats, err
+			}
+			if dst.NumUsedSlots == dst.NumSlots {
+				f.pagesWithFreeSlots.remove(dstNo)
+			}
+			if err := page.deleteTuple(&recordIDImpl{src, slot}); err != nil {
+				return stats, err
+			}
+			stats.TuplesMoved++
+		}
+		page.setDirty(tid, true)
+	}
+
+	// write the pages that are kept, and drop the rest
+	f.bufPool.discardPagesFrom(f, keep)
+	if err := f.bufPool.flushFilePages(f); err != nil {
+		return stats, err
+	}
+	if err := f.file.Truncate(int64(keep) * int64(PageSize)); err != nil {
+		return stats, err
+	}
+	for pageNo := keep; pageNo < f.numPages; pageNo++ {
+		f.pagesWithFreeSlots.remove(pageNo)
+	}
+	f.numPages = keep
+	f.indexes = nil
+	stats.PagesAfter = keep
+	if f.fsmFile != nil {
+		if err := f.truncateFreeSpaceMap(min(f.fsmPages, keep)); err != nil {
+			return stats, err
+		}
+	}
+	if f.outliers != nil {
+		outliers, err := f.outliers.Vacuum(tid)
+		if err != nil {
+			return stats, err
+		}
+		stats.PagesBefore += outliers.PagesBefore
+		stats.PagesAfter += outliers.PagesAfter
+		stats.TuplesMoved += outliers.TuplesMoved
+	}
+	return stats, nil
+}
+
+// A VacuumOp compacts a heap file (see [HeapFile.Vacuum]), for the VACUUM
+// table statement.
+type VacuumOp struct {
+	file *HeapFile
+}
+
+func NewVacuumOp(file *HeapFile) *VacuumOp {
+	return &VacuumOp{file}
+}
+
+// Vacuuming outputs what it did rather than tuples of the table.
+func (v *VacuumOp) SampleInfo() *SampleInfo {
+	return nil
+}
+
+// The vacuum TupleDesc has the number of pages of the heap file before and
+// after, the number of tuples moved, and the number of bytes freed.
+func (v *VacuumOp) Descriptor() *TupleDesc {
+	return &TupleDesc{[]FieldType{
+		{"pages_before", "", IntType},
+		{"pages_after", "", IntType},
+		{"tuples_moved", "", IntType},
+		{"reclaimed_bytes", "", IntType},
+	}}
+}
+
+// Return an iterator that vacuums the heap file, then returns a single tuple
+// reporting what it did.
+func (v *VacuumOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	done := false
+	return func() (*Tuple, error) {
+		if done {
+			return nil, nil
+		}
+		done = true
+		stats, err := v.file.Vacuum(tid)
+		if err != nil {
+			return nil, err
+		}
+		return &Tuple{*v.Descriptor(), []DBValue{
+			IntField{int64(stats.PagesBefore)},
+			IntField{int64(stats.PagesAfter)},
+			IntField{int64(stats.TuplesMoved)},
+			IntField{int64(stats.ReclaimedBytes())},
+		}, nil}, nil
+	}, nil
+}
+
+// Return the table of a VACUUM table statement, which the SQL parser doesn't
+// know, and whether query is one.
+func vacuumStatement(query string) (string, bool) {
+	words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(words) != 2 || !strings.EqualFold(words[0], "vacuum") {
+		return "", false
+	}
+	return strings.ToLower(words[1]), true
+}
+
+func parseVacuum(c *Catalog, table string, tableNames map[string]bool) (Operator, error) {
+	file, err := c.GetTable(table)
+	if err != nil {
+		return nil, err
+	}
+	hf, ok := file.(*HeapFile)
+	if !ok {
+		return nil, GoDBError{ParseError, fmt.Sprintf("can only vacuum heap files, not %s", table)}
+	}
+	tableNames[table] = true
+	return NewVacuumOp(hf), nil
+}
@@ -0,0 +1,197 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVacuum(t *testing.T) {
+	bp, hf := makeTestFile(t, 10)
+	td, _, _ := makeTupleTestVars()
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	n := 5 * hf.numSlots
+	for i := 0; i < n; i++ {
+		tup := Tuple{td, []DBValue{StringField{"sam"}, IntField{int64(i)}}, nil}
+		if err := hf.insertTuple(&tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// delete three quarters of the tuples
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	want := make(map[int64]bool)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		age := tup.Fields[1].(IntField).Value
+		if age%4 != 0 {
+			if err := hf.deleteTuple(tup, tid); err != nil {
+				t.Fatalf(err.Error())
+			}
+		} else {
+			want[age] = true
+		}
+	}
+
+	stats, err := hf.Vacuum(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pages := (len(want) + hf.numSlots - 1) / hf.numSlots
+	if stats.PagesBefore != 5 || stats.PagesAfter != pages || hf.NumPages() != pages {
+		t.Errorf("expected vacuuming to go from 5 pages to %d, got %+v", pages, stats)
+	}
+	if stats.TuplesMoved == 0 || stats.ReclaimedBytes() != (5-pages)*PageSize {
+		t.Errorf("expected tuples to be moved and %d bytes reclaimed, got %+v", (5-pages)*PageSize, stats)
+	}
+	if info, err := os.Stat(TestingFile); err != nil || info.Size() != int64(pages*PageSize) {
+		t.Errorf("expected the backing file to be cut to %d pages, got %v", pages, info.Size())
+	}
+
+	// the tuples are all still there, after reopening the heap file
+	bp2, err := NewBufferPool(10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hf2, err := NewHeapFile(TestingFile, &td, bp2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, err = hf2.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	got := make(map[int64]bool)
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		got[tup.Fields[1].(IntField).Value] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %d tuples after vacuuming, got %d", len(want), len(got))
+	}
+	for age := range want {
+		if !got[age] {
+			t.Errorf("expected tuple %d to survive vacuuming", age)
+		}
+	}
+	if hf2.pagesWithFreeSlots.Len() > 1 {
+		t.Errorf("expected at most the last page to have free slots, got %v", hf2.pagesWithFreeSlots.pages)
+	}
+}
+
+func TestParseVacuum(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	hf, err := c.GetTable("t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := BeginTransactionForTest(t, bp)
+	for _, tup := range runHavingQuery(t, bp, c, "select * from t where t.age > 20") {
+		if err := hf.deleteTuple(tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	before := runHavingQuery(t, bp, c, "select count(*) from t")
+	tups := runHavingQuery(t, bp, c, "VACUUM t;")
+	if len(tups) != 1 || len(tups[0].Fields) != 4 {
+		t.Fatalf("expected a report of what was vacuumed, got %v", tups)
+	}
+	after := runHavingQuery(t, bp, c, "select count(*) from t")
+	if !before[0].Fields[0].EvalPred(after[0].Fields[0], OpEq) {
+		t.Errorf("expected vacuuming to keep %v tuples, got %v", before[0], after[0])
+	}
+	if _, _, _, err := Parse(c, "vacuum nosuchtable"); err == nil {
+		t.Errorf("expected an error vacuuming a table that doesn't exist")
+	}
+}
+
+func TestVacuumOutliers(t *testing.T) {
+	// 30000 ages of 100 and 300 of 100000, whose outlier table takes a few
+	// pages
+	bp, hf := makeTestFile(t, 50)
+	td, t1, _ := makeTupleTestVars()
+	dir := t.TempDir()
+	csv, err := os.Create(dir + "/test.csv")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer csv.Close()
+	csv.WriteString("name,age\n")
+	for i := 0; i < 30000; i++ {
+		csv.WriteString("sam,100\n")
+		if i%100 == 0 {
+			csv.WriteString("bo,100000\n")
+		}
+	}
+	if err := hf.StatAndLoadFromCSV(csv, true, ",", false, dir+"/testStat.txt"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(outlierFileName(hf.BackingFile()))
+	outlierPages := hf.Outliers().NumPages()
+	if outlierPages < 3 {
+		t.Fatalf("expected an outlier table of at least 3 pages, got %d", outlierPages)
+	}
+
+	// a dirty page of another heap file
+	other, err := NewHeapFile(dir+"/other.dat", &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	if err := other.insertTuple(&t1, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// delete all but 50 of the outliers
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	kept := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, ok := tup.Rid.(outlierRID); !ok {
+			continue
+		}
+		if kept < 50 {
+			kept++
+			continue
+		}
+		if err := hf.deleteTuple(tup, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	before, _, _, _ := sampledCountSum(t, hf, tid)
+
+	stats, err := hf.Vacuum(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hf.Outliers().NumPages() != 1 || stats.PagesBefore-stats.PagesAfter != outlierPages-1 {
+		t.Errorf("expected the outlier table to be cut from %d pages to 1, got %d pages and %+v", outlierPages, hf.Outliers().NumPages(), stats)
+	}
+	if after, _, _, _ := sampledCountSum(t, hf, tid); after != before {
+		t.Errorf("expected vacuuming to keep the estimated count %d, got %d", before, after)
+	}
+	page, err := bp.GetPage(other, 0, tid, ReadPerm)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !page.isDirty() {
+		t.Errorf("expected vacuuming to leave the pages of other heap files alone")
+	}
+}
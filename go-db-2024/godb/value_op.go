@@ -8,7 +8,7 @@ type ValueOp struct {
 	exprs []([]Expr)
 }
 
-func (v *ValueOp) Statistics() map[string]map[string]float64 {
+func (v *ValueOp) SampleInfo() *SampleInfo {
 	return nil
 }
 
@@ -0,0 +1,521 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Online aggregation over multi-way joins with wander joins (see F. Li, B. Wu,
+// K. Yi and Z. Zhao, "Wander join: online aggregation via random walks",
+// SIGMOD 2016).
+//
+// Uniform samples of the tables of a join of several tables rarely join with
+// each other, so estimates from joining them are poor. A [WanderJoin] instead
+// samples the join itself, with random walks: it picks a random tuple of one
+// table, then a random tuple among those of the next table that join with it
+// (looked up in a hash index on the join column, see [hashIndex]), and so on
+// along the join predicates until it has visited every table. The probability
+// of the walk is the product of the probabilities of each choice, so weighting
+// its joined tuple by one over that probability (a Horvitz-Thompson
+// estimator) gives an unbiased estimate of the aggregates of the join, and the
+// average over many walks comes with a confidence interval from the central
+// limit theorem. Walks that reach a tuple that fails a filter or has nothing
+// to join with join nothing.
+//
+// Which table the walks start from makes a big difference to the variance, so
+// the walks from each table are tried [WanderTrialWalks] times first, and the
+// table whose walks vary least is used. Queries ask to be run as wander joins
+// with a hint right after SELECT: SELECT /*+ WANDER_JOIN */ ...
+
+// The number of random walks a wander join makes.
+var WanderJoinWalks = 100000
+
+// The number of walks a wander join tries from each table, to pick the table
+// to start its walks from.
+var WanderTrialWalks = 100
+
+// The name of the column of wander join results with the number of walks
+// made so far.
+const WanderWalksField = "wander_walks"
+
+// The hint that asks for a query to be run as a wander join.
+const wanderJoinHint = "wander_join"
+
+// Whether the comments of a SELECT include a hint (/*+ hint */).
+func hasHint(comments sqlparser.Comments, hint string) bool {
+	for _, comment := range comments {
+		c := strings.ToLower(string(comment))
+		if !strings.HasPrefix(c, "/*+") {
+			continue
+		}
+		for _, h := range strings.Fields(strings.TrimSuffix(strings.TrimPrefix(c, "/*+"), "*/")) {
+			if h == hint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// An equality join predicate between columns of two of the inputs of a
+// wander join.
+type WanderEdge struct {
+	Left, Right           int // the positions of the inputs
+	LeftField, RightField FieldType
+}
+
+// One of the inputs of a wander join: a heap file and the filters applied to
+// its tuples.
+type wanderInput struct {
+	op      Operator
+	file    *HeapFile
+	filters []Expr
+	scale   float64 // the number of tuples of the table each tuple of the heap file stands for
+}
+
+// Whether a tuple of the input read from one of its indexes passes its
+// filters, returning it with the input's descriptor. A tuple deleted since the
+// index was built (nil) doesn't pass.
+func (in *wanderInput) accept(t *Tuple, err error) (*Tuple, bool, error) {
+	if t == nil || err != nil {
+		return nil, false, err
+	}
+	t = &Tuple{*in.op.Descriptor(), t.Fields, t.Rid}
+	ok, err := evalJoinConditions(in.filters, t)
+	return t, ok, err
+}
+
+// A step of a walk, to a tuple of an input that joins with the tuple of an
+// input already visited.
+type wanderStep struct {
+	from, to  int        // the positions of the inputs
+	fromField int        // the position of the join column in the tuples of from
+	index     *hashIndex // the index of to on its join column
+}
+
+// The equality of two columns of inputs that a walk checks once it has
+// visited both, for join predicates that aren't steps of the walk.
+type wanderCheck struct {
+	left, right           int
+	leftField, rightField int
+}
+
+// The walks from one of the inputs.
+type wanderPlan struct {
+	start      int
+	startIndex *hashIndex // an index of the start input, to pick its tuples from
+	steps      []wanderStep
+	checks     []wanderCheck
+}
+
+// The totals over the walks of the contributions of joined tuples to an
+// aggregate, y (their values) and c (their counts), weighted by one over the
+// probabilities of the walks, and their squares and cross products.
+type wanderSums struct {
+	y, yy, c, cc, yc float64
+}
+
+// A WanderJoin estimates COUNT, SUM and AVG aggregates over an equality join of
+// (filtered) heap files with random walks (see [onlineAggregator]). Its last
+// output field is the number of walks made so far (see [WanderWalksField]).
+type WanderJoin struct {
+	inputs   []Operator
+	edges    []WanderEdge
+	residual []Expr // other join predicates, checked on the joined tuples
+	aggs     []onlineAgg
+	desc     *TupleDesc
+}
+
+// Construct a wander join of inputs on the equality predicates of edges,
+// which must connect all of them, and residual predicates over the joined
+// tuples, estimating the aggregates of aggs (which must be COUNT, SUM or AVG
+// states, initialized with expressions over the joined tuples).
+//
+// Returns an error if an input isn't a filtered heap file sampled with equal
+// probabilities, the inputs aren't connected, or an aggregate can't be
+// estimated.
+func NewWanderJoin(inputs []Operator, edges []WanderEdge, residual []Expr, aggs []AggState) (*WanderJoin, error) {
+	if len(inputs) == 0 {
+		return nil, GoDBError{IllegalOperationError, "wander joins need inputs"}
+	}
+	for _, in := range inputs {
+		if _, _, _, err := onlineSource("wander join", in); err != nil {
+			return nil, err
+		}
+	}
+	connected := map[int]bool{0: true}
+	for changed := true; changed; {
+		changed = false
+		for _, e := range edges {
+			if e.Left < 0 || e.Right < 0 || e.Left >= len(inputs) || e.Right >= len(inputs) {
+				return nil, GoDBError{IllegalOperationError, fmt.Sprintf("wander join edge %v between inputs that don't exist", e)}
+			}
+			if connected[e.Left] != connected[e.Right] {
+				connected[e.Left], connected[e.Right] = true, true
+				changed = true
+			}
+		}
+	}
+	if len(connected) != len(inputs) {
+		return nil, GoDBError{IllegalOperationError, "wander joins can't compute cross products"}
+	}
+	onlineAggs, desc, err := newOnlineAggs("wander join", aggs, FieldType{WanderWalksField, "", IntType})
+	if err != nil {
+		return nil, err
+	}
+	return &WanderJoin{inputs, edges, residual, onlineAggs, desc}, nil
+}
+
+func (wj *WanderJoin) Descriptor() *TupleDesc {
+	return wj.desc
+}
+
+// The estimates are already scaled up to the whole join.
+func (wj *WanderJoin) SampleInfo() *SampleInfo {
+	return nil
+}
+
+func (wj *WanderJoin) boundFields() []FieldType {
+	return wj.desc.Fields[len(wj.aggs):]
+}
+
+// Plan the walks that start from the input start, visiting the other inputs
+// along the edges in breadth first order.
+func (wj *WanderJoin) plan(start int, inputs []*wanderInput, tid TransactionID) (*wanderPlan, error) {
+	plan := &wanderPlan{start: start}
+	visited := map[int]bool{start: true}
+	used := make([]bool, len(wj.edges))
+	for len(visited) < len(inputs) {
+		for i, e := range wj.edges {
+			from, fromField, to, toField := e.Left, e.LeftField, e.Right, e.RightField
+			if visited[to] {
+				from, fromField, to, toField = to, toField, from, fromField
+			}
+			if used[i] || !visited[from] || visited[to] {
+				continue
+			}
+			fieldPos, err := findFieldInTd(fromField, inputs[from].op.Descriptor())
+			if err != nil {
+				return nil, err
+			}
+			index, err := inputs[to].file.hashIndex(toField.Fname, tid)
+			if err != nil {
+				return nil, err
+			}
+			plan.steps = append(plan.steps, wanderStep{from, to, fieldPos, index})
+			visited[to] = true
+			used[i] = true
+		}
+	}
+	for i, e := range wj.edges {
+		if used[i] {
+			continue
+		}
+		left, err := findFieldInTd(e.LeftField, inputs[e.Left].op.Descriptor())
+		if err != nil {
+			return nil, err
+		}
+		right, err := findFieldInTd(e.RightField, inputs[e.Right].op.Descriptor())
+		if err != nil {
+			return nil, err
+		}
+		plan.checks = append(plan.checks, wanderCheck{e.Left, e.Right, left, right})
+	}
+
+	// the tuples of the start input are picked from any of its indexes
+	for _, e := range wj.edges {
+		field := e.LeftField
+		if e.Right == start {
+			field = e.RightField
+		} else if e.Left != start {
+			continue
+		}
+		index, err := inputs[start].file.hashIndex(field.Fname, tid)
+		if err != nil {
+			return nil, err
+		}
+		plan.startIndex = index
+		break
+	}
+	if plan.startIndex == nil {
+		// a join of a single input
+		field := inputs[start].op.Descriptor().Fields[0]
+		index, err := inputs[start].file.hashIndex(field.Fname, tid)
+		if err != nil {
+			return nil, err
+		}
+		plan.startIndex = index
+	}
+	return plan, nil
+}
+
+// Make a random walk, returning the joined tuple it reached and the
+// probability of the walk, or nil if it didn't reach a joined tuple.
+func (wj *WanderJoin) walk(plan *wanderPlan, inputs []*wanderInput, tid TransactionID) (*Tuple, float64, error) {
+	n := plan.startIndex.size()
+	if n == 0 {
+		return nil, 0, nil
+	}
+	tuples := make([]*Tuple, len(inputs))
+	t, ok, err := inputs[plan.start].accept(plan.startIndex.tuple(rand.Intn(n), tid))
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	tuples[plan.start] = t
+	p := 1 / float64(n)
+	for _, step := range plan.steps {
+		matches := step.index.lookup(tuples[step.from].Fields[step.fromField])
+		if len(matches) == 0 {
+			return nil, 0, nil
+		}
+		t, ok, err := inputs[step.to].accept(step.index.tuple(matches[rand.Intn(len(matches))], tid))
+		if err != nil || !ok {
+			return nil, 0, err
+		}
+		tuples[step.to] = t
+		p /= float64(len(matches))
+	}
+	for _, check := range plan.checks {
+		if !tuples[check.left].Fields[check.leftField].EvalPred(tuples[check.right].Fields[check.rightField], OpEq) {
+			return nil, 0, nil
+		}
+	}
+
+	joined := tuples[0]
+	for _, t := range tuples[1:] {
+		joined = joinTuples(joined, t)
+	}
+	ok, err = evalJoinConditions(wj.residual, joined)
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	return joined, p, nil
+}
+
+// Make a walk and add its contributions to the totals of each aggregate.
+func (wj *WanderJoin) addWalk(plan *wanderPlan, inputs []*wanderInput, sums []wanderSums, tid TransactionID) error {
+	joined, p, err := wj.walk(plan, inputs, tid)
+	if err != nil || joined == nil {
+		return err
+	}
+	weight := 1 / p
+	for _, in := range inputs {
+		weight *= in.scale
+	}
+	for i, agg := range wj.aggs {
+		y, counted, err := agg.eval(joined)
+		if err != nil {
+			return err
+		}
+		if !counted {
+			continue
+		}
+		y, c := y*weight, weight
+		sums[i].y += y
+		sums[i].yy += y * y
+		sums[i].c += c
+		sums[i].cc += c * c
+		sums[i].yc += y * c
+	}
+	return nil
+}
+
+// Return the estimate of an aggregate from the totals of n walks, and the
+// variance of the estimate.
+func (agg onlineAgg) wanderEstimate(s wanderSums, n float64) (DBValue, float64) {
+	sum, count := s.y/n, s.c/n
+	if n < 2 {
+		return agg.estimate(sum, count), 0
+	}
+	var squares float64 // the sum of squared differences from the estimate
+	switch agg.kind {
+	case onlineCount:
+		squares = s.cc - n*count*count
+	case onlineSum:
+		squares = s.yy - n*sum*sum
+	case onlineAvg:
+		// the delta method, for the ratio of the estimates of the sum and
+		// the count
+		if count == 0 {
+			return agg.estimate(sum, count), 0
+		}
+		r := sum / count
+		squares = (s.yy - 2*r*s.yc + r*r*s.cc) / (count * count)
+	}
+	return agg.estimate(sum, count), math.Max(0, squares) / (n - 1) / n
+}
+
+// Make a tuple of the estimates of the aggregates from n walks.
+func (wj *WanderJoin) estimates(sums []wanderSums, n int) *Tuple {
+	fields := make([]DBValue, 0, len(wj.desc.Fields))
+	bounds := make([]DBValue, 0, len(wj.aggs))
+	for i, agg := range wj.aggs {
+		est, variance := agg.wanderEstimate(sums[i], float64(n))
+		fields = append(fields, est)
+		bounds = append(bounds, FloatField{ConfidenceZ * math.Sqrt(variance)})
+	}
+	fields = append(fields, bounds...)
+	fields = append(fields, IntField{int64(n)})
+	return &Tuple{*wj.desc, fields, nil}
+}
+
+// Pick the plan whose trial walks estimate the number of joined tuples with
+// the smallest variance.
+func (wj *WanderJoin) choosePlan(inputs []*wanderInput, tid TransactionID) (*wanderPlan, error) {
+	count := onlineAgg{kind: onlineCount, expr: countStarExpr}
+	var best *wanderPlan
+	bestVariance := math.Inf(1)
+	for start := range inputs {
+		plan, err := wj.plan(start, inputs, tid)
+		if err != nil {
+			return nil, err
+		}
+		trial := &WanderJoin{aggs: []onlineAgg{count}, residual: wj.residual}
+		sums := make([]wanderSums, 1)
+		for i := 0; i < WanderTrialWalks; i++ {
+			if err := trial.addWalk(plan, inputs, sums, tid); err != nil {
+				return nil, err
+			}
+		}
+		_, variance := count.wanderEstimate(sums[0], float64(WanderTrialWalks))
+		if best == nil || variance < bestVariance {
+			best, bestVariance = plan, variance
+		}
+	}
+	return best, nil
+}
+
+// Iterate over the running estimates of the aggregates, output every
+// [OnlineReportInterval] once at least two walks have been made, and after
+// [WanderJoinWalks] walks.
+func (wj *WanderJoin) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	inputs := make([]*wanderInput, len(wj.inputs))
+	for i, op := range wj.inputs {
+		file, filters, scale, err := onlineSource("wander join", op)
+		if err != nil {
+			return nil, err
+		}
+		inputs[i] = &wanderInput{op, file, filters, scale}
+	}
+	plan, err := wj.choosePlan(inputs, tid)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make([]wanderSums, len(wj.aggs))
+	walks := 0
+	var lastReport time.Time
+	finished := false
+	return func() (*Tuple, error) {
+		for !finished {
+			if walks >= WanderJoinWalks {
+				finished = true
+				return wj.estimates(sums, walks), nil
+			}
+			if err := wj.addWalk(plan, inputs, sums, tid); err != nil {
+				return nil, err
+			}
+			walks++
+			if walks >= 2 && walks < WanderJoinWalks && time.Since(lastReport) >= OnlineReportInterval {
+				lastReport = time.Now()
+				return wj.estimates(sums, walks), nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// Plan a wander join estimating aggs over the inputs of a query that asked to
+// be run as one (see [wanderJoinHint]), where inputs maps the names of its
+// tables to their filtered heap files, and deferred are the filters that
+// couldn't be applied to a single table.
+//
+// Returns an error if the query isn't an aggregate of an inner join of
+// tables that a wander join can estimate.
+func planWanderJoin(c *Catalog, plan *LogicalPlan, inputs map[string]*PlanNode, deferred []*LogicalFilterNode, gbys []Expr, aggs []AggState) (*WanderJoin, error) {
+	switch {
+	case len(gbys) > 0:
+		return nil, GoDBError{ParseError, "wander joins can't estimate GROUP BY queries"}
+	case plan.having != nil || len(plan.windows) > 0:
+		return nil, GoDBError{ParseError, "wander joins can't estimate queries with HAVING or window functions"}
+	case plan.joinTree != nil:
+		return nil, GoDBError{ParseError, "wander joins can't estimate outer joins"}
+	case len(plan.subqueries) > 0 || len(plan.subqueryJoins) > 0:
+		return nil, GoDBError{ParseError, "wander joins can't estimate queries with subqueries"}
+	}
+
+	var ops []Operator
+	positions := make(map[Operator]int)
+	var desc *TupleDesc
+	for _, t := range plan.tables {
+		name := t.tableName
+		if t.alias != "" {
+			name = t.alias
+		}
+		node := inputs[name]
+		positions[node.op] = len(ops)
+		ops = append(ops, node.op)
+		if desc == nil {
+			desc = node.desc
+		} else {
+			desc = desc.merge(node.desc)
+		}
+	}
+
+	// equalities of columns of two tables are the edges walks follow, and
+	// everything else is checked on the joined tuples
+	var edges []WanderEdge
+	var residual []Expr
+	for _, j := range plan.joins {
+		n1, n2, err := joinCondNodes(c, plan, inputs, j)
+		if err != nil {
+			return nil, err
+		}
+		if j.predOp == OpEq && n1 != nil && n2 != nil && n1.op != n2.op {
+			leftExpr, _, err := j.left.generateExpr(c, n1.desc, inputs)
+			if err != nil {
+				return nil, err
+			}
+			rightExpr, _, err := j.right.generateExpr(c, n2.desc, inputs)
+			if err != nil {
+				return nil, err
+			}
+			l, lok := leftExpr.(*FieldExpr)
+			r, rok := rightExpr.(*FieldExpr)
+			if lok && rok {
+				edges = append(edges, WanderEdge{positions[n1.op], positions[n2.op], l.selectField, r.selectField})
+				continue
+			}
+		}
+		if j.pred != nil {
+			pred, _, err := j.pred.generateExpr(c, desc, inputs)
+			if err != nil {
+				return nil, err
+			}
+			residual = append(residual, pred)
+			continue
+		}
+		leftExpr, _, err := j.left.generateExpr(c, desc, inputs)
+		if err != nil {
+			return nil, err
+		}
+		rightExpr, _, err := j.right.generateExpr(c, desc, inputs)
+		if err != nil {
+			return nil, err
+		}
+		residual = append(residual, &CompareExpr{leftExpr, j.predOp, rightExpr})
+	}
+	for _, f := range deferred {
+		filter, err := makeFilterOp(c, f, desc, inputs, nil)
+		if err != nil {
+			return nil, err
+		}
+		residual = append(residual, filter.pred)
+	}
+	return NewWanderJoin(ops, edges, residual, aggs)
+}
@@ -0,0 +1,158 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// Make a heap file aliased alias with n tuples of the name and age returned by
+// row.
+func makeWanderTestFile(t *testing.T, bp *BufferPool, tid TransactionID, alias string, n int, row func(int) (string, int64)) *HeapFile {
+	baseTd, _, _ := makeTupleTestVars()
+	td := *baseTd.copy()
+	td.setTableAlias(alias)
+	fileName := fmt.Sprintf("wander_%s.dat", alias)
+	os.Remove(fileName)
+	hf, err := NewHeapFile(fileName, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < n; i++ {
+		name, age := row(i)
+		tup := Tuple{td, []DBValue{StringField{name}, IntField{age}}, nil}
+		insertTupleForTest(t, hf, &tup, tid)
+	}
+	return hf
+}
+
+func TestWanderJoin(t *testing.T) {
+	bp, err := NewBufferPool(500)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+
+	// a chain: a.age = b.age and b.name = c.name
+	aRow := func(i int) (string, int64) { return "a", int64(i % 20) }
+	bRow := func(i int) (string, int64) { return fmt.Sprint(i % 7), int64(i % 40) }
+	cRow := func(i int) (string, int64) { return fmt.Sprint(i % 5), int64(i) }
+	a := makeWanderTestFile(t, bp, tid, "a", 200, aRow)
+	b := makeWanderTestFile(t, bp, tid, "b", 300, bRow)
+	c := makeWanderTestFile(t, bp, tid, "c", 100, cRow)
+
+	count, sum, aSum := 0.0, 0.0, 0.0
+	for i := 0; i < 200; i++ {
+		_, aAge := aRow(i)
+		for j := 0; j < 300; j++ {
+			bName, bAge := bRow(j)
+			if aAge != bAge {
+				continue
+			}
+			for k := 0; k < 100; k++ {
+				cName, cAge := cRow(k)
+				if bName == cName {
+					count++
+					sum += float64(cAge)
+					aSum += float64(aAge)
+				}
+			}
+		}
+	}
+
+	aAge := &FieldExpr{FieldType{"age", "a", IntType}}
+	cAge := &FieldExpr{FieldType{"age", "c", IntType}}
+	cnt, total, avg := &CountAggState{}, &SumAggState{}, &AvgAggState{}
+	cnt.Init("cnt", cAge)
+	total.Init("sum", cAge)
+	avg.Init("avg", aAge)
+	edges := []WanderEdge{
+		{0, 1, FieldType{"age", "a", IntType}, FieldType{"age", "b", IntType}},
+		{1, 2, FieldType{"name", "b", StringType}, FieldType{"name", "c", StringType}},
+	}
+	wj, err := NewWanderJoin([]Operator{a, b, c}, edges, nil, []AggState{cnt, total, avg})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(wj.Descriptor().Fields) != 7 {
+		t.Fatalf("expected 3 estimates, 3 bounds and the number of walks, got %v", wj.Descriptor())
+	}
+
+	defer func(interval time.Duration, walks int) {
+		OnlineReportInterval, WanderJoinWalks = interval, walks
+	}(OnlineReportInterval, WanderJoinWalks)
+	OnlineReportInterval, WanderJoinWalks = 0, 20000
+	iter, err := wj.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var reports []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		reports = append(reports, tup)
+	}
+	if len(reports) < 10 {
+		t.Fatalf("expected running estimates as the walks are made, got %d", len(reports))
+	}
+	last := reports[len(reports)-1].Fields
+	if last[6] != (IntField{20000}) {
+		t.Errorf("expected 20000 walks, got %v", last[6])
+	}
+	for i, want := range []float64{count, sum, aSum / count} {
+		est, _ := numericValue(last[i])
+		bound := last[3+i].(FloatField).Value
+		// (the average is truncated to an int)
+		if bound <= 0 || math.Abs(est-want) > 4*bound+1 {
+			t.Errorf("expected estimate %d to be near %v, got %v ± %v", i, want, est, bound)
+		}
+	}
+
+	// walks can't cross from one input to another without an edge
+	if _, err := NewWanderJoin([]Operator{a, b, c}, edges[:1], nil, []AggState{cnt}); err == nil {
+		t.Errorf("expected an error for disconnected inputs")
+	}
+	max := &MaxAggState{}
+	max.Init("max", aAge)
+	if _, err := NewWanderJoin([]Operator{a, b}, edges[:1], nil, []AggState{max}); err == nil {
+		t.Errorf("expected an error estimating MAX")
+	}
+}
+
+func TestParseWanderJoin(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+	exact := runHavingQuery(t, bp, c, "select count(*), sum(t.age) from t, t2 where t.name = t2.name and t2.age > 20")
+
+	tups := runHavingQuery(t, bp, c, "select /*+ WANDER_JOIN */ count(*), sum(t.age) from t, t2 where t.name = t2.name and t2.age > 20")
+	if len(tups) == 0 || len(tups[0].Fields) != 5 {
+		t.Fatalf("expected reports of 2 estimates, 2 bounds and the number of walks, got %v", tups)
+	}
+	last := tups[len(tups)-1].Fields
+	for i := 0; i < 2; i++ {
+		est, _ := numericValue(last[i])
+		want, _ := numericValue(exact[0].Fields[i])
+		bound := last[2+i].(FloatField).Value
+		if math.Abs(est-want) > 4*bound+1 {
+			t.Errorf("expected estimate %d to be near %v, got %v ± %v", i, want, est, bound)
+		}
+	}
+
+	// queries a wander join can't run are errors
+	tid := BeginTransactionForTest(t, bp)
+	defer bp.CommitTransaction(tid)
+	if _, _, _, err := Parse(c, "select /*+ WANDER_JOIN */ t.name, count(*) from t, t2 where t.name = t2.name group by t.name"); err == nil {
+		t.Errorf("expected an error running GROUP BY as a wander join")
+	}
+}
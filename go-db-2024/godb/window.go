@@ -0,0 +1,269 @@
+package godb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Window functions are parsed from the OVER clause that the rewrite in
+// sql_rewrite.go moved into their last argument, and are planned after
+// aggregation and HAVING, before the select list is projected, with an
+// [OrderBy] followed by a [Window] for each distinct PARTITION BY and ORDER BY
+// clause. The values of window functions are appended to the tuples, and the
+// select list refers to them like it refers to aggregates.
+
+// The OVER clause of a window function.
+type LogicalWindow struct {
+	partitionBy []*LogicalSelectNode
+	orderBy     []*OrderByNode
+	frame       WindowFrame
+}
+
+// Return the OVER clause of a function call that was moved into its last
+// argument, if there is one.
+func windowSpecArg(expr *sqlparser.FuncExpr) (string, bool) {
+	if len(expr.Exprs) == 0 {
+		return "", false
+	}
+	last, ok := expr.Exprs[len(expr.Exprs)-1].(*sqlparser.AliasedExpr)
+	if !ok {
+		return "", false
+	}
+	unary, ok := last.Expr.(*sqlparser.UnaryExpr)
+	if !ok || unary.Operator != sqlparser.UBinaryStr {
+		return "", false
+	}
+	val, ok := unary.Expr.(*sqlparser.SQLVal)
+	if !ok || val.Type != sqlparser.StrVal {
+		return "", false
+	}
+	return string(val.Val), true
+}
+
+var frameRegexp = regexp.MustCompile(`(?is)\b(rows|range)\b(.*)$`)
+var partitionByRegexp = regexp.MustCompile(`(?is)^\s*partition\s+by\b`)
+
+// Parse the inside of an OVER clause: [PARTITION BY exprs] [ORDER BY exprs]
+// [frame].
+func parseWindowSpec(c *Catalog, spec string) (*LogicalWindow, error) {
+	frameText := ""
+	if loc := frameRegexp.FindStringIndex(spec); loc != nil {
+		spec, frameText = spec[:loc[0]], spec[loc[0]:]
+	}
+	// the PARTITION BY and ORDER BY clauses are parsed as the GROUP BY and
+	// ORDER BY clauses of a query
+	clauses := partitionByRegexp.ReplaceAllString(spec, "group by")
+	stmt, err := sqlparser.Parse("select 1 from dual " + clauses)
+	if err != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid OVER clause (%s): %s", spec, err.Error())}
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Where != nil || sel.Having != nil || sel.Limit != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid OVER clause (%s)", spec)}
+	}
+
+	w := &LogicalWindow{}
+	for _, gby := range sel.GroupBy {
+		expr, err := parseExpr(c, gby, "")
+		if err != nil {
+			return nil, err
+		}
+		w.partitionBy = append(w.partitionBy, expr)
+	}
+	w.orderBy, _, err = parseOrderByLimit(c, sel.OrderBy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w.frame = DefaultWindowFrame(len(w.orderBy) > 0)
+	if frameText != "" {
+		w.frame, err = parseWindowFrame(frameText)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Parse a frame clause: ROWS or RANGE, followed by either BETWEEN bound AND
+// bound or a single bound that starts the frame (which ends at the current
+// row). A bound is UNBOUNDED PRECEDING, n PRECEDING, CURRENT ROW, n FOLLOWING
+// or UNBOUNDED FOLLOWING.
+func parseWindowFrame(text string) (WindowFrame, error) {
+	words := strings.Fields(strings.ToLower(text))
+	frame := WindowFrame{Range: words[0] == "range"}
+	words = words[1:]
+	invalid := GoDBError{ParseError, fmt.Sprintf("invalid window frame %s", text)}
+
+	// parse a bound, returning its offset, whether it is unbounded, and the
+	// remaining words
+	bound := func(words []string) (int, bool, []string, error) {
+		if len(words) < 2 {
+			return 0, false, nil, invalid
+		}
+		switch {
+		case words[0] == "current" && words[1] == "row":
+			return 0, false, words[2:], nil
+		case words[0] == "unbounded" && (words[1] == "preceding" || words[1] == "following"):
+			return 0, true, words[2:], nil
+		}
+		n, err := strconv.Atoi(words[0])
+		if err != nil || n < 0 {
+			return 0, false, nil, invalid
+		}
+		switch words[1] {
+		case "preceding":
+			return -n, false, words[2:], nil
+		case "following":
+			return n, false, words[2:], nil
+		}
+		return 0, false, nil, invalid
+	}
+
+	var err error
+	if len(words) > 0 && words[0] == "between" {
+		frame.Start, frame.UnboundedStart, words, err = bound(words[1:])
+		if err != nil {
+			return frame, err
+		}
+		if len(words) == 0 || words[0] != "and" {
+			return frame, invalid
+		}
+		frame.End, frame.UnboundedEnd, words, err = bound(words[1:])
+	} else {
+		frame.Start, frame.UnboundedStart, words, err = bound(words)
+	}
+	if err != nil {
+		return frame, err
+	}
+	if len(words) > 0 {
+		return frame, invalid
+	}
+	if frame.UnboundedStart && frame.Start > 0 || frame.UnboundedEnd && frame.End < 0 {
+		// UNBOUNDED FOLLOWING can't start a frame, nor UNBOUNDED PRECEDING end one
+		return frame, invalid
+	}
+	return frame, nil
+}
+
+// Return the window functions of s.
+func extractWindows(s *LogicalSelectNode) []*LogicalSelectNode {
+	switch s.exprType {
+	case ExprWindow:
+		return []*LogicalSelectNode{s}
+	case ExprFunc, ExprPred:
+		var windows []*LogicalSelectNode
+		for _, arg := range s.args {
+			windows = append(windows, extractWindows(arg)...)
+		}
+		return windows
+	}
+	return nil
+}
+
+// Describe the PARTITION BY and ORDER BY clauses of a window, such that window
+// functions with the same description can be computed by the same [Window].
+func (w *LogicalWindow) key() string {
+	key := "partition by "
+	for _, p := range w.partitionBy {
+		key += p.exprKey() + ","
+	}
+	key += " order by "
+	for _, o := range w.orderBy {
+		key += fmt.Sprintf("%s %v,", o.expr.exprKey(), o.ascending)
+	}
+	return key
+}
+
+// Compute the window functions of a plan over topOp, pointing each window
+// function's cachedField at the field of its value.
+func planWindows(c *Catalog, plan *LogicalPlan, topOp *OperatorCard, tableMap map[string]*PlanNode) (*OperatorCard, error) {
+	var keys []string
+	groups := make(map[string][]*LogicalSelectNode)
+	for _, w := range plan.windows {
+		key := w.window.key()
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], w)
+	}
+
+	windowCnt := 0
+	for _, key := range keys {
+		nodes := groups[key]
+		spec := nodes[0].window
+		desc := topOp.Descriptor()
+
+		var partitionBy, orderBy, sortBy []Expr
+		var ascending []bool
+		for _, p := range spec.partitionBy {
+			expr, _, err := p.generateExpr(c, desc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			partitionBy = append(partitionBy, expr)
+			sortBy = append(sortBy, expr)
+			ascending = append(ascending, true)
+		}
+		for _, o := range spec.orderBy {
+			expr, _, err := o.expr.generateExpr(c, desc, tableMap)
+			if err != nil {
+				return nil, err
+			}
+			orderBy = append(orderBy, expr)
+			sortBy = append(sortBy, expr)
+			ascending = append(ascending, o.ascending)
+		}
+
+		child := topOp
+		if len(sortBy) > 0 {
+			var orderOp *OrderBy
+			var err error
+			if c.bufferPool != nil {
+				orderOp, err = NewExternalOrderBy(sortBy, topOp, ascending, c.bufferPool, SortMemoryBudget)
+			} else {
+				orderOp, err = NewOrderBy(sortBy, topOp, ascending)
+			}
+			if err != nil {
+				return nil, err
+			}
+			child = NewOperatorCard(orderOp, topOp.Cardinality)
+		}
+
+		var funcs []*WindowFunc
+		for _, node := range nodes {
+			var args []Expr
+			for _, arg := range node.args {
+				expr, _, err := arg.generateExpr(c, desc, tableMap)
+				if err != nil {
+					return nil, err
+				}
+				if arg.isStar() {
+					expr = countStarExpr
+				}
+				args = append(args, expr)
+			}
+			name := node.alias
+			if name == "" {
+				name = fmt.Sprintf("%s()%d", *node.funcOp, windowCnt)
+			}
+			windowCnt++
+			f, err := NewWindowFunc(*node.funcOp, name, args, node.window.frame)
+			if err != nil {
+				return nil, err
+			}
+			funcs = append(funcs, f)
+		}
+		windowOp := NewWindow(funcs, partitionBy, orderBy, child)
+		fields := windowOp.Descriptor().Fields
+		for i, node := range nodes {
+			node.cachedField = &fields[len(fields)-len(nodes)+i]
+		}
+		topOp = NewOperatorCard(windowOp, topOp.Cardinality)
+	}
+	return topOp, nil
+}
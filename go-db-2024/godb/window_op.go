@@ -0,0 +1,346 @@
+package godb
+
+import (
+	"fmt"
+)
+
+// The frame of a window function: the rows of its partition, relative to the
+// current row, that an aggregate over the window reads.
+type WindowFrame struct {
+	// the offsets of the first and last rows of the frame from the current
+	// row, negative for preceding rows, unless the frame is unbounded on
+	// that side
+	Start, End                   int
+	UnboundedStart, UnboundedEnd bool
+	// a RANGE frame, whose CURRENT ROW bounds extend to the peers of the
+	// current row (the rows with the same ORDER BY values); its other bounds
+	// must be unbounded
+	Range bool
+}
+
+// The frame of window functions whose OVER clause doesn't have one: the whole
+// partition, or with ORDER BY, the rows up to the current row and its peers.
+func DefaultWindowFrame(ordered bool) WindowFrame {
+	if ordered {
+		return WindowFrame{UnboundedStart: true, Range: true}
+	}
+	return WindowFrame{UnboundedStart: true, UnboundedEnd: true}
+}
+
+// A function computed over the partition of each row by a [Window].
+type WindowFunc struct {
+	name  string // row_number, rank, dense_rank, lag, lead, or an aggregate
+	alias string
+	args  []Expr
+	frame WindowFrame
+	agg   AggState // for aggregates, initialized but empty
+}
+
+// Make a window function. Besides the aggregates, which read their frame,
+// the functions are ROW_NUMBER(), RANK() and DENSE_RANK(), and LAG(expr
+// [, offset [, default]]) and LEAD(...), which read the row offset (by
+// default 1) rows before or after the current row in its partition, or
+// default (by default NULL) if there isn't one.
+func NewWindowFunc(name string, alias string, args []Expr, frame WindowFrame) (*WindowFunc, error) {
+	f := &WindowFunc{name: name, alias: alias, args: args, frame: frame}
+	switch name {
+	case "row_number", "rank", "dense_rank":
+		if len(args) != 0 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("window function %s doesn't take arguments", name)}
+		}
+	case "lag", "lead":
+		if len(args) < 1 || len(args) > 3 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("window function %s takes one to three arguments", name)}
+		}
+		if len(args) > 1 {
+			if _, ok := args[1].(*ConstExpr); !ok {
+				return nil, GoDBError{ParseError, fmt.Sprintf("the offset of window function %s must be a constant", name)}
+			}
+		}
+	default:
+		agg, err := newAggState(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("window aggregate %s needs an argument", name)}
+		}
+		if err := setAggParams(name, agg, args[1:]); err != nil {
+			return nil, err
+		}
+		if err := agg.Init(alias, args[0]); err != nil {
+			return nil, err
+		}
+		f.agg = agg
+	}
+	if frame.Range && (!frame.UnboundedStart && frame.Start != 0 || !frame.UnboundedEnd && frame.End != 0) {
+		return nil, GoDBError{ParseError, "RANGE frames may only be bounded by UNBOUNDED or CURRENT ROW"}
+	}
+	return f, nil
+}
+
+// The type of the function's values.
+func (f *WindowFunc) fieldType() FieldType {
+	switch {
+	case f.agg != nil:
+		ft := f.agg.GetTupleDesc().Fields[0]
+		ft.Fname = f.alias
+		return ft
+	case f.name == "lag" || f.name == "lead":
+		return FieldType{f.alias, "", f.args[0].GetExprType().Ftype}
+	}
+	return FieldType{f.alias, "", IntType}
+}
+
+// Compute the function for each row of a partition. peers numbers the groups
+// of rows with the same ORDER BY values, in order.
+func (f *WindowFunc) evalPartition(rows []*Tuple, peers []int) ([]DBValue, error) {
+	vals := make([]DBValue, len(rows))
+	switch f.name {
+	case "row_number":
+		for i := range rows {
+			vals[i] = IntField{int64(i + 1)}
+		}
+	case "rank":
+		rank := 0
+		for i := range rows {
+			if i == 0 || peers[i] != peers[i-1] {
+				rank = i + 1
+			}
+			vals[i] = IntField{int64(rank)}
+		}
+	case "dense_rank":
+		for i := range rows {
+			vals[i] = IntField{int64(peers[i] + 1)}
+		}
+	case "lag", "lead":
+		offset := int64(1)
+		if len(f.args) > 1 {
+			v, err := f.args[1].EvalExpr(nil)
+			if err != nil {
+				return nil, err
+			}
+			off, ok := v.(IntField)
+			if !ok {
+				return nil, GoDBError{TypeMismatchError, fmt.Sprintf("the offset of window function %s must be an integer", f.name)}
+			}
+			offset = off.Value
+		}
+		if f.name == "lag" {
+			offset = -offset
+		}
+		for i := range rows {
+			j := int64(i) + offset
+			var err error
+			switch {
+			case j >= 0 && j < int64(len(rows)):
+				vals[i], err = f.args[0].EvalExpr(rows[j])
+			case len(f.args) > 2:
+				vals[i], err = f.args[2].EvalExpr(rows[i])
+			default:
+				vals[i] = NullField{}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		f.evalAggregate(rows, peers, vals)
+	}
+	return vals, nil
+}
+
+// Compute an aggregate over the frame of each row. Frames that start at the
+// start of the partition only grow from row to row, so they share a single
+// aggregation state; the others are aggregated from scratch.
+func (f *WindowFunc) evalAggregate(rows []*Tuple, peers []int, vals []DBValue) {
+	// the first and last rows of each group of peers
+	first, last := make([]int, len(rows)), make([]int, len(rows))
+	for i := range rows {
+		first[i] = i
+		if i > 0 && peers[i] == peers[i-1] {
+			first[i] = first[i-1]
+		}
+	}
+	for i := len(rows) - 1; i >= 0; i-- {
+		last[i] = i
+		if i < len(rows)-1 && peers[i] == peers[i+1] {
+			last[i] = last[i+1]
+		}
+	}
+
+	running := f.agg.Copy()
+	added := 0
+	for i := range rows {
+		lo, hi := 0, len(rows)-1
+		if !f.frame.UnboundedStart {
+			lo = max(i+f.frame.Start, 0)
+			if f.frame.Range {
+				lo = first[i]
+			}
+		}
+		if !f.frame.UnboundedEnd {
+			hi = min(i+f.frame.End, len(rows)-1)
+			if f.frame.Range {
+				hi = last[i]
+			}
+		}
+
+		state := running
+		if lo == 0 {
+			for ; added <= hi; added++ {
+				running.AddTuple(rows[added])
+			}
+		} else {
+			state = f.agg.Copy()
+			for j := lo; j <= hi; j++ {
+				state.AddTuple(rows[j])
+			}
+		}
+		// window aggregates describe the rows they read, so they aren't
+		// scaled up to the table
+		vals[i] = state.Finalize(nil).Fields[0]
+	}
+}
+
+// Window computes window functions, which all have the same PARTITION BY and
+// ORDER BY clauses, appending their values to each tuple of its child. The
+// child's tuples must already be sorted on the PARTITION BY expressions and
+// then the ORDER BY expressions (e.g., by an [OrderBy]). Each partition is
+// read into memory.
+type Window struct {
+	funcs       []*WindowFunc
+	partitionBy []Expr
+	orderBy     []Expr
+	child       Operator
+	desc        *TupleDesc
+}
+
+var DEBUGWINDOW = false
+
+func DebugWindow(format string, a ...any) (int, error) {
+	if DEBUGWINDOW || GLOBALDEBUG {
+		return fmt.Println(fmt.Sprintf(format, a...))
+	}
+	return 0, nil
+}
+
+func NewWindow(funcs []*WindowFunc, partitionBy []Expr, orderBy []Expr, child Operator) *Window {
+	desc := child.Descriptor().copy()
+	for _, f := range funcs {
+		desc.Fields = append(desc.Fields, f.fieldType())
+	}
+	return &Window{funcs, partitionBy, orderBy, child, desc}
+}
+
+func (w *Window) Descriptor() *TupleDesc {
+	return w.desc
+}
+
+func (w *Window) SampleInfo() *SampleInfo {
+	return w.child.SampleInfo()
+}
+
+// Return a key that is the same for two tuples exactly when the values of
+// exprs are the same for them.
+func exprsKey(exprs []Expr, t *Tuple) (any, error) {
+	key := &Tuple{Fields: make([]DBValue, len(exprs))}
+	for i, e := range exprs {
+		v, err := e.EvalExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		key.Desc.Fields = append(key.Desc.Fields, e.GetExprType())
+		key.Fields[i] = v
+	}
+	return key.tupleKey(), nil
+}
+
+func (w *Window) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := w.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+
+	var next *Tuple // the first tuple of the next partition
+	var nextKey any
+	childDone := false
+	var out []*Tuple
+
+	// read the next partition and compute its window functions
+	readPartition := func() error {
+		var rows []*Tuple
+		if next != nil {
+			rows = append(rows, next)
+			next = nil
+		}
+		for {
+			t, err := childIter()
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				childDone = true
+				break
+			}
+			key, err := exprsKey(w.partitionBy, t)
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 && key != nextKey {
+				next, nextKey = t, key
+				break
+			}
+			nextKey = key
+			rows = append(rows, t)
+		}
+
+		peers := make([]int, len(rows))
+		var prevKey any
+		for i, t := range rows {
+			key, err := exprsKey(w.orderBy, t)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				peers[i] = peers[i-1]
+				if key != prevKey {
+					peers[i]++
+				}
+			}
+			prevKey = key
+		}
+
+		out = make([]*Tuple, len(rows))
+		for i, t := range rows {
+			fields := make([]DBValue, len(t.Fields), len(w.desc.Fields))
+			copy(fields, t.Fields)
+			out[i] = &Tuple{*w.desc, fields, t.Rid}
+		}
+		for _, f := range w.funcs {
+			vals, err := f.evalPartition(rows, peers)
+			if err != nil {
+				return err
+			}
+			for i, v := range vals {
+				out[i].Fields = append(out[i].Fields, v)
+			}
+		}
+		DebugWindow("window partition of %d tuples", len(rows))
+		return nil
+	}
+
+	return func() (*Tuple, error) {
+		for len(out) == 0 {
+			if childDone && next == nil {
+				return nil, nil
+			}
+			if err := readPartition(); err != nil {
+				return nil, err
+			}
+		}
+		t := out[0]
+		out = out[1:]
+		return t, nil
+	}, nil
+}
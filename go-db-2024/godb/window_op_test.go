@@ -0,0 +1,123 @@
+package godb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWindowFrames(t *testing.T) {
+	// a single partition of 1, 2, 2, 3, 4, ordered by its values
+	var exprs [][]Expr
+	for _, v := range []int64{1, 2, 2, 3, 4} {
+		exprs = append(exprs, []Expr{&ConstExpr{IntField{v}, IntType}})
+	}
+	child := NewValueOp(exprs)
+	v := &FieldExpr{child.Descriptor().Fields[0]}
+
+	tests := []struct {
+		name  string
+		args  []Expr
+		frame WindowFrame
+		want  []int64
+	}{
+		{"row_number", nil, DefaultWindowFrame(true), []int64{1, 2, 3, 4, 5}},
+		{"rank", nil, DefaultWindowFrame(true), []int64{1, 2, 2, 4, 5}},
+		{"dense_rank", nil, DefaultWindowFrame(true), []int64{1, 2, 2, 3, 4}},
+		{"lag", []Expr{v}, DefaultWindowFrame(true), []int64{-1, 1, 2, 2, 3}},
+		{"lead", []Expr{v, &ConstExpr{IntField{2}, IntType}, &ConstExpr{IntField{0}, IntType}}, DefaultWindowFrame(true), []int64{2, 3, 4, 0, 0}},
+		// the default frame includes the peers of the current row
+		{"sum", []Expr{v}, DefaultWindowFrame(true), []int64{1, 5, 5, 8, 12}},
+		{"sum", []Expr{v}, WindowFrame{UnboundedStart: true}, []int64{1, 3, 5, 8, 12}},
+		{"sum", []Expr{v}, WindowFrame{Start: -1, End: 1}, []int64{3, 5, 7, 9, 7}},
+		{"count", []Expr{v}, WindowFrame{Start: 1, UnboundedEnd: true}, []int64{4, 3, 2, 1, 0}},
+		{"max", []Expr{v}, DefaultWindowFrame(false), []int64{4, 4, 4, 4, 4}},
+	}
+	for _, test := range tests {
+		f, err := NewWindowFunc(test.name, "w", test.args, test.frame)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, err := NewWindow([]*WindowFunc{f}, nil, []Expr{v}, child).Iterator(NewTID())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for i, want := range test.want {
+			tup, err := iter()
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			got, ok := tup.Fields[1].(IntField)
+			if (want == -1 && !isNull(tup.Fields[1])) || (want != -1 && (!ok || got.Value != want)) {
+				t.Errorf("%s %+v: row %d expected %d, got %v", test.name, test.frame, i, want, tup.Fields[1])
+			}
+		}
+		if tup, _ := iter(); tup != nil {
+			t.Errorf("%s: unexpected extra tuple %v", test.name, tup)
+		}
+	}
+
+	if _, err := NewWindowFunc("rank", "w", []Expr{v}, DefaultWindowFrame(true)); err == nil {
+		t.Errorf("expected error for RANK with an argument")
+	}
+	if _, err := NewWindowFunc("sum", "w", []Expr{v}, WindowFrame{Start: -1, Range: true}); err == nil {
+		t.Errorf("expected error for a RANGE frame with an offset")
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	bp, c, err := MakeParserTestDatabase(20)
+	if err != nil {
+		t.Fatalf("failed to create test database, %s", err.Error())
+	}
+
+	// the value of the last column of the tuple of each name and age
+	values := func(sql string) map[string]DBValue {
+		vals := make(map[string]DBValue)
+		for _, tup := range runHavingQuery(t, bp, c, sql) {
+			key := tup.Fields[0].(StringField).Value
+			if age, ok := tup.Fields[1].(IntField); ok && len(tup.Fields) > 2 {
+				key += " " + fmt.Sprint(age.Value)
+			}
+			vals[key] = tup.Fields[len(tup.Fields)-1]
+		}
+		return vals
+	}
+
+	vals := values("select name, age, rank() over (partition by name order by age desc) r from t")
+	for key, want := range map[string]int64{"sam 99": 1, "sam 25": 2, "riza 22": 2, "bo 99": 1} {
+		if vals[key] != (IntField{want}) {
+			t.Errorf("expected rank %d for %s, got %v", want, key, vals[key])
+		}
+	}
+
+	vals = values("select name, age, sum(age) over (order by age, name rows between unbounded preceding and current row) s from t")
+	if vals["ang 22"] != (IntField{22}) || vals["sam 99"] != (IntField{573}) {
+		t.Errorf("unexpected running sums %v", vals)
+	}
+
+	vals = values("select name, age, lag(age) over (partition by name order by age) prev from t")
+	if vals["sam 99"] != (IntField{25}) || !isNull(vals["sam 25"]) {
+		t.Errorf("unexpected previous ages %v", vals)
+	}
+
+	// window functions over aggregates
+	vals = values("select name, rank() over (order by sum(age) desc) r from t group by name")
+	if len(vals) != 10 || vals["sam"] != (IntField{1}) || vals["bo"] != (IntField{2}) {
+		t.Errorf("unexpected ranks of sums %v", vals)
+	}
+
+	// the oldest tuple of each name
+	if tups := runHavingQuery(t, bp, c, "select name, age from (select name, age, row_number() over (partition by name order by age desc) rn from t) x where rn = 1"); len(tups) != 10 {
+		t.Errorf("expected 10 names, got %d", len(tups))
+	}
+
+	for _, sql := range []string{
+		"select name, row_number(age) over (order by age) from t",
+		"select name, sum(age) over (order by age rows between 1 following) from t",
+		"select name, sum(age) over (order by age range between 1 preceding and current row) from t",
+	} {
+		if _, _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("expected error parsing %s", sql)
+		}
+	}
+}
@@ -19,26 +19,70 @@ var helpText = `Enter a SQL query terminated by a ; to process it.  Commands pre
 Available shell commands:
 	\h : This help
 	\c path/to/catalog : Change the current database to a specified catalog file
+	\check table : Read every page of a table from disk and report the pages whose checksums don't match, such as pages left half written when a load was interrupted
 	\d : List tables and fields in the current database
 	\f : List available functions for use in queries
 	\a : Toggle aligned vs csv output
     \o : Toggle query optimization
+	\j [auto|hash|grace|merge] [budget] : Set the join algorithm used by queries, and the number of tuples a hash join may buffer before spilling to disk. With no arguments, print the current settings
+	\r : Toggle online aggregation: queries that aggregate a join of two tables with COUNT, SUM and AVG run as ripple joins, printing running estimates with their error bounds until they finish or are interrupted with Ctrl-C
+	\g [estimate|certain|possible] : Set how HAVING clauses treat aggregates estimated from a sample: compare the estimates, only keep groups that pass over the whole confidence interval, or also keep groups that pass somewhere in it (marking which are certain in an extra column). With no arguments, print the current setting
 	\l table path/to/file [sep] [hasHeader]: Append csv file to end of table.  Default to sep = ',', hasHeader = 'true'
 	\i path/to/file [useMetaDataFile] [useStatFile] [mode] [extension] [sep] [hasHeader]: Change the current database to a specified catalog file, and load from csv-like files in same directory as catalog file, with given separator Default to mode = 'Some' (Options 'All', 'Some', 'Diagnostic'), extension = 'tbl', sep = '|', hasHeader = 'true'
 		- mode 'All' loads all the data from the csv
 		- mode 'Some' loads only some of the data from the csv, randomly seeking to each line
 		- mode 'Contiguous' loads only some of the data from the csv, in an in-order contiguous manner
 		- mode 'Stratified' loads only some of the data from the csv, in reading contiguously starting from a random offset
+		- mode 'Stat' computes statistics of each numerical column, loads all of the outlier rows into a separate outlier table, and samples the other rows
+		- mode 'Measure:column' samples rows with probability proportional to the given numerical column, in the tables that have it, and uniformly in the others
 		- useMetaDataFile will store the offsets that have been loaded in order to not load them again
 		- useStatFile will store statistics for each numerical column in order to make queries more accurate
 
-	\z : Compute statistics for the database`
+	\z : Compute statistics for the database
+
+Queries that aggregate a join of any number of tables with COUNT, SUM and AVG can be estimated by random walks over the join with SELECT /*+ WANDER_JOIN */ ..., printing running estimates with their error bounds until they finish or are interrupted with Ctrl-C
+
+VACUUM table; compacts a table after large deletes, moving its tuples into as few pages as possible and reporting the space reclaimed`
 
 func printCatalog(c *godb.Catalog) {
 	s := c.CatalogString()
 	fmt.Printf("\033[34m%s\n\033[0m", s)
 }
 
+// Return column if it is a numerical column of the heap file, or "" so that
+// the heap file is sampled uniformly.
+func measureColumn(hf *godb.HeapFile, column string) string {
+	for _, field := range hf.Descriptor().Fields {
+		if field.Fname == column && field.Ftype != godb.StringType {
+			return column
+		}
+	}
+	return ""
+}
+
+// Report the corrupt pages of a table (see [godb.HeapFile.CheckPages]).
+func checkTable(c *godb.Catalog, table string) {
+	file, err := c.GetTable(table)
+	if err != nil {
+		fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+		return
+	}
+	hf, ok := file.(*godb.HeapFile)
+	if !ok {
+		fmt.Printf("\033[31;1mcan only check heap files, not %s\033[0m\n", table)
+		return
+	}
+	corrupt, err := hf.CheckPages()
+	for _, page := range corrupt {
+		fmt.Printf("\033[31;1mpage %d: %s\033[0m\n", page.PageNo, page.Err.Error())
+	}
+	if err != nil {
+		fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+		return
+	}
+	fmt.Printf("\033[32;1mCHECK: %d pages, %d corrupt\033[0m\n\n", hf.NumPages(), len(corrupt))
+}
+
 func main() {
 	alarm := make(chan int, 1)
 
@@ -125,6 +169,14 @@ func main() {
 			case 'd':
 				printCatalog(c)
 			case 'c':
+				if splits := strings.Fields(text); splits[0] == "\\check" {
+					if len(splits) != 2 {
+						fmt.Printf("\033[31;1mExpected table name after \\check\033[0m\n")
+						continue
+					}
+					checkTable(c, splits[1])
+					break
+				}
 				if len(text) <= 3 {
 					fmt.Printf("Expected catalog file name after \\c")
 					continue
@@ -157,6 +209,43 @@ func main() {
 				} else {
 					fmt.Println("\033[32;1mOptimization disabled\033[0m\n\n")
 				}
+			case 'r':
+				godb.OnlineAggregation = !godb.OnlineAggregation
+				if godb.OnlineAggregation {
+					fmt.Printf("\033[32;1mOnline aggregation enabled\033[0m\n\n")
+				} else {
+					fmt.Printf("\033[32;1mOnline aggregation disabled\033[0m\n\n")
+				}
+			case 'j':
+				splits := strings.Fields(text)
+				if len(splits) > 1 {
+					alg, err := godb.ParseJoinAlgorithm(splits[1])
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					godb.PreferredJoinAlgorithm = alg
+				}
+				if len(splits) > 2 {
+					budget, err := strconv.Atoi(splits[2])
+					if err != nil || budget <= 0 {
+						fmt.Printf("\033[31;1mInvalid join memory budget %s\033[0m\n", splits[2])
+						continue
+					}
+					godb.JoinMemoryBudget = budget
+				}
+				fmt.Printf("\033[32;1mJoin algorithm: %v, join memory budget: %v tuples\033[0m\n\n", godb.PreferredJoinAlgorithm, godb.JoinMemoryBudget)
+			case 'g':
+				splits := strings.Fields(text)
+				if len(splits) > 1 {
+					mode, err := godb.ParseHavingMode(splits[1])
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					godb.HavingConfidence = mode
+				}
+				fmt.Printf("\033[32;1mHAVING mode: %v\033[0m\n\n", godb.HavingConfidence)
 			case 'z':
 				c.ComputeTableStats()
 				fmt.Printf("\033[32;1mAnalysis Complete\033[0m\n\n")
@@ -189,6 +278,11 @@ func main() {
 					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 					continue
 				}
+				// heap files keep their tuples, so reload them from scratch
+				if err := heapFile.Truncate(); err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
 				err = heapFile.LoadFromCSV(f, hasHeader, sep, false)
 				if err != nil {
 					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
@@ -245,9 +339,10 @@ func main() {
 				if mode == "Stat" {
 					// In first (read) pass, compute mean, std dev for full
 					// dataset.
-					// In second (write) pass, insert to database tuples
-					// containing numerical fields all within two standard
-					// deviations from the mean.
+					// In second pass, load all of the tuples with a
+					// numerical field more than two standard deviations
+					// from the mean into the outlier table, then sample
+					// the other tuples into the database.
 					for _, tableName := range c.TableNames() {
 						fmt.Printf("Processing table: %v\n", tableName)
 						hf, err := c.GetTable(tableName)
@@ -261,6 +356,10 @@ func main() {
 							fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 							continue
 						}
+						if err := heapFile.Truncate(); err != nil {
+							fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+							continue
+						}
 						statFilename := catPath + "/" + tableName + "Stat.txt"
 						err = heapFile.StatAndLoadFromCSV(f, hasHeader, sep, false, statFilename)
 						if err != nil {
@@ -285,7 +384,17 @@ func main() {
 						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 						continue
 					}
-					err = heapFile.LoadFromCSV(f, hasHeader, sep, false)
+					// heap files keep their tuples, so reload them from
+					// scratch
+					if err := heapFile.Truncate(); err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					if measure, ok := strings.CutPrefix(mode, "Measure"); ok {
+						err = heapFile.MeasureBiasedLoadFromCSV(f, hasHeader, sep, false, measureColumn(heapFile, strings.TrimPrefix(measure, ":")))
+					} else {
+						err = heapFile.LoadFromCSV(f, hasHeader, sep, false)
+					}
 					if err != nil {
 						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 						continue
@@ -359,7 +468,7 @@ func main() {
 				if mode == "Some" {
 					err = heapFile.LoadSomeFromCSV(f, hasHeader, sep, false, nil)
 				} else if mode == "Stat" {
-					err = heapFile.LoadSomeFromCSV(f, hasHeader, sep, false, heapFile.Statistics())
+					err = heapFile.LoadSomeFromCSV(f, hasHeader, sep, false, heapFile.SampleInfo())
 
 				} else if mode == "Contiguous" {
 					err = heapFile.LoadSomeFromCSVContiguous(f, hasHeader, sep, false)